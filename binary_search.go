@@ -0,0 +1,83 @@
+package syzgydb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+)
+
+/*
+Binary Search Protocol:
+
+A JSON query vector of a few hundred dimensions takes many kilobytes of text, so
+the search API also accepts and returns a packed binary format. All numbers are
+big-endian.
+
+A search request with a Content-Type of application/octet-stream has the body
+
+Request ::= DimensionCount (4, uint32)
+            K (4, uint32)
+            Radius (8, float64)
+            Vector (DimensionCount * 4, float32 each)
+
+Other search options, such as filter and precision, are taken from the query
+parameters. A request with an Accept header of application/octet-stream
+receives the results as
+
+Response ::= Count (4, uint32)
+             Result* (Count times)
+Result   ::= ID (8, uint64)
+             Distance (8, float64)
+
+in the same order as the JSON results. Metadata is not included.
+*/
+
+// binaryContentType is the media type of the binary search protocol.
+const binaryContentType = "application/octet-stream"
+
+// isBinaryContentType reports whether a Content-Type or Accept header asks for
+// the binary search protocol.
+func isBinaryContentType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	return err == nil && mediaType == binaryContentType
+}
+
+// readBinarySearchRequest reads a binary search request into args.
+func readBinarySearchRequest(r io.Reader, args *SearchArgs) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	dimensions := binary.BigEndian.Uint32(header[0:4])
+	if dimensions > uint32(maxDimensions()) {
+		return fmt.Errorf("too many dimensions: %d", dimensions)
+	}
+	args.K = int(binary.BigEndian.Uint32(header[4:8]))
+	args.Radius = math.Float64frombits(binary.BigEndian.Uint64(header[8:16]))
+
+	data := make([]byte, dimensions*4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read vector: %w", err)
+	}
+	args.Vector = make([]float64, dimensions)
+	for i := range args.Vector {
+		args.Vector[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(data[i*4:])))
+	}
+	return nil
+}
+
+// writeBinarySearchResults writes the IDs and distances of the results in the
+// binary search protocol.
+func writeBinarySearchResults(w http.ResponseWriter, results SearchResults) {
+	buf := make([]byte, 0, 4+len(results.Results)*16)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(results.Results)))
+	for _, result := range results.Results {
+		buf = binary.BigEndian.AppendUint64(buf, result.ID)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(result.Distance))
+	}
+	w.Header().Set("Content-Type", binaryContentType)
+	w.Write(buf)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/smhanov/syzgydb"
 	"github.com/spf13/pflag"
@@ -15,10 +16,30 @@ func init() {
 	pflag.String("ollama-server", "", "Hostname and port of the Ollama server")
 	pflag.String("text-model", "", "Name of the text embedding model")
 	pflag.String("image-model", "", "Name of the image embedding model")
+	pflag.Int("embedding-dimensions", 0, "Expected number of dimensions from the text model (0 to accept any)")
+	pflag.Int("embedding-retries", 2, "How many times to retry a failed embedding request")
+	pflag.Duration("embedding-retry-delay", 500*time.Millisecond, "Delay before retrying a failed embedding request; doubles on each attempt")
+	pflag.Int("embedding-cache-size", 100, "Number of search text embeddings to cache")
+	pflag.Duration("embedding-cache-ttl", 0, "How long cached embeddings are kept (0 to keep until evicted)")
+	pflag.Int("idempotency-cache-size", 10000, "Number of record insert idempotency keys to remember")
+	pflag.Duration("idempotency-ttl", 24*time.Hour, "How long record insert idempotency keys are remembered")
 	pflag.String("config", "", "Path to the configuration file")
 	pflag.String("data-folder", "./data", "Path to the data folder")
+	pflag.String("data-folder-layout", syzgydb.DataFolderLayoutFlat, "Arrangement of collection files: flat or hashed")
 	pflag.String("syzgy-host", "0.0.0.0:8080", "Host and port for the Syzygy server")
 	pflag.String("html-root", "./html", "Root directory for serving HTML files")
+	pflag.Duration("purge-interval", 0, "How often to remove expired documents (0 to disable)")
+	pflag.Bool("warmup-on-start", false, "Read every collection into memory after starting the server")
+	pflag.Uint64("node-id", 0, "ID of this node when sharding collections")
+	pflag.String("shard-nodes", "", "Comma separated IDs of the nodes that share the collections")
+	pflag.Int("max-dimensions", syzgydb.DefaultMaxDimensions, "Largest number of dimensions allowed in a collection")
+	pflag.Int("gzip-min-size", syzgydb.DefaultGzipMinSize, "Smallest response size in bytes that is compressed")
+	pflag.Int("max-search-k", syzgydb.DefaultMaxSearchK, "Largest k accepted by the search API")
+	pflag.Int("max-search-limit", syzgydb.DefaultMaxSearchLimit, "Largest limit accepted by the search API")
+	pflag.Duration("search-timeout", 0, "Longest time a search request may take before returning partial results (0 for no limit)")
+	pflag.Int64("max-request-bytes", syzgydb.DefaultMaxRequestBytes, "Largest request body accepted, in bytes")
+	pflag.Int("max-concurrent-requests", 0, "Most API requests handled at once (0 for no limit)")
+	pflag.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
 
 	f := pflag.CommandLine
 	normalizeFunc := f.GetNormalizeFunc()
@@ -67,6 +88,9 @@ func LoadConfig() error {
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return fmt.Errorf("unable to decode into struct, %v", err)
 	}
+	if _, err := syzgydb.ParseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
 
 	// Ensure the data folder exists
 	dataFolder := viper.GetString("data_folder")
@@ -78,10 +102,26 @@ func LoadConfig() error {
 	fmt.Println("Configuration values:")
 	fmt.Printf("Ollama Server: %s\n", cfg.OllamaServer)
 	fmt.Printf("Text Model: %s\n", cfg.TextModel)
+	fmt.Printf("Embedding Dimensions: %d\n", cfg.EmbeddingDimensions)
+	fmt.Printf("Embedding Retries: %d (delay %v)\n", cfg.EmbeddingRetries, cfg.EmbeddingRetryDelay)
+	fmt.Printf("Embedding Cache: %d entries (TTL %v)\n", cfg.EmbeddingCacheSize, cfg.EmbeddingCacheTTL)
+	fmt.Printf("Idempotency Keys: %d entries (TTL %v)\n", cfg.IdempotencyCacheSize, cfg.IdempotencyTTL)
 	fmt.Printf("Image Model: %s\n", cfg.ImageModel)
-	fmt.Printf("Data Folder: %s\n", cfg.DataFolder)
+	fmt.Printf("Data Folder: %s (%s layout)\n", cfg.DataFolder, cfg.DataFolderLayout)
 	fmt.Printf("Port: %s\n", cfg.SyzgyHost)
 	fmt.Printf("HTML Root: %s\n", cfg.HTMLRoot)
+	fmt.Printf("Purge Interval: %v\n", cfg.PurgeInterval)
+	fmt.Printf("Warmup On Start: %v\n", cfg.WarmupOnStart)
+	fmt.Printf("Max Dimensions: %d\n", cfg.MaxDimensions)
+	fmt.Printf("Gzip Min Size: %d\n", cfg.GzipMinSize)
+	fmt.Printf("Max Search K: %d, Limit: %d\n", cfg.MaxSearchK, cfg.MaxSearchLimit)
+	fmt.Printf("Search Timeout: %v\n", cfg.SearchTimeout)
+	fmt.Printf("Max Request Bytes: %d\n", cfg.MaxRequestBytes)
+	fmt.Printf("Max Concurrent Requests: %d\n", cfg.MaxConcurrentRequests)
+	fmt.Printf("Log Level: %s\n", cfg.LogLevel)
+	if len(cfg.ShardNodes) > 0 {
+		fmt.Printf("Node ID: %d of shard nodes %v\n", cfg.NodeID, cfg.ShardNodes)
+	}
 
 	// Assign the loaded configuration to the global variable
 	syzgydb.Configure(cfg)
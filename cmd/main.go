@@ -24,6 +24,8 @@ func main() {
 	pflag.String("export", "", "Export the collection from the specified file to stdout")
 	pflag.String("import", "", "Import a collection from the specified JSON file")
 	pflag.String("output", "", "Specify the output file for import (required with --import)")
+	pflag.String("backup", "", "Back up every collection in the data folder to the specified folder")
+	pflag.String("restore", "", "Restore the collections backed up in the specified folder to the data folder")
 	pflag.Parse()
 
 	// Handle --dump flag
@@ -87,6 +89,34 @@ func main() {
 		return
 	}
 
+	// Handle --backup and --restore flags
+	backupDir := pflag.Lookup("backup").Value.String()
+	restoreDir := pflag.Lookup("restore").Value.String()
+	if backupDir != "" || restoreDir != "" {
+		// The data folder comes from the configuration
+		if err := LoadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		if backupDir != "" {
+			manifest, err := syzgydb.BackupDataFolder(backupDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error backing up collections: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Backed up %d collections to: %s\n", len(manifest.Collections), backupDir)
+		} else {
+			manifest, err := syzgydb.RestoreDataFolder(restoreDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error restoring collections: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Restored %d collections from: %s\n", len(manifest.Collections), restoreDir)
+		}
+		return
+	}
+
 	// Handle --serve flag
 	if pflag.Lookup("serve").Value.String() == "true" {
 		// Load configuration
@@ -1,17 +1,23 @@
 package syzgydb
 
 import (
+	"bytes"
 	"container/heap"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
+	"mime"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/smhanov/syzgydb/query"
 )
@@ -23,8 +29,6 @@ const (
 	PointIgnored         // no action taken; pretend point did not exist
 )
 
-const useTree = true
-
 /*
 CollectionOptions defines the configuration options for creating a Collection.
 */
@@ -43,10 +47,178 @@ type CollectionOptions struct {
 	// Supported values are 4, 8, 16, 32, and 64, with 64 as the default.
 	Quantization int `json:"quantization"`
 
+	// QuantMin and QuantMax are the range of vector components that 4, 8 and
+	// 16 bit quantization can represent. Components outside the range are
+	// clipped to it. When both are zero, the range is -1 to 1, unless it is
+	// fitted to the first vectors added with FitQuantizationRange. They cannot
+	// be changed after the collection is created.
+	QuantMin float64 `json:"quant_min,omitempty"`
+	QuantMax float64 `json:"quant_max,omitempty"`
+
+	// FitQuantRange makes the server fit QuantMin and QuantMax to the first
+	// batch of records inserted through the API, when neither is given.
+	FitQuantRange bool `json:"fit_quant_range,omitempty"`
+
+	// Sparse stores only the nonzero components of each vector, with their
+	// indices, so that the space used depends on the number of nonzero
+	// components rather than DimensionCount. Searches compute distances from
+	// the nonzero components too. It cannot be changed after the collection is
+	// created.
+	Sparse bool `json:"sparse,omitempty"`
+
+	// LSHTrees is the number of trees in the search index. Defaults to 5.
+	LSHTrees int `json:"lsh_trees,omitempty"`
+
+	// LSHLeafSize is the number of documents a node of the search index holds
+	// before it is split. Defaults to 100.
+	LSHLeafSize int `json:"lsh_leaf_size,omitempty"`
+
+	// LSHSeed seeds the random hyperplanes of the search index, so that the same
+	// documents give the same index, and the same search results, on any machine
+	// and after the collection is reopened. Zero uses a different seed each time.
+	// The splits of the index also depend on the order the documents are added
+	// in. When the index is built as the collection is opened, they are added
+	// in ID order, but documents added while it is open are added as they
+	// come, so the index only matches a freshly built one if they come in ID
+	// order too.
+	LSHSeed int64 `json:"lsh_seed,omitempty"`
+
+	// IndexType chooses the search index: IndexLSH (the default) builds the
+	// LSH trees, and IndexFlat builds no index, so that every search reads all
+	// of the documents. For a few thousand documents, a flat collection can be
+	// as fast as an indexed one, and always finds the nearest documents.
+	IndexType string `json:"index_type,omitempty"`
+
+	// PersistIndex saves the search index in the file when the collection is
+	// closed, so that it is loaded instead of being built again from every
+	// document when the collection is next opened. The saved index is only
+	// used if the collection wasn't changed after it was saved.
+	PersistIndex bool `json:"persist_index,omitempty"`
+
+	// AutoCompactThreshold is the fraction of the file, between 0 and 1, that may be
+	// taken up by deleted and replaced records before the collection is compacted
+	// in the background. Zero disables automatic compaction.
+	AutoCompactThreshold float64 `json:"auto_compact_threshold,omitempty"`
+
+	// SeparateVectors stores the vectors in a second file, named after the
+	// collection with a ".vectors" suffix, so that scans of the metadata, such
+	// as filtered listings, don't read the vectors. It cannot be changed after
+	// the collection is created.
+	SeparateVectors bool `json:"separate_vectors,omitempty"`
+
+	// UseWAL records each change in a write-ahead log before making it, so that
+	// a write interrupted by a crash is completed when the collection is next
+	// opened. Writes are slower, because the log is synced to disk each time.
+	UseWAL bool `json:"use_wal,omitempty"`
+
+	// SkipChecksums stops reads from verifying the checksum of each document,
+	// which makes searches faster. A document damaged on disk is then read as
+	// if it were intact instead of causing an error, so it should only be used
+	// for trusted files. See SpanFile.SetVerifyChecksums.
+	SkipChecksums bool `json:"skip_checksums,omitempty"`
+
+	// NormalizeOnInsert scales each vector added to the collection to unit
+	// length, which is useful with the Cosine distance method.
+	NormalizeOnInsert bool `json:"normalize_on_insert,omitempty"`
+
+	// Normalized is set by the collection when every stored vector has unit
+	// length, because NormalizeOnInsert was set when it was created or
+	// Normalize was called. Cosine searches of a normalized collection only
+	// need dot products. It is cleared when NormalizeOnInsert is turned off,
+	// and can't be set through the options.
+	Normalized bool `json:"normalized,omitempty"`
+
+	// WithNorms stores the length of each document's vector next to it, so
+	// that Cosine searches don't have to compute it, and ComputeStats can
+	// report how the lengths are distributed. It cannot be changed after the
+	// collection is created.
+	WithNorms bool `json:"with_norms,omitempty"`
+
+	// Dedup stores each distinct vector once. A document added with the same
+	// vector as one already stored refers to that document's copy, which is
+	// read in its place. It cannot be changed after the collection is created.
+	Dedup bool `json:"dedup,omitempty"`
+
+	// DimensionPolicy decides what AddDocument does with a vector that doesn't
+	// have DimensionCount components: DimensionStrict (the default) rejects it,
+	// DimensionPad adds zeros to the end of a shorter vector, and
+	// DimensionTruncate drops the extra components of a longer one. These help
+	// when moving between embedding models, but the distances between adjusted
+	// vectors only approximate those the model intended, so recall is lower
+	// than with vectors made for the collection.
+	DimensionPolicy string `json:"dimension_policy,omitempty"`
+
+	// ExpectedDocuments is a hint of how many documents the collection will
+	// hold. With the Cosine distance method, the upper levels of the search
+	// index are built in advance for that many documents, so that bulk loading
+	// does not have to split them. Zero grows the index as documents are added.
+	ExpectedDocuments int `json:"expected_documents,omitempty"`
+
+	// IndexedFields lists top-level metadata fields whose values are indexed in
+	// memory. A search with a FilterQuery that requires one of these fields to
+	// equal a value only reads the documents that have that value. Only string,
+	// number and boolean values are indexed.
+	IndexedFields []string `json:"indexed_fields,omitempty"`
+
+	// WriteBufferSize is the number of bytes of documents that may be held in
+	// memory before they are written to the file together. Buffered documents
+	// can be read and searched, and are written when the buffer fills, within
+	// a second of being added, or when Flush or Close is called. Documents in
+	// the buffer are lost if the program ends before then, even with UseWAL.
+	// Zero writes each document right away.
+	WriteBufferSize int `json:"write_buffer_size,omitempty"`
+
+	// LockTimeout is how long operations that change the collection, such as
+	// AddDocument, Compact and Close, wait for searches and other changes to
+	// finish before giving up with ErrLockTimeout. Searches that start while
+	// one of them waits are held back until it gets the lock. Zero waits as
+	// long as it takes. It is not stored in the file.
+	LockTimeout time.Duration `json:"-"`
+
 	// FileMode specifies the mode for opening the memfile.
 	FileMode FileMode `json:"-"`
 }
 
+// Default parameters of the search index, used when the options leave them unset.
+const (
+	defaultLSHTrees    = 5
+	defaultLSHLeafSize = 100
+)
+
+// lshParams returns the number of trees and the leaf size of the search index.
+func (o CollectionOptions) lshParams() (trees, leafSize int) {
+	trees, leafSize = o.LSHTrees, o.LSHLeafSize
+	if trees <= 0 {
+		trees = defaultLSHTrees
+	}
+	if leafSize <= 0 {
+		leafSize = defaultLSHLeafSize
+	}
+	return trees, leafSize
+}
+
+// ErrImmutableOption is returned by UpdateOptions when a change would require
+// rewriting the stored vectors.
+var ErrImmutableOption = errors.New("option cannot be changed after the collection is created")
+
+// ErrCollectionClosed is returned when a collection is used after Close.
+// Methods that don't return an error return an empty result instead.
+var ErrCollectionClosed = errors.New("collection is closed")
+
+// ErrLockTimeout is returned when an operation that changes a collection could
+// not start within its LockTimeout.
+var ErrLockTimeout = errors.New("timed out waiting for the collection lock")
+
+// ErrStreamNotFound is returned by GetStream when a document has no data stream
+// with the given ID.
+var ErrStreamNotFound = errors.New("stream not found")
+
+// ErrDimensionMismatch is returned by SearchE when the search vector doesn't
+// have DimensionCount components, by EncodeVectors, AddVectors and Centroid
+// when the vectors don't all have the same number, and by DecodeVectors when
+// the data is too short.
+var ErrDimensionMismatch = errors.New("vector has the wrong number of dimensions")
+
 // GetDocumentCount returns the total number of documents in the collection.
 //
 // This method provides a quick way to determine the size of the collection
@@ -54,6 +226,9 @@ type CollectionOptions struct {
 func (c *Collection) GetDocumentCount() int {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return 0
+	}
 
 	// Use spanfile to count records
 	_, numRecords := c.spanfile.GetStats()
@@ -67,12 +242,89 @@ It returns a CollectionStats object filled with the relevant statistics.
 func (c *Collection) ComputeStats() CollectionStats {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return CollectionStats{}
+	}
 
-	// Calculate the storage size
-	storageSize, documentCount := c.spanfile.GetStats()
+	stats := c.computeStatsLite()
 
 	// Calculate the average distance
 	averageDistance := c.computeAverageDistance(100) // Example: use 100 samples
+	stats.AverageDistance = &averageDistance
+
+	if c.WithNorms {
+		norms, err := c.computeNormStats()
+		if err != nil {
+			logWarnf("Warning -- failed to read norms: %v", err)
+		} else {
+			stats.Norms = &norms
+		}
+	}
+	return stats
+}
+
+// NormStats describes the lengths of the vectors of a collection created
+// WithNorms.
+type NormStats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+
+	// Number of documents whose vector has a length of zero
+	Zero int `json:"zero"`
+}
+
+// computeNormStats reads the stored norm of every document. The caller must
+// hold the lock.
+func (c *Collection) computeNormStats() (NormStats, error) {
+	var stats NormStats
+	count := 0
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		norm, err := c.readNorm(id, sr)
+		if err != nil {
+			return fmt.Errorf("document %d: %w", id, err)
+		}
+		if count == 0 || norm < stats.Min {
+			stats.Min = norm
+		}
+		stats.Max = max(stats.Max, norm)
+		stats.Mean += norm
+		if norm == 0 {
+			stats.Zero++
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return NormStats{}, err
+	}
+	if count > 0 {
+		stats.Mean /= float64(count)
+	}
+	return stats, nil
+}
+
+/*
+ComputeStatsLite returns the same statistics as ComputeStats, except for
+AverageDistance, which is left nil. It does not read any documents, so it is
+much faster and always returns the same result for an unchanged collection.
+*/
+func (c *Collection) ComputeStatsLite() CollectionStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return CollectionStats{}
+	}
+	return c.computeStatsLite()
+}
+
+func (c *Collection) computeStatsLite() CollectionStats {
+	// Calculate the storage size
+	storageSize, documentCount := c.spanfile.GetStats()
+	if c.vectorfile != nil {
+		vectorSize, _ := c.vectorfile.GetStats()
+		storageSize += vectorSize
+	}
 
 	var distanceMethod string
 	switch c.DistanceMethod {
@@ -84,14 +336,32 @@ func (c *Collection) ComputeStats() CollectionStats {
 		distanceMethod = "unknown"
 	}
 
+	trees, leafSize := c.lshParams()
+
 	// Create and return the CollectionStats
 	return CollectionStats{
-		DocumentCount:   documentCount,
-		DimensionCount:  c.DimensionCount,
-		Quantization:    c.Quantization,
-		DistanceMethod:  distanceMethod,
-		StorageSize:     int64(storageSize),
-		AverageDistance: averageDistance,
+		DocumentCount:  documentCount,
+		DimensionCount: c.DimensionCount,
+		Quantization:   c.Quantization,
+		DistanceMethod: distanceMethod,
+		StorageSize:    int64(storageSize),
+		LSHTrees:       trees,
+		LSHLeafSize:    leafSize,
+		Metrics:        c.Metrics(),
+	}
+}
+
+/*
+Metrics returns the number of operations the collection has served since it was opened.
+*/
+func (c *Collection) Metrics() CollectionMetrics {
+	return CollectionMetrics{
+		Reads:    c.reads.Load(),
+		Writes:   c.writes.Load(),
+		Deletes:  c.deletes.Load(),
+		Searches: c.searches.Load(),
+
+		Compactions: c.compactions.Load(),
 	}
 }
 
@@ -107,6 +377,46 @@ type Document struct {
 
 	// Metadata is additional information associated with the document.
 	Metadata []byte
+
+	// metadataMap caches the result of MetadataMap, which was decoded from
+	// metadataFrom.
+	metadataMap  map[string]interface{}
+	metadataFrom []byte
+}
+
+/*
+MetadataMap decodes the document's metadata as a JSON object. Empty metadata
+gives an empty map. The map is cached, so calling it again is cheap, and it is
+decoded again only if Metadata is replaced. Changes to the returned map are seen
+by later calls.
+*/
+func (d *Document) MetadataMap() (map[string]interface{}, error) {
+	if d.metadataMap != nil && len(d.metadataFrom) == len(d.Metadata) &&
+		(len(d.Metadata) == 0 || &d.metadataFrom[0] == &d.Metadata[0]) {
+		return d.metadataMap, nil
+	}
+	metadata := map[string]interface{}{}
+	if len(d.Metadata) > 0 {
+		if err := json.Unmarshal(d.Metadata, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of document %d: %v", d.ID, err)
+		}
+	}
+	d.metadataMap, d.metadataFrom = metadata, d.Metadata
+	return metadata, nil
+}
+
+/*
+MetadataInto decodes the document's metadata as JSON into v, which may be a
+pointer to a struct. Empty metadata leaves v unchanged.
+*/
+func (d *Document) MetadataInto(v interface{}) error {
+	if len(d.Metadata) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(d.Metadata, v); err != nil {
+		return fmt.Errorf("failed to decode metadata of document %d: %v", d.ID, err)
+	}
+	return nil
 }
 
 /*
@@ -121,6 +431,14 @@ type SearchResult struct {
 
 	// Distance is the calculated distance from the search vector to the document vector.
 	Distance float64
+
+	// Score is the distance converted to the type requested in SearchArgs.ScoreType.
+	// It is zero when no ScoreType was requested.
+	Score float64
+
+	// ParsedMetadata is the metadata decoded from JSON. It is only set when the
+	// search used SearchArgs.ParsedFilter, which already had to decode it.
+	ParsedMetadata interface{}
 }
 
 /*
@@ -132,18 +450,91 @@ type SearchResults struct {
 
 	// PercentSearched indicates the percentage of the database that was searched to obtain the results.
 	PercentSearched float64
+
+	// Explanation describes the index traversal. It is only set when SearchArgs.Explain is true.
+	Explanation *SearchExplanation
+
+	// TimedOut is true when the search reached SearchArgs.Deadline, so the
+	// results are those found until then.
+	TimedOut bool
+
+	// Facets maps each field in SearchArgs.Facets to the number of results
+	// having each of its values.
+	Facets map[string]map[string]int
+}
+
+/*
+SearchExplanation describes how a search examined the collection.
+*/
+type SearchExplanation struct {
+	// Nodes lists the index nodes visited, in the order they were visited.
+	Nodes []ExplainedNode
+
+	// NodesPruned is the number of leaves skipped because they were farther
+	// from the search vector than the search radius.
+	NodesPruned int
+
+	// Candidates is the number of documents examined.
+	Candidates int
+
+	// FinalRadius is the search radius when the search ended.
+	FinalRadius float64
+
+	// StopReason describes why the search ended.
+	StopReason string
+}
+
+/*
+ExplainedNode is a single index node visited during a search.
+*/
+type ExplainedNode struct {
+	// Tree is the index of the tree containing the node.
+	Tree int
+
+	// Depth is the distance of the node from the root of its tree.
+	Depth int
+
+	// Leaf is true if the node holds documents rather than a hyperplane.
+	Leaf bool
+
+	// Priority is the distance from the search vector to the parent's hyperplane.
+	// It is negative when the node is on the opposite side from the search vector.
+	Priority float64
+
+	// Candidates is the number of documents examined in this node.
+	Candidates int
 }
 
 /*
 SearchArgs defines the arguments for performing a search in the collection.
 */
 type SearchArgs struct {
-	// Vector is the search vector used to find similar documents.
+	// Vector is the search vector used to find similar documents. Without one,
+	// the documents that pass the filters are listed in the order of the file,
+	// with a Distance of 0, as when K and Radius are both 0, and K only limits
+	// how many are returned.
 	Vector []float64
 
 	// Filter is an optional function to filter documents based on their ID and metadata.
 	Filter FilterFn
 
+	// ParsedFilter is like Filter, but receives the metadata decoded from JSON.
+	// The decoded metadata of each result is returned in
+	// SearchResult.ParsedMetadata, so callers don't need to decode it again.
+	// If both filters are set, a document must pass both.
+	ParsedFilter ParsedFilterFn
+
+	// FilterQuery is a query in the Query Filter Language that documents must
+	// match. It is applied like a ParsedFilter built with BuildParsedFilter, but
+	// when it requires one of the collection's IndexedFields to equal a value,
+	// only the documents with that value are read.
+	FilterQuery string
+
+	// ExcludeIDs lists documents that are never returned, such as results the
+	// user has already seen. They are skipped before they are read, so this is
+	// cheaper than a filter that checks their IDs.
+	ExcludeIDs []uint64
+
 	// K specifies the maximum number of nearest neighbors to return.
 	K int
 
@@ -155,6 +546,57 @@ type SearchArgs struct {
 	Offset    int
 	Limit     int
 	Precision string
+
+	// StopOnExact ends the search as soon as a document within ExactEpsilon of the
+	// search vector is found, and returns only that document. This is useful for
+	// checking whether a vector is already stored. It is ignored with Farthest.
+	StopOnExact bool
+
+	// ExactEpsilon is the largest distance considered an exact match when
+	// StopOnExact is set.
+	ExactEpsilon float64
+
+	// Parallelism is the number of goroutines used to compare documents when
+	// Precision is "exact". Values of 0 or 1 search serially.
+	Parallelism int
+
+	// ScoreType selects how SearchResult.Score is computed. It may be "distance"
+	// (the default, which leaves Score unset) or "similarity", which is
+	// 1 - distance and is only available for cosine collections.
+	ScoreType string
+
+	// SortBy selects the order of the results: "distance_asc" (the default),
+	// "distance_desc", "id_asc" or "id_desc". When K is set, the nearest K
+	// documents are found first and then sorted. Documents at the same
+	// distance are ordered by ID.
+	SortBy string
+
+	// Explain records how the search index was traversed and returns it in
+	// SearchResults.Explanation. It is meant for debugging poor recall.
+	Explain bool
+
+	// Deadline, if set, is when the search stops and returns the results it
+	// has found so far, with SearchResults.TimedOut set.
+	Deadline time.Time
+
+	// Farthest returns the K documents farthest from the search vector, or with
+	// Radius, the documents at least Radius from it, with the farthest first.
+	// The search index only finds near documents, so every document is read.
+	// This is useful for finding outliers, or documents unlike an example.
+	Farthest bool
+
+	// Facets lists metadata fields whose values are counted among the results
+	// returned by Search and SearchE, in SearchResults.Facets. See countFacets.
+	Facets []string
+
+	// excluded holds ExcludeIDs for quick lookups during the search.
+	excluded map[uint64]struct{}
+}
+
+// isExcluded reports whether ExcludeIDs contains id.
+func (args *SearchArgs) isExcluded(id uint64) bool {
+	_, ok := args.excluded[id]
+	return ok
 }
 
 /*
@@ -177,12 +619,108 @@ type CollectionStats struct {
 	// Storage on disk used by the collection
 	StorageSize int64 `json:"storage_size"`
 
-	// Average distance between random pairs of documents
-	AverageDistance float64 `json:"average_distance"`
+	// Average distance between random pairs of documents, estimated from a
+	// sample. Nil when the stats come from ComputeStatsLite.
+	AverageDistance *float64 `json:"average_distance,omitempty"`
+
+	// Distribution of the lengths of the document vectors. Nil unless the
+	// collection was created WithNorms, or when the stats come from
+	// ComputeStatsLite.
+	Norms *NormStats `json:"norms,omitempty"`
+
+	// Parameters of the search index
+	LSHTrees    int `json:"lsh_trees"`
+	LSHLeafSize int `json:"lsh_leaf_size"`
+
+	// Operation counts since the collection was opened
+	Metrics CollectionMetrics `json:"metrics"`
+}
+
+/*
+StorageBreakdown divides the bytes used by a collection's files by what they hold.
+The byte counts add up to TotalBytes.
+*/
+type StorageBreakdown struct {
+	// Bytes of metadata and vectors of the current documents
+	LiveBytes uint64 `json:"live_bytes"`
+
+	// Bytes of deleted and replaced documents whose space has not been reused
+	DeletedBytes uint64 `json:"deleted_bytes"`
+
+	// Bytes that hold no record, including the unused space at the end of a file
+	FreeBytes uint64 `json:"free_bytes"`
+
+	// Bytes of span headers, checksums and padding, and of the collection header
+	OverheadBytes uint64 `json:"overhead_bytes"`
+
+	// Total size of the collection's files
+	TotalBytes uint64 `json:"total_bytes"`
+
+	// How the free space between records is divided
+	FreeSpace FreeSpaceStats `json:"free_space"`
+}
+
+func (b *StorageBreakdown) add(other StorageBreakdown) {
+	b.LiveBytes += other.LiveBytes
+	b.DeletedBytes += other.DeletedBytes
+	b.FreeBytes += other.FreeBytes
+	b.OverheadBytes += other.OverheadBytes
+	b.TotalBytes += other.TotalBytes
+
+	b.FreeSpace.FreeBytes += other.FreeSpace.FreeBytes
+	b.FreeSpace.FreeSpans += other.FreeSpace.FreeSpans
+	b.FreeSpace.LargestFreeSpan = max(b.FreeSpace.LargestFreeSpan, other.FreeSpace.LargestFreeSpan)
+	b.FreeSpace.updateRatio()
+}
+
+/*
+StorageBreakdown reads through the collection's files and reports how much of
+them is used by live documents, deleted documents, free space and overhead, and
+how fragmented the free space is. It reads every span, so it is slower than
+ComputeStats.
+*/
+func (c *Collection) StorageBreakdown() StorageBreakdown {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return StorageBreakdown{}
+	}
+
+	breakdown := c.spanfile.storageBreakdown()
+	breakdown.FreeSpace = c.spanfile.FreeSpaceStats()
+	if c.vectorfile != nil {
+		vectors := c.vectorfile.storageBreakdown()
+		vectors.FreeSpace = c.vectorfile.FreeSpaceStats()
+		breakdown.add(vectors)
+	}
+	return breakdown
+}
+
+/*
+CollectionMetrics counts the operations a collection has served since it was opened.
+*/
+type CollectionMetrics struct {
+	// Number of documents read with GetDocument
+	Reads uint64 `json:"reads"`
+
+	// Number of documents added or updated
+	Writes uint64 `json:"writes"`
+
+	// Number of documents removed
+	Deletes uint64 `json:"deletes"`
+
+	// Number of searches performed
+	Searches uint64 `json:"searches"`
+
+	// Number of times the file was compacted
+	Compactions uint64 `json:"compactions"`
 }
 
 type FilterFn func(id uint64, metadata []byte) bool
 
+// ParsedFilterFn filters documents using metadata that has already been decoded from JSON.
+type ParsedFilterFn func(id uint64, metadata interface{}) bool
+
 const (
 	Euclidean = iota
 	Cosine
@@ -198,6 +736,67 @@ type Collection struct {
 	lshTree  *lshTree
 	mutex    sync.RWMutex // Change from sync.Mutex to sync.RWMutex
 	distance func([]float64, []float64) float64
+
+	// vectorfile holds the vectors when SeparateVectors is set. Otherwise it is
+	// nil and the vectors are stored with the metadata in spanfile.
+	vectorfile *SpanFile
+
+	// fields indexes the values of IndexedFields. It is nil when there are none.
+	fields *fieldIndex
+
+	// dedup finds the stored copies of vectors when Dedup is set. Otherwise it
+	// is nil.
+	dedup *dedupIndex
+
+	// Operation counters, updated atomically so they don't need the mutex
+	reads    atomic.Uint64
+	writes   atomic.Uint64
+	deletes  atomic.Uint64
+	searches atomic.Uint64
+
+	compactions atomic.Uint64
+	compacting  atomic.Bool // set while a compaction is pending or running
+
+	// lockTimeout holds LockTimeout, so that it can be read without the mutex
+	lockTimeout atomic.Int64
+
+	// flushTimer flushes the write buffer when it is not flushed for a while.
+	flushTimer *time.Timer
+}
+
+// writeBufferFlushInterval is how long documents may stay in the write buffer.
+const writeBufferFlushInterval = time.Second
+
+// lock acquires the write lock, waiting at most LockTimeout for it.
+func (c *Collection) lock() error {
+	timeout := time.Duration(c.lockTimeout.Load())
+	if timeout <= 0 {
+		c.mutex.Lock()
+		return nil
+	}
+
+	// Wait with Lock in the background, so that new readers queue behind the
+	// writer instead of starving it. If the wait is given up, the lock is
+	// released as soon as it is acquired.
+	acquired := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		c.mutex.Lock()
+		select {
+		case acquired <- struct{}{}:
+		case <-abandoned:
+			c.mutex.Unlock()
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acquired:
+		return nil
+	case <-timer.C:
+		close(abandoned)
+		return ErrLockTimeout
+	}
 }
 
 // BuildFilter compiles the query into a filter function that can be used with SearchArgs.
@@ -210,13 +809,47 @@ func BuildFilter(queryIn string) (FilterFn, error) {
 	return func(id uint64, metadata []byte) bool {
 		pass, err := fn(metadata)
 		if err != nil {
-			log.Printf("Error applying filter to document %d: %v", id, err)
+			logWarnf("Error applying filter to document %d: %v", id, err)
+			return false
+		}
+		return pass
+	}, nil
+}
+
+// BuildParsedFilter compiles the query into a filter function for SearchArgs.ParsedFilter.
+func BuildParsedFilter(queryIn string) (ParsedFilterFn, error) {
+	fn, err := query.ParsedFilterFunctionFromQuery(queryIn)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(id uint64, metadata interface{}) bool {
+		pass, err := fn(metadata)
+		if err != nil {
+			logWarnf("Error applying filter to document %d: %v", id, err)
 			return false
 		}
 		return pass
 	}, nil
 }
 
+// applyFilter reports whether a document passes the filters in args. When
+// ParsedFilter is set, it also returns the decoded metadata.
+func (args *SearchArgs) applyFilter(id uint64, metadata []byte) (bool, interface{}) {
+	if args.Filter != nil && !args.Filter(id, metadata) {
+		return false, nil
+	}
+	if args.ParsedFilter == nil {
+		return true, nil
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(metadata, &parsed); err != nil {
+		logWarnf("Error decoding metadata for document %d: %v", id, err)
+		return false, nil
+	}
+	return args.ParsedFilter(id, parsed), parsed
+}
+
 /*
 NewCollection creates a new Collection with the specified options.
 It initializes the collection's memory file and pivots manager.
@@ -232,30 +865,56 @@ func NewCollection(options CollectionOptions) (*Collection, error) {
 		}
 	}
 
+	if !fileExists {
+		if err := checkDimensionCount(options.DimensionCount); err != nil {
+			return nil, err
+		}
+		if (options.QuantMin != 0 || options.QuantMax != 0) && options.QuantMax <= options.QuantMin {
+			return nil, fmt.Errorf("invalid quantization range: %v to %v", options.QuantMin, options.QuantMax)
+		}
+		if err := checkDimensionPolicy(options.DimensionPolicy); err != nil {
+			return nil, err
+		}
+		if err := checkIndexType(options.IndexType); err != nil {
+			return nil, err
+		}
+	}
+
 	// Open or create the memory-mapped file with the specified mode
 	spanFile, err := OpenFile(options.Name, options.FileMode)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
+	var savedIndex []byte
 	if fileExists {
 		// Read the header to get the collection options
-		header, err := spanFile.ReadRecord("")
+		header, err := spanFile.readRecord(headerRecordID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read header: %v", err)
 		}
+		savedIndex = savedIndexData(spanFile, header)
 
-		// Decode the collection options from the header
+		// Decode the collection options from the header. The name saved in
+		// it is out of date if the file has been renamed.
+		name := options.Name
 		err = json.Unmarshal(header.DataStreams[0].Data, &options)
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal options: %v", err)
 		}
+		options.Name = name
+
+		if err := checkDimensionCount(options.DimensionCount); err != nil {
+			spanFile.Close()
+			return nil, err
+		}
 	} else {
 		if options.Quantization == 0 {
 			options.Quantization = 64
 		}
+		options.Normalized = options.NormalizeOnInsert
 
-		// Write the options to a JSON string and save it to the spanFile as record with id ""
+		// Write the options to a JSON string and save it to the spanFile as the header record
 		// as datastream 0
 		optionsData, err := json.Marshal(options)
 		if err != nil {
@@ -265,105 +924,628 @@ func NewCollection(options CollectionOptions) (*Collection, error) {
 		dataStreams := []DataStream{
 			{StreamID: 0, Data: optionsData},
 		}
-		err = spanFile.WriteRecord("", dataStreams)
+		err = spanFile.WriteRecord(headerRecordID, dataStreams)
 		if err != nil {
 			return nil, fmt.Errorf("failed to write options: %v", err)
 		}
 	}
 
 	// Determine the distance function
-	var distanceFunc func([]float64, []float64) float64
-	switch options.DistanceMethod {
-	case Euclidean:
-		distanceFunc = euclideanDistance
-	case Cosine:
-		distanceFunc = angularDistance
-	default:
-		return nil, fmt.Errorf("unsupported distance method")
+	distanceFunc, err := distanceFunction(options.DistanceMethod, options.Normalized && !options.Sparse)
+	if err != nil {
+		return nil, err
+	}
+
+	var vectorFile *SpanFile
+	if options.SeparateVectors {
+		vectorFile, err = OpenFile(vectorFileName(options.Name), options.FileMode)
+		if err != nil {
+			spanFile.Close()
+			return nil, fmt.Errorf("failed to open vector file: %w", err)
+		}
+	}
+
+	if options.UseWAL && options.FileMode != ReadOnly {
+		for _, file := range []*SpanFile{spanFile, vectorFile} {
+			if file == nil {
+				continue
+			}
+			if err := file.EnableWAL(); err != nil {
+				spanFile.Close()
+				if vectorFile != nil {
+					vectorFile.Close()
+				}
+				return nil, err
+			}
+		}
+	}
+
+	if options.SkipChecksums {
+		spanFile.SetVerifyChecksums(false)
+		if vectorFile != nil {
+			vectorFile.SetVerifyChecksums(false)
+		}
+	}
+
+	if options.WriteBufferSize > 0 && options.FileMode != ReadOnly {
+		for _, file := range []*SpanFile{spanFile, vectorFile} {
+			if file != nil {
+				file.SetWriteBuffer(options.WriteBufferSize)
+			}
+		}
 	}
 
 	c := &Collection{
 		CollectionOptions: options,
 		spanfile:          spanFile,
+		vectorfile:        vectorFile,
 		distance:          distanceFunc,
 	}
+	c.lockTimeout.Store(int64(options.LockTimeout))
 
-	if useTree {
-		lshTree := newLSHTree(c, 100, 5)
-		c.index = lshTree
-		c.lshTree = lshTree
+	// Create the search index, adding any documents already in the file,
+	// unless it was saved when the collection was last closed
+	err = nil
+	if !c.loadIndex(savedIndex) {
+		err = c.buildIndex()
 	}
-
-	// If the file exists, iterate through all existing documents and add them to the LSH table
-	if fileExists {
-		err := c.spanfile.IterateRecords(func(recordID string, sr *SpanReader) error {
-			id, err := strconv.ParseUint(recordID, 10, 64)
-			if err != nil {
-				return nil
-			}
-			doc := c.decodeDocument(sr, id)
-			c.lshTree.addPoint(id, doc.Vector)
-			return nil
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to iterate records: %v", err)
+	if err == nil {
+		err = c.buildFieldIndex()
+	}
+	if err == nil {
+		err = c.buildDedupIndex()
+	}
+	if err != nil {
+		spanFile.Close()
+		if vectorFile != nil {
+			vectorFile.Close()
 		}
+		return nil, err
 	}
 
 	return c, nil
 }
 
-// GetOptions returns the collection options used to create the collection.
-func (c *Collection) GetOptions() CollectionOptions {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.CollectionOptions
+// vectorFileName returns the name of the file that holds the vectors of a
+// collection created with SeparateVectors.
+func vectorFileName(name string) string {
+	return name + ".vectors"
 }
 
-/*
-GetAllIDs returns a sorted list of all document IDs in the collection.
-*/
-func (c *Collection) GetAllIDs() []uint64 {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// buildIndex creates the search index from the collection options and adds every
+// document to it. The caller must hold the write lock, or have exclusive access.
+func (c *Collection) buildIndex() error {
+	if !c.hasIndex() {
+		c.index = nil
+		c.lshTree = nil
+		return nil
+	}
 
-	var ids []uint64
-	c.spanfile.IterateRecords(func(recordID string, sr *SpanReader) error {
-		id, err := strconv.ParseUint(recordID, 10, 64)
-		if err == nil {
-			ids = append(ids, id)
+	trees, leafSize := c.lshParams()
+	lshTree := newLSHTree(c, leafSize, trees)
+	lshTree.presplit(c.ExpectedDocuments)
+	c.index = lshTree
+	c.lshTree = lshTree
+
+	// With a seed, the documents are added in a fixed order too
+	err := c.iterateDataRecords(c.LSHSeed != 0, func(id uint64, sr *SpanReader) error {
+		doc, err := c.decodeDocument(sr, id)
+		if err != nil {
+			return err
 		}
+		c.lshTree.addPoint(id, doc.Vector)
 		return nil
 	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate records: %v", err)
+	}
+	return nil
+}
 
-	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+// indexStreamID is the data stream of the header record that holds the search
+// index saved with PersistIndex.
+const indexStreamID = 1
 
-	return ids
+// savedIndexData returns the search index saved in the header of a file, or nil
+// if there is none, or records were written after it was saved.
+func savedIndexData(spanFile *SpanFile, header *Span) []byte {
+	data, err := header.getStream(indexStreamID)
+	if err != nil {
+		return nil
+	}
+	if header.SequenceNumber != spanFile.lastSequenceNumber() {
+		return nil
+	}
+	return data
+}
+
+// loadIndex uses the search index saved in the file, if PersistIndex is set
+// and it matches the collection. It reports whether the index was loaded. The
+// caller must have exclusive access.
+func (c *Collection) loadIndex(data []byte) bool {
+	if data == nil || !c.PersistIndex || !c.hasIndex() {
+		return false
+	}
+	trees, leafSize := c.lshParams()
+	_, documents := c.spanfile.GetStats()
+	lshTree, err := decodeLSHTree(c, leafSize, trees, documents, data)
+	if err != nil {
+		logWarnf("Warning -- rebuilding the search index of %s: %v", c.Name, err)
+		return false
+	}
+	c.index = lshTree
+	c.lshTree = lshTree
+	return true
 }
 
 /*
-ComputeAverageDistance calculates the average distance between random pairs of documents in the collection.
-It returns the average distance or 0.0 if there are fewer than two documents or if the sample size is non-positive.
+SaveIndex saves the search index in the collection's file, so that it is loaded
+instead of being built from every document when the collection is next opened
+with PersistIndex set. Close saves it when PersistIndex is set, but a program
+that keeps a collection open for a long time can save it sooner. The saved index
+is ignored if the collection is changed after it is saved.
 */
-func (c *Collection) computeAverageDistance(samples int) float64 {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+func (c *Collection) SaveIndex() error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
 
-	if samples <= 0 {
-		return 0.0
+	if c.spanfile == nil {
+		return ErrCollectionClosed
 	}
+	return c.saveIndex()
+}
 
-	totalDistance := 0.0
-	count := 0
+// saveIndex writes the header with the search index, unless the index saved in
+// it is still up to date. The caller must hold the write lock.
+func (c *Collection) saveIndex() error {
+	if c.lshTree == nil {
+		return nil
+	}
+	if header, err := c.spanfile.readRecord(headerRecordID); err == nil && savedIndexData(c.spanfile, header) != nil {
+		return nil
+	}
+
+	optionsData, err := json.Marshal(c.CollectionOptions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %v", err)
+	}
+	_, documents := c.spanfile.GetStats()
+	return c.spanfile.WriteRecord(headerRecordID, []DataStream{
+		{StreamID: 0, Data: optionsData},
+		{StreamID: indexStreamID, Data: c.lshTree.encode(documents)},
+	})
+}
+
+// buildFieldIndex indexes the IndexedFields of every document. The caller must
+// hold the write lock, or have exclusive access.
+func (c *Collection) buildFieldIndex() error {
+	c.fields = nil
+	if len(c.IndexedFields) == 0 {
+		return nil
+	}
+
+	fields := newFieldIndex(c.IndexedFields)
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		metadata, err := sr.getStream(0)
+		if err != nil {
+			logWarnf("Warning -- could not read metadata for record %d", id)
+			return nil
+		}
+		fields.add(id, metadata)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate records: %v", err)
+	}
+	c.fields = fields
+	return nil
+}
+
+/*
+UpdateOptions changes the options of an existing collection. Only options that
+don't affect how vectors are stored may change. Changing DistanceMethod,
+DimensionCount, Quantization, QuantMin, QuantMax, Sparse, SeparateVectors,
+UseWAL, WithNorms or Dedup returns ErrImmutableOption. All other options, such
+as the search index parameters, IndexType, IndexedFields, DimensionPolicy,
+NormalizeOnInsert, LockTimeout and AutoCompactThreshold, may change. The new
+options are saved in the file header, and the search index is rebuilt if its
+parameters changed. The Name and FileMode are ignored.
+*/
+func (c *Collection) UpdateOptions(options CollectionOptions) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	if options.DistanceMethod != c.DistanceMethod {
+		return fmt.Errorf("%w: distance method", ErrImmutableOption)
+	}
+	if options.DimensionCount != c.DimensionCount {
+		return fmt.Errorf("%w: dimension count", ErrImmutableOption)
+	}
+	if options.Quantization != c.Quantization {
+		return fmt.Errorf("%w: quantization", ErrImmutableOption)
+	}
+	if options.QuantMin != c.QuantMin || options.QuantMax != c.QuantMax {
+		return fmt.Errorf("%w: quantization range", ErrImmutableOption)
+	}
+	if options.Sparse != c.Sparse {
+		return fmt.Errorf("%w: sparse", ErrImmutableOption)
+	}
+	if options.SeparateVectors != c.SeparateVectors {
+		return fmt.Errorf("%w: separate vectors", ErrImmutableOption)
+	}
+	if options.UseWAL != c.UseWAL {
+		return fmt.Errorf("%w: write-ahead log", ErrImmutableOption)
+	}
+	if options.WithNorms != c.WithNorms {
+		return fmt.Errorf("%w: with norms", ErrImmutableOption)
+	}
+	if options.Dedup != c.Dedup {
+		return fmt.Errorf("%w: dedup", ErrImmutableOption)
+	}
+	if err := checkDimensionPolicy(options.DimensionPolicy); err != nil {
+		return err
+	}
+	if err := checkIndexType(options.IndexType); err != nil {
+		return err
+	}
+
+	options.Name = c.Name
+	options.FileMode = c.FileMode
+	options.Normalized = c.Normalized && options.NormalizeOnInsert
+	optionsData, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %v", err)
+	}
+	err = c.spanfile.WriteRecord(headerRecordID, []DataStream{{StreamID: 0, Data: optionsData}})
+	if err != nil {
+		return fmt.Errorf("failed to write options: %v", err)
+	}
+
+	if options.SkipChecksums != c.SkipChecksums {
+		c.spanfile.SetVerifyChecksums(!options.SkipChecksums)
+		if c.vectorfile != nil {
+			c.vectorfile.SetVerifyChecksums(!options.SkipChecksums)
+		}
+	}
+
+	if options.WriteBufferSize != c.WriteBufferSize && c.FileMode != ReadOnly {
+		if err := c.setWriteBuffer(options.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+
+	oldTrees, oldLeafSize := c.lshParams()
+	oldExpected := c.ExpectedDocuments
+	oldSeed := c.LSHSeed
+	oldIndex := c.hasIndex()
+	oldFields := c.IndexedFields
+	c.CollectionOptions = options
+	c.lockTimeout.Store(int64(options.LockTimeout))
+	c.distance, _ = distanceFunction(c.DistanceMethod, c.unitVectors())
+	if !slices.Equal(c.IndexedFields, oldFields) {
+		if err := c.buildFieldIndex(); err != nil {
+			return err
+		}
+	}
+	if trees, leafSize := c.lshParams(); trees != oldTrees || leafSize != oldLeafSize || c.ExpectedDocuments != oldExpected || c.LSHSeed != oldSeed || c.hasIndex() != oldIndex {
+		return c.buildIndex()
+	}
+	return nil
+}
+
+// rename moves the collection's files to newName, which must not exist, and
+// changes its Name. The files stay open while they are renamed.
+func (c *Collection) rename(newName string) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	return c.renameUnlocked(newName)
+}
+
+// renameUnlocked renames the collection as rename does. The caller must hold
+// the write lock.
+func (c *Collection) renameUnlocked(newName string) error {
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	if err := c.spanfile.rename(newName); err != nil {
+		return fmt.Errorf("failed to rename %s: %v", c.Name, err)
+	}
+	if c.vectorfile != nil {
+		if err := c.vectorfile.rename(vectorFileName(newName)); err != nil {
+			c.spanfile.rename(c.Name)
+			return fmt.Errorf("failed to rename vector file of %s: %v", c.Name, err)
+		}
+	}
+	c.Name = newName
+	return nil
+}
+
+// Values of CollectionOptions.DimensionPolicy.
+const (
+	DimensionStrict   = "strict"
+	DimensionPad      = "pad"
+	DimensionTruncate = "truncate"
+)
+
+// checkDimensionPolicy rejects unknown values of DimensionPolicy.
+func checkDimensionPolicy(policy string) error {
+	switch policy {
+	case "", DimensionStrict, DimensionPad, DimensionTruncate:
+		return nil
+	}
+	return fmt.Errorf("invalid dimension policy %q", policy)
+}
+
+// Values of CollectionOptions.IndexType. IndexNone is the same as IndexFlat.
+const (
+	IndexLSH  = "lsh"
+	IndexFlat = "flat"
+	IndexNone = "none"
+)
+
+// checkIndexType rejects unknown values of IndexType.
+func checkIndexType(indexType string) error {
+	switch indexType {
+	case "", IndexLSH, IndexFlat, IndexNone:
+		return nil
+	}
+	return fmt.Errorf("invalid index type %q", indexType)
+}
+
+// hasIndex reports whether the collection keeps a search index, rather than
+// reading every document for each search.
+func (c *Collection) hasIndex() bool {
+	return c.IndexType == "" || c.IndexType == IndexLSH
+}
+
+// applyDimensionPolicy pads or truncates vector to the given number of
+// dimensions, if the policy allows it. Otherwise it returns vector unchanged.
+func applyDimensionPolicy(policy string, vector []float64, dimensions int) []float64 {
+	switch {
+	case policy == DimensionPad && len(vector) < dimensions:
+		padded := make([]float64, dimensions)
+		copy(padded, vector)
+		return padded
+	case policy == DimensionTruncate && len(vector) > dimensions:
+		return vector[:dimensions]
+	}
+	return vector
+}
+
+// checkDimensionCount rejects dimension counts that are negative or larger than
+// the configured maximum, before they can cause huge allocations.
+func checkDimensionCount(dimensions int) error {
+	if dimensions < 0 || dimensions > maxDimensions() {
+		return fmt.Errorf("invalid dimension count %d: must be between 0 and %d", dimensions, maxDimensions())
+	}
+	return nil
+}
+
+// GetOptions returns the collection options used to create the collection.
+func (c *Collection) GetOptions() CollectionOptions {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.CollectionOptions
+}
+
+/*
+GetAllIDs returns a sorted list of all document IDs in the collection.
+*/
+func (c *Collection) GetAllIDs() []uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return nil
+	}
 
 	var ids []uint64
-	c.spanfile.IterateRecords(func(recordID string, sr *SpanReader) error {
-		id, err := strconv.ParseUint(recordID, 10, 64)
-		if err == nil {
-			ids = append(ids, id)
+	c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		ids = append(ids, id)
+		return nil
+	})
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// errStopIteration stops an iteration over the records early.
+var errStopIteration = errors.New("stop iteration")
+
+/*
+IterateBySequence calls fn for each document in the order the documents were
+written, which is useful to replay changes. An updated document comes where it
+was last written. Iteration stops when fn returns false. The collection is
+locked for reading until it finishes, so fn must not change the collection.
+*/
+func (c *Collection) IterateBySequence(fn func(doc *Document) bool) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	err := c.spanfile.IterateRecordsBySequence(func(recordID string, sr *SpanReader) error {
+		id, ok := parseDocumentID(recordID)
+		if !ok {
+			return nil
+		}
+		doc, err := c.decodeDocument(sr, id)
+		if err != nil {
+			return err
+		}
+		if !fn(doc) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+/*
+ValidationReport lists the problems found by Validate. Each list is sorted by
+document ID, and all of them are empty for a healthy collection.
+*/
+type ValidationReport struct {
+	Documents int `json:"documents"` // the number of documents stored
+
+	// NotIndexed has the documents that are stored but missing from some
+	// of the search trees, so searches may not find them.
+	NotIndexed []uint64 `json:"not_indexed,omitempty"`
+
+	// NotStored has the IDs that are in the search trees without a stored
+	// document, which searches may return but that can't be read.
+	NotStored []uint64 `json:"not_stored,omitempty"`
+
+	// BadVectors has the documents whose vectors can't be read or don't
+	// have DimensionCount dimensions.
+	BadVectors []uint64 `json:"bad_vectors,omitempty"`
+}
+
+// OK reports whether Validate found no problems.
+func (r ValidationReport) OK() bool {
+	return len(r.NotIndexed) == 0 && len(r.NotStored) == 0 && len(r.BadVectors) == 0
+}
+
+/*
+IndexStats describes the shape of a collection's search trees, to help find why
+searches miss documents. The trees split the documents into leaves of up to
+LeafSize documents each; a leaf that can't be split, for example because its
+documents have nearly the same vector, keeps growing, and searches that reach it
+read all of its documents. A high Skew or many OversizedLeaves means the
+documents are poorly spread, and searches will miss more of the nearest ones.
+All counts are over every tree. A collection without a search index reports
+zero trees.
+*/
+type IndexStats struct {
+	Trees    int `json:"trees"`
+	LeafSize int `json:"leaf_size"`
+
+	// MaxDepth is the depth of the deepest leaf, where a root that has not
+	// been split is at depth zero.
+	MaxDepth     int     `json:"max_depth"`
+	AverageDepth float64 `json:"average_depth"`
+
+	Leaves          int `json:"leaves"`
+	EmptyLeaves     int `json:"empty_leaves"`
+	OversizedLeaves int `json:"oversized_leaves"` // leaves of more than LeafSize documents
+
+	// The number of documents in the leaves
+	AverageLeafDocuments float64 `json:"average_leaf_documents"`
+	MedianLeafDocuments  int     `json:"median_leaf_documents"`
+	P90LeafDocuments     int     `json:"p90_leaf_documents"`
+	MaxLeafDocuments     int     `json:"max_leaf_documents"`
+
+	// Skew is the number of documents in the largest leaf, divided by the
+	// average. It is close to 1 when the documents are spread evenly.
+	Skew float64 `json:"skew"`
+}
+
+// IndexStats describes the shape of the collection's search trees.
+func (c *Collection) IndexStats() IndexStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.lshTree == nil {
+		return IndexStats{}
+	}
+	return c.lshTree.stats()
+}
+
+/*
+Validate checks that the search index and the stored documents agree, and that
+every document has a readable vector of the right size, for example after a
+crash or after the files were changed by hand. It reads every document, and the
+collection is locked for reading until it finishes. Problems are listed in the
+report; the error is only for failures to run the check.
+*/
+func (c *Collection) Validate() (ValidationReport, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var report ValidationReport
+	if c.spanfile == nil {
+		return report, ErrCollectionClosed
+	}
+
+	indexed := make(map[uint64]int)
+	trees := 0
+	if c.lshTree != nil {
+		c.lshTree.countIDs(indexed)
+		trees = len(c.lshTree.roots)
+	}
+	vectorSize := getVectorSize(c.Quantization, c.DimensionCount)
+
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		report.Documents++
+		if c.lshTree != nil {
+			if indexed[id] != trees {
+				report.NotIndexed = append(report.NotIndexed, id)
+			}
+			delete(indexed, id)
+		}
+
+		_, vectorData, err := c.readDocument(id)
+		if err == nil && c.Sparse {
+			var sv sparseVector
+			min, max := c.quantRange()
+			err = decodeSparseVectorInto(&sv, vectorData, c.DimensionCount, c.Quantization, min, max)
+		} else if err == nil && len(vectorData) != vectorSize {
+			err = fmt.Errorf("vector has %d bytes, expected %d", len(vectorData), vectorSize)
+		}
+		if err != nil {
+			report.BadVectors = append(report.BadVectors, id)
 		}
 		return nil
 	})
+	if err != nil {
+		return report, fmt.Errorf("failed to iterate records: %v", err)
+	}
+
+	// The IDs left in the index have no stored document
+	for id := range indexed {
+		report.NotStored = append(report.NotStored, id)
+	}
+	for _, ids := range [][]uint64{report.NotIndexed, report.NotStored, report.BadVectors} {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return report, nil
+}
+
+// averageDistanceSampled is called whenever computeAverageDistance reads the
+// documents, so that tests can tell when it does.
+var averageDistanceSampled = func() {}
+
+/*
+ComputeAverageDistance calculates the average distance between random pairs of documents in the collection.
+It returns the average distance or 0.0 if there are fewer than two documents or if the sample size is non-positive.
+The caller must hold the lock.
+*/
+func (c *Collection) computeAverageDistance(samples int) float64 {
+	averageDistanceSampled()
+
+	if samples <= 0 {
+		return 0.0
+	}
+
+	totalDistance := 0.0
+	count := 0
+
+	var ids []uint64
+	c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		ids = append(ids, id)
+		return nil
+	})
 
 	if len(ids) < 2 {
 		return 0.0
@@ -406,9 +1588,31 @@ Returns:
 - An error if the memfile cannot be closed.
 */
 func (c *Collection) Close() error {
-	c.mutex.Lock()
+	if err := c.lock(); err != nil {
+		return err
+	}
 	defer c.mutex.Unlock()
+	return c.close()
+}
 
+// close closes the collection as Close does. The caller must hold the write
+// lock.
+func (c *Collection) close() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	// Write buffered vectors before the documents that refer to them
+	if c.vectorfile != nil {
+		if err := c.vectorfile.Flush(); err != nil {
+			return err
+		}
+	}
+	if c.spanfile != nil && c.PersistIndex && c.FileMode != ReadOnly {
+		if err := c.saveIndex(); err != nil {
+			logWarnf("Warning -- failed to save the search index of %s: %v", c.Name, err)
+		}
+	}
 	if c.spanfile != nil {
 		err := c.spanfile.Close()
 		if err != nil {
@@ -416,71 +1620,832 @@ func (c *Collection) Close() error {
 		}
 		c.spanfile = nil
 	}
+	if c.vectorfile != nil {
+		err := c.vectorfile.Close()
+		if err != nil {
+			return err
+		}
+		c.vectorfile = nil
+	}
 
 	return nil
 }
 
 /*
-AddDocument adds a new document to the collection with the specified ID, vector, and metadata.
-It manages pivots and encodes the document for storage.
+Warmup loads the collection's files into memory, so that the first searches
+after the collection is opened aren't slowed down by reading them from disk. It
+reads the files sequentially, which is much faster than the random reads of a
+search. The operating system may still drop the pages later if memory runs
+short. The collection can be used while it is warmed up.
 */
-func (c *Collection) AddDocument(id uint64, vector []float64, metadata []byte) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+func (c *Collection) Warmup() error {
+	c.mutex.RLock()
+	files := []*SpanFile{c.spanfile, c.vectorfile}
+	c.mutex.RUnlock()
 
-	// Check if the vector size matches the expected dimensions
-	if len(vector) != c.DimensionCount {
-		log.Panicf("vector size does not match the expected number of dimensions: expected %d, got %d", c.DimensionCount, len(vector))
+	if files[0] == nil {
+		return ErrCollectionClosed
+	}
+	// Each file takes its own mutex for every chunk it reads, so the
+	// collection need not stay locked
+	for _, file := range files {
+		if file != nil {
+			file.Warmup()
+		}
 	}
+	return nil
+}
 
-	doc := &Document{
-		Vector:   vector,
-		Metadata: metadata,
-		ID:       id,
+/*
+Flush writes any documents held in the write buffer to the file. See
+CollectionOptions.WriteBufferSize.
+*/
+func (c *Collection) Flush() error {
+	if err := c.lock(); err != nil {
+		return err
 	}
+	defer c.mutex.Unlock()
 
-	// Encode the document
-	encodedVector := encodeDocument(doc, c.Quantization)
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	return c.flush()
+}
 
-	// Write to spanfile
-	dataStreams := []DataStream{
-		{StreamID: 0, Data: metadata},
-		{StreamID: 1, Data: encodedVector},
+// flush writes the write buffers of the collection's files. The caller must
+// hold the write lock.
+func (c *Collection) flush() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
 	}
-	err := c.spanfile.WriteRecord(fmt.Sprintf("%d", id), dataStreams)
-	if err != nil {
-		log.Panicf("Failed to write record: %v", err)
+	// Write buffered vectors before the documents that refer to them
+	if c.vectorfile != nil {
+		if err := c.vectorfile.Flush(); err != nil {
+			return err
+		}
 	}
-
-	// Add the document's vector to the LSH table
-	c.lshTree.addPoint(id, vector)
+	return c.spanfile.Flush()
 }
 
-/*
-GetDocument retrieves a document from the collection by its ID.
-It returns the document or an error if the document is not found.
-*/
-func (c *Collection) GetDocument(id uint64) (*Document, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-
-	return c.getDocument(id)
+// setWriteBuffer changes the size of the write buffers of the collection's
+// files. The caller must hold the write lock.
+func (c *Collection) setWriteBuffer(size int) error {
+	if c.vectorfile != nil {
+		if err := c.vectorfile.SetWriteBuffer(size); err != nil {
+			return err
+		}
+	}
+	return c.spanfile.SetWriteBuffer(size)
 }
 
-func (c *Collection) getDocument(id uint64) (*Document, error) {
-	span, err := c.spanfile.ReadRecord(fmt.Sprintf("%d", id))
-	if err != nil {
-		return nil, err
+// scheduleFlush makes sure that buffered documents are flushed within
+// writeBufferFlushInterval. The caller must hold the write lock.
+func (c *Collection) scheduleFlush() {
+	if c.WriteBufferSize <= 0 || c.flushTimer != nil {
+		return
 	}
+	c.flushTimer = time.AfterFunc(writeBufferFlushInterval, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.flushTimer = nil
+		if c.spanfile == nil {
+			return
+		}
+		if err := c.flush(); err != nil {
+			logErrorf("Failed to flush collection %s: %v", c.Name, err)
+		}
+	})
+}
 
-	metadata := span.DataStreams[0].Data
-	vector := decodeVector(span.DataStreams[1].Data, c.DimensionCount, c.Quantization)
-
-	return &Document{
-		ID:       id,
+/*
+AddDocument adds a new document to the collection with the specified ID, vector, and metadata.
+It manages pivots and encodes the document for storage. It returns an error if the vector
+has the wrong number of dimensions or contains NaN or infinite components.
+*/
+func (c *Collection) AddDocument(id uint64, vector []float64, metadata []byte) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	return c.addDocument(id, vector, metadata)
+}
+
+// Values of the onDuplicate policy of AddDocumentWithPolicy.
+const (
+	DuplicateOverwrite = "overwrite"
+	DuplicateError     = "error"
+	DuplicateSkip      = "skip"
+)
+
+// ErrDuplicateID is returned by AddDocumentWithPolicy when the collection
+// already has a document with the ID and the policy is DuplicateError.
+var ErrDuplicateID = errors.New("a document with this ID already exists")
+
+// checkDuplicatePolicy rejects unknown values of the onDuplicate policy.
+func checkDuplicatePolicy(policy string) error {
+	switch policy {
+	case "", DuplicateOverwrite, DuplicateError, DuplicateSkip:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate policy %q", policy)
+}
+
+/*
+AddDocumentWithPolicy is like AddDocument, but onDuplicate decides what happens
+when the collection already has a document with the ID: DuplicateOverwrite (or
+"") replaces it as AddDocument does, DuplicateError returns ErrDuplicateID, and
+DuplicateSkip leaves it unchanged. It reports whether the document was written.
+*/
+func (c *Collection) AddDocumentWithPolicy(id uint64, vector []float64, metadata []byte, onDuplicate string) (bool, error) {
+	added, err := c.AddDocumentsWithPolicy([]Document{{ID: id, Vector: vector, Metadata: metadata}}, []string{onDuplicate})
+	if err != nil {
+		return false, err
+	}
+	return added[0], nil
+}
+
+/*
+AddDocumentsWithPolicy adds several documents at once, as AddDocumentWithPolicy
+does, with onDuplicate[i] deciding what happens when docs[i] has the ID of a
+document in the collection or earlier in docs. The collection is locked once for
+the whole batch, and every document is checked before any is written, so that
+the batch is not written at all if one of the documents has the wrong number of
+dimensions or fails with ErrDuplicateID. It reports which documents were
+written.
+*/
+func (c *Collection) AddDocumentsWithPolicy(docs []Document, onDuplicate []string) ([]bool, error) {
+	if len(docs) != len(onDuplicate) {
+		return nil, fmt.Errorf("got %d documents but %d duplicate policies", len(docs), len(onDuplicate))
+	}
+	for _, policy := range onDuplicate {
+		if err := checkDuplicatePolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.lock(); err != nil {
+		return nil, err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	added := make([]bool, len(docs))
+	vectors := make([][]float64, len(docs))
+	seen := make(map[uint64]bool, len(docs))
+	for i, doc := range docs {
+		vector, err := c.prepareVector(doc.Vector)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", doc.ID, err)
+		}
+		vectors[i] = vector
+
+		exists := seen[doc.ID]
+		if !exists && (onDuplicate[i] == DuplicateError || onDuplicate[i] == DuplicateSkip) {
+			_, err := c.spanfile.getSpanReader(fmt.Sprintf("%d", doc.ID))
+			exists = err == nil
+		}
+		seen[doc.ID] = true
+		switch {
+		case exists && onDuplicate[i] == DuplicateError:
+			return nil, fmt.Errorf("document %d: %w", doc.ID, ErrDuplicateID)
+		case exists && onDuplicate[i] == DuplicateSkip:
+		default:
+			added[i] = true
+		}
+	}
+
+	for i, doc := range docs {
+		if !added[i] {
+			continue
+		}
+		if err := c.writeDocument(doc.ID, vectors[i], doc.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// addDocument adds or replaces a document. The caller must hold the write lock.
+func (c *Collection) addDocument(id uint64, vector []float64, metadata []byte) error {
+	vector, err := c.prepareVector(vector)
+	if err != nil {
+		return err
+	}
+	return c.writeDocument(id, vector, metadata)
+}
+
+// prepareVector applies the DimensionPolicy to a vector for a new or updated
+// document, and checks it, and normalizes it with NormalizeOnInsert.
+func (c *Collection) prepareVector(vector []float64) ([]float64, error) {
+	// Check if the vector size matches the expected dimensions
+	vector = applyDimensionPolicy(c.DimensionPolicy, vector, c.DimensionCount)
+	if len(vector) != c.DimensionCount {
+		return nil, fmt.Errorf("vector size does not match the expected number of dimensions: expected %d, got %d", c.DimensionCount, len(vector))
+	}
+	if err := validateVector(vector); err != nil {
+		return nil, err
+	}
+	if c.NormalizeOnInsert {
+		vector = normalizeVector(append([]float64(nil), vector...))
+	}
+	return vector, nil
+}
+
+// writeDocument writes a document whose vector has been prepared with
+// prepareVector. The caller must hold the write lock.
+func (c *Collection) writeDocument(id uint64, vector []float64, metadata []byte) error {
+	doc := &Document{
 		Vector:   vector,
 		Metadata: metadata,
-	}, nil
+		ID:       id,
+	}
+
+	// Encode the document
+	encodedVector := c.encodeVector(doc.Vector)
+
+	// Write to spanfile
+	err := c.writeRecord(fmt.Sprintf("%d", id), metadata, encodedVector)
+	if err != nil {
+		return fmt.Errorf("failed to write document %d: %w", id, err)
+	}
+
+	// Add the document's vector to the LSH table
+	if c.lshTree != nil {
+		c.lshTree.addPoint(id, vector)
+	}
+	if c.fields != nil {
+		c.fields.add(id, metadata)
+	}
+	c.scheduleFlush()
+	c.writes.Add(1)
+	c.maybeCompact()
+	return nil
+}
+
+// validateVector returns an error if any component of the vector is NaN or
+// infinite, which would make its distance to every other vector NaN.
+func validateVector(vector []float64) error {
+	for i, v := range vector {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("vector component %d is %v; components must be finite numbers", i, v)
+		}
+	}
+	return nil
+}
+
+/*
+GetDocument retrieves a document from the collection by its ID.
+It returns the document or an error if the document is not found.
+*/
+func (c *Collection) GetDocument(id uint64) (*Document, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	c.reads.Add(1)
+	return c.getDocument(id)
+}
+
+/*
+GetDocumentNorm returns the stored length of a document's vector. The collection
+must have been created WithNorms.
+*/
+func (c *Collection) GetDocumentNorm(id uint64) (float64, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return 0, ErrCollectionClosed
+	}
+
+	if !c.WithNorms {
+		return 0, fmt.Errorf("the collection does not store norms")
+	}
+	c.reads.Add(1)
+	sr, err := c.spanfile.getSpanReader(fmt.Sprintf("%d", id))
+	if err != nil {
+		return 0, err
+	}
+	return c.readNorm(id, sr)
+}
+
+func (c *Collection) getDocument(id uint64) (*Document, error) {
+	doc := &Document{}
+	if err := c.getDocumentInto(id, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// getDocumentInto reads a document into doc, reusing doc.Vector as the decode
+// buffer when it has enough capacity.
+func (c *Collection) getDocumentInto(id uint64, doc *Document) error {
+	metadata, vectorData, err := c.readDocument(id)
+	if err != nil {
+		return err
+	}
+	return c.decodeDocumentInto(doc, id, metadata, vectorData)
+}
+
+// getDocumentNormInto reads a document into doc, as getDocumentInto does, and
+// returns its stored norm. The collection must have been created WithNorms.
+func (c *Collection) getDocumentNormInto(id uint64, doc *Document) (float64, error) {
+	metadata, vectorSpan, err := c.readDocumentSpan(id)
+	if err != nil {
+		return 0, err
+	}
+	vectorData, err := vectorSpan.getStream(1)
+	if err != nil {
+		return 0, err
+	}
+	normData, err := vectorSpan.getStream(2)
+	if err != nil {
+		return 0, err
+	}
+	norm, err := decodeNorm(normData)
+	if err != nil {
+		return 0, err
+	}
+	return norm, c.decodeDocumentInto(doc, id, metadata, vectorData)
+}
+
+// decodeDocumentInto sets doc to a document read from the file, decoding its
+// vector into doc.Vector when it has enough capacity.
+func (c *Collection) decodeDocumentInto(doc *Document, id uint64, metadata, vectorData []byte) error {
+	if cap(doc.Vector) < c.DimensionCount {
+		doc.Vector = make([]float64, c.DimensionCount)
+	}
+	doc.Vector = doc.Vector[:c.DimensionCount]
+	if err := c.decodeVectorInto(doc.Vector, vectorData); err != nil {
+		return err
+	}
+
+	doc.ID = id
+	doc.Metadata = metadata
+	return nil
+}
+
+// getSparseDocumentInto reads the ID and metadata of a document in a Sparse
+// collection into doc, and its vector into sv. doc.Vector is left unchanged.
+func (c *Collection) getSparseDocumentInto(id uint64, doc *Document, sv *sparseVector) error {
+	metadata, vectorData, err := c.readDocument(id)
+	if err != nil {
+		return err
+	}
+	min, max := c.quantRange()
+	if err := decodeSparseVectorInto(sv, vectorData, c.DimensionCount, c.Quantization, min, max); err != nil {
+		return err
+	}
+	doc.ID = id
+	doc.Metadata = metadata
+	return nil
+}
+
+// readDocument returns the metadata and the encoded vector of a document.
+func (c *Collection) readDocument(id uint64) (metadata, vectorData []byte, err error) {
+	metadata, vectorSpan, err := c.readDocumentSpan(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	vectorData, err = vectorSpan.getStream(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, vectorData, nil
+}
+
+// readDocumentSpan returns the metadata of a document, and the reader for the
+// record that holds its vector.
+func (c *Collection) readDocumentSpan(id uint64) (metadata []byte, vectorSpan *Span, err error) {
+	recordID := fmt.Sprintf("%d", id)
+	span, err := c.spanfile.readRecord(recordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, err = span.getStream(0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vectorSpan = span
+	if owner := c.vectorOwner(id, span); c.vectorfile != nil || owner != id {
+		file := c.spanfile
+		if c.vectorfile != nil {
+			file = c.vectorfile
+		}
+		vectorSpan, err = file.readRecord(fmt.Sprintf("%d", owner))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read vector: %v", err)
+		}
+	}
+	return metadata, vectorSpan, nil
+}
+
+// decodeVectorInto decodes a stored vector into dst, which must have a length of
+// DimensionCount.
+func (c *Collection) decodeVectorInto(dst []float64, data []byte) error {
+	min, max := c.quantRange()
+	if c.Sparse {
+		var sv sparseVector
+		if err := decodeSparseVectorInto(&sv, data, c.DimensionCount, c.Quantization, min, max); err != nil {
+			return err
+		}
+		sv.denseInto(dst)
+		return nil
+	}
+	DecodeVectorRangeInto(dst, data, c.DimensionCount, c.Quantization, min, max)
+	return nil
+}
+
+// encodeVector encodes a vector in the collection's storage format.
+func (c *Collection) encodeVector(vector []float64) []byte {
+	min, max := c.quantRange()
+	if c.Sparse {
+		return encodeSparseVector(vector, c.Quantization, min, max)
+	}
+	data := make([]byte, getVectorSize(c.Quantization, len(vector)))
+	encodeVectorInto(data, vector, c.Quantization, min, max)
+	return data
+}
+
+// quantRange returns the range of vector components that quantization maps
+// to the available integers.
+func (c *Collection) quantRange() (min, max float64) {
+	if c.QuantMin == 0 && c.QuantMax == 0 {
+		return -1, 1
+	}
+	return c.QuantMin, c.QuantMax
+}
+
+// minQuantRangeSample is the fewest vectors FitQuantizationRange fits a range to.
+const minQuantRangeSample = 100
+
+/*
+FitQuantizationRange sets QuantMin and QuantMax to the range of the components of
+the given vectors, widened by a tenth on each side so that later vectors a little
+outside it are not clipped. Vectors whose components are not between -1 and 1
+are then stored more precisely. The range always covers -1 to 1. It is meant to
+be called with the first vectors added to a collection, and does nothing if
+there are fewer than 100 of them, the collection already has documents or a
+range, or it does not use 4, 8 or 16 bit quantization.
+*/
+func (c *Collection) FitQuantizationRange(vectors [][]float64) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	if c.Quantization > 16 || c.QuantMin != 0 || c.QuantMax != 0 {
+		return nil
+	}
+	if _, numRecords := c.spanfile.GetStats(); numRecords > 0 || len(vectors) < minQuantRangeSample {
+		return nil
+	}
+
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, vector := range vectors {
+		if c.NormalizeOnInsert {
+			vector = normalizeVector(append([]float64(nil), vector...))
+		}
+		for _, v := range vector {
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+	}
+	if math.IsInf(min, 0) || math.IsInf(max, 0) || max <= min {
+		return nil
+	}
+	margin := (max - min) / 10
+
+	options := c.CollectionOptions
+	options.QuantMin, options.QuantMax = math.Min(min-margin, -1), math.Max(max+margin, 1)
+	optionsData, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %v", err)
+	}
+	err = c.spanfile.WriteRecord(headerRecordID, []DataStream{{StreamID: 0, Data: optionsData}})
+	if err != nil {
+		return fmt.Errorf("failed to write options: %v", err)
+	}
+	c.CollectionOptions = options
+	return nil
+}
+
+// readVector returns the encoded vector of a document, given the reader for its
+// record in the main file. When the vectors are kept in a separate file, the
+// vector is read from there instead.
+func (c *Collection) readVector(id uint64, sr *SpanReader) ([]byte, error) {
+	sr, err := c.vectorSpanReader(id, sr)
+	if err != nil {
+		return nil, err
+	}
+	return sr.getStream(1)
+}
+
+// readNorm returns the stored norm of a document, given the reader for its
+// record in the main file.
+func (c *Collection) readNorm(id uint64, sr *SpanReader) (float64, error) {
+	sr, err := c.vectorSpanReader(id, sr)
+	if err != nil {
+		return 0, err
+	}
+	data, err := sr.getStream(2)
+	if err != nil {
+		return 0, err
+	}
+	return decodeNorm(data)
+}
+
+// vectorSpanReader returns the reader for the record that holds a document's
+// vector, given the reader for its record in the main file. With Dedup, that
+// may be the record of another document.
+func (c *Collection) vectorSpanReader(id uint64, sr *SpanReader) (*SpanReader, error) {
+	owner := c.vectorOwner(id, sr)
+	if c.vectorfile == nil && owner == id {
+		return sr, nil
+	}
+	file := c.spanfile
+	if c.vectorfile != nil {
+		file = c.vectorfile
+	}
+	sr, err := file.getSpanReader(fmt.Sprintf("%d", owner))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector: %v", err)
+	}
+	return sr, nil
+}
+
+// writeRecord stores the metadata and encoded vector of a document. A nil
+// vector leaves the stored vector unchanged, which is only possible when the
+// vectors are kept in a separate file.
+func (c *Collection) writeRecord(recordID string, metadata, vector []byte) error {
+	streams := []DataStream{{StreamID: 0, Data: metadata}}
+	if c.dedup != nil {
+		id, _ := parseDocumentID(recordID)
+		ref, err := c.shareVector(id, vector)
+		if err != nil {
+			return err
+		}
+		if ref != nil {
+			// Another document stores the vector
+			if c.vectorfile != nil {
+				if err := c.removeVectorRecord(recordID); err != nil {
+					return err
+				}
+			}
+			streams = append(streams, DataStream{StreamID: refStreamID, Data: ref})
+			streams = append(streams, c.customStreams(recordID)...)
+			return c.spanfile.WriteRecord(recordID, streams)
+		}
+		if vector == nil && c.vectorfile == nil {
+			return fmt.Errorf("no vector to write for record %s", recordID)
+		}
+	}
+	if c.vectorfile == nil || vector != nil {
+		vectorStreams, err := c.vectorStreams(vector)
+		if err != nil {
+			return err
+		}
+		if c.vectorfile == nil {
+			streams = append(streams, vectorStreams...)
+		} else if err := c.vectorfile.WriteRecord(recordID, vectorStreams); err != nil {
+			return err
+		}
+	}
+	streams = append(streams, c.customStreams(recordID)...)
+	return c.spanfile.WriteRecord(recordID, streams)
+}
+
+// MinCustomStreamID is the smallest data stream ID that GetStream and SetStream
+// accept. The smaller IDs hold the metadata (0), vector (1), norm (2), shared
+// vector reference (3) and stream content types (4) of each document, and are
+// reserved for the collection.
+const MinCustomStreamID = 8
+
+// streamTypesStreamID is the data stream that holds the content types declared
+// with SetStreamWithType for the other streams of a document.
+const streamTypesStreamID = 4
+
+// customStreams returns copies of the streams set with SetStream on a record,
+// and of their content types, so that they are kept when the record is written
+// again.
+func (c *Collection) customStreams(recordID string) []DataStream {
+	sr, err := c.spanfile.getSpanReader(recordID)
+	if err != nil {
+		return nil
+	}
+	var streams []DataStream
+	sr.walkStreams(func(streamID uint8, data []byte) bool {
+		if streamID >= MinCustomStreamID || streamID == streamTypesStreamID {
+			streams = append(streams, DataStream{StreamID: streamID, Data: bytes.Clone(data)})
+		}
+		return true
+	})
+	return streams
+}
+
+func checkCustomStreamID(streamID uint8) error {
+	if streamID < MinCustomStreamID {
+		return fmt.Errorf("stream IDs below %d are reserved", MinCustomStreamID)
+	}
+	return nil
+}
+
+// checkContentType rejects content types that aren't valid media types.
+func checkContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return fmt.Errorf("invalid content type %q: %v", contentType, err)
+	}
+	return nil
+}
+
+// encodeStreamTypes encodes the content types of streams, in order of stream
+// ID, as the stream ID followed by the length and text of its type.
+func encodeStreamTypes(types map[uint8]string) []byte {
+	ids := make([]int, 0, len(types))
+	for streamID := range types {
+		ids = append(ids, int(streamID))
+	}
+	sort.Ints(ids)
+	var buf []byte
+	for _, streamID := range ids {
+		buf = append(buf, uint8(streamID))
+		buf = binary.AppendUvarint(buf, uint64(len(types[uint8(streamID)])))
+		buf = append(buf, types[uint8(streamID)]...)
+	}
+	return buf
+}
+
+// decodeStreamTypes decodes the content types written by encodeStreamTypes,
+// ignoring any that are damaged.
+func decodeStreamTypes(data []byte) map[uint8]string {
+	types := make(map[uint8]string)
+	for len(data) > 0 {
+		streamID := data[0]
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			break
+		}
+		data = data[1+n:]
+		types[streamID] = string(data[:length])
+		data = data[length:]
+	}
+	return types
+}
+
+/*
+GetStream returns the data stream of a document with the given ID, which must be
+at least MinCustomStreamID. It returns ErrRecordNotFound if there is no such
+document, and ErrStreamNotFound if the document has no such stream.
+*/
+func (c *Collection) GetStream(id uint64, streamID uint8) ([]byte, error) {
+	data, _, err := c.GetStreamWithType(id, streamID)
+	return data, err
+}
+
+// GetStreamWithType is like GetStream, but also returns the content type
+// declared for the stream with SetStreamWithType, or "" if none was.
+func (c *Collection) GetStreamWithType(id uint64, streamID uint8) ([]byte, string, error) {
+	if err := checkCustomStreamID(streamID); err != nil {
+		return nil, "", err
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return nil, "", ErrCollectionClosed
+	}
+
+	c.reads.Add(1)
+	span, err := c.spanfile.readRecord(fmt.Sprintf("%d", id))
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := span.getStream(streamID)
+	if err != nil {
+		return nil, "", ErrStreamNotFound
+	}
+	var contentType string
+	if types, err := span.getStream(streamTypesStreamID); err == nil {
+		contentType = decodeStreamTypes(types)[streamID]
+	}
+	return bytes.Clone(data), contentType, nil
+}
+
+/*
+SetStream stores data in a data stream of a document, replacing the stream if
+the document already has it. Streams let applications keep data with a document
+that isn't part of its metadata, such as a thumbnail or the original file. The
+stream ID must be at least MinCustomStreamID. The streams are kept when the
+document's metadata or vector changes, and removed with the document. It returns
+ErrRecordNotFound if there is no such document.
+*/
+func (c *Collection) SetStream(id uint64, streamID uint8, data []byte) error {
+	return c.SetStreamWithType(id, streamID, data, "")
+}
+
+/*
+SetStreamWithType is like SetStream, but also records the content type of the
+data, such as "image/png", so that it can be served correctly. An empty content
+type declares none, removing the type of the stream it replaces.
+*/
+func (c *Collection) SetStreamWithType(id uint64, streamID uint8, data []byte, contentType string) error {
+	if err := checkCustomStreamID(streamID); err != nil {
+		return err
+	}
+	if err := checkContentType(contentType); err != nil {
+		return err
+	}
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	recordID := fmt.Sprintf("%d", id)
+	span, err := c.spanfile.readRecord(recordID)
+	if err != nil {
+		return err
+	}
+	types := make(map[uint8]string)
+	if encoded, err := span.getStream(streamTypesStreamID); err == nil {
+		types = decodeStreamTypes(encoded)
+	}
+	typeChanged := types[streamID] != contentType
+	if contentType == "" {
+		delete(types, streamID)
+	} else {
+		types[streamID] = contentType
+	}
+
+	stream := DataStream{StreamID: streamID, Data: data}
+	streams := make([]DataStream, 0, len(span.DataStreams)+2)
+	found := false
+	for _, old := range span.DataStreams {
+		if old.StreamID == streamID {
+			found = true
+			continue
+		}
+		if old.StreamID == streamTypesStreamID && typeChanged {
+			continue
+		}
+		streams = append(streams, DataStream{StreamID: old.StreamID, Data: bytes.Clone(old.Data)})
+	}
+	if typeChanged && len(types) > 0 {
+		streams = append(streams, DataStream{StreamID: streamTypesStreamID, Data: encodeStreamTypes(types)})
+	}
+	if found || typeChanged {
+		err = c.spanfile.WriteRecord(recordID, append(streams, stream))
+	} else {
+		// A new stream can often be added without moving the record
+		err = c.spanfile.AppendStream(recordID, stream)
+	}
+	if err != nil {
+		return err
+	}
+	c.scheduleFlush()
+	c.writes.Add(1)
+	c.maybeCompact()
+	return nil
+}
+
+// vectorStreams returns the data streams stored for an encoded vector: the
+// vector in stream 1 and, with WithNorms, its length in stream 2. The length is
+// that of the vector as it is stored, after quantization.
+func (c *Collection) vectorStreams(vector []byte) ([]DataStream, error) {
+	streams := []DataStream{{StreamID: 1, Data: vector}}
+	if c.WithNorms {
+		decoded := make([]float64, c.DimensionCount)
+		if err := c.decodeVectorInto(decoded, vector); err != nil {
+			return nil, fmt.Errorf("failed to decode vector: %w", err)
+		}
+		streams = append(streams, DataStream{StreamID: 2, Data: encodeNorm(vectorLength(decoded))})
+	}
+	return streams, nil
+}
+
+func encodeNorm(norm float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(norm))
+}
+
+func decodeNorm(data []byte) (float64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("norm has %d bytes, expected 8", len(data))
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
 }
 
 /*
@@ -488,50 +2453,459 @@ UpdateDocument updates the metadata of an existing document in the collection.
 It returns an error if the document is not found.
 */
 func (c *Collection) UpdateDocument(id uint64, newMetadata []byte) error {
-	c.mutex.Lock()
+	return c.updateMetadata(id, func([]byte) ([]byte, error) {
+		return newMetadata, nil
+	})
+}
+
+/*
+SetMetadataField sets one field of a document's JSON metadata, leaving the rest
+unchanged. The path names nested fields separated by dots, as in queries, such as
+"user.profile.active". Objects are created for fields along the path that are
+missing, and a number in the path indexes an array, as in "tags.0". It returns an
+error if the document is not found or its metadata is not JSON.
+*/
+func (c *Collection) SetMetadataField(id uint64, path string, value interface{}) error {
+	return c.updateMetadata(id, func(metadata []byte) ([]byte, error) {
+		var data interface{}
+		if len(metadata) > 0 {
+			if err := json.Unmarshal(metadata, &data); err != nil {
+				return nil, fmt.Errorf("failed to decode metadata: %v", err)
+			}
+		}
+		data, err := query.SetField(data, strings.Split(path, "."), value)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(data)
+	})
+}
+
+/*
+UpdateDocumentVector replaces the vector of a document, keeping its metadata. It
+returns ErrRecordNotFound if there is no document with the ID.
+*/
+func (c *Collection) UpdateDocumentVector(id uint64, vector []float64) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
 	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	vector, err := c.prepareVector(vector)
+	if err != nil {
+		return err
+	}
 
-	span, err := c.spanfile.ReadRecord(fmt.Sprintf("%d", id))
+	old, err := c.getDocument(id)
+	if err != nil {
+		return err
+	}
+	err = c.writeRecord(fmt.Sprintf("%d", id), old.Metadata, c.encodeVector(vector))
 	if err != nil {
 		return err
 	}
 
-	dataStreams := []DataStream{
-		{StreamID: 0, Data: newMetadata},
-		{StreamID: 1, Data: span.DataStreams[1].Data},
+	if c.lshTree != nil {
+		c.lshTree.removePoint(id, old.Vector)
+		c.lshTree.addPoint(id, vector)
+	}
+	c.scheduleFlush()
+	c.writes.Add(1)
+	c.maybeCompact()
+	return nil
+}
+
+/*
+Normalize scales the vectors of a Cosine collection to unit length, and sets
+NormalizeOnInsert and Normalized, so that searches of the collection are faster.
+It only needs to be called once, for a collection that was created without
+NormalizeOnInsert. It doesn't change the distances between documents. If it
+fails part way, the vectors it has normalized are kept but the collection isn't
+marked as normalized.
+*/
+func (c *Collection) Normalize() error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	if c.DistanceMethod != Cosine || c.Sparse {
+		return fmt.Errorf("only dense Cosine collections can be normalized")
+	}
+
+	var ids []uint64
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate records: %v", err)
+	}
+	for _, id := range ids {
+		doc, err := c.getDocument(id)
+		if err != nil {
+			return fmt.Errorf("document %d: %w", id, err)
+		}
+		vector := normalizeVector(doc.Vector)
+		if err := c.writeRecord(fmt.Sprintf("%d", id), doc.Metadata, c.encodeVector(vector)); err != nil {
+			return fmt.Errorf("document %d: %w", id, err)
+		}
+	}
+	if err := c.buildIndex(); err != nil {
+		return err
+	}
+
+	options := c.CollectionOptions
+	options.NormalizeOnInsert = true
+	options.Normalized = true
+	optionsData, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %v", err)
+	}
+	err = c.spanfile.WriteRecord(headerRecordID, []DataStream{{StreamID: 0, Data: optionsData}})
+	if err != nil {
+		return fmt.Errorf("failed to write options: %v", err)
+	}
+	c.CollectionOptions = options
+	c.distance, _ = distanceFunction(c.DistanceMethod, c.unitVectors())
+	c.scheduleFlush()
+	c.writes.Add(uint64(len(ids)))
+	c.maybeCompact()
+	return nil
+}
+
+/*
+UpdateDocuments replaces the metadata of several documents at once, keeping their
+vectors, with metadata[i] becoming the metadata of ids[i]. The collection is
+locked once for the whole batch. Documents that can't be updated, such as those
+that don't exist, don't stop the others from being updated, and the returned
+error lists them all.
+*/
+func (c *Collection) UpdateDocuments(ids []uint64, metadata [][]byte) error {
+	if len(ids) != len(metadata) {
+		return fmt.Errorf("got %d IDs but %d metadata values", len(ids), len(metadata))
+	}
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	var errs []error
+	for i, id := range ids {
+		err := c.updateMetadataUnlocked(id, func([]byte) ([]byte, error) {
+			return metadata[i], nil
+		})
+		if err != nil {
+			errs = append(errs, &documentError{id: id, err: err})
+		}
+	}
+	c.maybeCompact()
+	return errors.Join(errs...)
+}
+
+// documentError is the error about one document of a batch.
+type documentError struct {
+	id  uint64
+	err error
+}
+
+func (e *documentError) Error() string {
+	return fmt.Sprintf("document %d: %v", e.id, e.err)
+}
+
+func (e *documentError) Unwrap() error {
+	return e.err
+}
+
+// failedDocuments returns the IDs of the documents that err, as returned by
+// UpdateDocuments, reports errors for.
+func failedDocuments(err error) []uint64 {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	var ids []uint64
+	for _, err := range errs {
+		var docErr *documentError
+		if errors.As(err, &docErr) {
+			ids = append(ids, docErr.id)
+		}
+	}
+	return ids
+}
+
+// updateMetadata replaces the metadata of a document with the result of update,
+// which is given the current metadata.
+func (c *Collection) updateMetadata(id uint64, update func(metadata []byte) ([]byte, error)) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	if err := c.updateMetadataUnlocked(id, update); err != nil {
+		return err
+	}
+	c.maybeCompact()
+	return nil
+}
+
+func (c *Collection) updateMetadataUnlocked(id uint64, update func(metadata []byte) ([]byte, error)) error {
+	recordID := fmt.Sprintf("%d", id)
+	span, err := c.spanfile.readRecord(recordID)
+	if err != nil {
+		return err
+	}
+	metadata, err := span.getStream(0)
+	if err != nil {
+		return err
+	}
+	newMetadata, err := update(metadata)
+	if err != nil {
+		return err
+	}
+
+	// With a separate vector file, only the metadata needs to be rewritten.
+	var vector []byte
+	if c.vectorfile == nil {
+		vectorSpan := span
+		if owner := c.vectorOwner(id, span); owner != id {
+			vectorSpan, err = c.spanfile.readRecord(fmt.Sprintf("%d", owner))
+			if err != nil {
+				return fmt.Errorf("failed to read vector: %v", err)
+			}
+		}
+		vector, err = vectorSpan.getStream(1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.writeRecord(recordID, newMetadata, vector)
+	if err != nil {
+		return err
+	}
+	if c.fields != nil {
+		c.fields.add(id, newMetadata)
+	}
+	c.scheduleFlush()
+
+	c.writes.Add(1)
+	return nil
+}
+
+func (c *Collection) removeDocument(id uint64) error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+
+	return c.removeDocumentUnlocked(id)
+}
+
+// removeDocumentUnlocked removes a document; the caller must hold the write lock.
+func (c *Collection) removeDocumentUnlocked(id uint64) error {
+	// Remove the document's vector from the LSH table
+	doc, err := c.getDocument(id)
+	if err == nil && c.lshTree != nil {
+		c.lshTree.removePoint(id, doc.Vector)
+	}
+	if err == nil && c.dedup != nil {
+		if err := c.releaseVector(id); err != nil {
+			return err
+		}
+	}
+	if err := c.spanfile.RemoveRecord(fmt.Sprintf("%d", id)); err != nil {
+		return err
+	}
+	if c.fields != nil {
+		c.fields.remove(id)
+	}
+	if c.vectorfile != nil {
+		if err := c.removeVectorRecord(fmt.Sprintf("%d", id)); err != nil {
+			return err
+		}
+	}
+	c.deletes.Add(1)
+	c.maybeCompact()
+	return nil
+}
+
+/*
+Compact rewrites the collection's file without the space used by deleted and
+replaced documents. It returns ErrCompactionRunning if the collection is already
+being compacted in the background.
+*/
+func (c *Collection) Compact() error {
+	if !c.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionRunning
+	}
+	defer c.compacting.Store(false)
+	return c.compact()
+}
+
+func (c *Collection) compact() error {
+	if err := c.lock(); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+
+	if c.spanfile == nil {
+		return ErrCollectionClosed
+	}
+	if err := c.spanfile.Compact(); err != nil {
+		return err
+	}
+	if c.vectorfile != nil {
+		if err := c.vectorfile.Compact(); err != nil {
+			return err
+		}
+	}
+	c.compactions.Add(1)
+	return nil
+}
+
+// maybeCompact starts a compaction in the background if the fraction of unused
+// space in the file exceeds AutoCompactThreshold. Only one compaction is started
+// at a time. The caller must hold the write lock.
+func (c *Collection) maybeCompact() {
+	if c.AutoCompactThreshold <= 0 {
+		return
+	}
+	size, _ := c.spanfile.GetStats()
+	free := c.spanfile.FreeSpace()
+	if c.vectorfile != nil {
+		vectorSize, _ := c.vectorfile.GetStats()
+		size += vectorSize
+		free += c.vectorfile.FreeSpace()
+	}
+	if size == 0 || float64(free)/float64(size) <= c.AutoCompactThreshold {
+		return
+	}
+	if !c.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.compacting.Store(false)
+		if err := c.compact(); err != nil {
+			logErrorf("Failed to compact collection %s: %v", c.Name, err)
+		}
+	}()
+}
+
+/*
+PurgeExpired removes every document whose metadata contains an "expires_at" unix
+timestamp (in seconds) that is at or before now. The timestamp may be stored as a
+JSON number or as a numeric string. Documents without a valid "expires_at" field
+never expire. It returns the number of documents removed.
+*/
+func (c *Collection) PurgeExpired(now time.Time) (int, error) {
+	if err := c.lock(); err != nil {
+		return 0, err
+	}
+	defer c.mutex.Unlock()
+	if c.spanfile == nil {
+		return 0, ErrCollectionClosed
+	}
+
+	var expired []uint64
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		metadata, err := sr.getStream(0)
+		if err != nil {
+			return nil
+		}
+		if expiresAt, ok := parseExpiresAt(metadata); ok && expiresAt <= now.Unix() {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range expired {
+		if err := c.removeDocumentUnlocked(id); err != nil {
+			return count, fmt.Errorf("failed to remove expired document %d: %v", id, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// parseExpiresAt extracts the "expires_at" unix timestamp from JSON metadata.
+func parseExpiresAt(metadata []byte) (int64, bool) {
+	var fields struct {
+		ExpiresAt json.RawMessage `json:"expires_at"`
 	}
-	err = c.spanfile.WriteRecord(fmt.Sprintf("%d", id), dataStreams)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(metadata, &fields); err != nil || len(fields.ExpiresAt) == 0 {
+		return 0, false
 	}
 
-	return nil
-}
-
-func (c *Collection) removeDocument(id uint64) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	var value interface{}
+	if err := json.Unmarshal(fields.ExpiresAt, &value); err != nil {
+		return 0, false
+	}
 
-	// Remove the document's vector from the LSH table
-	doc, err := c.getDocument(id)
-	if err == nil {
-		c.lshTree.removePoint(id, doc.Vector)
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		ts, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		return int64(ts), true
 	}
-	return c.spanfile.RemoveRecord(fmt.Sprintf("%d", id))
+	return 0, false
 }
 
-// iterateDocuments applies a function to each document in the collection.
 /*
-func (c *Collection) iterateDocuments(fn func(doc *Document)) {
-	for id := range c.memfile.idOffsets {
-		data, err := c.memfile.readRecord(id)
-		if err != nil {
-			continue
+iterateDataRecords calls fn with the ID of each document in the collection. The
+header record and any other record whose ID is not a document ID are skipped.
+When sorted is true, records are visited in order of their record IDs.
+The caller must hold the lock.
+*/
+func (c *Collection) iterateDataRecords(sorted bool, fn func(id uint64, sr *SpanReader) error) error {
+	callback := func(recordID string, sr *SpanReader) error {
+		id, ok := parseDocumentID(recordID)
+		if !ok {
+			return nil
 		}
-		doc := c.decodeDocument(data, id)
-		fn(doc)
+		return fn(id, sr)
+	}
+	if sorted {
+		return c.spanfile.IterateSortedRecords(callback)
+	}
+	return c.spanfile.IterateRecords(callback)
+}
+
+// parseDocumentID returns the document ID stored in a record ID. It returns false
+// for the header and other reserved records.
+func parseDocumentID(recordID string) (uint64, bool) {
+	if recordID == headerRecordID {
+		return 0, false
 	}
-}*/
+	id, err := strconv.ParseUint(recordID, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
 
 type resultItem struct {
 	SearchResult
@@ -543,7 +2917,17 @@ type resultPriorityQueue []*resultItem
 func (pq resultPriorityQueue) Len() int { return len(pq) }
 
 func (pq resultPriorityQueue) Less(i, j int) bool {
-	return pq[i].Priority > pq[j].Priority // Max-heap based on distance
+	return pq[i].after(pq[j].Priority, pq[j].ID) // Max-heap based on distance
+}
+
+// after reports whether the item comes after a result with the given priority
+// and ID. Results with the same priority are ordered by ID, so that documents
+// at the same distance are always returned in the same order.
+func (item *resultItem) after(priority float64, id uint64) bool {
+	if item.Priority != priority {
+		return item.Priority > priority
+	}
+	return item.ID > id
 }
 
 func (pq resultPriorityQueue) Swap(i, j int) {
@@ -567,96 +2951,216 @@ func (pq *resultPriorityQueue) Pop() interface{} {
 Search returns the search results, including the list of matching documents and the percentage of the database searched.
 */
 func (c *Collection) Search(args SearchArgs) SearchResults {
+	ret, _ := c.SearchE(args)
+	return ret
+}
+
+/*
+SearchE performs a search like Search, but also returns an error if the search
+could not be completed, such as when a document can't be read because the file
+is damaged, or the collection has been closed. The results found before the
+error are still returned.
+*/
+func (c *Collection) SearchE(args SearchArgs) (SearchResults, error) {
+	var results []SearchResult
+	ret, err := c.searchStream(args, func(result SearchResult) bool {
+		// The metadata may be in the mapped file, which can be unmapped
+		// once the lock is released, by Close or a compaction
+		result.Metadata = bytes.Clone(result.Metadata)
+		results = append(results, result)
+		return true
+	})
+	if args.SortBy == "" && args.Vector != nil && (args.K > 0 || args.Radius > 0) {
+		// Results within a radius are streamed in the order they are found.
+		// A listing of all documents keeps the order of the file.
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Distance == results[j].Distance {
+				return results[i].ID < results[j].ID
+			}
+			if args.Farthest {
+				return results[i].Distance > results[j].Distance
+			}
+			return results[i].Distance < results[j].Distance
+		})
+	}
+	ret.Results = results
+	if len(args.Facets) > 0 {
+		ret.Facets = countFacets(results, args.Facets)
+	}
+	return ret, err
+}
+
+/*
+SearchStream performs a search like Search, but passes each result to emit
+instead of returning it. Results of a radius search, or a listing of all
+documents, are passed on as soon as they are found, in no particular order.
+Results of a K nearest neighbour search, or one using StopOnExact or SortBy,
+are only known when the search ends, so they are passed on then, in order.
+Returning false from emit stops the search.
+
+The returned SearchResults has no Results. The collection is locked for reading
+until SearchStream returns, so emit must not modify the collection.
+*/
+func (c *Collection) SearchStream(args SearchArgs, emit func(SearchResult) bool) SearchResults {
+	ret, err := c.searchStream(args, emit)
+	if err != nil {
+		logWarnf("Warning -- search failed: %v", err)
+	}
+	return ret
+}
+
+// searchStream implements SearchStream, returning the error that stopped the
+// search, if any.
+func (c *Collection) searchStream(args SearchArgs, emit func(SearchResult) bool) (SearchResults, error) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
+	if c.spanfile == nil {
+		return SearchResults{}, ErrCollectionClosed
+	}
+	if args.Vector != nil && len(args.Vector) != c.DimensionCount {
+		return SearchResults{}, fmt.Errorf("%w: got %d, expected %d", ErrDimensionMismatch, len(args.Vector), c.DimensionCount)
+	}
+	less, err := resultOrder(args.SortBy)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	c.searches.Add(1)
 	// Default precision to "medium" if not set
 	if args.Precision == "" {
 		args.Precision = "medium"
 	}
 
-	log.Printf("Search called with %+v", args)
+	logDebugf("Search called with %+v", args)
+
+	// The stored vectors have unit length, so with a unit query vector the
+	// distance only needs their dot product
+	if c.unitVectors() && args.Vector != nil {
+		args.Vector = normalizeVector(append([]float64(nil), args.Vector...))
+	}
 
-	resultsPQ := &resultPriorityQueue{}
-	heap.Init(resultsPQ)
-	pointsSearched := 0
+	if len(args.ExcludeIDs) > 0 {
+		args.excluded = make(map[uint64]struct{}, len(args.ExcludeIDs))
+		for _, id := range args.ExcludeIDs {
+			args.excluded[id] = struct{}{}
+		}
+	}
 
-	consider := func(docid uint64, radius float64) (int, float64) {
-		doc, err := c.getDocument(docid)
+	// When the filter query requires indexed fields to have certain values,
+	// only the documents that have them need to be read.
+	var candidates []uint64
+	useCandidates := false
+	if args.FilterQuery != "" {
+		filter, err := BuildParsedFilter(args.FilterQuery)
 		if err != nil {
-			return StopSearch, radius
+			return SearchResults{}, fmt.Errorf("invalid filter query: %v", err)
+		}
+		if parsedFilter := args.ParsedFilter; parsedFilter != nil {
+			args.ParsedFilter = func(id uint64, metadata interface{}) bool {
+				return parsedFilter(id, metadata) && filter(id, metadata)
+			}
+		} else {
+			args.ParsedFilter = filter
 		}
+		candidates, useCandidates = c.indexedCandidates(args.FilterQuery)
+	}
 
-		pointsSearched++
+	score, err := c.scoreFunction(args.ScoreType)
+	if err != nil {
+		return SearchResults{}, err
+	}
 
-		// Apply filter function if provided
-		if args.Filter != nil && !args.Filter(doc.ID, doc.Metadata) {
-			return PointIgnored, radius
+	// Without a search vector there is nothing to rank the documents by, so
+	// no distances are computed and the matching documents are listed
+	if args.Vector == nil {
+		if args.K > 0 && (args.Limit == 0 || args.K < args.Limit) {
+			args.Limit = args.K
 		}
+		args.K, args.Radius = 0, 0
+		args.StopOnExact, args.Farthest = false, false
+	}
 
-		distance := c.distance(args.Vector, doc.Vector)
+	// An exact match would be the nearest document, not one of the farthest
+	if args.Farthest {
+		args.StopOnExact = false
+	}
 
-		if args.Radius > 0 && distance <= args.Radius {
-			heap.Push(resultsPQ, &resultItem{
-				SearchResult: SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance},
-				Priority:     distance,
-			})
-			return PointAccepted, radius
-		} else if args.Radius > 0 {
-			return PointChecked, radius
-		} else if args.K > 0 {
-			if resultsPQ.Len() <= args.K {
-				if resultsPQ.Len() < args.K || (*resultsPQ)[0].Priority > distance {
-					heap.Push(resultsPQ, &resultItem{
-						SearchResult: SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance},
-						Priority:     distance,
-					})
-					if resultsPQ.Len() > args.K {
-						heap.Pop(resultsPQ)
-					}
-					radius = (*resultsPQ)[0].Distance
-					return PointAccepted, radius
-				}
+	// Without an index, every search reads all of the documents, as do
+	// searches for the farthest documents, which the index can't find
+	exact := args.Precision == "exact" || c.index == nil || args.Farthest
+
+	state := c.newSearchState(&args)
+	if args.K == 0 && !args.StopOnExact && args.SortBy == "" {
+		// Each accepted result is final, so it can be passed on right away.
+		state.emit = func(result SearchResult) bool {
+			if score != nil {
+				result.Score = score(result.Distance)
 			}
-		} else if args.K == 0 && args.Radius == 0 {
-			// Exhaustive search: add all results
-			heap.Push(resultsPQ, &resultItem{
-				SearchResult: SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance},
-				Priority:     distance,
-			})
-			return PointAccepted, radius
+			return emit(result)
 		}
-		return PointChecked, radius
+	}
+
+	var explanation *SearchExplanation
+	if args.Explain {
+		explanation = &SearchExplanation{}
 	}
 
 	var results []SearchResult
+	stop := fmt.Errorf("stop iterating")
 
 	if args.Radius == 0 && args.K == 0 {
-		stop := fmt.Errorf("stop iterating")
 		// Exhaustive search: consider all documents
-		err := c.spanfile.IterateSortedRecords(func(recordID string, sr *SpanReader) error {
-			id, _ := strconv.ParseUint(recordID, 10, 64)
+		var candidateSet map[uint64]struct{}
+		if useCandidates {
+			candidateSet = make(map[uint64]struct{}, len(candidates))
+			for _, id := range candidates {
+				candidateSet[id] = struct{}{}
+			}
+		}
+		count := 0
+		err := c.iterateDataRecords(true, func(id uint64, sr *SpanReader) error {
+			if candidateSet != nil {
+				if _, ok := candidateSet[id]; !ok {
+					return nil
+				}
+			}
+			if args.isExcluded(id) {
+				return nil
+			}
+			if state.pastDeadline() {
+				return stop
+			}
 			metadata, err := sr.getStream(0)
 			if err != nil {
-				log.Printf("Warning -- could not read metadata for record %s", recordID)
+				logWarnf("Warning -- could not read metadata for record %d", id)
 			}
 
-			if args.Filter != nil && !args.Filter(id, metadata) {
+			pass, parsed := args.applyFilter(id, metadata)
+			if !pass {
 				// skip this record
 				return nil
 			}
-			pointsSearched++
+			state.pointsSearched++
 
-			if args.Offset > 0 && pointsSearched <= args.Offset {
+			if args.Offset > 0 && state.pointsSearched <= args.Offset {
 				// skip this record
 				return nil
 			}
 
-			results = append(results, SearchResult{
-				ID:       id,
-				Metadata: metadata,
-			})
+			result := SearchResult{
+				ID:             id,
+				Metadata:       metadata,
+				ParsedMetadata: parsed,
+			}
+			if state.emit != nil {
+				if !state.emit(result) {
+					return stop
+				}
+			} else {
+				results = append(results, result)
+			}
 
-			if args.Limit > 0 && len(results) >= args.Limit {
+			count++
+			if args.Limit > 0 && count >= args.Limit {
 				return stop
 			}
 
@@ -664,95 +3168,497 @@ func (c *Collection) Search(args SearchArgs) SearchResults {
 		})
 
 		if err != nil && err != stop {
-			log.Panicf("Failed to iterate records: %v", err)
+			return SearchResults{}, fmt.Errorf("failed to iterate records: %v", err)
 		}
 
 	} else {
 
-		if args.Precision == "exact" {
+		if useCandidates {
+			// Only the documents found in the field index can pass the filter.
+			for _, id := range candidates {
+				state.consider(id, math.MaxFloat64)
+				if state.exactMatch != nil || state.stopped || state.timedOut || state.err != nil {
+					break
+				}
+			}
+		} else if exact && args.Parallelism > 1 {
+			// The workers keep their own results, which are passed on when
+			// they have been merged.
+			state = c.searchExactParallel(&args, args.Parallelism)
+		} else if exact {
 			// Exact search: consider all documents
-			err := c.spanfile.IterateRecords(func(recordID string, sr *SpanReader) error {
-				id, err := strconv.ParseUint(recordID, 10, 64)
-				if err != nil {
-					return nil
+			err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+				state.consider(id, math.MaxFloat64)
+				if state.exactMatch != nil || state.stopped || state.timedOut || state.err != nil {
+					return stop
 				}
-				consider(id, math.MaxFloat64)
 				return nil
 			})
-			if err != nil {
-				log.Panicf("Failed to iterate records: %v", err)
+			if err != nil && err != stop {
+				return SearchResults{}, fmt.Errorf("failed to iterate records: %v", err)
 			}
 		} else {
 			radius := math.MaxFloat64
 			if args.Radius > 0 {
 				radius = args.Radius
 			}
-			c.index.search(args.Vector, radius, consider)
+			c.index.search(args.Vector, radius, state.consider, explanation)
 		}
 
-		// Extract results from the priority queue
-		results = make([]SearchResult, resultsPQ.Len())
-		for i := len(results) - 1; i >= 0; i-- {
-			results[i] = heap.Pop(resultsPQ).(*resultItem).SearchResult
+		if state.exactMatch != nil {
+			results = []SearchResult{*state.exactMatch}
+		} else {
+			// Extract results from the priority queue
+			results = make([]SearchResult, state.results.Len())
+			for i := len(results) - 1; i >= 0; i-- {
+				results[i] = heap.Pop(&state.results).(*resultItem).SearchResult
+			}
 		}
 	}
 
 	_, numRecords := c.spanfile.GetStats()
 
 	ret := SearchResults{
-		Results:         results,
-		PercentSearched: float64(pointsSearched) / float64(numRecords) * 100,
+		PercentSearched: float64(state.pointsSearched) / float64(numRecords) * 100,
+		Explanation:     explanation,
+		TimedOut:        state.timedOut,
+	}
+	if score != nil {
+		for i := range results {
+			results[i].Score = score(results[i].Distance)
+		}
+	}
+	if args.SortBy != "" {
+		sort.SliceStable(results, func(i, j int) bool {
+			return less(&results[i], &results[j])
+		})
+	}
+	for _, result := range results {
+		if !emit(result) {
+			break
+		}
+	}
+	if explanation != nil && explanation.StopReason == "" {
+		// The index was not used; documents were scanned directly.
+		explanation.Candidates = state.pointsSearched
+		explanation.StopReason = "index not used"
 	}
 	if numRecords == 0 {
 		// avoid NaN
 		ret.PercentSearched = 0
 	}
-	return ret
+	return ret, state.err
 }
 
-func encodeDocument(doc *Document, quantization int) []byte {
-	dimensions := len(doc.Vector)
+// indexedCandidates returns the IDs of the only documents that can match the
+// filter query, according to the field index. It returns false if the index
+// can't narrow down the documents.
+func (c *Collection) indexedCandidates(filterQuery string) ([]uint64, bool) {
+	if c.fields == nil {
+		return nil, false
+	}
+	conditions, err := query.EqualityConditions(filterQuery)
+	if err != nil {
+		return nil, false
+	}
+	return c.fields.candidates(conditions)
+}
+
+// scoreFunction returns the function that converts a distance into the requested
+// score type, or nil if distances are used unchanged. It returns an error if the
+// score type is unknown or not defined for the collection's distance method.
+func (c *Collection) scoreFunction(scoreType string) (func(float64) float64, error) {
+	switch scoreType {
+	case "", "distance":
+		return nil, nil
+	case "similarity":
+		if c.DistanceMethod != Cosine {
+			return nil, fmt.Errorf("score type %q is only supported for cosine collections", scoreType)
+		}
+		return func(distance float64) float64 { return 1 - distance }, nil
+	default:
+		return nil, fmt.Errorf("unknown score type %q", scoreType)
+	}
+}
+
+// resultOrder returns the comparison used to sort search results for the given
+// SortBy value, or an error if the value is unknown.
+func resultOrder(sortBy string) (func(a, b *SearchResult) bool, error) {
+	switch sortBy {
+	case "", "distance_asc":
+		return func(a, b *SearchResult) bool {
+			if a.Distance == b.Distance {
+				return a.ID < b.ID
+			}
+			return a.Distance < b.Distance
+		}, nil
+	case "distance_desc":
+		return func(a, b *SearchResult) bool {
+			if a.Distance == b.Distance {
+				return a.ID < b.ID
+			}
+			return a.Distance > b.Distance
+		}, nil
+	case "id_asc":
+		return func(a, b *SearchResult) bool { return a.ID < b.ID }, nil
+	case "id_desc":
+		return func(a, b *SearchResult) bool { return a.ID > b.ID }, nil
+	default:
+		return nil, fmt.Errorf("unknown sort order %q", sortBy)
+	}
+}
+
+// searchState accumulates the candidates examined by a search.
+type searchState struct {
+	c              *Collection
+	args           *SearchArgs
+	results        resultPriorityQueue
+	pointsSearched int
+
+	// The candidate document is decoded into the same buffer on every call
+	// so that searches don't allocate a new vector per point.
+	doc Document
+
+	// Set when StopOnExact is requested and a matching document is found.
+	exactMatch *SearchResult
+
+	// emit, if set, receives each accepted result instead of the results
+	// queue. It returns false to stop the search, which sets stopped.
+	emit    func(SearchResult) bool
+	stopped bool
+
+	// Set when the search reached SearchArgs.Deadline.
+	timedOut bool
+
+	// err is set if a document could not be read, which stops the search.
+	err error
+
+	// In Sparse collections, the candidate's vector is decoded into sparse
+	// instead of doc.Vector, and querySquared is the squared magnitude of the
+	// search vector.
+	sparse       sparseVector
+	querySquared float64
+
+	// With useNorms, the stored norm of the candidate is read into docNorm,
+	// and distances are computed from it and queryNorm, the length of the
+	// search vector.
+	useNorms  bool
+	queryNorm float64
+	docNorm   float64
+}
+
+func (c *Collection) newSearchState(args *SearchArgs) *searchState {
+	s := &searchState{
+		c:    c,
+		args: args,
+	}
+	if c.Sparse {
+		for _, v := range args.Vector {
+			s.querySquared += v * v
+		}
+	} else {
+		s.doc.Vector = make([]float64, c.DimensionCount)
+	}
+	if c.WithNorms && c.DistanceMethod == Cosine && !c.Sparse && !c.unitVectors() {
+		s.useNorms = true
+		s.queryNorm = vectorLength(args.Vector)
+	}
+	return s
+}
+
+// distance returns the distance from the search vector to the candidate
+// document read by consider.
+func (s *searchState) distance() float64 {
+	if s.useNorms {
+		return normAngularDistance(s.args.Vector, s.doc.Vector, s.queryNorm, s.docNorm)
+	}
+	if !s.c.Sparse {
+		return s.c.distance(s.args.Vector, s.doc.Vector)
+	}
+	if s.c.DistanceMethod == Cosine {
+		return sparseAngularDistance(s.args.Vector, s.querySquared, &s.sparse)
+	}
+	return sparseEuclideanDistance(s.args.Vector, s.querySquared, &s.sparse)
+}
+
+// pastDeadline reports whether the search has reached SearchArgs.Deadline, and
+// if so, sets timedOut.
+func (s *searchState) pastDeadline() bool {
+	if !s.timedOut && !s.args.Deadline.IsZero() && time.Now().After(s.args.Deadline) {
+		s.timedOut = true
+	}
+	return s.timedOut
+}
+
+// consider examines a single candidate document. It is used as the callback for
+// the search index.
+func (s *searchState) consider(docid uint64, radius float64) (int, float64) {
+	args := s.args
+	if args.isExcluded(docid) {
+		return PointIgnored, radius
+	}
+	if s.pastDeadline() {
+		return StopSearch, radius
+	}
+	doc := &s.doc
+	var err error
+	if s.c.Sparse {
+		err = s.c.getSparseDocumentInto(docid, doc, &s.sparse)
+	} else if s.useNorms {
+		s.docNorm, err = s.c.getDocumentNormInto(docid, doc)
+	} else {
+		err = s.c.getDocumentInto(docid, doc)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("failed to read document %d: %v", docid, err)
+		return StopSearch, radius
+	}
+
+	s.pointsSearched++
+
+	// Apply filter function if provided
+	pass, parsed := args.applyFilter(doc.ID, doc.Metadata)
+	if !pass {
+		return PointIgnored, radius
+	}
+
+	distance := s.distance()
+
+	// The results queue keeps the highest priority at its root, to be
+	// replaced first, which is the nearest result when looking for the
+	// farthest
+	priority := distance
+	inRadius := distance <= args.Radius
+	if args.Farthest {
+		priority = -distance
+		inRadius = distance >= args.Radius
+	}
+
+	if args.StopOnExact && distance <= args.ExactEpsilon {
+		s.exactMatch = &SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance, ParsedMetadata: parsed}
+		return StopSearch, radius
+	}
+
+	if args.Radius > 0 && inRadius {
+		result := SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance, ParsedMetadata: parsed}
+		if s.emit != nil {
+			if !s.emit(result) {
+				s.stopped = true
+				return StopSearch, radius
+			}
+			return PointAccepted, radius
+		}
+		heap.Push(&s.results, &resultItem{
+			SearchResult: result,
+			Priority:     priority,
+		})
+		return PointAccepted, radius
+	} else if args.Radius > 0 {
+		return PointChecked, radius
+	} else if args.K > 0 {
+		if s.results.Len() <= args.K {
+			if s.results.Len() < args.K || s.results[0].after(priority, doc.ID) {
+				heap.Push(&s.results, &resultItem{
+					SearchResult: SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance, ParsedMetadata: parsed},
+					Priority:     priority,
+				})
+				if s.results.Len() > args.K {
+					heap.Pop(&s.results)
+				}
+				radius = s.results[0].Distance
+				return PointAccepted, radius
+			}
+		}
+	} else if args.K == 0 && args.Radius == 0 {
+		// Exhaustive search: add all results
+		heap.Push(&s.results, &resultItem{
+			SearchResult: SearchResult{ID: doc.ID, Metadata: doc.Metadata, Distance: distance, ParsedMetadata: parsed},
+			Priority:     priority,
+		})
+		return PointAccepted, radius
+	}
+	return PointChecked, radius
+}
+
+// merge adds the results of another search state into this one, keeping only
+// the nearest K when K is set.
+func (s *searchState) merge(other *searchState) {
+	s.pointsSearched += other.pointsSearched
+	s.timedOut = s.timedOut || other.timedOut
+	if s.exactMatch == nil {
+		s.exactMatch = other.exactMatch
+	}
+	if s.err == nil {
+		s.err = other.err
+	}
+	for _, item := range other.results {
+		heap.Push(&s.results, item)
+		if s.args.K > 0 && s.results.Len() > s.args.K {
+			heap.Pop(&s.results)
+		}
+	}
+}
+
+// searchExactParallel compares the search vector against every document, splitting
+// the documents between the given number of goroutines. Each goroutine keeps its
+// own results, which are merged when all of them are done.
+func (c *Collection) searchExactParallel(args *SearchArgs, workers int) *searchState {
+	var ids []uint64
+	c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		ids = append(ids, id)
+		return nil
+	})
+
+	var stopped int32
+	states := make([]*searchState, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		states[w] = c.newSearchState(args)
+		chunk := ids[w*len(ids)/workers : (w+1)*len(ids)/workers]
+		wg.Add(1)
+		go func(state *searchState, chunk []uint64) {
+			defer wg.Done()
+			for _, id := range chunk {
+				if atomic.LoadInt32(&stopped) != 0 {
+					return
+				}
+				state.consider(id, math.MaxFloat64)
+				if state.exactMatch != nil || state.timedOut || state.err != nil {
+					atomic.StoreInt32(&stopped, 1)
+					return
+				}
+			}
+		}(states[w], chunk)
+	}
+	wg.Wait()
 
-	vectorSize := getVectorSize(quantization, dimensions)
+	merged := c.newSearchState(args)
+	for _, state := range states {
+		merged.merge(state)
+	}
+	return merged
+}
 
-	docSize := vectorSize
-	data := make([]byte, docSize)
+func encodeDocument(doc *Document, quantization int) []byte {
+	data := make([]byte, getVectorSize(quantization, len(doc.Vector)))
+	encodeVectorInto(data, doc.Vector, quantization, -1, 1)
+	return data
+}
 
-	// Encode the vector
-	vectorOffset := 0
-	for i, v := range doc.Vector {
-		quantizedValue := quantize(v, quantization)
+// encodeVectorInto quantizes vector into data, which must be exactly
+// getVectorSize(quantization, len(vector)) bytes long. Components are expected
+// to lie between min and max.
+func encodeVectorInto(data []byte, vector []float64, quantization int, min, max float64) {
+	for i, v := range vector {
+		quantizedValue := quantizeRange(v, quantization, min, max)
 		switch quantization {
 		case 4:
 			if i%2 == 0 {
-				data[vectorOffset+i/2] = byte(quantizedValue << 4)
+				data[i/2] = byte(quantizedValue << 4)
 			} else {
-				data[vectorOffset+i/2] |= byte(quantizedValue & 0x0F)
+				data[i/2] |= byte(quantizedValue & 0x0F)
 			}
 		case 8:
-			data[vectorOffset+i] = byte(quantizedValue)
+			data[i] = byte(quantizedValue)
 		case 16:
-			binary.BigEndian.PutUint16(data[vectorOffset+i*2:], uint16(quantizedValue))
+			binary.BigEndian.PutUint16(data[i*2:], uint16(quantizedValue))
 		case 32:
-			binary.BigEndian.PutUint32(data[vectorOffset+i*4:], uint32(quantizedValue))
+			binary.BigEndian.PutUint32(data[i*4:], uint32(quantizedValue))
 		case 64:
-			binary.BigEndian.PutUint64(data[vectorOffset+i*8:], quantizedValue)
+			binary.BigEndian.PutUint64(data[i*8:], quantizedValue)
 		}
 	}
+}
 
-	return data
+/*
+EncodeVectors quantizes many vectors at once, in the same format used to store
+them in a collection with the default quantization range of -1 to 1. All of the
+results share a single allocation. Every vector must have the same number of
+dimensions, or ErrDimensionMismatch is returned. An error is also returned for
+an unsupported quantization level.
+*/
+func EncodeVectors(vectors [][]float64, quantization int) ([][]byte, error) {
+	return EncodeVectorsRange(vectors, quantization, -1, 1)
 }
-func (c *Collection) decodeDocument(sr *SpanReader, id uint64) *Document {
-	data, err := sr.getStream(1)
-	if err != nil {
-		log.Panicf("Failed to read vector data of doc %d: %v", id, err)
+
+// EncodeVectorsRange is EncodeVectors for a collection whose quantization range
+// is min to max.
+func EncodeVectorsRange(vectors [][]float64, quantization int, min, max float64) ([][]byte, error) {
+	if len(vectors) == 0 {
+		return nil, nil
+	}
+	if err := checkQuantRange(quantization, min, max); err != nil {
+		return nil, err
 	}
+	size := getVectorSize(quantization, len(vectors[0]))
+	buffer := make([]byte, size*len(vectors))
+	result := make([][]byte, len(vectors))
+	for i, vector := range vectors {
+		if len(vector) != len(vectors[0]) {
+			return nil, fmt.Errorf("%w: vector %d has %d, expected %d", ErrDimensionMismatch, i, len(vector), len(vectors[0]))
+		}
+		result[i] = buffer[i*size : (i+1)*size : (i+1)*size]
+		encodeVectorInto(result[i], vector, quantization, min, max)
+	}
+	return result, nil
+}
+
+/*
+DecodeVectors decodes many vectors quantized with the default range of -1 to 1.
+All of the results share a single allocation. If any of the data is too short to
+hold a vector of the given dimensions, ErrDimensionMismatch is returned. An
+error is also returned for an unsupported quantization level.
+*/
+func DecodeVectors(data [][]byte, dimensions, quantization int) ([][]float64, error) {
+	return DecodeVectorsRange(data, dimensions, quantization, -1, 1)
+}
 
-	vector := decodeVector(data, c.DimensionCount, c.Quantization)
+// DecodeVectorsRange is DecodeVectors for vectors quantized with the range min
+// to max.
+func DecodeVectorsRange(data [][]byte, dimensions, quantization int, min, max float64) ([][]float64, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if err := checkQuantRange(quantization, min, max); err != nil {
+		return nil, err
+	}
+	size := getVectorSize(quantization, dimensions)
+	buffer := make([]float64, dimensions*len(data))
+	result := make([][]float64, len(data))
+	for i, encoded := range data {
+		if len(encoded) < size {
+			return nil, fmt.Errorf("%w: vector %d has %d bytes, expected %d", ErrDimensionMismatch, i, len(encoded), size)
+		}
+		result[i] = buffer[i*dimensions : (i+1)*dimensions : (i+1)*dimensions]
+		DecodeVectorRangeInto(result[i], encoded, dimensions, quantization, min, max)
+	}
+	return result, nil
+}
 
-	metadata, err := sr.getStream(0)
+// decodeDocument reads a document from the reader for its record.
+func (c *Collection) decodeDocument(sr *SpanReader, id uint64) (*Document, error) {
+	// Read the metadata and vector in one pass over the span
+	streams, err := sr.getAllStreams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read streams of document %d: %w", id, err)
+	}
+	metadata, ok := streams[0]
+	if !ok {
+		return nil, fmt.Errorf("failed to read metadata of document %d", id)
+	}
+	data, ok := streams[1]
+	if c.vectorfile != nil || (!ok && c.Dedup) {
+		data, err = c.readVector(id, sr)
+	} else if !ok {
+		err = fmt.Errorf("stream ID 1 not found")
+	}
 	if err != nil {
-		log.Panic("Failed to read metadata")
+		return nil, fmt.Errorf("failed to read vector data of document %d: %w", id, err)
+	}
+
+	vector := make([]float64, c.DimensionCount)
+	if err := c.decodeVectorInto(vector, data); err != nil {
+		return nil, fmt.Errorf("failed to decode vector of document %d: %w", id, err)
 	}
 
 	metadataCopy := make([]byte, len(metadata))
@@ -762,11 +3668,28 @@ func (c *Collection) decodeDocument(sr *SpanReader, id uint64) *Document {
 		ID:       id,
 		Vector:   vector,
 		Metadata: metadataCopy,
-	}
+	}, nil
 }
 
 func decodeVector(data []byte, dimensions int, quantization int) []float64 {
 	vector := make([]float64, dimensions)
+	DecodeVectorInto(vector, data, dimensions, quantization)
+	return vector
+}
+
+/*
+DecodeVectorInto decodes a vector quantized with the default range of -1 to 1
+into dst, which must have a length of at least dimensions. It is the
+allocation-free form of decoding a stored vector.
+*/
+func DecodeVectorInto(dst []float64, data []byte, dimensions, quantization int) {
+	DecodeVectorRangeInto(dst, data, dimensions, quantization, -1, 1)
+}
+
+// DecodeVectorRangeInto is DecodeVectorInto for vectors quantized with the
+// range min to max.
+func DecodeVectorRangeInto(dst []float64, data []byte, dimensions, quantization int, min, max float64) {
+	vector := dst[:dimensions]
 
 	for i := range vector {
 		var quantizedValue uint64
@@ -787,10 +3710,30 @@ func decodeVector(data []byte, dimensions int, quantization int) []float64 {
 			quantizedValue = binary.BigEndian.Uint64(data[i*8:])
 		}
 
-		vector[i] = dequantize(quantizedValue, quantization)
+		vector[i] = dequantizeRange(quantizedValue, quantization, min, max)
 	}
+}
 
-	return vector
+// checkQuantization rejects quantization levels that vectors can't be stored
+// with.
+func checkQuantization(quantization int) error {
+	switch quantization {
+	case 4, 8, 16, 32, 64:
+		return nil
+	}
+	return fmt.Errorf("unsupported quantization level %d", quantization)
+}
+
+// checkQuantRange rejects quantization levels that vectors can't be stored with
+// and empty quantization ranges.
+func checkQuantRange(quantization int, min, max float64) error {
+	if err := checkQuantization(quantization); err != nil {
+		return err
+	}
+	if max <= min {
+		return fmt.Errorf("invalid quantization range: %v to %v", min, max)
+	}
+	return nil
 }
 
 func getVectorSize(quantization int, dimensions int) int {
@@ -818,6 +3761,10 @@ func euclideanDistance(vec1, vec2 []float64) float64 {
 	return math.Sqrt(sum)
 }
 
+// angularDistance returns the angle between two vectors, scaled to lie between 0
+// and 1. A zero vector has no direction, so it is treated as identical to
+// another zero vector (distance 0) and as far as possible from any other vector
+// (distance 1).
 func angularDistance(vec1, vec2 []float64) float64 {
 	dotProduct, magnitude1, magnitude2 := 0.0, 0.0, 0.0
 	for i := range vec1 {
@@ -825,16 +3772,79 @@ func angularDistance(vec1, vec2 []float64) float64 {
 		magnitude1 += vec1[i] * vec1[i]
 		magnitude2 += vec2[i] * vec2[i]
 	}
+	if magnitude1 == 0 && magnitude2 == 0 {
+		return 0.0 // Two zero vectors are identical
+	}
 	if magnitude1 == 0 || magnitude2 == 0 {
 		return 1.0 // Return max distance if one vector is zero
 	}
 	return math.Acos(dotProduct/(math.Sqrt(magnitude1)*math.Sqrt(magnitude2))) / math.Pi
 }
 
+// normAngularDistance is angularDistance for vectors whose lengths are already
+// known, which only needs their dot product, and not even that when one of them
+// is a zero vector.
+func normAngularDistance(vec1, vec2 []float64, norm1, norm2 float64) float64 {
+	if norm1 == 0 && norm2 == 0 {
+		return 0.0
+	}
+	if norm1 == 0 || norm2 == 0 {
+		return 1.0
+	}
+	dotProduct := 0.0
+	for i := range vec1 {
+		dotProduct += vec1[i] * vec2[i]
+	}
+	return math.Acos(max(-1, min(dotProduct/(norm1*norm2), 1))) / math.Pi
+}
+
+// unitAngularDistance is angularDistance for vectors of unit length, which
+// only needs their dot product. Zero vectors are treated as angularDistance
+// treats them.
+func unitAngularDistance(vec1, vec2 []float64) float64 {
+	dotProduct := 0.0
+	for i := range vec1 {
+		dotProduct += vec1[i] * vec2[i]
+	}
+	if dotProduct == 0 {
+		zero1, zero2 := vectorLength(vec1) == 0, vectorLength(vec2) == 0
+		if zero1 && zero2 {
+			return 0.0
+		}
+		if zero1 || zero2 {
+			return 1.0
+		}
+	}
+	// Quantized vectors are only about unit length
+	return math.Acos(max(-1, min(dotProduct, 1))) / math.Pi
+}
+
+// distanceFunction returns the distance function of a distance method. With
+// unit set, Cosine distances assume vectors of unit length.
+func distanceFunction(method int, unit bool) (func([]float64, []float64) float64, error) {
+	switch method {
+	case Euclidean:
+		return euclideanDistance, nil
+	case Cosine:
+		if unit {
+			return unitAngularDistance, nil
+		}
+		return angularDistance, nil
+	}
+	return nil, fmt.Errorf("unsupported distance method")
+}
+
+// unitVectors reports whether searches can use unitAngularDistance, because
+// the collection is a normalized Cosine collection. Sparse collections have
+// their own distance functions.
+func (c *Collection) unitVectors() bool {
+	return c.Normalized && c.DistanceMethod == Cosine && !c.Sparse
+}
+
 type searchIndex interface {
 	addPoint(docid uint64, vector []float64)
 	removePoint(docid uint64, vector []float64)
-	search(vector []float64, radius float64, callback searchCallback)
+	search(vector []float64, radius float64, callback searchCallback, trace *SearchExplanation)
 }
 
 type searchCallback func(docid uint64, radius float64) (int, float64)
@@ -1,12 +1,23 @@
 package syzgydb
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"math"
 	"math/rand"
 	"os"
+	"reflect"
+	"runtime"
 	"runtime/pprof"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestEuclideanDistance(t *testing.T) {
@@ -228,6 +239,102 @@ func TestUpdateDocument(t *testing.T) {
 	}
 }
 
+func TestUpdateDocuments(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_update_documents.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	var ids []uint64
+	var metadata [][]byte
+	for i := uint64(0); i < 100; i++ {
+		if err := collection.AddDocument(i, []float64{float64(i), 1, 2}, []byte("original")); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+		ids = append(ids, i)
+		metadata = append(metadata, []byte(fmt.Sprintf("updated %d", i)))
+	}
+
+	// A missing document is reported without stopping the others
+	ids = append(ids, 1000)
+	metadata = append(metadata, []byte("missing"))
+	err = collection.UpdateDocuments(ids, metadata)
+	if !errors.Is(err, ErrRecordNotFound) || !strings.Contains(err.Error(), "1000") {
+		t.Errorf("Expected the missing document to be reported, got %v", err)
+	}
+
+	for i := uint64(0); i < 100; i++ {
+		doc, err := collection.GetDocument(i)
+		if err != nil {
+			t.Fatalf("Failed to get document %d: %v", i, err)
+		}
+		if expected := fmt.Sprintf("updated %d", i); string(doc.Metadata) != expected {
+			t.Errorf("Expected metadata %q, got %q", expected, doc.Metadata)
+		}
+		if !aboutEqual(doc.Vector, []float64{float64(i), 1, 2}) {
+			t.Errorf("Expected document %d to keep its vector, got %v", i, doc.Vector)
+		}
+	}
+
+	if err := collection.UpdateDocuments([]uint64{1}, nil); err == nil {
+		t.Errorf("Expected an error when the IDs and metadata don't match")
+	}
+}
+
+func TestUpdateDocumentVector(t *testing.T) {
+	ensureTestFolder(t)
+	for _, separate := range []bool{false, true} {
+		collection, err := NewCollection(CollectionOptions{
+			Name:            testFilePath("test_update_document_vector.dat"),
+			DistanceMethod:  Euclidean,
+			DimensionCount:  2,
+			Quantization:    64,
+			SeparateVectors: separate,
+			FileMode:        CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		for i := uint64(0); i < 50; i++ {
+			collection.AddDocument(i, []float64{float64(i), 0}, []byte(fmt.Sprintf("doc %d", i)))
+		}
+
+		if err := collection.UpdateDocumentVector(10, []float64{100, 100}); err != nil {
+			t.Fatalf("UpdateDocumentVector failed: %v", err)
+		}
+		doc, err := collection.GetDocument(10)
+		if err != nil {
+			t.Fatalf("Failed to get document: %v", err)
+		}
+		if !aboutEqual(doc.Vector, []float64{100, 100}) || string(doc.Metadata) != "doc 10" {
+			t.Errorf("separate=%v: expected the new vector and the old metadata, got %v %q", separate, doc.Vector, doc.Metadata)
+		}
+		results := collection.Search(SearchArgs{Vector: []float64{99, 99}, K: 1})
+		if ids := resultIDs(results.Results); !equalUint64Slices(ids, []uint64{10}) {
+			t.Errorf("separate=%v: expected to find the document at its new vector, got %v", separate, ids)
+		}
+		if report, err := collection.Validate(); err != nil || !report.OK() {
+			t.Errorf("separate=%v: expected a healthy collection, got %+v, %v", separate, report, err)
+		}
+
+		if err := collection.UpdateDocumentVector(1000, []float64{1, 1}); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound, got %v", err)
+		}
+		if err := collection.UpdateDocumentVector(10, []float64{1, 1, 1}); err == nil {
+			t.Errorf("Expected an error for a vector of the wrong size")
+		}
+		collection.Close()
+	}
+}
+
 func TestRemoveDocument(t *testing.T) {
 	ensureTestFolder(t)
 	// Create a new collection with appropriate options
@@ -665,3 +772,3533 @@ func TestVectorSearchWith4BitQuantization(t *testing.T) {
 
 	//DumpIndex("test_collection_4bit")
 }
+
+func TestPurgeExpired(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_purge_expired.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	now := time.Unix(1700000000, 0)
+	collection.AddDocument(1, []float64{1, 1}, []byte(fmt.Sprintf(`{"expires_at":%d}`, now.Unix()-60)))
+	collection.AddDocument(2, []float64{2, 2}, []byte(fmt.Sprintf(`{"expires_at":"%d"}`, now.Unix()-1)))
+	collection.AddDocument(3, []float64{3, 3}, []byte(fmt.Sprintf(`{"expires_at":%d}`, now.Unix()+60)))
+	collection.AddDocument(4, []float64{4, 4}, []byte(`{"name":"forever"}`))
+	collection.AddDocument(5, []float64{5, 5}, []byte("not json"))
+
+	count, err := collection.PurgeExpired(now)
+	if err != nil {
+		t.Fatalf("PurgeExpired failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 documents purged, got %d", count)
+	}
+
+	ids := collection.GetAllIDs()
+	if !equalUint64Slices(ids, []uint64{3, 4, 5}) {
+		t.Errorf("Unexpected remaining IDs: got %v want %v", ids, []uint64{3, 4, 5})
+	}
+
+	// Purged documents should no longer be found by a search.
+	results := collection.Search(SearchArgs{Vector: []float64{1, 1}, K: 5})
+	for _, result := range results.Results {
+		if result.ID == 1 || result.ID == 2 {
+			t.Errorf("Expired document %d returned by search", result.ID)
+		}
+	}
+}
+
+func BenchmarkSearchAllocations(b *testing.B) {
+	ensureTestdataDir()
+	options := CollectionOptions{
+		Name:           testFilePath("bench_search_allocations.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 64,
+		Quantization:   8,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		b.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 10000; i++ {
+		vector := make([]float64, options.DimensionCount)
+		for d := range vector {
+			vector[d] = myRandom.Float64()*2 - 1
+		}
+		collection.AddDocument(uint64(i), vector, []byte(`{}`))
+	}
+
+	query := make([]float64, options.DimensionCount)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		collection.Search(SearchArgs{Vector: query, K: 10, Precision: "exact"})
+	}
+}
+
+func TestSearchParsedFilter(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_parsed_filter.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 20; i++ {
+		metadata := fmt.Sprintf(`{"n": %d}`, i)
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(metadata))
+	}
+
+	filter, err := BuildFilter("n >= 10")
+	if err != nil {
+		t.Fatalf("BuildFilter failed: %v", err)
+	}
+	parsedFilter, err := BuildParsedFilter("n >= 10")
+	if err != nil {
+		t.Fatalf("BuildParsedFilter failed: %v", err)
+	}
+
+	for _, args := range []SearchArgs{
+		{Vector: []float64{0, 0}, K: 5},
+		{Vector: []float64{0, 0}, K: 5, Precision: "exact"},
+		{Vector: []float64{0, 0}, K: 5, Precision: "exact", Parallelism: 4},
+		{},
+	} {
+		withBytes := args
+		withBytes.Filter = filter
+		withParsed := args
+		withParsed.ParsedFilter = parsedFilter
+
+		expected := collection.Search(withBytes).Results
+		got := collection.Search(withParsed).Results
+		if len(got) != len(expected) || len(got) == 0 {
+			t.Fatalf("Expected %d results, got %d", len(expected), len(got))
+		}
+		for i := range got {
+			if got[i].ID != expected[i].ID {
+				t.Errorf("Result %d: expected ID %d, got %d", i, expected[i].ID, got[i].ID)
+			}
+			parsed, ok := got[i].ParsedMetadata.(map[string]interface{})
+			if !ok || parsed["n"] != float64(got[i].ID) {
+				t.Errorf("Result %d: unexpected parsed metadata %v", i, got[i].ParsedMetadata)
+			}
+			if expected[i].ParsedMetadata != nil {
+				t.Errorf("Result %d: ParsedMetadata set without a ParsedFilter", i)
+			}
+		}
+	}
+}
+
+// BenchmarkFilteredSearch compares filtering on raw metadata and decoding the
+// results again, as the REST API used to, with filtering on parsed metadata
+// and reusing it for the results.
+func BenchmarkFilteredSearch(b *testing.B) {
+	ensureTestdataDir()
+	options := CollectionOptions{
+		Name:           testFilePath("bench_filtered_search.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 16,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		b.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	text := strings.Repeat("lorem ipsum dolor sit amet ", 40)
+	for i := 0; i < 2000; i++ {
+		vector := make([]float64, options.DimensionCount)
+		for d := range vector {
+			vector[d] = myRandom.Float64()*2 - 1
+		}
+		metadata, _ := json.Marshal(map[string]interface{}{
+			"category": []string{"a", "b"}[i%2],
+			"title":    fmt.Sprintf("document %d", i),
+			"body":     text,
+		})
+		collection.AddDocument(uint64(i), vector, metadata)
+	}
+
+	queryVector := make([]float64, options.DimensionCount)
+	queryVector[0] = 1
+	const filterQuery = "category == 'a'"
+
+	b.Run("raw", func(b *testing.B) {
+		filter, _ := BuildFilter(filterQuery)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			results := collection.Search(SearchArgs{Vector: queryVector, K: 200, Precision: "exact", Filter: filter})
+			for _, result := range results.Results {
+				var metadata map[string]interface{}
+				json.Unmarshal(result.Metadata, &metadata)
+			}
+		}
+	})
+
+	b.Run("parsed", func(b *testing.B) {
+		filter, _ := BuildParsedFilter(filterQuery)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			results := collection.Search(SearchArgs{Vector: queryVector, K: 200, Precision: "exact", ParsedFilter: filter})
+			for _, result := range results.Results {
+				resultMetadata(result)
+			}
+		}
+	})
+}
+
+func BenchmarkSearchChecksums(b *testing.B) {
+	ensureTestdataDir()
+	options := CollectionOptions{
+		Name:           testFilePath("bench_search_checksums.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 16,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		b.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 100000; i++ {
+		vector := make([]float64, options.DimensionCount)
+		for d := range vector {
+			vector[d] = myRandom.Float64()
+		}
+		collection.AddDocument(uint64(i), vector, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	queryVector := make([]float64, options.DimensionCount)
+	for _, verify := range []bool{true, false} {
+		b.Run(fmt.Sprintf("verify=%v", verify), func(b *testing.B) {
+			collection.spanfile.SetVerifyChecksums(verify)
+			for i := 0; i < b.N; i++ {
+				collection.Search(SearchArgs{Vector: queryVector, K: 10, Precision: "exact"})
+			}
+		})
+	}
+}
+
+func TestSearchStopOnExact(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_stop_on_exact.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 1000; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), float64(i + 1), float64(i + 2)}, []byte("metadata"))
+	}
+
+	for _, precision := range []string{"medium", "exact"} {
+		results := collection.Search(SearchArgs{
+			Vector:       []float64{500, 501, 502},
+			K:            10,
+			Precision:    precision,
+			StopOnExact:  true,
+			ExactEpsilon: 1e-9,
+		})
+
+		if len(results.Results) != 1 {
+			t.Fatalf("%s: expected a single result, got %d", precision, len(results.Results))
+		}
+		if results.Results[0].ID != 500 || results.Results[0].Distance != 0 {
+			t.Errorf("%s: expected exact match 500, got %+v", precision, results.Results[0])
+		}
+		t.Logf("%s: %v%% searched", precision, results.PercentSearched)
+	}
+
+	// Without an exact match the search returns the usual K results.
+	results := collection.Search(SearchArgs{
+		Vector:       []float64{500.5, 501.5, 502.5},
+		K:            10,
+		StopOnExact:  true,
+		ExactEpsilon: 1e-9,
+	})
+	if len(results.Results) != 10 {
+		t.Errorf("Expected 10 results without an exact match, got %d", len(results.Results))
+	}
+}
+
+func TestParallelExactSearch(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_parallel_exact_search.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 4,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 2000; i++ {
+		vector := []float64{myRandom.Float64(), myRandom.Float64(), myRandom.Float64(), myRandom.Float64()}
+		collection.AddDocument(uint64(i), vector, []byte(fmt.Sprintf(`{"even":%v}`, i%2 == 0)))
+	}
+
+	filter, err := BuildFilter("even == true")
+	if err != nil {
+		t.Fatalf("Failed to build filter: %v", err)
+	}
+
+	query := []float64{0.5, 0.5, 0.5, 0.5}
+	for _, args := range []SearchArgs{
+		{Vector: query, K: 20, Precision: "exact"},
+		{Vector: query, Radius: 0.3, Precision: "exact"},
+		{Vector: query, K: 20, Precision: "exact", Filter: filter},
+	} {
+		serial := collection.Search(args)
+		args.Parallelism = 4
+		parallel := collection.Search(args)
+
+		if len(serial.Results) == 0 || len(serial.Results) != len(parallel.Results) {
+			t.Fatalf("Result count mismatch: serial %d, parallel %d", len(serial.Results), len(parallel.Results))
+		}
+		for i := range serial.Results {
+			if serial.Results[i].Distance != parallel.Results[i].Distance {
+				t.Errorf("Result %d differs: serial %+v, parallel %+v", i, serial.Results[i], parallel.Results[i])
+			}
+			if args.Filter != nil && parallel.Results[i].ID%2 != 0 {
+				t.Errorf("Filter not applied to result %d", parallel.Results[i].ID)
+			}
+		}
+		if serial.PercentSearched != parallel.PercentSearched {
+			t.Errorf("PercentSearched differs: serial %v, parallel %v", serial.PercentSearched, parallel.PercentSearched)
+		}
+	}
+}
+
+func BenchmarkParallelExactSearch(b *testing.B) {
+	ensureTestdataDir()
+	options := CollectionOptions{
+		Name:           testFilePath("bench_parallel_exact_search.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 32,
+		Quantization:   8,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		b.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 100000; i++ {
+		vector := make([]float64, options.DimensionCount)
+		for d := range vector {
+			vector[d] = myRandom.Float64()*2 - 1
+		}
+		collection.AddDocument(uint64(i), vector, []byte(`{}`))
+	}
+
+	query := make([]float64, options.DimensionCount)
+	for d := range query {
+		query[d] = myRandom.Float64()*2 - 1
+	}
+
+	for _, parallelism := range []int{1, max(2, runtime.NumCPU())} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				collection.Search(SearchArgs{Vector: query, K: 10, Precision: "exact", Parallelism: parallelism})
+			}
+		})
+	}
+}
+
+func TestCollectionMetrics(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_collection_metrics.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 5; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), float64(i)}, []byte("{}"))
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := collection.GetDocument(uint64(i)); err != nil {
+			t.Fatalf("GetDocument failed: %v", err)
+		}
+	}
+	if err := collection.UpdateDocument(1, []byte(`{"updated":true}`)); err != nil {
+		t.Fatalf("UpdateDocument failed: %v", err)
+	}
+	if err := collection.removeDocument(4); err != nil {
+		t.Fatalf("removeDocument failed: %v", err)
+	}
+	collection.Search(SearchArgs{Vector: []float64{0, 0}, K: 2})
+	collection.Search(SearchArgs{Vector: []float64{1, 1}, Radius: 1})
+
+	expected := CollectionMetrics{Reads: 3, Writes: 6, Deletes: 1, Searches: 2}
+	if metrics := collection.Metrics(); metrics != expected {
+		t.Errorf("Expected metrics %+v, got %+v", expected, metrics)
+	}
+	if stats := collection.ComputeStats(); stats.Metrics != expected {
+		t.Errorf("Expected stats metrics %+v, got %+v", expected, stats.Metrics)
+	}
+}
+
+func TestSearchExplain(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_search_explain.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 500; i++ {
+		collection.AddDocument(uint64(i), []float64{myRandom.Float64(), myRandom.Float64()}, []byte("{}"))
+	}
+
+	results := collection.Search(SearchArgs{Vector: []float64{0.5, 0.5}, K: 5})
+	if results.Explanation != nil {
+		t.Errorf("Expected no explanation unless requested")
+	}
+
+	results = collection.Search(SearchArgs{Vector: []float64{0.5, 0.5}, K: 5, Explain: true})
+	explanation := results.Explanation
+	if explanation == nil {
+		t.Fatalf("Expected an explanation")
+	}
+	if len(explanation.Nodes) == 0 {
+		t.Errorf("Expected at least one visited node")
+	}
+	if explanation.StopReason == "" {
+		t.Errorf("Expected a stop reason")
+	}
+
+	pointsSearched := int(math.Round(results.PercentSearched * 500 / 100))
+	if explanation.Candidates != pointsSearched {
+		t.Errorf("Expected %d candidates, got %d", pointsSearched, explanation.Candidates)
+	}
+	total := 0
+	for _, node := range explanation.Nodes {
+		total += node.Candidates
+	}
+	if total != explanation.Candidates {
+		t.Errorf("Node candidates sum to %d, expected %d", total, explanation.Candidates)
+	}
+}
+
+func TestMaxDimensionCount(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_max_dimensions.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 1 << 30,
+		FileMode:       CreateAndOverwrite,
+	}
+	if _, err := NewCollection(options); err == nil || !strings.Contains(err.Error(), "invalid dimension count") {
+		t.Fatalf("Expected invalid dimension count error, got %v", err)
+	}
+
+	// A header with too many dimensions is also rejected.
+	options.DimensionCount = 10
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	collection.Close()
+
+	saved := globalConfig
+	defer func() { globalConfig = saved }()
+	globalConfig.MaxDimensions = 5
+
+	options.FileMode = ReadWrite
+	if _, err := NewCollection(options); err == nil || !strings.Contains(err.Error(), "invalid dimension count") {
+		t.Fatalf("Expected invalid dimension count error on open, got %v", err)
+	}
+}
+
+func TestSearchSortBy(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_sort.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 1,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	// Document i is at (i*7)%10, so distance order differs from ID order.
+	for i := 0; i < 10; i++ {
+		collection.AddDocument(uint64(i), []float64{float64((i * 7) % 10)}, []byte(`{}`))
+	}
+
+	// The five nearest documents to 0 are, by distance, 0, 3, 6, 9 and 2.
+	tests := []struct {
+		sortBy   string
+		expected []uint64
+	}{
+		{"", []uint64{0, 3, 6, 9, 2}},
+		{"distance_asc", []uint64{0, 3, 6, 9, 2}},
+		{"distance_desc", []uint64{2, 9, 6, 3, 0}},
+		{"id_asc", []uint64{0, 2, 3, 6, 9}},
+		{"id_desc", []uint64{9, 6, 3, 2, 0}},
+	}
+	for _, tt := range tests {
+		results := collection.Search(SearchArgs{Vector: []float64{0}, K: 5, Precision: "exact", SortBy: tt.sortBy})
+		var ids []uint64
+		for _, result := range results.Results {
+			ids = append(ids, result.ID)
+		}
+		if !equalUint64Slices(ids, tt.expected) {
+			t.Errorf("SortBy %q: expected %v, got %v", tt.sortBy, tt.expected, ids)
+		}
+	}
+
+	if _, err := resultOrder("random"); err == nil {
+		t.Errorf("Expected an error for an unknown sort order")
+	}
+	if _, err := collection.SearchE(SearchArgs{Vector: []float64{0}, K: 5, SortBy: "random"}); err == nil {
+		t.Errorf("Expected searching with an unknown sort order to fail")
+	}
+}
+
+func TestSearchSimilarityScore(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_similarity_score.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	collection.AddDocument(1, []float64{1, 0, 0}, []byte("{}"))
+	collection.AddDocument(2, []float64{1, 1, 0}, []byte("{}"))
+	collection.AddDocument(3, []float64{0, 0, 1}, []byte("{}"))
+
+	results := collection.Search(SearchArgs{Vector: []float64{1, 0.2, 0}, K: 3, ScoreType: "similarity"})
+	if len(results.Results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results.Results))
+	}
+	for _, result := range results.Results {
+		if math.Abs(result.Score-(1-result.Distance)) > 1e-12 {
+			t.Errorf("Document %d: expected score %v, got %v", result.ID, 1-result.Distance, result.Score)
+		}
+	}
+
+	results = collection.Search(SearchArgs{Vector: []float64{1, 0.2, 0}, K: 3})
+	for _, result := range results.Results {
+		if result.Score != 0 {
+			t.Errorf("Expected no score by default, got %v", result.Score)
+		}
+	}
+
+	euclidean, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_similarity_score_euclidean.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer euclidean.Close()
+	if _, err := euclidean.scoreFunction("similarity"); err == nil {
+		t.Errorf("Expected an error for similarity scores on a euclidean collection")
+	}
+	if _, err := euclidean.SearchE(SearchArgs{Vector: []float64{1, 0, 0}, K: 3, ScoreType: "similarity"}); err == nil {
+		t.Errorf("Expected searching with similarity scores on a euclidean collection to fail")
+	}
+}
+
+func TestReservedRecordsSkipped(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_reserved_records.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	collection.AddDocument(1, []float64{1, 1}, []byte("{}"))
+	collection.AddDocument(2, []float64{2, 2}, []byte("{}"))
+
+	// A reserved record that is not a document must never be returned.
+	err = collection.spanfile.WriteRecord("_reserved", []DataStream{{StreamID: 0, Data: []byte("{}")}})
+	if err != nil {
+		t.Fatalf("Failed to write reserved record: %v", err)
+	}
+
+	expected := []uint64{1, 2}
+	if ids := collection.GetAllIDs(); !equalUint64Slices(ids, expected) {
+		t.Errorf("Expected IDs %v, got %v", expected, ids)
+	}
+
+	for _, args := range []SearchArgs{
+		{},
+		{Vector: []float64{0, 0}, K: 10},
+		{Vector: []float64{0, 0}, K: 10, Precision: "exact"},
+		{Vector: []float64{0, 0}, K: 10, Precision: "exact", Parallelism: 2},
+	} {
+		results := collection.Search(args)
+		var ids []uint64
+		for _, result := range results.Results {
+			ids = append(ids, result.ID)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if !equalUint64Slices(ids, expected) {
+			t.Errorf("Search %+v: expected IDs %v, got %v", args, expected, ids)
+		}
+	}
+}
+
+func TestEncodeDecodeVectors(t *testing.T) {
+	const dimensions = 7
+	vectors := make([][]float64, 50)
+	for i := range vectors {
+		vectors[i] = make([]float64, dimensions)
+		for j := range vectors[i] {
+			vectors[i][j] = myRandom.Float64()*2 - 1
+		}
+	}
+
+	for _, quantization := range []int{4, 8, 16, 32, 64} {
+		encoded, err := EncodeVectors(vectors, quantization)
+		if err != nil || len(encoded) != len(vectors) {
+			t.Fatalf("Quantization %d: expected %d encoded vectors, got %d, %v", quantization, len(vectors), len(encoded), err)
+		}
+
+		// The bulk encoding must match the format used for stored documents.
+		for i, vector := range vectors {
+			single := encodeDocument(&Document{Vector: vector}, quantization)
+			if string(single) != string(encoded[i]) {
+				t.Errorf("Quantization %d: vector %d encodes differently in bulk", quantization, i)
+			}
+		}
+
+		tolerance := 2 / float64(int(1)<<quantization-1)
+		switch quantization {
+		case 32:
+			tolerance = 1e-6
+		case 64:
+			tolerance = 0
+		}
+
+		decoded, err := DecodeVectors(encoded, dimensions, quantization)
+		if err != nil {
+			t.Fatalf("Quantization %d: failed to decode: %v", quantization, err)
+		}
+		for i := range vectors {
+			for j := range vectors[i] {
+				if math.Abs(decoded[i][j]-vectors[i][j]) > tolerance {
+					t.Errorf("Quantization %d: vector %d[%d] decoded as %v, expected %v", quantization, i, j, decoded[i][j], vectors[i][j])
+				}
+			}
+		}
+	}
+
+	if _, err := EncodeVectors([][]float64{{1, 2}, {1, 2, 3}}, 8); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("Expected ErrDimensionMismatch for vectors of different sizes, got %v", err)
+	}
+	if _, err := DecodeVectors([][]byte{make([]byte, dimensions), make([]byte, dimensions-1)}, dimensions, 8); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("Expected ErrDimensionMismatch for data that is too short, got %v", err)
+	}
+	if _, err := EncodeVectors([][]float64{{1, 2}}, 5); err == nil {
+		t.Errorf("Expected an error encoding with an unsupported quantization level")
+	}
+	if _, err := DecodeVectors([][]byte{make([]byte, dimensions)}, dimensions, 5); err == nil {
+		t.Errorf("Expected an error decoding with an unsupported quantization level")
+	}
+}
+
+func TestEncodeDecodeVectorsRange(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_encode_vectors_range.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 4,
+		Quantization:   8,
+		QuantMin:       -5,
+		QuantMax:       5,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	vectors := [][]float64{{-5, -2.5, 0, 4.5}, {3, -4, 1, 5}}
+	encoded, err := EncodeVectorsRange(vectors, 8, -5, 5)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	for i, vector := range vectors {
+		if string(encoded[i]) != string(collection.encodeVector(vector)) {
+			t.Errorf("Vector %d encodes differently from the collection", i)
+		}
+	}
+
+	decoded, err := DecodeVectorsRange(encoded, 4, 8, -5, 5)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	for i := range vectors {
+		for j := range vectors[i] {
+			if math.Abs(decoded[i][j]-vectors[i][j]) > 10.0/255 {
+				t.Errorf("Vector %d[%d] decoded as %v, expected %v", i, j, decoded[i][j], vectors[i][j])
+			}
+		}
+	}
+
+	if _, err := EncodeVectorsRange(vectors, 8, 1, 1); err == nil {
+		t.Errorf("Expected an error encoding with an empty quantization range")
+	}
+	if _, err := DecodeVectorsRange(encoded, 4, 8, 1, -1); err == nil {
+		t.Errorf("Expected an error decoding with an empty quantization range")
+	}
+}
+
+func BenchmarkEncodeDecodeVectors(b *testing.B) {
+	const dimensions = 128
+	vectors := make([][]float64, 1000)
+	for i := range vectors {
+		vectors[i] = make([]float64, dimensions)
+		for j := range vectors[i] {
+			vectors[i][j] = myRandom.Float64()*2 - 1
+		}
+	}
+
+	for _, quantization := range []int{8, 64} {
+		b.Run(fmt.Sprintf("Single-%d", quantization), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				for _, vector := range vectors {
+					encoded := encodeDocument(&Document{Vector: vector}, quantization)
+					decodeVector(encoded, dimensions, quantization)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Bulk-%d", quantization), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				encoded, _ := EncodeVectors(vectors, quantization)
+				DecodeVectors(encoded, dimensions, quantization)
+			}
+		})
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:                 testFilePath("test_auto_compact.dat"),
+		DistanceMethod:       Euclidean,
+		DimensionCount:       16,
+		AutoCompactThreshold: 0.5,
+		FileMode:             CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	vector := make([]float64, options.DimensionCount)
+	for i := 0; i < 500; i++ {
+		for j := range vector {
+			vector[j] = myRandom.Float64()
+		}
+		collection.AddDocument(uint64(i), vector, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	peakSize, _ := collection.spanfile.GetStats()
+	if count := collection.Metrics().Compactions; count != 0 {
+		t.Fatalf("Expected no compaction while only adding documents, got %d", count)
+	}
+
+	for i := 0; i < 450; i++ {
+		if err := collection.removeDocument(uint64(i)); err != nil {
+			t.Fatalf("Failed to remove document: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for collection.Metrics().Compactions == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if collection.Metrics().Compactions == 0 {
+		t.Fatalf("Expected a compaction to run")
+	}
+
+	collection.mutex.RLock()
+	size, _ := collection.spanfile.GetStats()
+	collection.mutex.RUnlock()
+	if size >= peakSize {
+		t.Errorf("Expected the file to shrink from %d bytes, got %d", peakSize, size)
+	}
+
+	if ids := collection.GetAllIDs(); len(ids) != 50 || ids[0] != 450 {
+		t.Errorf("Expected documents 450-499 to remain, got %d documents", len(ids))
+	}
+	doc, err := collection.GetDocument(475)
+	if err != nil || string(doc.Metadata) != `{"n":475}` {
+		t.Errorf("Document 475 was not preserved: %v %v", doc, err)
+	}
+	if results := collection.Search(SearchArgs{Vector: vector, K: 1}); len(results.Results) != 1 || results.Results[0].ID != 499 {
+		t.Errorf("Expected search to find document 499, got %+v", results.Results)
+	}
+}
+
+func TestSeparateVectors(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:            testFilePath("test_separate_vectors.dat"),
+		DistanceMethod:  Euclidean,
+		DimensionCount:  4,
+		Quantization:    64,
+		SeparateVectors: true,
+		FileMode:        CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	vectorFor := func(i int) []float64 {
+		return []float64{float64(i), float64(i) / 2, -float64(i), 1}
+	}
+	for i := 0; i < 50; i++ {
+		collection.AddDocument(uint64(i), vectorFor(i), []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	if err := collection.UpdateDocument(3, []byte(`{"n":3,"updated":true}`)); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	if err := collection.removeDocument(4); err != nil {
+		t.Fatalf("Failed to remove document: %v", err)
+	}
+	if err := collection.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	collection.Close()
+
+	if _, err := os.Stat(vectorFileName(options.Name)); err != nil {
+		t.Fatalf("Expected a vector file: %v", err)
+	}
+
+	// Reopen the collection, reading the options from the file.
+	collection, err = NewCollection(CollectionOptions{Name: options.Name})
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+
+	if !collection.SeparateVectors {
+		t.Fatalf("Expected SeparateVectors to be read from the header")
+	}
+	if _, count := collection.vectorfile.GetStats(); count != 49 {
+		t.Errorf("Expected 49 vectors in the vector file, got %d", count)
+	}
+	for i := 0; i < 50; i++ {
+		doc, err := collection.GetDocument(uint64(i))
+		if i == 4 {
+			if err == nil {
+				t.Errorf("Expected removed document 4 to be missing")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to get document %d: %v", i, err)
+		}
+		if !aboutEqual(doc.Vector, vectorFor(i)) {
+			t.Errorf("Document %d: expected vector %v, got %v", i, vectorFor(i), doc.Vector)
+		}
+		expected := fmt.Sprintf(`{"n":%d}`, i)
+		if i == 3 {
+			expected = `{"n":3,"updated":true}`
+		}
+		if string(doc.Metadata) != expected {
+			t.Errorf("Document %d: expected metadata %s, got %s", i, expected, doc.Metadata)
+		}
+	}
+
+	results := collection.Search(SearchArgs{Vector: vectorFor(10), K: 1})
+	if len(results.Results) != 1 || results.Results[0].ID != 10 {
+		t.Errorf("Expected nearest document 10, got %+v", results.Results)
+	}
+
+	// Make the vectors unreadable. A filtered listing only reads metadata, so
+	// it must still work, while a vector search finds nothing.
+	collection.vectorfile.Close()
+	collection.vectorfile.index = map[string]uint64{}
+
+	filter, err := BuildFilter("n >= 40")
+	if err != nil {
+		t.Fatalf("BuildFilter failed: %v", err)
+	}
+	results = collection.Search(SearchArgs{Filter: filter})
+	var ids []uint64
+	for _, result := range results.Results {
+		ids = append(ids, result.ID)
+	}
+	if !equalUint64Slices(ids, []uint64{40, 41, 42, 43, 44, 45, 46, 47, 48, 49}) {
+		t.Errorf("Unexpected filtered IDs: %v", ids)
+	}
+
+	results = collection.Search(SearchArgs{Vector: vectorFor(10), K: 1, Precision: "exact"})
+	if len(results.Results) != 0 {
+		t.Errorf("Expected the vector search to need the vector file, got %+v", results.Results)
+	}
+}
+
+func TestCollectionUseWAL(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_collection_wal.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		UseWAL:         true,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(`{}`))
+	}
+	if _, err := os.Stat(walFileName(options.Name)); err != nil {
+		t.Errorf("Expected a write-ahead log while the collection is open: %v", err)
+	}
+	collection.Close()
+	if _, err := os.Stat(walFileName(options.Name)); !os.IsNotExist(err) {
+		t.Errorf("Expected the write-ahead log to be removed on close")
+	}
+
+	collection, err = NewCollection(CollectionOptions{Name: options.Name})
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	if !collection.UseWAL || collection.spanfile.wal == nil {
+		t.Errorf("Expected the reopened collection to use the write-ahead log")
+	}
+	if count := collection.GetDocumentCount(); count != 10 {
+		t.Errorf("Expected 10 documents, got %d", count)
+	}
+}
+
+func TestStorageBreakdown(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_storage_breakdown.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 8,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	vector := make([]float64, 8)
+	for i := 0; i < 100; i++ {
+		collection.AddDocument(uint64(i), vector, []byte(`{"name":"document"}`))
+	}
+	for i := 0; i < 30; i++ {
+		if err := collection.removeDocument(uint64(i)); err != nil {
+			t.Fatalf("Failed to remove document: %v", err)
+		}
+	}
+
+	b := collection.StorageBreakdown()
+	size, _ := collection.spanfile.GetStats()
+	if b.TotalBytes != size {
+		t.Errorf("Expected total %d, got %d", size, b.TotalBytes)
+	}
+	if sum := b.LiveBytes + b.DeletedBytes + b.FreeBytes + b.OverheadBytes; sum != b.TotalBytes {
+		t.Errorf("Categories sum to %d, expected %d: %+v", sum, b.TotalBytes, b)
+	}
+	if b.DeletedBytes == 0 || b.FreeBytes == 0 {
+		t.Errorf("Expected deleted and free bytes: %+v", b)
+	}
+
+	// Each live document holds its metadata and a 64 bit vector.
+	expectedLive := uint64(70 * (len(`{"name":"document"}`) + 8*8))
+	if b.LiveBytes != expectedLive {
+		t.Errorf("Expected %d live bytes, got %d", expectedLive, b.LiveBytes)
+	}
+
+	// Compaction removes the deleted documents.
+	if err := collection.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	b = collection.StorageBreakdown()
+	if b.DeletedBytes != 0 || b.LiveBytes != expectedLive {
+		t.Errorf("Unexpected breakdown after compaction: %+v", b)
+	}
+}
+
+func TestCosineZeroVectors(t *testing.T) {
+	if d := angularDistance([]float64{0, 0}, []float64{0, 0}); d != 0 {
+		t.Errorf("Expected distance 0 between zero vectors, got %v", d)
+	}
+	if d := angularDistance([]float64{0, 0}, []float64{1, 2}); d != 1 {
+		t.Errorf("Expected distance 1 between a zero and a non-zero vector, got %v", d)
+	}
+
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_cosine_zero.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	collection.AddDocument(1, []float64{0, 0}, []byte(`{}`))
+	collection.AddDocument(2, []float64{1, 0}, []byte(`{}`))
+	collection.AddDocument(3, []float64{0, 1}, []byte(`{}`))
+
+	tests := []struct {
+		query    []float64
+		expected []uint64
+	}{
+		// A zero query finds the zero document first.
+		{[]float64{0, 0}, []uint64{1}},
+		// A non-zero query ranks the zero document last.
+		{[]float64{1, 0}, []uint64{2, 3, 1}},
+	}
+	for _, precision := range []string{"", "exact"} {
+		for _, tt := range tests {
+			results := collection.Search(SearchArgs{Vector: tt.query, K: 3, Precision: precision})
+			var ids []uint64
+			for _, result := range results.Results {
+				ids = append(ids, result.ID)
+			}
+			if len(ids) < len(tt.expected) || !equalUint64Slices(ids[:len(tt.expected)], tt.expected) {
+				t.Errorf("Precision %q, query %v: expected %v first, got %v", precision, tt.query, tt.expected, ids)
+			}
+			if results.Results[0].Distance != 0 {
+				t.Errorf("Precision %q, query %v: expected the best distance to be 0, got %v", precision, tt.query, results.Results[0].Distance)
+			}
+		}
+	}
+}
+
+func TestSearchStream(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_stream.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := 0; i < 200; i++ {
+		collection.AddDocument(uint64(i), []float64{myRandom.Float64(), myRandom.Float64()}, []byte(`{}`))
+	}
+
+	stream := func(args SearchArgs) []SearchResult {
+		var results []SearchResult
+		collection.SearchStream(args, func(result SearchResult) bool {
+			results = append(results, result)
+			return true
+		})
+		return results
+	}
+	ids := func(results []SearchResult) []uint64 {
+		var ids []uint64
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		return ids
+	}
+
+	for _, args := range []SearchArgs{
+		{Vector: []float64{0.5, 0.5}, Radius: 0.3, Precision: "exact"},
+		{Vector: []float64{0.5, 0.5}, Radius: 0.3},
+		{Vector: []float64{0.5, 0.5}, K: 10},
+		{Limit: 20, Offset: 5},
+	} {
+		streamed := stream(args)
+		// Radius results arrive in the order they are found.
+		sort.SliceStable(streamed, func(i, j int) bool { return streamed[i].Distance < streamed[j].Distance })
+		buffered := collection.Search(args).Results
+		if len(buffered) == 0 || !equalUint64Slices(ids(streamed), ids(buffered)) {
+			t.Errorf("%+v: streamed %v, searched %v", args, ids(streamed), ids(buffered))
+		}
+	}
+
+	// Returning false stops the search.
+	count := 0
+	collection.SearchStream(SearchArgs{Vector: []float64{0.5, 0.5}, Radius: 1, Precision: "exact"}, func(result SearchResult) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("Expected the search to stop after 3 results, got %d", count)
+	}
+}
+
+func TestAddDocumentValidation(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_add_validation.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for _, vector := range [][]float64{
+		{1, math.NaN(), 3},
+		{math.Inf(1), 2, 3},
+		{1, 2},
+	} {
+		if err := collection.AddDocument(1, vector, []byte("{}")); err == nil {
+			t.Errorf("Expected vector %v to be rejected", vector)
+		}
+	}
+	if count := collection.GetDocumentCount(); count != 0 {
+		t.Errorf("Expected no documents to be added, got %d", count)
+	}
+	if err := collection.AddDocument(1, []float64{1, 2, 3}, []byte("{}")); err != nil {
+		t.Errorf("Failed to add valid document: %v", err)
+	}
+}
+
+func TestNormalizeOnInsert(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:              testFilePath("test_normalize_on_insert.dat"),
+		DistanceMethod:    Cosine,
+		DimensionCount:    2,
+		NormalizeOnInsert: true,
+		FileMode:          CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	vector := []float64{3, 4}
+	if err := collection.AddDocument(1, vector, []byte("{}")); err != nil {
+		t.Fatalf("Failed to add document: %v", err)
+	}
+	if vector[0] != 3 || vector[1] != 4 {
+		t.Errorf("Expected the caller's vector to be unchanged, got %v", vector)
+	}
+
+	doc, err := collection.GetDocument(1)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if !aboutEqual(doc.Vector, []float64{0.6, 0.8}) {
+		t.Errorf("Expected a unit length vector, got %v", doc.Vector)
+	}
+}
+
+// cosineRanking returns the IDs of vectors, numbered from 1, in order of their
+// angular distance from query.
+func cosineRanking(vectors [][]float64, query []float64) []uint64 {
+	ids := make([]uint64, len(vectors))
+	for i := range ids {
+		ids[i] = uint64(i + 1)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return angularDistance(vectors[ids[i]-1], query) < angularDistance(vectors[ids[j]-1], query)
+	})
+	return ids
+}
+
+func TestNormalizedCollection(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:              testFilePath("test_normalized.dat"),
+		DistanceMethod:    Cosine,
+		DimensionCount:    4,
+		NormalizeOnInsert: true,
+		FileMode:          CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	vectors := make([][]float64, 50)
+	for i := range vectors {
+		vectors[i] = []float64{r.Float64()*10 - 5, r.Float64()*10 - 5, r.Float64()*10 - 5, r.Float64()*10 - 5}
+		if err := collection.AddDocument(uint64(i+1), vectors[i], []byte("{}")); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+	}
+	if !collection.Normalized {
+		t.Errorf("Expected a collection created with NormalizeOnInsert to be normalized")
+	}
+	collection.Close()
+
+	options.FileMode = ReadWrite
+	collection, err = NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	if !collection.Normalized {
+		t.Fatalf("Expected the normalized flag to be kept when the collection is reopened")
+	}
+
+	query := []float64{3, -1, 2, 0.5}
+	results := collection.Search(SearchArgs{Vector: query, K: len(vectors), Precision: "exact"})
+	expected := cosineRanking(vectors, query)
+	if ids := resultIDs(results.Results); !equalUint64Slices(ids, expected) {
+		t.Errorf("Expected ranking %v, got %v", expected, ids)
+	}
+	for _, result := range results.Results {
+		if want := angularDistance(vectors[result.ID-1], query); math.Abs(result.Distance-want) > 1e-6 {
+			t.Errorf("Document %d: expected distance %v, got %v", result.ID, want, result.Distance)
+		}
+	}
+
+	// Turning off NormalizeOnInsert clears the flag
+	updated := collection.CollectionOptions
+	updated.NormalizeOnInsert = false
+	if err := collection.UpdateOptions(updated); err != nil {
+		t.Fatalf("Failed to update options: %v", err)
+	}
+	if collection.Normalized {
+		t.Errorf("Expected the normalized flag to be cleared with NormalizeOnInsert")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_normalize.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	r := rand.New(rand.NewSource(2))
+	vectors := make([][]float64, 40)
+	for i := range vectors {
+		vectors[i] = []float64{r.Float64()*20 - 10, r.Float64()*20 - 10, r.Float64()*20 - 10}
+		if err := collection.AddDocument(uint64(i+1), vectors[i], []byte(`{"n":1}`)); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+	}
+	if collection.Normalized {
+		t.Fatalf("Expected a collection without NormalizeOnInsert not to be normalized")
+	}
+
+	if err := collection.Normalize(); err != nil {
+		t.Fatalf("Failed to normalize: %v", err)
+	}
+	if !collection.Normalized || !collection.NormalizeOnInsert {
+		t.Errorf("Expected Normalize to set Normalized and NormalizeOnInsert")
+	}
+	doc, err := collection.GetDocument(7)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if length := vectorLength(doc.Vector); math.Abs(length-1) > 1e-9 {
+		t.Errorf("Expected a unit vector, got length %v", length)
+	}
+	if string(doc.Metadata) != `{"n":1}` {
+		t.Errorf("Expected the metadata to be kept, got %s", doc.Metadata)
+	}
+	collection.Close()
+
+	options.FileMode = ReadWrite
+	collection, err = NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	if !collection.Normalized {
+		t.Fatalf("Expected the normalized flag to be kept when the collection is reopened")
+	}
+	query := []float64{-1, 4, 2}
+	results := collection.Search(SearchArgs{Vector: query, K: len(vectors), Precision: "exact"})
+	expected := cosineRanking(vectors, query)
+	if ids := resultIDs(results.Results); !equalUint64Slices(ids, expected) {
+		t.Errorf("Expected ranking %v, got %v", expected, ids)
+	}
+	if report, err := collection.Validate(); err != nil || !report.OK() {
+		t.Errorf("Expected a healthy collection, got %+v, %v", report, err)
+	}
+
+	euclidean, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_normalize_euclidean.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer euclidean.Close()
+	if err := euclidean.Normalize(); err == nil {
+		t.Errorf("Expected an error normalizing a Euclidean collection")
+	}
+}
+
+func TestFlatIndex(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_flat_index.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		IndexType:      IndexFlat,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		if err := collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte("{}")); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+	}
+	if collection.lshTree != nil {
+		t.Errorf("Expected a flat collection to have no LSH tree")
+	}
+	if err := collection.removeDocument(5); err != nil {
+		t.Fatalf("Failed to remove document: %v", err)
+	}
+	if err := collection.UpdateDocumentVector(6, []float64{100, 0}); err != nil {
+		t.Fatalf("Failed to update vector: %v", err)
+	}
+	collection.Close()
+
+	options.FileMode = ReadWrite
+	collection, err = NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	if collection.IndexType != IndexFlat || collection.lshTree != nil {
+		t.Fatalf("Expected the index type to be kept when the collection is reopened")
+	}
+
+	results := collection.Search(SearchArgs{Vector: []float64{5.2, 0}, K: 3})
+	if ids := resultIDs(results.Results); !equalUint64Slices(ids, []uint64{4, 7, 3}) {
+		t.Errorf("Expected the exact nearest documents, got %v", ids)
+	}
+	if results.PercentSearched != 100 {
+		t.Errorf("Expected every document to be searched, got %v%%", results.PercentSearched)
+	}
+	if report, err := collection.Validate(); err != nil || !report.OK() {
+		t.Errorf("Expected a healthy collection, got %+v, %v", report, err)
+	}
+
+	_, err = NewCollection(CollectionOptions{
+		Name:           testFilePath("test_bad_index.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		IndexType:      "btree",
+		FileMode:       CreateAndOverwrite,
+	})
+	if err == nil {
+		t.Errorf("Expected an error for an unknown index type")
+	}
+}
+
+func TestWithNorms(t *testing.T) {
+	ensureTestFolder(t)
+	for _, separate := range []bool{false, true} {
+		newCollection := func(name string, withNorms bool) *Collection {
+			collection, err := NewCollection(CollectionOptions{
+				Name:            testFilePath(name),
+				DistanceMethod:  Cosine,
+				DimensionCount:  5,
+				Quantization:    64,
+				SeparateVectors: separate,
+				WithNorms:       withNorms,
+				FileMode:        CreateAndOverwrite,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create collection: %v", err)
+			}
+			return collection
+		}
+		collection := newCollection("test_with_norms.dat", true)
+		defer collection.Close()
+		plain := newCollection("test_without_norms.dat", false)
+		defer plain.Close()
+
+		r := rand.New(rand.NewSource(3))
+		for i := 1; i <= 60; i++ {
+			vector := make([]float64, 5)
+			if i != 10 {
+				for j := range vector {
+					vector[j] = r.Float64()*2 - 1
+				}
+			}
+			for _, c := range []*Collection{collection, plain} {
+				if err := c.AddDocument(uint64(i), vector, []byte(`{"n":1}`)); err != nil {
+					t.Fatalf("Failed to add document: %v", err)
+				}
+			}
+		}
+		if err := collection.UpdateDocument(20, []byte(`{"n":2}`)); err != nil {
+			t.Fatalf("Failed to update document: %v", err)
+		}
+		for _, c := range []*Collection{collection, plain} {
+			if err := c.UpdateDocumentVector(30, []float64{0.5, 0.5, 0, 0, 0}); err != nil {
+				t.Fatalf("Failed to update vector: %v", err)
+			}
+		}
+
+		for i := uint64(1); i <= 60; i++ {
+			doc, err := collection.GetDocument(i)
+			if err != nil {
+				t.Fatalf("Failed to get document: %v", err)
+			}
+			norm, err := collection.GetDocumentNorm(i)
+			if err != nil {
+				t.Fatalf("separate=%v: failed to get the norm of document %d: %v", separate, i, err)
+			}
+			if want := vectorLength(doc.Vector); math.Abs(norm-want) > 1e-12 {
+				t.Errorf("separate=%v: document %d: expected norm %v, got %v", separate, i, want, norm)
+			}
+		}
+		if _, err := plain.GetDocumentNorm(1); err == nil {
+			t.Errorf("Expected an error getting a norm from a collection without norms")
+		}
+
+		for _, query := range [][]float64{{1, 0, 0, 0, 0}, {0.3, -0.2, 0.9, 0.1, -0.5}} {
+			for _, args := range []SearchArgs{{Vector: query, K: 10}, {Vector: query, K: 60, Precision: "exact"}} {
+				got := collection.Search(args).Results
+				want := plain.Search(args).Results
+				if !equalUint64Slices(resultIDs(got), resultIDs(want)) {
+					t.Errorf("separate=%v: expected results %v, got %v", separate, resultIDs(want), resultIDs(got))
+					continue
+				}
+				for i := range got {
+					if math.Abs(got[i].Distance-want[i].Distance) > 1e-9 {
+						t.Errorf("separate=%v: document %d: expected distance %v, got %v", separate, got[i].ID, want[i].Distance, got[i].Distance)
+					}
+				}
+			}
+		}
+
+		stats := collection.ComputeStats()
+		if stats.Norms == nil {
+			t.Fatalf("Expected norm statistics")
+		}
+		if stats.Norms.Zero != 1 || stats.Norms.Min != 0 || stats.Norms.Max <= stats.Norms.Mean || stats.Norms.Mean <= 0 {
+			t.Errorf("Unexpected norm statistics: %+v", *stats.Norms)
+		}
+		if plain.ComputeStats().Norms != nil {
+			t.Errorf("Expected no norm statistics without norms")
+		}
+	}
+}
+
+func TestUnitAngularDistance(t *testing.T) {
+	pairs := [][2][]float64{
+		{{1, 0}, {0, 1}},
+		{{0.6, 0.8}, {0.6, 0.8}},
+		{{1, 0}, {-1, 0}},
+		{{0.6, 0.8}, {0.8, -0.6}},
+		{{0, 0}, {0, 0}},
+		{{0, 0}, {1, 0}},
+		{{1, 0}, {0, 0}},
+	}
+	for _, pair := range pairs {
+		got, want := unitAngularDistance(pair[0], pair[1]), angularDistance(pair[0], pair[1])
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("%v, %v: expected %v, got %v", pair[0], pair[1], want, got)
+		}
+	}
+}
+
+func TestDocumentMetadata(t *testing.T) {
+	doc := &Document{ID: 1, Metadata: []byte(`{"name":"first","count":2}`)}
+	metadata, err := doc.MetadataMap()
+	if err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+	if metadata["name"] != "first" || metadata["count"] != float64(2) {
+		t.Errorf("Unexpected metadata: %v", metadata)
+	}
+
+	// The map is cached until the metadata is replaced
+	metadata["cached"] = true
+	if again, _ := doc.MetadataMap(); again["cached"] != true {
+		t.Errorf("Expected the cached map, got %v", again)
+	}
+	doc.Metadata = []byte(`{"name":"second"}`)
+	if replaced, _ := doc.MetadataMap(); replaced["name"] != "second" || replaced["cached"] != nil {
+		t.Errorf("Expected the replaced metadata, got %v", replaced)
+	}
+
+	var typed struct {
+		Name string `json:"name"`
+	}
+	if err := doc.MetadataInto(&typed); err != nil || typed.Name != "second" {
+		t.Errorf("Expected name second, got %q (%v)", typed.Name, err)
+	}
+
+	empty := &Document{ID: 2}
+	if metadata, err := empty.MetadataMap(); err != nil || len(metadata) != 0 {
+		t.Errorf("Expected an empty map for empty metadata, got %v (%v)", metadata, err)
+	}
+	typed.Name = "unchanged"
+	if err := empty.MetadataInto(&typed); err != nil || typed.Name != "unchanged" {
+		t.Errorf("Expected empty metadata to leave the value unchanged, got %q (%v)", typed.Name, err)
+	}
+
+	invalid := &Document{ID: 3, Metadata: []byte("not json")}
+	if _, err := invalid.MetadataMap(); err == nil {
+		t.Error("Expected an error for invalid metadata")
+	}
+	if err := invalid.MetadataInto(&typed); err == nil {
+		t.Error("Expected an error for invalid metadata")
+	}
+}
+
+func TestExpectedDocuments(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:              testFilePath("test_expected_documents.dat"),
+		DistanceMethod:    Cosine,
+		DimensionCount:    8,
+		LSHLeafSize:       10,
+		ExpectedDocuments: 1000,
+		FileMode:          CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	// 1000 documents in leaves of 10 need 100 leaves, so 6 levels are built
+	for i, root := range collection.lshTree.roots {
+		depth := 0
+		for node := root; !node.isLeaf(); node = node.left {
+			depth++
+		}
+		if depth != 6 {
+			t.Errorf("Tree %d: expected a depth of 6, got %d", i, depth)
+		}
+	}
+
+	vectors := make([][]float64, 300)
+	for i := range vectors {
+		vectors[i] = make([]float64, 8)
+		for d := range vectors[i] {
+			vectors[i][d] = myRandom.Float64()*2 - 1
+		}
+		collection.AddDocument(uint64(i), vectors[i], []byte("{}"))
+	}
+
+	// Every document is in one leaf of each tree
+	var countIDs func(node *lshNode) int
+	countIDs = func(node *lshNode) int {
+		if node.isLeaf() {
+			return len(node.ids)
+		}
+		return countIDs(node.left) + countIDs(node.right)
+	}
+	for i, root := range collection.lshTree.roots {
+		if count := countIDs(root); count != len(vectors) {
+			t.Errorf("Tree %d: expected %d documents, got %d", i, len(vectors), count)
+		}
+	}
+	if results := collection.Search(SearchArgs{Vector: vectors[0], K: 10}); len(results.Results) != 10 {
+		t.Errorf("Expected 10 results, got %d", len(results.Results))
+	}
+	for i := 0; i < len(vectors); i++ {
+		collection.removeDocument(uint64(i))
+	}
+	if results := collection.Search(SearchArgs{Vector: vectors[0], K: 1}); len(results.Results) != 0 {
+		t.Errorf("Expected no results after removing every document, got %v", results.Results)
+	}
+}
+
+// BenchmarkBulkLoad measures the time to add a document while loading b.N
+// documents into a new collection, with and without the ExpectedDocuments hint.
+// Use -benchtime=1000000x to load a million documents.
+func BenchmarkBulkLoad(b *testing.B) {
+	ensureTestdataDir()
+	for _, hint := range []bool{false, true} {
+		b.Run(fmt.Sprintf("hint=%v", hint), func(b *testing.B) {
+			options := CollectionOptions{
+				Name:           testFilePath("bench_bulk_load.dat"),
+				DistanceMethod: Cosine,
+				DimensionCount: 16,
+				FileMode:       CreateAndOverwrite,
+			}
+			if hint {
+				options.ExpectedDocuments = b.N
+			}
+			collection, err := NewCollection(options)
+			if err != nil {
+				b.Fatalf("Failed to create collection: %v", err)
+			}
+			defer collection.Close()
+
+			vector := make([]float64, options.DimensionCount)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for d := range vector {
+					vector[d] = myRandom.Float64()*2 - 1
+				}
+				collection.AddDocument(uint64(i), vector, []byte("{}"))
+			}
+		})
+	}
+}
+
+func TestNewCollectionIndexError(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_index_error.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	collection.AddDocument(1, []float64{1, 2}, []byte("{}"))
+	// A document without a vector can't be added to the search index
+	if err := collection.spanfile.WriteRecord("2", []DataStream{{StreamID: 0, Data: []byte("{}")}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	collection.Close()
+
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("Can't count open files: %v", err)
+		}
+		return len(entries)
+	}
+	before := openFiles()
+	options.FileMode = ReadWrite
+	if _, err := NewCollection(options); err == nil {
+		t.Fatalf("Expected an error opening a collection whose index can't be built")
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("Expected the files to be closed, %d were open before and %d after", before, after)
+	}
+}
+
+func TestSearchError(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_error.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		collection.AddDocument(i, []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"doc":"doc%d"}`, i)))
+	}
+	results, err := collection.SearchE(SearchArgs{Vector: []float64{0, 0}, K: 10})
+	if err != nil || len(results.Results) != 10 {
+		t.Fatalf("Expected 10 results, got %d (%v)", len(results.Results), err)
+	}
+
+	// Damage one document so that it fails its checksum
+	offset := collection.spanfile.index["5"]
+	pos := bytes.Index(collection.spanfile.mmapData[offset:], []byte("doc5"))
+	if pos < 0 {
+		t.Fatal("Could not find document data")
+	}
+	collection.spanfile.mmapData[offset+uint64(pos)] = 'x'
+
+	if _, err := collection.SearchE(SearchArgs{Vector: []float64{0, 0}, K: 10}); err == nil {
+		t.Error("Expected an error searching a damaged collection")
+	}
+
+	collection.Close()
+	if _, err := collection.SearchE(SearchArgs{Vector: []float64{0, 0}, K: 10}); !errors.Is(err, ErrCollectionClosed) {
+		t.Errorf("Expected ErrCollectionClosed, got %v", err)
+	}
+}
+
+func TestClosedCollection(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_closed_collection.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	if err := collection.AddDocument(1, []float64{1, 2}, []byte("{}")); err != nil {
+		t.Fatalf("Failed to add document: %v", err)
+	}
+	collection.Close()
+
+	// Every method that changes or reads the documents fails, rather than
+	// crashing
+	_, addErr := collection.AddDocumentWithPolicy(2, []float64{1, 2}, []byte("{}"), DuplicateError)
+	_, getErr := collection.GetDocument(1)
+	_, purgeErr := collection.PurgeExpired(time.Now())
+	for name, err := range map[string]error{
+		"AddDocument":           collection.AddDocument(2, []float64{1, 2}, []byte("{}")),
+		"AddDocumentWithPolicy": addErr,
+		"UpdateDocument":        collection.UpdateDocument(1, []byte("{}")),
+		"UpdateDocuments":       collection.UpdateDocuments([]uint64{1}, [][]byte{[]byte("{}")}),
+		"UpdateDocumentVector":  collection.UpdateDocumentVector(1, []float64{3, 4}),
+		"removeDocument":        collection.removeDocument(1),
+		"GetDocument":           getErr,
+		"PurgeExpired":          purgeErr,
+		"UpdateOptions":         collection.UpdateOptions(collection.GetOptions()),
+	} {
+		if !errors.Is(err, ErrCollectionClosed) {
+			t.Errorf("%s: expected ErrCollectionClosed, got %v", name, err)
+		}
+	}
+	if ids := collection.GetAllIDs(); len(ids) != 0 {
+		t.Errorf("Expected no IDs, got %v", ids)
+	}
+	if count := collection.GetDocumentCount(); count != 0 {
+		t.Errorf("Expected no documents, got %d", count)
+	}
+	if stats := collection.ComputeStats(); stats.DocumentCount != 0 {
+		t.Errorf("Expected empty stats, got %+v", stats)
+	}
+}
+
+func TestSearchDimensionMismatch(t *testing.T) {
+	ensureTestFolder(t)
+	for _, method := range []int{Euclidean, Cosine} {
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath("test_search_dimensions.dat"),
+			DistanceMethod: method,
+			DimensionCount: 3,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			collection.AddDocument(i, []float64{float64(i), 1, 0}, []byte("{}"))
+		}
+
+		for _, vector := range [][]float64{{1}, {1, 2, 3, 4}, {}} {
+			for _, precision := range []string{"", "exact"} {
+				args := SearchArgs{Vector: vector, K: 5, Precision: precision}
+				if _, err := collection.SearchE(args); !errors.Is(err, ErrDimensionMismatch) {
+					t.Errorf("%v: expected ErrDimensionMismatch, got %v", vector, err)
+				}
+				if results := collection.Search(args); len(results.Results) != 0 {
+					t.Errorf("%v: expected no results, got %v", vector, resultIDs(results.Results))
+				}
+			}
+		}
+		collection.Close()
+	}
+}
+
+func TestIndexedFields(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_indexed_fields.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		metadata := fmt.Sprintf(`{"category":"c%d","rank":%d}`, i%100, i%3)
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(metadata))
+	}
+
+	args := SearchArgs{
+		Vector:      []float64{0, 0},
+		K:           3,
+		Precision:   "exact",
+		FilterQuery: "category == 'c7' AND rank > 0",
+	}
+	unindexed, err := collection.SearchE(args)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	options = collection.GetOptions()
+	options.IndexedFields = []string{"category"}
+	if err := collection.UpdateOptions(options); err != nil {
+		t.Fatalf("Failed to update options: %v", err)
+	}
+	indexed, err := collection.SearchE(args)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	if ids := resultIDs(indexed.Results); !equalUint64Slices(ids, resultIDs(unindexed.Results)) || !equalUint64Slices(ids, []uint64{7, 107, 307}) {
+		t.Errorf("Expected IDs [7 107 307] with and without the index, got %v and %v", ids, resultIDs(unindexed.Results))
+	}
+	if indexed.PercentSearched > 1 || unindexed.PercentSearched < 99 {
+		t.Errorf("Expected the index to reduce the documents searched from 100%% to 1%%, got %.1f%% and %.1f%%",
+			unindexed.PercentSearched, indexed.PercentSearched)
+	}
+
+	// The index follows changes to the documents
+	collection.UpdateDocument(107, []byte(`{"category":"c8","rank":1}`))
+	collection.removeDocument(307)
+	collection.AddDocument(5000, []float64{1, 0}, []byte(`{"category":"c7","rank":2}`))
+	collection.Close()
+
+	// and is rebuilt when the collection is opened
+	options.FileMode = ReadWrite
+	collection, err = NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	results, err := collection.SearchE(args)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if ids := resultIDs(results.Results); !equalUint64Slices(ids, []uint64{5000, 7, 407}) {
+		t.Errorf("Expected IDs [5000 7 407], got %v", ids)
+	}
+
+	// Listings use the index too
+	list, err := collection.SearchE(SearchArgs{FilterQuery: "category == 'c8'"})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(list.Results) != 11 {
+		t.Errorf("Expected 11 documents in category c8, got %d", len(list.Results))
+	}
+}
+
+func resultIDs(results []SearchResult) []uint64 {
+	ids := make([]uint64, len(results))
+	for i, result := range results {
+		ids[i] = result.ID
+	}
+	return ids
+}
+
+func TestCollectionWriteBuffer(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:            testFilePath("test_write_buffer.dat"),
+		DistanceMethod:  Euclidean,
+		DimensionCount:  2,
+		WriteBufferSize: 1 << 20,
+		SeparateVectors: true,
+		FileMode:        CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := uint64(0); i < 100; i++ {
+		collection.AddDocument(i, []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	// A record that has not been flushed can be read and searched
+	if _, ok := collection.spanfile.pending["42"]; !ok {
+		t.Fatal("Expected document 42 to be buffered")
+	}
+	doc, err := collection.GetDocument(42)
+	if err != nil || doc.Vector[0] != 42 || string(doc.Metadata) != `{"n":42}` {
+		t.Fatalf("Expected to read buffered document, got %v (%v)", doc, err)
+	}
+	results := collection.Search(SearchArgs{Vector: []float64{42, 0}, K: 1, Precision: "exact"})
+	if len(results.Results) != 1 || results.Results[0].ID != 42 {
+		t.Errorf("Expected to find buffered document 42, got %v", results.Results)
+	}
+
+	// Another handle on the file doesn't see it until it is flushed
+	readFile := func() error {
+		file, err := OpenFile(options.Name, ReadOnly)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.ReadRecord("42")
+		return err
+	}
+	if err := readFile(); err == nil {
+		t.Error("Expected document 42 not to be in the file before flushing")
+	}
+	if err := collection.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if len(collection.spanfile.pending) != 0 || len(collection.vectorfile.pending) != 0 {
+		t.Error("Expected the write buffers to be empty after flushing")
+	}
+	if err := readFile(); err != nil {
+		t.Errorf("Expected document 42 to be in the file after flushing: %v", err)
+	}
+	if count := collection.GetDocumentCount(); count != 100 {
+		t.Errorf("Expected 100 documents, got %d", count)
+	}
+}
+
+func TestSparseVectors(t *testing.T) {
+	ensureTestFolder(t)
+	const dimensions = 5000
+	rng := rand.New(rand.NewSource(1))
+	sparseVector := func(nonzero int) []float64 {
+		vector := make([]float64, dimensions)
+		for i := 0; i < nonzero; i++ {
+			vector[rng.Intn(dimensions)] = rng.Float64()
+		}
+		return vector
+	}
+
+	for _, method := range []int{Euclidean, Cosine} {
+		newCollection := func(name string, sparse bool) *Collection {
+			collection, err := NewCollection(CollectionOptions{
+				Name:           testFilePath(name),
+				DistanceMethod: method,
+				DimensionCount: dimensions,
+				Sparse:         sparse,
+				FileMode:       CreateAndOverwrite,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create collection: %v", err)
+			}
+			return collection
+		}
+		sparse := newCollection("test_sparse.dat", true)
+		dense := newCollection("test_sparse_dense.dat", false)
+
+		vectors := make([][]float64, 50)
+		for i := range vectors {
+			vectors[i] = sparseVector(10 + i%4*10)
+			sparse.AddDocument(uint64(i), vectors[i], []byte("{}"))
+			dense.AddDocument(uint64(i), vectors[i], []byte("{}"))
+		}
+
+		// The stored size depends on the number of nonzero components
+		storedSize := func(id uint64) int {
+			_, data, err := sparse.readDocument(id)
+			if err != nil {
+				t.Fatalf("Failed to read document %d: %v", id, err)
+			}
+			return len(data)
+		}
+		small, large := storedSize(0), storedSize(3)
+		if small > 10*12 || large > 40*12 || large < 3*small {
+			t.Errorf("Expected stored size to be proportional to nonzero components, got %d bytes for 10 and %d for 40", small, large)
+		}
+
+		doc, err := sparse.GetDocument(7)
+		if err != nil || !aboutEqual(doc.Vector, vectors[7]) {
+			t.Errorf("Expected to read back the stored vector (%v)", err)
+		}
+
+		// Sparse and dense collections rank documents the same way
+		for _, query := range [][]float64{vectors[5], sparseVector(30)} {
+			for _, precision := range []string{"exact", "medium"} {
+				args := SearchArgs{Vector: query, K: 5, Precision: precision}
+				expected := dense.Search(args).Results
+				results := sparse.Search(args).Results
+				if len(results) != len(expected) {
+					t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+				}
+				// Documents at the same distance may be returned in either order
+				for i := range results {
+					if math.Abs(results[i].Distance-expected[i].Distance) > 1e-9 {
+						t.Errorf("Result %d: expected %d at %v, got %d at %v", i, expected[i].ID, expected[i].Distance, results[i].ID, results[i].Distance)
+					}
+				}
+			}
+		}
+		if results := sparse.Search(SearchArgs{Vector: vectors[5], K: 1, Precision: "exact"}).Results; len(results) == 0 || results[0].ID != 5 {
+			t.Errorf("Expected document 5 to be nearest to itself, got %v", results)
+		}
+
+		sparse.Close()
+		dense.Close()
+	}
+}
+
+func TestQuantizationRange(t *testing.T) {
+	ensureTestFolder(t)
+	const dimensions = 16
+	rng := rand.New(rand.NewSource(1))
+	randomVector := func() []float64 {
+		vector := make([]float64, dimensions)
+		for i := range vector {
+			vector[i] = rng.Float64()*10 - 5
+		}
+		return vector
+	}
+	vectors := make([][]float64, 500)
+	for i := range vectors {
+		vectors[i] = randomVector()
+	}
+	queries := make([][]float64, 20)
+	for i := range queries {
+		queries[i] = randomVector()
+	}
+
+	// recall returns the fraction of the true 10 nearest neighbours found
+	recall := func(fit bool) float64 {
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath("test_quant_range.dat"),
+			DistanceMethod: Euclidean,
+			DimensionCount: dimensions,
+			Quantization:   8,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		defer collection.Close()
+		if fit {
+			if err := collection.FitQuantizationRange(vectors); err != nil {
+				t.Fatalf("Failed to fit quantization range: %v", err)
+			}
+		}
+		for i, vector := range vectors {
+			collection.AddDocument(uint64(i), vector, nil)
+		}
+
+		found := 0
+		for _, query := range queries {
+			ids := make([]uint64, len(vectors))
+			for i := range ids {
+				ids[i] = uint64(i)
+			}
+			sort.Slice(ids, func(i, j int) bool {
+				return euclideanDistance(query, vectors[ids[i]]) < euclideanDistance(query, vectors[ids[j]])
+			})
+			expected := make(map[uint64]bool)
+			for _, id := range ids[:10] {
+				expected[id] = true
+			}
+			for _, result := range collection.Search(SearchArgs{Vector: query, K: 10, Precision: "exact"}).Results {
+				if expected[result.ID] {
+					found++
+				}
+			}
+		}
+		return float64(found) / float64(10*len(queries))
+	}
+
+	defaultRecall, fittedRecall := recall(false), recall(true)
+	if fittedRecall < 0.9 || fittedRecall <= defaultRecall {
+		t.Errorf("Expected fitted range to improve recall, got %v with default range and %v with fitted range", defaultRecall, fittedRecall)
+	}
+
+	// The fitted range is kept in the header and cannot be changed
+	collection, err := NewCollection(CollectionOptions{Name: testFilePath("test_quant_range.dat")})
+	if err != nil {
+		t.Fatalf("Failed to open collection: %v", err)
+	}
+	defer collection.Close()
+	if collection.QuantMin > -5 || collection.QuantMax < 5 {
+		t.Errorf("Expected range to cover -5 to 5, got %v to %v", collection.QuantMin, collection.QuantMax)
+	}
+	doc, err := collection.GetDocument(3)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	step := (collection.QuantMax - collection.QuantMin) / 255
+	for i, v := range doc.Vector {
+		if math.Abs(v-vectors[3][i]) > step {
+			t.Errorf("Component %d: expected %v, got %v", i, vectors[3][i], v)
+		}
+	}
+	options := collection.CollectionOptions
+	options.QuantMax = 10
+	if err := collection.UpdateOptions(options); !errors.Is(err, ErrImmutableOption) {
+		t.Errorf("Expected ErrImmutableOption, got %v", err)
+	}
+
+	// A range isn't fitted to a few vectors, or narrowed below -1 to 1
+	for _, sample := range [][][]float64{vectors[:minQuantRangeSample-1], make([][]float64, minQuantRangeSample)} {
+		for i := range sample {
+			if sample[i] == nil {
+				sample[i] = []float64{0.1 * float64(i%3), 0.2}
+			}
+		}
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath("test_quant_range_small.dat"),
+			DistanceMethod: Euclidean,
+			DimensionCount: len(sample[0]),
+			Quantization:   8,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		if err := collection.FitQuantizationRange(sample); err != nil {
+			t.Fatalf("Failed to fit quantization range: %v", err)
+		}
+		if min, max := collection.quantRange(); min > -1 || max < 1 {
+			t.Errorf("%d vectors: expected the range to cover -1 to 1, got %v to %v", len(sample), min, max)
+		}
+		if len(sample) < minQuantRangeSample && (collection.QuantMin != 0 || collection.QuantMax != 0) {
+			t.Errorf("Expected no range fitted to %d vectors, got %v to %v", len(sample), collection.QuantMin, collection.QuantMax)
+		}
+		collection.Close()
+	}
+}
+
+func TestAddDocumentWithPolicy(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_duplicate_policy.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	collection.AddDocument(1, []float64{1, 1}, []byte("first"))
+
+	expect := func(policy string, wantAdded bool, wantErr error, wantMetadata string) {
+		t.Helper()
+		added, err := collection.AddDocumentWithPolicy(1, []float64{2, 2}, []byte(policy), policy)
+		if added != wantAdded || !errors.Is(err, wantErr) {
+			t.Errorf("%q: got added=%v err=%v, want added=%v err=%v", policy, added, err, wantAdded, wantErr)
+		}
+		doc, err := collection.GetDocument(1)
+		if err != nil || string(doc.Metadata) != wantMetadata {
+			t.Errorf("%q: expected metadata %q, got %q, %v", policy, wantMetadata, doc.Metadata, err)
+		}
+	}
+	expect(DuplicateSkip, false, nil, "first")
+	expect(DuplicateError, false, ErrDuplicateID, "first")
+	expect(DuplicateOverwrite, true, nil, DuplicateOverwrite)
+	expect("", true, nil, "")
+
+	if _, err := collection.AddDocumentWithPolicy(1, []float64{2, 2}, nil, "replace"); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+	for _, policy := range []string{DuplicateError, DuplicateSkip} {
+		id := uint64(len(policy))
+		added, err := collection.AddDocumentWithPolicy(id, []float64{3, 3}, nil, policy)
+		if !added || err != nil {
+			t.Errorf("%q: expected a new ID to be added, got added=%v err=%v", policy, added, err)
+		}
+	}
+	if count := collection.GetDocumentCount(); count != 3 {
+		t.Errorf("Expected 3 documents, got %d", count)
+	}
+
+	// A batch is checked in full before any of it is written
+	docs := []Document{{ID: 10, Vector: []float64{1, 1}}, {ID: 1, Vector: []float64{1, 1}}}
+	if _, err := collection.AddDocumentsWithPolicy(docs, []string{"", DuplicateError}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Expected ErrDuplicateID, got %v", err)
+	}
+	docs[1] = Document{ID: 11, Vector: []float64{1}}
+	if _, err := collection.AddDocumentsWithPolicy(docs, []string{"", ""}); err == nil {
+		t.Errorf("Expected an error for a vector with the wrong size")
+	}
+	if _, err := collection.GetDocument(10); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected no document of the failed batches to be written, got %v", err)
+	}
+
+	// Documents earlier in the batch count as duplicates
+	docs = []Document{{ID: 12, Vector: []float64{1, 1}}, {ID: 12, Vector: []float64{2, 2}}}
+	added, err := collection.AddDocumentsWithPolicy(docs, []string{DuplicateSkip, DuplicateSkip})
+	if err != nil || !reflect.DeepEqual(added, []bool{true, false}) {
+		t.Errorf("Expected only the first copy to be added, got %v (%v)", added, err)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	ensureTestFolder(t)
+	for _, separate := range []bool{false, true} {
+		collection, err := NewCollection(CollectionOptions{
+			Name:            testFilePath("test_warmup.dat"),
+			DistanceMethod:  Euclidean,
+			DimensionCount:  4,
+			SeparateVectors: separate,
+			FileMode:        CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		for i := uint64(1); i <= 1000; i++ {
+			collection.AddDocument(i, []float64{float64(i), 1, 2, 3}, []byte(`{"a":1}`))
+		}
+		collection.Close()
+
+		collection, err = NewCollection(CollectionOptions{Name: testFilePath("test_warmup.dat")})
+		if err != nil {
+			t.Fatalf("Failed to reopen collection: %v", err)
+		}
+		// Collections can be warmed up at the same time, and written
+		// meanwhile
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := collection.Warmup(); err != nil {
+					t.Errorf("separate=%v: Warmup failed: %v", separate, err)
+				}
+			}()
+		}
+		if err := collection.AddDocument(1001, []float64{1001, 1, 2, 3}, []byte(`{"a":1}`)); err != nil {
+			t.Errorf("separate=%v: failed to add a document during the warmup: %v", separate, err)
+		}
+		wg.Wait()
+		results := collection.Search(SearchArgs{Vector: []float64{500, 1, 2, 3}, K: 1, Precision: "exact"})
+		if len(results.Results) != 1 || results.Results[0].ID != 500 {
+			t.Errorf("separate=%v: expected document 500, got %+v", separate, results.Results)
+		}
+		collection.Close()
+
+		if err := collection.Warmup(); !errors.Is(err, ErrCollectionClosed) {
+			t.Errorf("Expected ErrCollectionClosed warming a closed collection, got %v", err)
+		}
+	}
+}
+
+func TestRecordStreams(t *testing.T) {
+	ensureTestFolder(t)
+	for _, separate := range []bool{false, true} {
+		collection, err := NewCollection(CollectionOptions{
+			Name:            testFilePath("test_record_streams.dat"),
+			DistanceMethod:  Euclidean,
+			DimensionCount:  2,
+			SeparateVectors: separate,
+			FileMode:        CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		for i := uint64(1); i <= 3; i++ {
+			collection.AddDocument(i, []float64{float64(i), 0}, []byte(`{"a":1}`))
+		}
+
+		if err := collection.SetStream(1, 8, []byte("thumbnail")); err != nil {
+			t.Fatalf("separate=%v: failed to set stream: %v", separate, err)
+		}
+		if err := collection.SetStream(1, 200, []byte("original")); err != nil {
+			t.Fatalf("separate=%v: failed to set stream: %v", separate, err)
+		}
+		if err := collection.SetStream(1, 8, []byte("new thumbnail")); err != nil {
+			t.Fatalf("separate=%v: failed to replace stream: %v", separate, err)
+		}
+
+		// The streams are kept when the document is written again
+		if err := collection.UpdateDocument(1, []byte(`{"a":2}`)); err != nil {
+			t.Fatalf("Failed to update document: %v", err)
+		}
+		if err := collection.UpdateDocumentVector(1, []float64{5, 5}); err != nil {
+			t.Fatalf("Failed to update vector: %v", err)
+		}
+		if err := collection.Compact(); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+		for streamID, want := range map[uint8]string{8: "new thumbnail", 200: "original"} {
+			data, err := collection.GetStream(1, streamID)
+			if err != nil || string(data) != want {
+				t.Errorf("separate=%v: stream %d: expected %q, got %q, %v", separate, streamID, want, data, err)
+			}
+		}
+		doc, err := collection.GetDocument(1)
+		if err != nil || string(doc.Metadata) != `{"a":2}` || !aboutEqual(doc.Vector, []float64{5, 5}) {
+			t.Errorf("separate=%v: unexpected document %+v, %v", separate, doc, err)
+		}
+
+		if _, err := collection.GetStream(2, 8); !errors.Is(err, ErrStreamNotFound) {
+			t.Errorf("Expected ErrStreamNotFound, got %v", err)
+		}
+		if err := collection.SetStream(10, 8, []byte("x")); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound setting a stream of a missing document, got %v", err)
+		}
+		if err := collection.SetStream(1, 1, []byte("x")); err == nil {
+			t.Errorf("Expected an error setting a reserved stream")
+		}
+		if _, err := collection.GetStream(1, 0); err == nil {
+			t.Errorf("Expected an error getting a reserved stream")
+		}
+
+		if err := collection.removeDocument(1); err != nil {
+			t.Fatalf("Failed to remove document: %v", err)
+		}
+		if _, err := collection.GetStream(1, 8); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected the streams to be removed with the document, got %v", err)
+		}
+		collection.Close()
+	}
+}
+
+func TestStreamContentTypes(t *testing.T) {
+	ensureTestFolder(t)
+	open := func(mode FileMode) *Collection {
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath("test_stream_types.dat"),
+			DistanceMethod: Euclidean,
+			DimensionCount: 2,
+			FileMode:       mode,
+		})
+		if err != nil {
+			t.Fatalf("Failed to open collection: %v", err)
+		}
+		return collection
+	}
+	collection := open(CreateAndOverwrite)
+	collection.AddDocument(1, []float64{1, 0}, []byte(`{}`))
+
+	if err := collection.SetStream(1, 8, []byte("untyped")); err != nil {
+		t.Fatalf("Failed to set stream: %v", err)
+	}
+	if err := collection.SetStreamWithType(1, 9, []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Failed to set stream: %v", err)
+	}
+	if err := collection.SetStreamWithType(1, 10, []byte("pdf"), "application/pdf"); err != nil {
+		t.Fatalf("Failed to set stream: %v", err)
+	}
+	if err := collection.SetStreamWithType(1, 11, []byte("x"), "not a type"); err == nil {
+		t.Errorf("Expected an error for an invalid content type")
+	}
+
+	// Replacing a stream without a type removes its type
+	if err := collection.SetStream(1, 10, []byte("raw")); err != nil {
+		t.Fatalf("Failed to replace stream: %v", err)
+	}
+
+	// The types are kept when the document is written again, and reopened
+	if err := collection.UpdateDocument(1, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	collection.Close()
+	collection = open(ReadWrite)
+	defer collection.Close()
+	for streamID, want := range map[uint8][2]string{8: {"untyped", ""}, 9: {"png", "image/png"}, 10: {"raw", ""}} {
+		data, contentType, err := collection.GetStreamWithType(1, streamID)
+		if err != nil || string(data) != want[0] || contentType != want[1] {
+			t.Errorf("stream %d: expected %q of type %q, got %q of type %q, %v", streamID, want[0], want[1], data, contentType, err)
+		}
+	}
+	if _, _, err := collection.GetStreamWithType(1, 11); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("Expected ErrStreamNotFound, got %v", err)
+	}
+}
+
+func TestSetMetadataField(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_set_metadata_field.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	collection.AddDocument(1, []float64{1, 2}, []byte(`{"user":{"name":"ann","profile":{"active":false}},"tags":["a","b"]}`))
+
+	tests := []struct {
+		path     string
+		value    interface{}
+		expected string
+	}{
+		{"user.profile.active", true, `{"tags":["a","b"],"user":{"name":"ann","profile":{"active":true}}}`},
+		{"user.settings.theme", "dark", `{"tags":["a","b"],"user":{"name":"ann","profile":{"active":true},"settings":{"theme":"dark"}}}`},
+		{"tags.1", "c", `{"tags":["a","c"],"user":{"name":"ann","profile":{"active":true},"settings":{"theme":"dark"}}}`},
+	}
+	for _, test := range tests {
+		if err := collection.SetMetadataField(1, test.path, test.value); err != nil {
+			t.Fatalf("Failed to set %s: %v", test.path, err)
+		}
+		doc, err := collection.GetDocument(1)
+		if err != nil {
+			t.Fatalf("Failed to get document: %v", err)
+		}
+		if string(doc.Metadata) != test.expected {
+			t.Errorf("After setting %s, expected %s, got %s", test.path, test.expected, doc.Metadata)
+		}
+		if !aboutEqual(doc.Vector, []float64{1, 2}) {
+			t.Errorf("Expected vector to be unchanged, got %v", doc.Vector)
+		}
+	}
+
+	for _, path := range []string{"tags.2", "tags.x", "user.name.first"} {
+		if err := collection.SetMetadataField(1, path, 1); err == nil {
+			t.Errorf("Expected an error setting %s", path)
+		}
+	}
+	if err := collection.SetMetadataField(2, "a", 1); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+func TestCompactAsync(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:            testFilePath("test_compact_async.dat"),
+		DistanceMethod:  Euclidean,
+		DimensionCount:  8,
+		SeparateVectors: true,
+		FileMode:        CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	const count = 3000
+	vector := make([]float64, options.DimensionCount)
+	for i := 0; i < count; i++ {
+		for j := range vector {
+			vector[j] = myRandom.Float64()
+		}
+		vector[0] = float64(i) / count
+		collection.AddDocument(uint64(i), vector, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	for i := 0; i < count; i += 2 {
+		collection.removeDocument(uint64(i))
+	}
+	sizeBefore, _ := collection.spanfile.GetStats()
+
+	job, err := collection.CompactAsync()
+	if err != nil {
+		t.Fatalf("Failed to start compaction: %v", err)
+	}
+	if _, err := collection.CompactAsync(); !errors.Is(err, ErrCompactionRunning) {
+		t.Errorf("Expected ErrCompactionRunning, got %v", err)
+	}
+
+	// Read, write and remove documents while the compaction runs
+	lastProgress := 0.0
+	for i := 1; ; i += 2 {
+		if progress := job.Progress(); progress < lastProgress || progress > 1 {
+			t.Errorf("Expected progress to increase up to 1, got %v after %v", progress, lastProgress)
+		} else {
+			lastProgress = progress
+		}
+		id := uint64(i % count)
+		if doc, err := collection.GetDocument(id); err != nil || doc.Vector[0] != float64(id)/count {
+			t.Fatalf("Failed to read document %d during compaction: %v", id, err)
+		}
+		collection.UpdateDocument(id, []byte(fmt.Sprintf(`{"n":%d,"updated":true}`, id)))
+		collection.AddDocument(uint64(count+i), vector, []byte(`{}`))
+		collection.removeDocument(uint64(count + i))
+		if finished, _ := job.Result(); finished {
+			break
+		}
+	}
+	if err := <-job.Done(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if job.Progress() != 1 {
+		t.Errorf("Expected progress 1 when done, got %v", job.Progress())
+	}
+
+	sizeAfter, documents := collection.spanfile.GetStats()
+	if documents != count/2 {
+		t.Errorf("Expected %d documents after compaction, got %d", count/2, documents)
+	}
+	if sizeAfter >= sizeBefore {
+		t.Errorf("Expected the file to shrink from %d bytes, got %d", sizeBefore, sizeAfter)
+	}
+	for i := 1; i < count; i += 2 {
+		doc, err := collection.GetDocument(uint64(i))
+		if err != nil || doc.Vector[0] != float64(i)/count {
+			t.Fatalf("Failed to read document %d after compaction: %v", i, err)
+		}
+	}
+
+	// The file opens the same way after compaction
+	collection.Close()
+	collection, err = NewCollection(CollectionOptions{Name: options.Name})
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	if ids := collection.GetAllIDs(); len(ids) != count/2 {
+		t.Errorf("Expected %d documents after reopening, got %d", count/2, len(ids))
+	}
+	if doc, err := collection.GetDocument(1); err != nil || string(doc.Metadata) != `{"n":1,"updated":true}` {
+		t.Errorf("Expected the update made during compaction to be kept, got %v", err)
+	}
+
+	// A cancelled compaction leaves the collection as it was
+	job, err = collection.CompactAsync()
+	if err != nil {
+		t.Fatalf("Failed to start compaction: %v", err)
+	}
+	job.Cancel()
+	if err := <-job.Done(); err != nil && !errors.Is(err, ErrCompactionCancelled) {
+		t.Errorf("Expected ErrCompactionCancelled, got %v", err)
+	}
+	if ids := collection.GetAllIDs(); len(ids) != count/2 {
+		t.Errorf("Expected %d documents after cancelling, got %d", count/2, len(ids))
+	}
+	if _, err := os.Stat(options.Name + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_facets.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	categories := []string{"books", "music", "films"}
+	for i := 0; i < 100; i++ {
+		metadata := fmt.Sprintf(`{"category":%q,"tags":["t%d","t%d"],"user":{"country":"c%d"},"rank":%d}`,
+			categories[i%3], i%2, i%5, i%4, i%2)
+		if i == 7 {
+			metadata = `{"tags":"single"}`
+		}
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(metadata))
+	}
+
+	results := collection.Search(SearchArgs{
+		Vector: []float64{0, 0},
+		K:      20,
+		Facets: []string{"category", "tags", "user.country", "rank", "missing"},
+	})
+	if len(results.Results) != 20 {
+		t.Fatalf("Expected 20 results, got %d", len(results.Results))
+	}
+
+	expected := map[string]map[string]int{
+		"category": {}, "tags": {}, "user.country": {}, "rank": {}, "missing": {},
+	}
+	for _, result := range results.Results {
+		i := int(result.ID)
+		if i == 7 {
+			expected["tags"]["single"]++
+			continue
+		}
+		expected["category"][categories[i%3]]++
+		expected["tags"][fmt.Sprintf("t%d", i%2)]++
+		expected["tags"][fmt.Sprintf("t%d", i%5)]++
+		expected["user.country"][fmt.Sprintf("c%d", i%4)]++
+		expected["rank"][fmt.Sprint(i%2)]++
+	}
+	if !reflect.DeepEqual(results.Facets, expected) {
+		t.Errorf("Expected facets %v, got %v", expected, results.Facets)
+	}
+
+	if results := collection.Search(SearchArgs{Vector: []float64{0, 0}, K: 5}); results.Facets != nil {
+		t.Errorf("Expected no facets when none are requested, got %v", results.Facets)
+	}
+}
+
+func TestSearchFarthest(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_farthest.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	r := rand.New(rand.NewSource(4))
+	vectors := make(map[uint64][]float64)
+	for i := uint64(0); i < 300; i++ {
+		vectors[i] = []float64{r.Float64()*100 - 50, r.Float64()*100 - 50}
+		collection.AddDocument(i, vectors[i], []byte("{}"))
+	}
+
+	query := []float64{10, -20}
+	ids := make([]uint64, 0, len(vectors))
+	for id := range vectors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return euclideanDistance(query, vectors[ids[i]]) > euclideanDistance(query, vectors[ids[j]])
+	})
+
+	for name, args := range map[string]SearchArgs{
+		"k":        {K: 10},
+		"exact":    {K: 10, Precision: "exact"},
+		"parallel": {K: 10, Precision: "exact", Parallelism: 4},
+
+		// An exact match is the nearest document, so it doesn't end the search
+		"stop on exact": {K: 10, StopOnExact: true, ExactEpsilon: 1000},
+	} {
+		args.Vector = query
+		args.Farthest = true
+		results := collection.Search(args)
+		if got := resultIDs(results.Results); !equalUint64Slices(got, ids[:10]) {
+			t.Errorf("%s: expected the farthest documents %v, got %v", name, ids[:10], got)
+		}
+		if results.PercentSearched != 100 {
+			t.Errorf("%s: expected every document to be read, got %v%%", name, results.PercentSearched)
+		}
+	}
+
+	radius := euclideanDistance(query, vectors[ids[14]])
+	results := collection.Search(SearchArgs{Vector: query, Radius: radius, Farthest: true})
+	if got := resultIDs(results.Results); !equalUint64Slices(got, ids[:15]) {
+		t.Errorf("Expected the documents at least %v away, %v, got %v", radius, ids[:15], got)
+	}
+}
+
+func TestSearchExcludeIDs(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_exclude_ids.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	for i := 0; i < 200; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte("{}"))
+	}
+
+	// The excluded documents are the nearest to the search vector
+	exclude := []uint64{0, 1, 2, 5}
+	searches := map[string]SearchArgs{
+		"k":        {K: 10},
+		"exact":    {K: 10, Precision: "exact"},
+		"parallel": {K: 10, Precision: "exact", Parallelism: 4},
+		"radius":   {Radius: 13},
+		"listing":  {Limit: 10},
+	}
+	for name, args := range searches {
+		args.Vector = []float64{0, 0}
+		args.ExcludeIDs = exclude
+		results := collection.Search(args).Results
+		if len(results) != 10 {
+			t.Errorf("%s: expected 10 results, got %v", name, resultIDs(results))
+		}
+		for _, result := range results {
+			if slices.Contains(exclude, result.ID) {
+				t.Errorf("%s: excluded document %d was returned", name, result.ID)
+			}
+		}
+	}
+
+	expected := []uint64{3, 4, 6, 7, 8}
+	if ids := resultIDs(collection.Search(SearchArgs{Vector: []float64{0, 0}, K: 5, ExcludeIDs: exclude}).Results); !equalUint64Slices(ids, expected) {
+		t.Errorf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_lock_timeout.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		LockTimeout:    50 * time.Millisecond,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	collection.AddDocument(1, []float64{1, 2}, []byte("{}"))
+
+	// Hold the read lock, as a long search would
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		collection.mutex.RLock()
+		close(locked)
+		<-release
+		collection.mutex.RUnlock()
+	}()
+	<-locked
+
+	operations := map[string]func() error{
+		"AddDocument": func() error { return collection.AddDocument(2, []float64{3, 4}, []byte("{}")) },
+		"Compact":     collection.Compact,
+		"Close":       collection.Close,
+	}
+	for name, operation := range operations {
+		start := time.Now()
+		err := operation()
+		if !errors.Is(err, ErrLockTimeout) {
+			t.Errorf("%s: expected ErrLockTimeout, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+			t.Errorf("%s: expected to give up after 50ms, took %v", name, elapsed)
+		}
+	}
+
+	close(release)
+	if err := collection.AddDocument(2, []float64{3, 4}, []byte("{}")); err != nil {
+		t.Errorf("Expected AddDocument to succeed once the lock is released, got %v", err)
+	}
+
+	// A waiting writer keeps new readers out, so reads that overlap each
+	// other don't starve it
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				collection.mutex.RLock()
+				time.Sleep(5 * time.Millisecond)
+				collection.mutex.RUnlock()
+			}
+		}()
+		time.Sleep(2 * time.Millisecond)
+	}
+	err = collection.AddDocument(3, []float64{5, 6}, []byte("{}"))
+	close(stop)
+	readers.Wait()
+	if err != nil {
+		t.Errorf("Expected AddDocument to get the lock between reads, got %v", err)
+	}
+	if err := collection.Close(); err != nil {
+		t.Errorf("Expected Close to succeed once the lock is released, got %v", err)
+	}
+}
+
+func TestEvaluateRecall(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_evaluate_recall.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	// Documents lie on a line, so the nearest neighbours of a point just past
+	// document q are q, q+1 and q-1.
+	for i := 0; i < 100; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, nil)
+	}
+	var queries [][]float64
+	var groundTruth [][]uint64
+	for q := 10; q < 90; q += 10 {
+		queries = append(queries, []float64{float64(q) + 0.1, 0})
+		groundTruth = append(groundTruth, []uint64{uint64(q), uint64(q + 1), uint64(q - 1), uint64(q + 2)})
+	}
+
+	if recall := EvaluateRecall(collection, queries, groundTruth, 3, "exact"); recall != 1 {
+		t.Errorf("Expected exact recall of 1, got %v", recall)
+	}
+	if recall := EvaluateRecall(collection, queries, groundTruth, 3, "medium"); recall < 0 || recall > 1 {
+		t.Errorf("Expected recall between 0 and 1, got %v", recall)
+	}
+
+	// Ground truth that is wrong for half of the queries halves the recall
+	wrong := make([][]uint64, len(groundTruth))
+	for i := range groundTruth {
+		wrong[i] = groundTruth[i]
+		if i%2 == 1 {
+			wrong[i] = []uint64{99, 98, 97}
+		}
+	}
+	if recall := EvaluateRecall(collection, queries, wrong, 3, "exact"); math.Abs(recall-0.5) > 1e-9 {
+		t.Errorf("Expected recall of 0.5, got %v", recall)
+	}
+
+	// One of three neighbours wrong
+	partial := [][]uint64{{10, 11, 50}}
+	if recall := EvaluateRecall(collection, queries[:1], partial, 3, "exact"); math.Abs(recall-2.0/3) > 1e-9 {
+		t.Errorf("Expected recall of 2/3, got %v", recall)
+	}
+}
+
+func TestDimensionPolicy(t *testing.T) {
+	ensureTestFolder(t)
+	newCollection := func(name, policy string) (*Collection, error) {
+		return NewCollection(CollectionOptions{
+			Name:            testFilePath(name),
+			DistanceMethod:  Euclidean,
+			DimensionCount:  3,
+			Quantization:    64,
+			DimensionPolicy: policy,
+			FileMode:        CreateAndOverwrite,
+		})
+	}
+
+	padded, err := newCollection("test_dimension_pad.dat", DimensionPad)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer padded.Close()
+	if err := padded.AddDocument(1, []float64{1, 2}, []byte("{}")); err != nil {
+		t.Fatalf("Failed to add short vector: %v", err)
+	}
+	doc, err := padded.GetDocument(1)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if !aboutEqual(doc.Vector, []float64{1, 2, 0}) {
+		t.Errorf("Expected a padded vector, got %v", doc.Vector)
+	}
+	if err := padded.AddDocument(2, []float64{1, 2, 3, 4}, []byte("{}")); err == nil {
+		t.Errorf("Expected padding to reject a long vector")
+	}
+
+	truncated, err := newCollection("test_dimension_truncate.dat", DimensionTruncate)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer truncated.Close()
+	if err := truncated.AddDocument(1, []float64{1, 2, 3, 4}, []byte("{}")); err != nil {
+		t.Fatalf("Failed to add long vector: %v", err)
+	}
+	doc, err = truncated.GetDocument(1)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if !aboutEqual(doc.Vector, []float64{1, 2, 3}) {
+		t.Errorf("Expected a truncated vector, got %v", doc.Vector)
+	}
+
+	strict, err := newCollection("test_dimension_strict.dat", "")
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer strict.Close()
+	if err := strict.AddDocument(1, []float64{1, 2}, []byte("{}")); err == nil {
+		t.Errorf("Expected the default policy to reject a short vector")
+	}
+
+	if _, err := newCollection("test_dimension_invalid.dat", "stretch"); err == nil {
+		t.Errorf("Expected an invalid dimension policy to be rejected")
+	}
+}
+
+func TestLSHSeed(t *testing.T) {
+	ensureTestFolder(t)
+	vectors := make([][]float64, 2000)
+	for i := range vectors {
+		vectors[i] = []float64{myRandom.Float64(), myRandom.Float64(), myRandom.Float64(), myRandom.Float64()}
+	}
+
+	newCollection := func(name string) *Collection {
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath(name),
+			DistanceMethod: Euclidean,
+			DimensionCount: 4,
+			Quantization:   64,
+			LSHLeafSize:    20,
+			LSHSeed:        42,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		for i, vector := range vectors {
+			if err := collection.AddDocument(uint64(i), vector, []byte("{}")); err != nil {
+				t.Fatalf("Failed to add document: %v", err)
+			}
+		}
+		return collection
+	}
+	first := newCollection("test_lsh_seed_1.dat")
+	defer first.Close()
+	second := newCollection("test_lsh_seed_2.dat")
+	defer second.Close()
+
+	for _, query := range vectors[:10] {
+		args := SearchArgs{Vector: query, K: 10}
+		results1, results2 := first.Search(args), second.Search(args)
+		if results1.PercentSearched != results2.PercentSearched {
+			t.Errorf("Expected the same percent searched, got %v and %v", results1.PercentSearched, results2.PercentSearched)
+		}
+		if !slices.Equal(resultIDs(results1.Results), resultIDs(results2.Results)) {
+			t.Errorf("Expected the same results, got %v and %v", resultIDs(results1.Results), resultIDs(results2.Results))
+		}
+	}
+
+	// The seed is kept in the header
+	first.Close()
+	reopened, err := NewCollection(CollectionOptions{Name: testFilePath("test_lsh_seed_1.dat"), FileMode: ReadWrite})
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.LSHSeed != 42 {
+		t.Errorf("Expected the seed to be kept, got %d", reopened.LSHSeed)
+	}
+}
+
+func TestIterateBySequence(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_iterate_by_sequence.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	var inserted []uint64
+	for i := uint64(0); i < 50; i++ {
+		id := (i * 37) % 50
+		if err := collection.AddDocument(id, []float64{float64(id), 0}, []byte(fmt.Sprintf("%d", id))); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+		inserted = append(inserted, id)
+	}
+
+	// An updated document moves to the end
+	if err := collection.UpdateDocument(inserted[0], []byte("updated")); err != nil {
+		t.Fatalf("Failed to update document: %v", err)
+	}
+	expected := append(slices.Clone(inserted[1:]), inserted[0])
+
+	var ids []uint64
+	err = collection.IterateBySequence(func(doc *Document) bool {
+		ids = append(ids, doc.ID)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("IterateBySequence failed: %v", err)
+	}
+	if !equalUint64Slices(ids, expected) {
+		t.Errorf("Expected documents in the order written %v, got %v", expected, ids)
+	}
+
+	count := 0
+	collection.IterateBySequence(func(doc *Document) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Errorf("Expected iteration to stop after 5 documents, got %d", count)
+	}
+
+	// A document without a vector is reported, rather than crashing
+	if err := collection.spanfile.WriteRecord("50", []DataStream{{StreamID: 0, Data: []byte("{}")}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	if err := collection.IterateBySequence(func(doc *Document) bool { return true }); err == nil {
+		t.Error("Expected an error for a document without a vector")
+	}
+}
+
+func TestSearchDeadline(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_deadline.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	for i := 0; i < 200; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte("{}"))
+	}
+
+	// Each document takes a millisecond to filter, so searching them all
+	// takes much longer than the deadline.
+	slowFilter := func(id uint64, metadata []byte) bool {
+		time.Sleep(time.Millisecond)
+		return true
+	}
+	for _, args := range []SearchArgs{
+		{Vector: []float64{0, 0}, K: 5, Precision: "exact"},
+		{Vector: []float64{0, 0}},
+	} {
+		args.Filter = slowFilter
+		args.Deadline = time.Now().Add(20 * time.Millisecond)
+		start := time.Now()
+		results := collection.Search(args)
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("Expected the search to stop at the deadline, took %v", elapsed)
+		}
+		if !results.TimedOut {
+			t.Errorf("Expected the search to time out")
+		}
+		if len(results.Results) == 0 || results.PercentSearched >= 100 {
+			t.Errorf("Expected partial results, got %d results with %v%% searched", len(results.Results), results.PercentSearched)
+		}
+	}
+
+	results := collection.Search(SearchArgs{Vector: []float64{0, 0}, K: 5, Deadline: time.Now().Add(time.Minute)})
+	if results.TimedOut || len(results.Results) != 5 {
+		t.Errorf("Expected a search within its deadline to finish, got %d results, timed out %v", len(results.Results), results.TimedOut)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_validate.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	for i := uint64(0); i < 100; i++ {
+		collection.AddDocument(i, []float64{myRandom.Float64(), myRandom.Float64()}, []byte(`{}`))
+	}
+	// A replaced document is still healthy
+	collection.AddDocument(10, []float64{0.5, 0.5}, []byte(`{}`))
+	report, err := collection.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if !report.OK() || report.Documents != 100 {
+		t.Errorf("Expected a healthy collection of 100 documents, got %+v", report)
+	}
+
+	// Desync the index and the file, and store a vector of the wrong size
+	doc, _ := collection.GetDocument(5)
+	collection.lshTree.removePoint(5, doc.Vector)
+	// addPoint could split a leaf, which reads its documents, so put the ID
+	// of a missing document straight into a leaf of each tree
+	for _, root := range collection.lshTree.roots {
+		for !root.isLeaf() {
+			root = root.left
+		}
+		root.ids = append(root.ids, 1000)
+	}
+	if err := collection.writeRecord("7", []byte(`{}`), make([]byte, 3)); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+
+	report, err = collection.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if report.OK() {
+		t.Errorf("Expected problems to be found")
+	}
+	if !equalUint64Slices(report.NotIndexed, []uint64{5}) {
+		t.Errorf("Expected document 5 to be missing from the index, got %v", report.NotIndexed)
+	}
+	if !equalUint64Slices(report.NotStored, []uint64{1000}) {
+		t.Errorf("Expected ID 1000 to be missing from the file, got %v", report.NotStored)
+	}
+	if !equalUint64Slices(report.BadVectors, []uint64{7}) {
+		t.Errorf("Expected document 7 to have a bad vector, got %v", report.BadVectors)
+	}
+
+	collection.Close()
+	if _, err := collection.Validate(); err != ErrCollectionClosed {
+		t.Errorf("Expected ErrCollectionClosed, got %v", err)
+	}
+}
+
+func TestVectorHelpers(t *testing.T) {
+	a := []float64{1, 2, 3}
+	b := []float64{3, 2, -1}
+	if got, err := AddVectors(a, b); err != nil || !aboutEqual(got, []float64{4, 4, 2}) {
+		t.Errorf("AddVectors: got %v, %v", got, err)
+	}
+	if got := ScaleVector(a, -0.5); !aboutEqual(got, []float64{-0.5, -1, -1.5}) {
+		t.Errorf("ScaleVector: got %v", got)
+	}
+	if got, err := Centroid([][]float64{a, b, {2, 5, 1}}); err != nil || !aboutEqual(got, []float64{2, 3, 1}) {
+		t.Errorf("Centroid: got %v, %v", got, err)
+	}
+	if got, err := Centroid(nil); got != nil || err != nil {
+		t.Errorf("Expected the centroid of no vectors to be nil, got %v, %v", got, err)
+	}
+	if !aboutEqual(a, []float64{1, 2, 3}) {
+		t.Errorf("Expected the arguments to be unchanged, got %v", a)
+	}
+
+	if _, err := AddVectors(a, []float64{1}); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("Expected ErrDimensionMismatch for vectors of different lengths, got %v", err)
+	}
+	if _, err := Centroid([][]float64{a, {1}}); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("Expected ErrDimensionMismatch for a centroid of different lengths, got %v", err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogInfo)
+
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_log_level.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	collection.AddDocument(1, []float64{1, 2}, []byte(`{}`))
+
+	SetLogLevel(LogError)
+	buf.Reset()
+	collection.Search(SearchArgs{Vector: []float64{1, 2}, K: 1})
+	logDebugf("debug message")
+	logInfof("info message")
+	logWarnf("warning message")
+	if buf.Len() != 0 {
+		t.Errorf("Expected messages below the error level to be suppressed, got %q", buf.String())
+	}
+	logErrorf("error message")
+	if !strings.Contains(buf.String(), "error message") {
+		t.Errorf("Expected the error to be logged, got %q", buf.String())
+	}
+
+	SetLogLevel(LogDebug)
+	buf.Reset()
+	collection.Search(SearchArgs{Vector: []float64{1, 2}, K: 1})
+	if !strings.Contains(buf.String(), "Search called") {
+		t.Errorf("Expected the search to be logged at the debug level, got %q", buf.String())
+	}
+
+	for name, want := range map[string]LogLevel{"": LogInfo, "debug": LogDebug, "WARN": LogWarn, "error": LogError} {
+		if level, err := ParseLogLevel(name); err != nil || level != want {
+			t.Errorf("ParseLogLevel(%q): got %v, %v want %v", name, level, err, want)
+		}
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Errorf("Expected an invalid log level to be rejected")
+	}
+}
+
+func TestSearchTieOrder(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_ties.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	// Every document but 10 is at distance 1 from the origin
+	collection.AddDocument(7, []float64{1, 0}, []byte("{}"))
+	collection.AddDocument(3, []float64{0, 1}, []byte("{}"))
+	collection.AddDocument(9, []float64{-1, 0}, []byte("{}"))
+	collection.AddDocument(1, []float64{0, -1}, []byte("{}"))
+	collection.AddDocument(5, []float64{1, 0}, []byte("{}"))
+	collection.AddDocument(10, []float64{0.5, 0}, []byte("{}"))
+
+	for name, test := range map[string]struct {
+		args SearchArgs
+		want []uint64
+	}{
+		"k":             {SearchArgs{K: 3}, []uint64{10, 1, 3}},
+		"exact":         {SearchArgs{K: 3, Precision: "exact"}, []uint64{10, 1, 3}},
+		"parallel":      {SearchArgs{K: 3, Precision: "exact", Parallelism: 3}, []uint64{10, 1, 3}},
+		"radius":        {SearchArgs{Radius: 1}, []uint64{10, 1, 3, 5, 7, 9}},
+		"farthest":      {SearchArgs{K: 3, Farthest: true}, []uint64{1, 3, 5}},
+		"distance_desc": {SearchArgs{K: 6, SortBy: "distance_desc"}, []uint64{1, 3, 5, 7, 9, 10}},
+	} {
+		test.args.Vector = []float64{0, 0}
+		for i := 0; i < 5; i++ {
+			results := collection.Search(test.args)
+			if got := resultIDs(results.Results); !equalUint64Slices(got, test.want) {
+				t.Errorf("%s: expected %v, got %v", name, test.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ensureTestFolder(t)
+	vectorA := make([]float64, 128)
+	vectorB := make([]float64, 128)
+	for i := range vectorA {
+		vectorA[i] = float64(i)
+		vectorB[i] = float64(-i)
+	}
+	vectorOf := func(id uint64) []float64 {
+		if id%2 == 0 {
+			return vectorA
+		}
+		return vectorB
+	}
+
+	for _, separate := range []bool{false, true} {
+		liveBytes := make(map[bool]uint64)
+		for _, dedup := range []bool{false, true} {
+			collection, err := NewCollection(CollectionOptions{
+				Name:            testFilePath("test_dedup.dat"),
+				DistanceMethod:  Euclidean,
+				DimensionCount:  128,
+				SeparateVectors: separate,
+				WithNorms:       true,
+				Dedup:           dedup,
+				FileMode:        CreateAndOverwrite,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create collection: %v", err)
+			}
+			for id := uint64(0); id < 200; id++ {
+				collection.AddDocument(id, vectorOf(id), []byte(fmt.Sprintf("doc %d", id)))
+			}
+			liveBytes[dedup] = collection.StorageBreakdown().LiveBytes
+			collection.Close()
+		}
+		if liveBytes[true]*10 > liveBytes[false] {
+			t.Errorf("separate=%v: expected duplicates to take much less space, got %d bytes with dedup and %d without", separate, liveBytes[true], liveBytes[false])
+		}
+
+		collection, err := NewCollection(CollectionOptions{Name: testFilePath("test_dedup.dat")})
+		if err != nil {
+			t.Fatalf("Failed to reopen collection: %v", err)
+		}
+		check := func(step string, ids []uint64) {
+			t.Helper()
+			for _, id := range ids {
+				doc, err := collection.GetDocument(id)
+				if err != nil {
+					t.Fatalf("separate=%v, %s: failed to get document %d: %v", separate, step, id, err)
+				}
+				if !aboutEqual(doc.Vector, vectorOf(id)) || string(doc.Metadata) != fmt.Sprintf("doc %d", id) {
+					t.Fatalf("separate=%v, %s: document %d has the wrong vector or metadata %q", separate, step, id, doc.Metadata)
+				}
+				if norm, err := collection.GetDocumentNorm(id); err != nil || math.Abs(norm-vectorLength(vectorA)) > 1e-9 {
+					t.Fatalf("separate=%v, %s: document %d has norm %v, %v", separate, step, id, norm, err)
+				}
+			}
+			if report, err := collection.Validate(); err != nil || !report.OK() {
+				t.Fatalf("separate=%v, %s: validation failed: %+v, %v", separate, step, report, err)
+			}
+		}
+		var all []uint64
+		for id := uint64(0); id < 200; id++ {
+			all = append(all, id)
+		}
+		check("reopened", all)
+
+		results := collection.Search(SearchArgs{Vector: vectorA, Radius: 0.001})
+		if len(results.Results) != 100 {
+			t.Errorf("separate=%v: expected 100 documents with the first vector, got %d", separate, len(results.Results))
+		}
+
+		// Removing or changing the documents that hold the shared vectors
+		// leaves the others able to read them
+		if err := collection.removeDocument(0); err != nil {
+			t.Fatalf("Failed to remove document: %v", err)
+		}
+		if err := collection.UpdateDocumentVector(1, vectorA); err != nil {
+			t.Fatalf("Failed to update vector: %v", err)
+		}
+		if err := collection.UpdateDocument(3, []byte("doc 3")); err != nil {
+			t.Fatalf("Failed to update document: %v", err)
+		}
+		if err := collection.Compact(); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+		doc, err := collection.GetDocument(1)
+		if err != nil || !aboutEqual(doc.Vector, vectorA) {
+			t.Errorf("separate=%v: expected document 1 to have the new vector, got %v", separate, err)
+		}
+		check("changed", all[2:])
+		collection.Close()
+
+		collection, err = NewCollection(CollectionOptions{Name: testFilePath("test_dedup.dat")})
+		if err != nil {
+			t.Fatalf("Failed to reopen collection: %v", err)
+		}
+		check("reopened after changes", all[2:])
+		collection.Close()
+	}
+}
+
+func TestSearchMetadataOnly(t *testing.T) {
+	ensureTestFolder(t)
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_metadata_only.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	// Two digit IDs, so that the order of the file is the order of the IDs
+	for i := uint64(10); i < 30; i++ {
+		collection.AddDocument(i, []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"even":%v}`, i%2 == 0)))
+	}
+
+	evens := []uint64{10, 12, 14, 16, 18, 20, 22, 24, 26, 28}
+	for name, test := range map[string]struct {
+		args SearchArgs
+		want []uint64
+	}{
+		"filter":        {SearchArgs{FilterQuery: "even == true"}, evens},
+		"k":             {SearchArgs{FilterQuery: "even == true", K: 3}, evens[:3]},
+		"k and limit":   {SearchArgs{FilterQuery: "even == true", K: 5, Limit: 2}, evens[:2]},
+		"offset":        {SearchArgs{FilterQuery: "even == true", Offset: 4, Limit: 3}, evens[4:7]},
+		"radius":        {SearchArgs{FilterQuery: "even == true", Radius: 1}, evens},
+		"sort":          {SearchArgs{FilterQuery: "even == true", K: 3, SortBy: "id_desc"}, []uint64{14, 12, 10}},
+		"filter func":   {SearchArgs{Filter: func(id uint64, metadata []byte) bool { return id >= 25 }}, []uint64{25, 26, 27, 28, 29}},
+		"no filter, k":  {SearchArgs{K: 2}, []uint64{10, 11}},
+		"stop on exact": {SearchArgs{FilterQuery: "even == false", K: 2, StopOnExact: true}, []uint64{11, 13}},
+	} {
+		results, err := collection.SearchE(test.args)
+		if err != nil {
+			t.Fatalf("%s: search failed: %v", name, err)
+		}
+		if got := resultIDs(results.Results); !equalUint64Slices(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", name, test.want, got)
+		}
+		for _, result := range results.Results {
+			if result.Distance != 0 {
+				t.Errorf("%s: expected no distance for document %d, got %v", name, result.ID, result.Distance)
+			}
+		}
+	}
+}
+
+func TestPersistIndex(t *testing.T) {
+	ensureTestFolder(t)
+	const documents = 5000
+	r := rand.New(rand.NewSource(7))
+	open := func(persist bool) (*Collection, time.Duration) {
+		start := time.Now()
+		collection, err := NewCollection(CollectionOptions{
+			Name:         testFilePath("test_persist_index.dat"),
+			PersistIndex: persist,
+		})
+		if err != nil {
+			t.Fatalf("Failed to open collection: %v", err)
+		}
+		return collection, time.Since(start)
+	}
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_persist_index.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 32,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	for i := uint64(0); i < documents; i++ {
+		vector := make([]float64, 32)
+		for j := range vector {
+			vector[j] = r.NormFloat64()
+		}
+		collection.AddDocument(i, vector, []byte("{}"))
+	}
+	collection.Close()
+
+	collection, rebuildTime := open(false)
+	collection.Close()
+
+	// The first collection opened with PersistIndex builds the index, and
+	// saves it when closed
+	query := make([]float64, 32)
+	query[0] = 1
+	collection, _ = open(true)
+	saved := collection.lshTree.encode(documents)
+	want := collection.Search(SearchArgs{Vector: query, K: 10})
+	collection.Close()
+
+	collection, loadTime := open(true)
+	if !bytes.Equal(collection.lshTree.encode(documents), saved) {
+		t.Fatalf("Expected the saved index to be loaded")
+	}
+	t.Logf("Opening %d documents took %v building the index and %v loading it", documents, rebuildTime, loadTime)
+	results := collection.Search(SearchArgs{Vector: query, K: 10})
+	if !equalUint64Slices(resultIDs(results.Results), resultIDs(want.Results)) {
+		t.Errorf("Expected the loaded index to find %v, got %v", resultIDs(want.Results), resultIDs(results.Results))
+	}
+	collection.Close()
+
+	// A change made after the index was saved makes it out of date
+	for name, change := range map[string]func(file *SpanFile) error{
+		"remove": func(file *SpanFile) error {
+			return file.RemoveRecord("5")
+		},
+		"rewrite": func(file *SpanFile) error {
+			span, err := file.ReadRecord("6")
+			if err != nil {
+				return err
+			}
+			return file.WriteRecord("6", span.DataStreams)
+		},
+	} {
+		collection, _ = open(true)
+		saved = collection.lshTree.encode(collection.GetDocumentCount())
+		collection.Close()
+
+		file, err := OpenFile(testFilePath("test_persist_index.dat"), ReadWrite)
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		if err := change(file); err != nil {
+			t.Fatalf("%s: failed to change file: %v", name, err)
+		}
+		file.Close()
+
+		collection, _ = open(true)
+		if bytes.Equal(collection.lshTree.encode(collection.GetDocumentCount()), saved) {
+			t.Errorf("%s: expected the out of date index to be rebuilt", name)
+		}
+		if report, err := collection.Validate(); err != nil || !report.OK() {
+			t.Errorf("%s: expected the rebuilt index to match the documents, got %+v, %v", name, report, err)
+		}
+		collection.Close()
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	ensureTestFolder(t)
+	r := rand.New(rand.NewSource(3))
+	build := func(name string, clustered int, indexType string) IndexStats {
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath(name),
+			DistanceMethod: Cosine,
+			DimensionCount: 8,
+			IndexType:      indexType,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		defer collection.Close()
+		for i := 0; i < 2000; i++ {
+			vector := make([]float64, 8)
+			for j := range vector {
+				if i < clustered {
+					vector[j] = 1
+				} else {
+					vector[j] = r.NormFloat64()
+				}
+			}
+			collection.AddDocument(uint64(i), vector, nil)
+		}
+		return collection.IndexStats()
+	}
+
+	spread := build("test_index_stats_spread.dat", 0, "")
+	if spread.Trees != defaultLSHTrees || spread.LeafSize != defaultLSHLeafSize || spread.Leaves < spread.Trees*2000/defaultLSHLeafSize {
+		t.Errorf("Unexpected stats for spread documents: %+v", spread)
+	}
+	if spread.MaxDepth == 0 || spread.AverageDepth > float64(spread.MaxDepth) || spread.MaxLeafDocuments > 2*spread.LeafSize {
+		t.Errorf("Expected spread documents to be split evenly, got %+v", spread)
+	}
+
+	// Documents with the same vector can't be split, so they stay in one leaf
+	clustered := build("test_index_stats_clustered.dat", 1500, "")
+	if clustered.MaxLeafDocuments < 1500 || clustered.OversizedLeaves < clustered.Trees {
+		t.Errorf("Expected the clustered documents in oversized leaves, got %+v", clustered)
+	}
+	if clustered.Skew < 3*spread.Skew || clustered.MedianLeafDocuments > clustered.LeafSize {
+		t.Errorf("Expected a few leaves to hold most clustered documents, got %+v (spread %+v)", clustered, spread)
+	}
+
+	if flat := build("test_index_stats_flat.dat", 0, IndexFlat); flat != (IndexStats{}) {
+		t.Errorf("Expected no stats without a search index, got %+v", flat)
+	}
+}
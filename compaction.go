@@ -0,0 +1,177 @@
+package syzgydb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors returned by CompactAsync and its jobs.
+var (
+	ErrCompactionRunning   = errors.New("a compaction is already running")
+	ErrCompactionCancelled = errors.New("compaction cancelled")
+)
+
+/*
+CompactionJob is a compaction running in the background, started by
+CompactAsync.
+*/
+type CompactionJob struct {
+	mutex      sync.Mutex
+	progress   float64
+	finished   bool
+	finishedAt time.Time
+	err        error
+
+	done       chan error
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+// Progress returns the fraction of the collection's records that have been
+// copied, from 0 to 1.
+func (j *CompactionJob) Progress() float64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.progress
+}
+
+// Done returns a channel that receives the result of the compaction when it
+// finishes, and is then closed.
+func (j *CompactionJob) Done() <-chan error {
+	return j.done
+}
+
+// Result reports whether the compaction has finished, and if so, its result.
+func (j *CompactionJob) Result() (bool, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.finished, j.err
+}
+
+// Cancel stops the compaction, leaving the collection as it was. The job then
+// finishes with ErrCompactionCancelled, unless it had already finished.
+func (j *CompactionJob) Cancel() {
+	j.cancelOnce.Do(func() { close(j.cancel) })
+}
+
+// finishedBefore reports whether the job finished before t.
+func (j *CompactionJob) finishedBefore(t time.Time) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.finished && j.finishedAt.Before(t)
+}
+
+func (j *CompactionJob) setProgress(progress float64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.progress = progress
+}
+
+func (j *CompactionJob) finish(err error) {
+	j.mutex.Lock()
+	j.finished = true
+	j.finishedAt = time.Now()
+	j.err = err
+	if err == nil {
+		j.progress = 1
+	}
+	j.mutex.Unlock()
+
+	j.done <- err
+	close(j.done)
+}
+
+/*
+CompactAsync starts compacting the collection in the background, and returns a
+job to follow its progress. Unlike Compact, documents can be read and searched
+while the records are copied. Writes wait for each step of the copy, which is
+short, and documents written during the copy are copied again at the end. Only
+the last step, which replaces the file, blocks reads. It returns
+ErrCompactionRunning if the collection is already being compacted.
+*/
+func (c *Collection) CompactAsync() (*CompactionJob, error) {
+	c.mutex.RLock()
+	closed := c.spanfile == nil
+	c.mutex.RUnlock()
+	if closed {
+		return nil, ErrCollectionClosed
+	}
+	if !c.compacting.CompareAndSwap(false, true) {
+		return nil, ErrCompactionRunning
+	}
+
+	job := &CompactionJob{
+		done:   make(chan error, 1),
+		cancel: make(chan struct{}),
+	}
+	go func() {
+		defer c.compacting.Store(false)
+		job.finish(c.compactInSteps(job))
+	}()
+	return job, nil
+}
+
+// compactInSteps compacts the collection's files one after the other, holding
+// the write lock only to start and finish each one.
+func (c *Collection) compactInSteps(job *CompactionJob) error {
+	c.mutex.RLock()
+	files := []*SpanFile{c.spanfile}
+	if c.vectorfile != nil {
+		files = append(files, c.vectorfile)
+	}
+	c.mutex.RUnlock()
+
+	for i, file := range files {
+		c.mutex.Lock()
+		if c.spanfile == nil {
+			c.mutex.Unlock()
+			return ErrCollectionClosed
+		}
+		cp, err := file.startCompaction()
+		c.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if cp == nil {
+			continue
+		}
+
+		for done := false; !done; {
+			select {
+			case <-job.cancel:
+				cp.abort()
+				return ErrCompactionCancelled
+			default:
+			}
+
+			c.mutex.RLock()
+			if c.spanfile == nil {
+				c.mutex.RUnlock()
+				cp.abort()
+				return ErrCollectionClosed
+			}
+			done, err = cp.step(compactionStepSpans)
+			c.mutex.RUnlock()
+			if err != nil {
+				cp.abort()
+				return err
+			}
+			job.setProgress((float64(i) + cp.progress()) / float64(len(files)))
+		}
+
+		c.mutex.Lock()
+		if c.spanfile == nil {
+			c.mutex.Unlock()
+			cp.abort()
+			return ErrCollectionClosed
+		}
+		err = cp.finish()
+		c.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	c.compactions.Add(1)
+	return nil
+}
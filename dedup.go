@@ -0,0 +1,258 @@
+package syzgydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// refStreamID is the data stream that holds, in place of a vector, the ID of the
+// document that stores the same vector, in a collection with Dedup set.
+const refStreamID = 3
+
+/*
+dedupIndex finds the documents of a Dedup collection that store each encoded
+vector, so that a document added with the same vector can refer to one of them
+instead of storing another copy. The collection's mutex protects it.
+*/
+type dedupIndex struct {
+	// holders maps the hash of each stored vector to the documents that store
+	// it, and hashes holds the hash of the vector each of them stores.
+	holders map[uint64][]uint64
+	hashes  map[uint64]uint64
+
+	// refs holds the documents that refer to each holder, and refOf the
+	// holder that each of them refers to.
+	refs  map[uint64]map[uint64]struct{}
+	refOf map[uint64]uint64
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{
+		holders: make(map[uint64][]uint64),
+		hashes:  make(map[uint64]uint64),
+		refs:    make(map[uint64]map[uint64]struct{}),
+		refOf:   make(map[uint64]uint64),
+	}
+}
+
+func (d *dedupIndex) addHolder(id, hash uint64) {
+	d.holders[hash] = append(d.holders[hash], id)
+	d.hashes[id] = hash
+}
+
+func (d *dedupIndex) removeHolder(id uint64) {
+	hash := d.hashes[id]
+	ids := d.holders[hash]
+	for i, holder := range ids {
+		if holder == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(d.holders, hash)
+	} else {
+		d.holders[hash] = ids
+	}
+	delete(d.hashes, id)
+}
+
+func (d *dedupIndex) addRef(id, holder uint64) {
+	refs := d.refs[holder]
+	if refs == nil {
+		refs = make(map[uint64]struct{})
+		d.refs[holder] = refs
+	}
+	refs[id] = struct{}{}
+	d.refOf[id] = holder
+}
+
+func (d *dedupIndex) removeRef(id uint64) {
+	holder := d.refOf[id]
+	delete(d.refs[holder], id)
+	if len(d.refs[holder]) == 0 {
+		delete(d.refs, holder)
+	}
+	delete(d.refOf, id)
+}
+
+// hashVector returns the hash of an encoded vector used to find its copies.
+func hashVector(vector []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(vector)
+	return h.Sum64()
+}
+
+func encodeRef(holder uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, holder)
+}
+
+// readRef returns the document whose vector a record refers to, if it refers
+// to one instead of storing its own.
+func readRef(record interface{ getStream(uint8) ([]byte, error) }) (uint64, bool) {
+	data, err := record.getStream(refStreamID)
+	if err != nil || len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// vectorOwner returns the ID of the document that stores the vector of a
+// document, given its record in the main file.
+func (c *Collection) vectorOwner(id uint64, record interface{ getStream(uint8) ([]byte, error) }) uint64 {
+	if c.Dedup {
+		if holder, ok := readRef(record); ok {
+			return holder
+		}
+	}
+	return id
+}
+
+// buildDedupIndex finds the vector stored by, or referred to by, every
+// document of a Dedup collection. The caller must hold the write lock, or have
+// exclusive access.
+func (c *Collection) buildDedupIndex() error {
+	c.dedup = nil
+	if !c.Dedup {
+		return nil
+	}
+
+	dedup := newDedupIndex()
+	err := c.iterateDataRecords(false, func(id uint64, sr *SpanReader) error {
+		if holder, ok := readRef(sr); ok {
+			dedup.addRef(id, holder)
+			return nil
+		}
+		vector, err := c.readVector(id, sr)
+		if err != nil {
+			logWarnf("Warning -- could not read vector for record %d", id)
+			return nil
+		}
+		dedup.addHolder(id, hashVector(vector))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate records: %v", err)
+	}
+	c.dedup = dedup
+	return nil
+}
+
+// storedVector returns the encoded vector of a document.
+func (c *Collection) storedVector(id uint64) ([]byte, error) {
+	sr, err := c.spanfile.getSpanReader(fmt.Sprintf("%d", id))
+	if err != nil {
+		return nil, err
+	}
+	return c.readVector(id, sr)
+}
+
+// storesVector reports whether a document stores the given encoded vector.
+func (c *Collection) storesVector(id uint64, vector []byte) bool {
+	stored, err := c.storedVector(id)
+	return err == nil && bytes.Equal(stored, vector)
+}
+
+/*
+shareVector updates the dedup index for a document about to be written with the
+given encoded vector, and returns its reference to the document that already
+stores the same vector, or nil if it must store the vector itself. A nil vector
+leaves the stored vector unchanged. The caller must hold the write lock.
+*/
+func (c *Collection) shareVector(id uint64, vector []byte) ([]byte, error) {
+	d := c.dedup
+	if vector == nil {
+		if holder, ok := d.refOf[id]; ok {
+			return encodeRef(holder), nil
+		}
+		return nil, nil
+	}
+
+	// A document written again with the same vector stays as it was
+	hash := hashVector(vector)
+	if holder, ok := d.refOf[id]; ok && d.hashes[holder] == hash && c.storesVector(holder, vector) {
+		return encodeRef(holder), nil
+	}
+	if stored, ok := d.hashes[id]; ok && stored == hash && c.storesVector(id, vector) {
+		return nil, nil
+	}
+
+	if err := c.releaseVector(id); err != nil {
+		return nil, err
+	}
+	for _, holder := range d.holders[hash] {
+		if c.storesVector(holder, vector) {
+			d.addRef(id, holder)
+			return encodeRef(holder), nil
+		}
+	}
+	d.addHolder(id, hash)
+	return nil, nil
+}
+
+/*
+releaseVector removes a document that is about to be removed or given another
+vector from the dedup index. When other documents refer to its vector, the first
+of them is given a copy of the vector, and the rest are changed to refer to it.
+The caller must hold the write lock.
+*/
+func (c *Collection) releaseVector(id uint64) error {
+	d := c.dedup
+	if _, ok := d.refOf[id]; ok {
+		d.removeRef(id)
+		return nil
+	}
+	if _, ok := d.hashes[id]; !ok {
+		return nil
+	}
+
+	var referrers []uint64
+	for ref := range d.refs[id] {
+		referrers = append(referrers, ref)
+	}
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i] < referrers[j] })
+	var vector []byte
+	if len(referrers) > 0 {
+		var err error
+		vector, err = c.storedVector(id)
+		if err != nil {
+			return fmt.Errorf("failed to read shared vector of document %d: %v", id, err)
+		}
+		vector = bytes.Clone(vector)
+	}
+	for _, ref := range referrers {
+		d.removeRef(ref)
+	}
+	d.removeHolder(id)
+
+	// Writing the first referrer makes it a holder, which the rest then find
+	for _, ref := range referrers {
+		recordID := fmt.Sprintf("%d", ref)
+		span, err := c.spanfile.readRecord(recordID)
+		if err != nil {
+			return fmt.Errorf("failed to read document %d: %v", ref, err)
+		}
+		metadata, err := span.getStream(0)
+		if err != nil {
+			return fmt.Errorf("failed to read document %d: %v", ref, err)
+		}
+		if err := c.writeRecord(recordID, bytes.Clone(metadata), vector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVectorRecord removes the record of a document from the vector file,
+// which a document that refers to another's vector doesn't have.
+func (c *Collection) removeVectorRecord(recordID string) error {
+	err := c.vectorfile.RemoveRecord(recordID)
+	if c.Dedup && errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
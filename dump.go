@@ -1,12 +1,17 @@
 package syzgydb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // indentWriter is a custom writer that adds an indent to the start of each line
@@ -45,7 +50,21 @@ func (iw *indentWriter) Write(p []byte) (n int, err error) {
 	return written, nil
 }
 
-func ExportJSON(c *Collection, w io.Writer) error {
+// exportBufferSize is the size of the buffer used by ExportJSON, and
+// exportFlushInterval is the number of records written between flushes.
+const (
+	exportBufferSize    = 64 * 1024
+	exportFlushInterval = 1000
+)
+
+/*
+ExportJSON writes the collection options and all of its documents to out as JSON.
+Documents are written one at a time as they are read, so the whole collection is
+never held in memory.
+*/
+func ExportJSON(c *Collection, out io.Writer) error {
+	w := bufio.NewWriterSize(out, exportBufferSize)
+
 	// Write the opening brace
 	fmt.Fprintln(w, "{")
 
@@ -124,6 +143,12 @@ func ExportJSON(c *Collection, w io.Writer) error {
 			// If there's only one line, write it directly
 			fmt.Fprint(w, string(metadataJSON))
 		}
+
+		if (i+1)%exportFlushInterval == 0 {
+			if err := w.Flush(); err != nil {
+				return fmt.Errorf("failed to write records: %v", err)
+			}
+		}
 	}
 
 	// Write the closing brackets
@@ -132,6 +157,9 @@ func ExportJSON(c *Collection, w io.Writer) error {
 	}
 	fmt.Fprintln(w, "]\n}")
 
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write records: %v", err)
+	}
 	return nil
 }
 
@@ -191,7 +219,9 @@ func ImportJSON(collectionName string, r io.Reader) error {
 				}
 
 				// Add the document to the collection
-				collection.AddDocument(doc.ID, doc.Vector, doc.Metadata)
+				if err := collection.AddDocument(doc.ID, doc.Vector, doc.Metadata); err != nil {
+					return fmt.Errorf("failed to add document %d: %v", doc.ID, err)
+				}
 			}
 
 			// Read the closing bracket of the records array
@@ -216,6 +246,237 @@ func ImportJSON(collectionName string, r io.Reader) error {
 	return nil
 }
 
+// backupManifestFile is the name of the manifest in a backup folder.
+const backupManifestFile = "manifest.json"
+
+/*
+BackupManifest describes a backup of the data folder made by BackupDataFolder.
+It is saved as manifest.json in the backup folder, next to one JSON Lines file
+of documents for each collection.
+*/
+type BackupManifest struct {
+	Created     time.Time          `json:"created"`
+	Collections []BackupCollection `json:"collections"`
+}
+
+// BackupCollection is the entry of one collection in a BackupManifest.
+type BackupCollection struct {
+	// Name is the collection's name, with its tenant, such as "acme/notes".
+	Name string `json:"name"`
+
+	// File is the name of the collection's JSON Lines file in the backup folder.
+	File string `json:"file"`
+
+	Documents int               `json:"documents"`
+	Options   CollectionOptions `json:"options"`
+}
+
+// backupRecord is one line of a collection's file in a backup. Metadata that
+// isn't valid JSON is kept in RawMetadata instead.
+type backupRecord struct {
+	ID          uint64          `json:"id"`
+	Vector      []float64       `json:"vector"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+	RawMetadata []byte          `json:"raw_metadata,omitempty"`
+	Streams     []backupStream  `json:"streams,omitempty"`
+}
+
+// backupStream is a data stream set on a document with SetStreamWithType.
+type backupStream struct {
+	ID          uint8  `json:"id"`
+	ContentType string `json:"content_type,omitempty"`
+	Data        []byte `json:"data"`
+}
+
+// backupStreams returns the data streams set on a document with
+// SetStreamWithType, and their content types.
+func backupStreams(collection *Collection, id uint64) []backupStream {
+	collection.mutex.RLock()
+	defer collection.mutex.RUnlock()
+
+	var streams []backupStream
+	var types map[uint8]string
+	for _, stream := range collection.customStreams(fmt.Sprintf("%d", id)) {
+		if stream.StreamID == streamTypesStreamID {
+			types = decodeStreamTypes(stream.Data)
+			continue
+		}
+		streams = append(streams, backupStream{ID: stream.StreamID, Data: stream.Data})
+	}
+	for i := range streams {
+		streams[i].ContentType = types[streams[i].ID]
+	}
+	return streams
+}
+
+/*
+BackupDataFolder writes every collection in the configured data folder to dir,
+which is created if needed: each collection's documents, with their data
+streams, as JSON Lines, and a manifest listing the collections and their
+options. The collections are opened read only, but the server should not be
+changing them during the backup.
+*/
+func BackupDataFolder(dir string) (*BackupManifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err := filepath.WalkDir(globalConfig.DataFolder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".dat") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list .dat files: %v", err)
+	}
+
+	s := &Server{}
+	manifest := &BackupManifest{Created: time.Now().UTC()}
+	for _, file := range files {
+		name, ok := s.fileNameToCollectionKey(file)
+		if !ok {
+			logWarnf("Warning -- skipping %s, which is not where the %s layout keeps collections", file, globalConfig.DataFolderLayout)
+			continue
+		}
+		entry := BackupCollection{
+			Name: name,
+			File: fmt.Sprintf("%04d.jsonl", len(manifest.Collections)+1),
+		}
+		if err := backupCollection(file, filepath.Join(dir, entry.File), &entry); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", name, err)
+		}
+		manifest.Collections = append(manifest.Collections, entry)
+		logInfof("Backed up %d documents of %s", entry.Documents, name)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupManifestFile), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// backupCollection writes the documents of the collection in file to out, and
+// fills in the options and document count of its manifest entry.
+func backupCollection(file, out string, entry *BackupCollection) error {
+	collection, err := NewCollection(CollectionOptions{Name: file, FileMode: ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+	entry.Options = collection.GetOptions()
+	entry.Options.Name = ""
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriterSize(f, exportBufferSize)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	for _, id := range collection.GetAllIDs() {
+		doc, err := collection.GetDocument(id)
+		if err != nil {
+			return fmt.Errorf("failed to get document with id %v: %v", id, err)
+		}
+		record := backupRecord{ID: id, Vector: doc.Vector, Streams: backupStreams(collection, id)}
+		if json.Valid(doc.Metadata) {
+			record.Metadata = doc.Metadata
+		} else {
+			record.RawMetadata = doc.Metadata
+		}
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to write document with id %v: %v", id, err)
+		}
+		entry.Documents++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+/*
+RestoreDataFolder recreates the collections of a backup made by BackupDataFolder
+in the configured data folder, with their names and options, where the
+configured layout keeps them. It fails without changing anything if one of the
+collections already exists. The server should not be running.
+*/
+func RestoreDataFolder(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+
+	s := &Server{}
+	for _, entry := range manifest.Collections {
+		if _, err := os.Stat(s.collectionNameToFileName(entry.Name)); err == nil {
+			return nil, fmt.Errorf("collection %s already exists", entry.Name)
+		}
+	}
+	for _, entry := range manifest.Collections {
+		if err := restoreCollection(s, filepath.Join(dir, entry.File), entry); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", entry.Name, err)
+		}
+		logInfof("Restored %d documents of %s", entry.Documents, entry.Name)
+	}
+	return &manifest, nil
+}
+
+// restoreCollection creates a collection from its manifest entry, and adds the
+// documents in file to it.
+func restoreCollection(s *Server, file string, entry BackupCollection) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	options := entry.Options
+	options.FileMode = CreateIfNotExists
+	collection, err := s.createCollectionFile(entry.Name, options)
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+
+	decoder := json.NewDecoder(bufio.NewReaderSize(f, exportBufferSize))
+	for {
+		var record backupRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to decode document: %v", err)
+		}
+		metadata := []byte(record.Metadata)
+		if record.RawMetadata != nil {
+			metadata = record.RawMetadata
+		}
+		if err := collection.AddDocument(record.ID, record.Vector, metadata); err != nil {
+			return fmt.Errorf("failed to add document %d: %v", record.ID, err)
+		}
+		for _, stream := range record.Streams {
+			if err := collection.SetStreamWithType(record.ID, stream.ID, stream.Data, stream.ContentType); err != nil {
+				return fmt.Errorf("failed to set stream %d of document %d: %v", stream.ID, record.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
 // DumpIndex reads the specified file and displays its contents in a human-readable format.
 func DumpIndex(filename string) {
 	// Open the file
@@ -3,7 +3,10 @@ package syzgydb
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -295,3 +298,211 @@ func TestExportToFileAndImport(t *testing.T) {
 	// Close the imported collection
 	importedCollection.Close()
 }
+
+// countingWriter counts the bytes written to it and remembers the largest write.
+// If onWrite is set, it is called with each write.
+type countingWriter struct {
+	bytes    int
+	writes   int
+	maxWrite int
+	onWrite  func(p []byte)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.bytes += len(p)
+	cw.writes++
+	if len(p) > cw.maxWrite {
+		cw.maxWrite = len(p)
+	}
+	if cw.onWrite != nil {
+		cw.onWrite(p)
+	}
+	return len(p), nil
+}
+
+func TestExportJSONStreams(t *testing.T) {
+	ensureTestFolder(t)
+	options := CollectionOptions{
+		Name:           testFilePath("test_export_streams.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 8,
+		FileMode:       CreateAndOverwrite,
+	}
+	collection, err := NewCollection(options)
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+
+	const numDocs = 5000
+	vector := make([]float64, options.DimensionCount)
+	for i := 0; i < numDocs; i++ {
+		for j := range vector {
+			vector[j] = myRandom.Float64()
+		}
+		collection.AddDocument(uint64(i), vector, []byte(fmt.Sprintf(`{"name":"document %d","tags":["a","b"]}`, i)))
+	}
+
+	// At each write, count the documents that were read but not yet written
+	reads := collection.Metrics().Reads
+	written, maxHeld := 0, 0
+	cw := &countingWriter{onWrite: func(p []byte) {
+		written += bytes.Count(p, []byte(`"id": `))
+		if held := int(collection.Metrics().Reads-reads) - written; held > maxHeld {
+			maxHeld = held
+		}
+	}}
+	if err := ExportJSON(collection, cw); err != nil {
+		t.Fatalf("ExportJSON failed: %v", err)
+	}
+
+	// The output must arrive in many bounded pieces rather than all at once.
+	if cw.maxWrite > exportBufferSize {
+		t.Errorf("Largest write was %d bytes, expected at most %d", cw.maxWrite, exportBufferSize)
+	}
+	if cw.writes < cw.bytes/exportBufferSize {
+		t.Errorf("Expected at least %d writes, got %d", cw.bytes/exportBufferSize, cw.writes)
+	}
+
+	// Only the documents that fit in the buffer are held at once. Each one
+	// takes more than 100 bytes.
+	t.Logf("Exported %d bytes in %d writes, holding at most %d documents", cw.bytes, cw.writes, maxHeld)
+	if written != numDocs {
+		t.Errorf("Expected %d documents to be written, got %d", numDocs, written)
+	}
+	if maxHeld > exportBufferSize/100 {
+		t.Errorf("Expected at most %d documents to be held at once, got %d", exportBufferSize/100, maxHeld)
+	}
+}
+
+func TestBackupRestoreDataFolder(t *testing.T) {
+	saved := globalConfig
+	defer func() { globalConfig = saved }()
+	globalConfig.DataFolder = t.TempDir()
+
+	server := &Server{collections: make(map[string]*Collection)}
+	options := map[string]CollectionOptions{
+		"products": {
+			DistanceMethod: Euclidean,
+			DimensionCount: 3,
+			Quantization:   64,
+			IndexedFields:  []string{"category"},
+		},
+		"acme/notes": {
+			DistanceMethod:  Cosine,
+			DimensionCount:  2,
+			Quantization:    16,
+			SeparateVectors: true,
+			UseWAL:          true,
+		},
+	}
+	documents := map[string]map[uint64]*Document{}
+	for name, opts := range options {
+		collection, err := server.CreateCollection(name, opts)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		documents[name] = map[uint64]*Document{}
+		for i := uint64(1); i <= 20; i++ {
+			vector := make([]float64, opts.DimensionCount)
+			for j := range vector {
+				vector[j] = float64(i*uint64(j+1)%7)/7 - 0.5
+			}
+			metadata := []byte(fmt.Sprintf(`{"category":"c%d","name":"%s %d"}`, i%3, name, i))
+			if i == 5 {
+				metadata = []byte("not json")
+			}
+			if err := collection.AddDocument(i, vector, metadata); err != nil {
+				t.Fatalf("Failed to add document: %v", err)
+			}
+			if i%4 == 0 {
+				if err := collection.SetStreamWithType(i, MinCustomStreamID, []byte(fmt.Sprintf("image %d", i)), "image/png"); err != nil {
+					t.Fatalf("Failed to set stream: %v", err)
+				}
+				if err := collection.SetStream(i, MinCustomStreamID+1, []byte{0, 1, 2}); err != nil {
+					t.Fatalf("Failed to set stream: %v", err)
+				}
+			}
+			doc, _ := collection.GetDocument(i)
+			doc.Metadata = bytes.Clone(doc.Metadata)
+			documents[name][i] = doc
+		}
+		collection.Close()
+	}
+
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	manifest, err := BackupDataFolder(backupDir)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if len(manifest.Collections) != 2 {
+		t.Fatalf("Expected 2 collections in the manifest, got %+v", manifest.Collections)
+	}
+	for _, entry := range manifest.Collections {
+		if entry.Documents != 20 {
+			t.Errorf("%s: expected 20 documents in the manifest, got %d", entry.Name, entry.Documents)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, "manifest.json")); err != nil {
+		t.Errorf("Expected a manifest file: %v", err)
+	}
+
+	globalConfig.DataFolder = t.TempDir()
+	if _, err := RestoreDataFolder(backupDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored := &Server{collections: make(map[string]*Collection)}
+	if err := restored.loadCollections(); err != nil {
+		t.Fatalf("Failed to load restored collections: %v", err)
+	}
+	if len(restored.collections) != 2 {
+		t.Fatalf("Expected 2 restored collections, got %d", len(restored.collections))
+	}
+	for name, opts := range options {
+		collection := restored.collections[name]
+		if collection == nil {
+			t.Fatalf("Collection %s was not restored", name)
+		}
+		defer collection.Close()
+
+		got := collection.GetOptions()
+		got.Name = ""
+		got.FileMode = 0
+		if !reflect.DeepEqual(got, opts) {
+			t.Errorf("%s: expected options %+v, got %+v", name, opts, got)
+		}
+		if count := collection.GetDocumentCount(); count != 20 {
+			t.Errorf("%s: expected 20 documents, got %d", name, count)
+		}
+		for id, want := range documents[name] {
+			doc, err := collection.GetDocument(id)
+			if err != nil {
+				t.Errorf("%s: failed to get document %d: %v", name, id, err)
+				continue
+			}
+			if !aboutEqual(doc.Vector, want.Vector) || !bytes.Equal(doc.Metadata, want.Metadata) {
+				t.Errorf("%s: document %d is %v %s, expected %v %s", name, id, doc.Vector, doc.Metadata, want.Vector, want.Metadata)
+			}
+
+			// The data streams are restored with their content types
+			data, contentType, err := collection.GetStreamWithType(id, MinCustomStreamID)
+			if id%4 != 0 {
+				if !errors.Is(err, ErrStreamNotFound) {
+					t.Errorf("%s: expected no stream on document %d, got %q (%v)", name, id, data, err)
+				}
+				continue
+			}
+			if string(data) != fmt.Sprintf("image %d", id) || contentType != "image/png" || err != nil {
+				t.Errorf("%s: document %d has stream %q of type %q (%v)", name, id, data, contentType, err)
+			}
+			data, contentType, err = collection.GetStreamWithType(id, MinCustomStreamID+1)
+			if !bytes.Equal(data, []byte{0, 1, 2}) || contentType != "" || err != nil {
+				t.Errorf("%s: document %d has stream %v of type %q (%v)", name, id, data, contentType, err)
+			}
+		}
+	}
+
+	if _, err := RestoreDataFolder(backupDir); err == nil {
+		t.Errorf("Expected an error restoring over existing collections")
+	}
+}
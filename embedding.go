@@ -5,17 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
-const maxCacheSize = 100
+// defaultEmbeddingCacheSize is the number of search texts whose embeddings are
+// cached when Config.EmbeddingCacheSize is not set.
+const defaultEmbeddingCacheSize = 100
 
 var (
-	embeddingCache = newLRUCache(maxCacheSize)
-	cacheMutex     sync.RWMutex
+	embeddingCache *lruCache[[]float64]
+	cacheMutex     sync.Mutex
 )
 
 type EmbedTextFunc func(text []string, useCache bool) ([][]float64, error)
@@ -23,30 +25,93 @@ type EmbedTextFunc func(text []string, useCache bool) ([][]float64, error)
 // Default implementation of the embedding function
 var embedText EmbedTextFunc = EmbedText
 
+// fetchEmbeddings makes a single request to the embedding service. It is a
+// variable so that tests can simulate the service.
+var fetchEmbeddings = fetchOllamaEmbeddings
+
+// getEmbeddingCache returns the embedding cache, creating it again if the
+// configured size or lifetime has changed.
+func getEmbeddingCache() *lruCache[[]float64] {
+	size := globalConfig.EmbeddingCacheSize
+	if size <= 0 {
+		size = defaultEmbeddingCacheSize
+	}
+	ttl := globalConfig.EmbeddingCacheTTL
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if embeddingCache == nil || embeddingCache.capacity != size || embeddingCache.ttl != ttl {
+		embeddingCache = newLRUCache[[]float64](size, ttl)
+	}
+	return embeddingCache
+}
+
 // EmbedText connects to the configured Ollama server and runs the configured text model
-// to generate an embedding for the given text.
+// to generate an embedding for the given text. Failed requests are retried
+// Config.EmbeddingRetries times, doubling the delay between attempts each time.
 func EmbedText(texts []string, useCache bool) ([][]float64, error) {
+	cache := getEmbeddingCache()
+
 	// Check the cache first if useCache is true
 	if useCache {
 		cachedEmbeddings := make([][]float64, len(texts))
 		allCached := true
 
-		cacheMutex.RLock()
 		for i, text := range texts {
-			if embedding, found := embeddingCache.get(text); found {
+			if embedding, found := cache.get(text); found {
 				cachedEmbeddings[i] = embedding
 			} else {
 				allCached = false
 				break
 			}
 		}
-		cacheMutex.RUnlock()
 
 		if allCached {
 			return cachedEmbeddings, nil
 		}
 	}
 
+	var embeddings [][]float64
+	var err error
+	delay := globalConfig.EmbeddingRetryDelay
+	for attempt := 0; ; attempt++ {
+		embeddings, err = fetchEmbeddings(texts)
+		if err == nil || attempt >= globalConfig.EmbeddingRetries {
+			break
+		}
+		logWarnf("Embedding request failed (attempt %d), retrying in %v: %v", attempt+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if embeddings are present
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings in response, got %d", len(texts), len(embeddings))
+	}
+
+	if want := globalConfig.EmbeddingDimensions; want > 0 {
+		for _, embedding := range embeddings {
+			if len(embedding) != want {
+				return nil, fmt.Errorf("model %s returned %d dimensions, expected %d", globalConfig.TextModel, len(embedding), want)
+			}
+		}
+	}
+
+	// Store the new embeddings in the cache if useCache is true
+	if useCache {
+		for i, text := range texts {
+			cache.put(text, embeddings[i])
+		}
+	}
+
+	return embeddings, nil
+}
+
+// fetchOllamaEmbeddings asks the Ollama server for the embeddings of the texts.
+func fetchOllamaEmbeddings(texts []string) ([][]float64, error) {
 	// Prepare the request payload
 	payload := map[string]interface{}{
 		"model": globalConfig.TextModel,
@@ -63,7 +128,7 @@ func EmbedText(texts []string, useCache bool) ([][]float64, error) {
 		url = "http://" + url
 	}
 	url = fmt.Sprintf("%s/api/embed", url)
-	log.Printf("Sending to %v %v", url, payload)
+	logDebugf("Sending to %v %v", url, payload)
 
 	// Make the HTTP request
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payloadBytes))
@@ -86,19 +151,5 @@ func EmbedText(texts []string, useCache bool) ([][]float64, error) {
 		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
-	// Check if embeddings are present
-	if len(response.Embeddings) == 0 {
-		return nil, fmt.Errorf("no embeddings found in response")
-	}
-
-	// Store the new embeddings in the cache if useCache is true
-	if useCache {
-		cacheMutex.Lock()
-		for i, text := range texts {
-			embeddingCache.put(text, response.Embeddings[i])
-		}
-		cacheMutex.Unlock()
-	}
-
 	return response.Embeddings, nil
 }
@@ -3,43 +3,62 @@ package syzgydb
 import (
 	"container/list"
 	"sync"
+	"time"
 )
 
-type cacheItem struct {
-	key   string
-	value []float64
+type cacheItem[V any] struct {
+	key     string
+	value   V
+	expires time.Time
 }
 
-type lruCache struct {
+// lruCache holds up to capacity values, evicting the least recently used one
+// when it is full.
+type lruCache[V any] struct {
 	mutex    sync.Mutex
 	capacity int
+	ttl      time.Duration // zero means items never expire
 	items    map[string]*list.Element
 	order    *list.List
 }
 
-func newLRUCache(capacity int) *lruCache {
-	return &lruCache{
+func newLRUCache[V any](capacity int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
 		capacity: capacity,
+		ttl:      ttl,
 		items:    make(map[string]*list.Element),
 		order:    list.New(),
 	}
 }
 
-func (c *lruCache) get(key string) ([]float64, bool) {
+func (c *lruCache[V]) get(key string) (V, bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	if element, found := c.items[key]; found {
+		item := element.Value.(*cacheItem[V])
+		if c.ttl > 0 && time.Now().After(item.expires) {
+			c.order.Remove(element)
+			delete(c.items, key)
+			var zero V
+			return zero, false
+		}
 		c.order.MoveToFront(element)
-		return element.Value.(*cacheItem).value, true
+		return item.value, true
 	}
-	return nil, false
+	var zero V
+	return zero, false
 }
 
-func (c *lruCache) put(key string, value []float64) {
+func (c *lruCache[V]) put(key string, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expires := time.Now().Add(c.ttl)
 	if element, found := c.items[key]; found {
 		c.order.MoveToFront(element)
-		element.Value.(*cacheItem).value = value
+		element.Value.(*cacheItem[V]).value = value
+		element.Value.(*cacheItem[V]).expires = expires
 		return
 	}
 
@@ -47,11 +66,11 @@ func (c *lruCache) put(key string, value []float64) {
 		oldest := c.order.Back()
 		if oldest != nil {
 			c.order.Remove(oldest)
-			delete(c.items, oldest.Value.(*cacheItem).key)
+			delete(c.items, oldest.Value.(*cacheItem[V]).key)
 		}
 	}
 
-	item := &cacheItem{key: key, value: value}
+	item := &cacheItem[V]{key: key, value: value, expires: expires}
 	element := c.order.PushFront(item)
 	c.items[key] = element
 }
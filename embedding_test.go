@@ -0,0 +1,79 @@
+package syzgydb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// setupEmbeddingTest replaces the embedding service with fetch and returns a
+// function that restores the original configuration.
+func setupEmbeddingTest(fetch func(texts []string) ([][]float64, error)) func() {
+	savedConfig := globalConfig
+	savedFetch := fetchEmbeddings
+	fetchEmbeddings = fetch
+	embeddingCache = nil
+	return func() {
+		globalConfig = savedConfig
+		fetchEmbeddings = savedFetch
+		embeddingCache = nil
+	}
+}
+
+func TestEmbedTextRetries(t *testing.T) {
+	calls := 0
+	defer setupEmbeddingTest(func(texts []string) ([][]float64, error) {
+		calls++
+		if calls == 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return [][]float64{{1, 2, 3}}, nil
+	})()
+	globalConfig.EmbeddingRetries = 1
+	globalConfig.EmbeddingRetryDelay = time.Millisecond
+
+	embeddings, err := EmbedText([]string{"hello"}, false)
+	if err != nil {
+		t.Fatalf("EmbedText failed: %v", err)
+	}
+	if calls != 2 || len(embeddings) != 1 {
+		t.Errorf("Expected success on the second attempt, got %d calls and %v", calls, embeddings)
+	}
+
+	// Without retries the first failure is returned.
+	calls = 0
+	globalConfig.EmbeddingRetries = 0
+	if _, err := EmbedText([]string{"hello"}, false); err == nil {
+		t.Errorf("Expected an error when retries are disabled")
+	}
+}
+
+func TestEmbedTextCache(t *testing.T) {
+	calls := 0
+	defer setupEmbeddingTest(func(texts []string) ([][]float64, error) {
+		calls++
+		return [][]float64{{float64(calls)}}, nil
+	})()
+
+	first, err := EmbedText([]string{"query"}, true)
+	if err != nil {
+		t.Fatalf("EmbedText failed: %v", err)
+	}
+	second, err := EmbedText([]string{"query"}, true)
+	if err != nil {
+		t.Fatalf("EmbedText failed: %v", err)
+	}
+	if calls != 1 || second[0][0] != first[0][0] {
+		t.Errorf("Expected the second lookup to be cached, got %d calls", calls)
+	}
+
+	// Expired entries are fetched again.
+	globalConfig.EmbeddingCacheTTL = time.Millisecond
+	EmbedText([]string{"query"}, true)
+	calls = 0
+	time.Sleep(5 * time.Millisecond)
+	EmbedText([]string{"query"}, true)
+	if calls != 1 {
+		t.Errorf("Expected an expired entry to be fetched again, got %d calls", calls)
+	}
+}
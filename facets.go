@@ -0,0 +1,53 @@
+package syzgydb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/smhanov/syzgydb/query"
+)
+
+/*
+countFacets counts the values of each facet field among the metadata of the
+results. A field may name a nested field with dots, as in "user.country". String,
+number and boolean values are counted by their text, and each such element of an
+array is counted separately, so a "tags" field counts every tag. Results whose
+metadata isn't a JSON object, or lacks the field, are not counted.
+*/
+func countFacets(results []SearchResult, fields []string) map[string]map[string]int {
+	facets := make(map[string]map[string]int, len(fields))
+	for _, field := range fields {
+		facets[field] = make(map[string]int)
+	}
+	for _, result := range results {
+		metadata, err := resultMetadata(result)
+		if err != nil {
+			continue
+		}
+		for _, field := range fields {
+			value, err := query.GetField(metadata, strings.Split(field, "."))
+			if err != nil || value == nil {
+				continue
+			}
+			if values, isArray := value.([]interface{}); isArray {
+				for _, v := range values {
+					countFacetValue(facets[field], v)
+				}
+			} else {
+				countFacetValue(facets[field], value)
+			}
+		}
+	}
+	return facets
+}
+
+func countFacetValue(counts map[string]int, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		counts[v]++
+	case float64:
+		counts[strconv.FormatFloat(v, 'f', -1, 64)]++
+	case bool:
+		counts[strconv.FormatBool(v)]++
+	}
+}
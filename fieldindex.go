@@ -0,0 +1,111 @@
+package syzgydb
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+/*
+fieldIndex maps the values of a collection's IndexedFields to the IDs of the
+documents that have them, so that a search filtered on those values only needs
+to read the matching documents. Only top-level string, number and boolean values
+are indexed. The collection's mutex protects it.
+*/
+type fieldIndex struct {
+	// values maps each indexed field to its values, and each value to the
+	// documents that have it.
+	values map[string]map[interface{}]map[uint64]struct{}
+
+	// docs holds the indexed values of each document, so that they can be
+	// removed when the document is changed or removed.
+	docs map[uint64][]indexedValue
+}
+
+type indexedValue struct {
+	field string
+	value interface{}
+}
+
+func newFieldIndex(fields []string) *fieldIndex {
+	fi := &fieldIndex{
+		values: make(map[string]map[interface{}]map[uint64]struct{}),
+		docs:   make(map[uint64][]indexedValue),
+	}
+	for _, field := range fields {
+		fi.values[field] = make(map[interface{}]map[uint64]struct{})
+	}
+	return fi
+}
+
+// add indexes the metadata of a document, replacing any values indexed for it
+// before. Metadata that is not a JSON object has nothing to index.
+func (fi *fieldIndex) add(id uint64, metadata []byte) {
+	fi.remove(id)
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(metadata, &parsed); err != nil {
+		return
+	}
+	for field, values := range fi.values {
+		value := parsed[field]
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			continue
+		}
+		ids := values[value]
+		if ids == nil {
+			ids = make(map[uint64]struct{})
+			values[value] = ids
+		}
+		ids[id] = struct{}{}
+		fi.docs[id] = append(fi.docs[id], indexedValue{field, value})
+	}
+}
+
+// remove removes a document from the index.
+func (fi *fieldIndex) remove(id uint64) {
+	for _, iv := range fi.docs[id] {
+		ids := fi.values[iv.field][iv.value]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(fi.values[iv.field], iv.value)
+		}
+	}
+	delete(fi.docs, id)
+}
+
+// candidates returns the sorted IDs of the documents that meet every condition
+// on an indexed field. It returns false if none of the conditions are on an
+// indexed field, in which case any document could match.
+func (fi *fieldIndex) candidates(conditions map[string]interface{}) ([]uint64, bool) {
+	var smallest map[uint64]struct{}
+	var sets []map[uint64]struct{}
+	for field, value := range conditions {
+		values, ok := fi.values[field]
+		if !ok {
+			continue
+		}
+		ids := values[value]
+		if len(sets) == 0 || len(ids) < len(smallest) {
+			smallest = ids
+		}
+		sets = append(sets, ids)
+	}
+	if len(sets) == 0 {
+		return nil, false
+	}
+
+	result := []uint64{}
+next:
+	for id := range smallest {
+		for _, ids := range sets {
+			if _, ok := ids[id]; !ok {
+				continue next
+			}
+		}
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, true
+}
@@ -89,6 +89,17 @@ func (fm *freeMap) markFree(start, length int) {
 	fm.freeSpaces = merged
 }
 
+// freeLengthAt returns the length of the free space that begins at start, or 0
+// if start is not the beginning of a free space.
+func (fm *freeMap) freeLengthAt(start int) int {
+	for _, s := range fm.freeSpaces {
+		if s.start == start {
+			return s.length
+		}
+	}
+	return 0
+}
+
 // getFreeRange finds a free range of the specified length and marks it as used.
 func (fm *freeMap) getFreeRange(length int) (int64, int64, error) {
 	if verboseFreeMap {
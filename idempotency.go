@@ -0,0 +1,166 @@
+package syzgydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The number of idempotency keys remembered, and for how long, when
+// Config.IdempotencyCacheSize and Config.IdempotencyTTL are not set.
+const (
+	defaultIdempotencyCacheSize = 10000
+	defaultIdempotencyTTL       = 24 * time.Hour
+)
+
+// idempotentResponse is a response remembered for an Idempotency-Key, so that
+// it can be sent again when the request is retried.
+type idempotentResponse struct {
+	status      int
+	contentType string
+	body        []byte
+
+	// request is the hash of the request that the response is for, so that
+	// a key reused for another request can be rejected.
+	request [sha256.Size]byte
+}
+
+// pendingRequest is a request with an Idempotency-Key that is being handled.
+// Retries with the same key wait until done is closed.
+type pendingRequest struct {
+	request [sha256.Size]byte
+	done    chan struct{}
+}
+
+var (
+	idempotencyCache *lruCache[idempotentResponse]
+	idempotencyMutex sync.Mutex
+
+	// idempotencyPending holds the requests being handled, by cache key. The
+	// idempotencyMutex protects it.
+	idempotencyPending = make(map[string]*pendingRequest)
+)
+
+// getIdempotencyCache returns the cache of responses by idempotency key,
+// creating it again if the configured size or lifetime has changed.
+func getIdempotencyCache() *lruCache[idempotentResponse] {
+	size := globalConfig.IdempotencyCacheSize
+	if size <= 0 {
+		size = defaultIdempotencyCacheSize
+	}
+	ttl := globalConfig.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	if idempotencyCache == nil || idempotencyCache.capacity != size || idempotencyCache.ttl != ttl {
+		idempotencyCache = newLRUCache[idempotentResponse](size, ttl)
+	}
+	return idempotencyCache
+}
+
+// recordingResponseWriter passes a response through to the client while
+// keeping a copy of it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+/*
+withIdempotencyKey runs handler, unless the request has an Idempotency-Key
+header that was seen before with the same scope, in which case the response to
+that request is sent again. Only successful responses are remembered, so that
+failed requests can be retried with the same key. A retry that arrives while the
+first request is still being handled waits for it to finish. A key reused with a
+different method, path or body is rejected with 422 Unprocessable Entity.
+*/
+func withIdempotencyKey(w http.ResponseWriter, r *http.Request, scope string, handler func(http.ResponseWriter)) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		handler(w)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + "\x00" + r.URL.Path + "\x00"))
+	hash.Write(body)
+	var request [sha256.Size]byte
+	hash.Sum(request[:0])
+
+	cacheKey := scope + "\x00" + key
+	cache := getIdempotencyCache()
+	var pending *pendingRequest
+	for {
+		idempotencyMutex.Lock()
+		response, cached := cache.get(cacheKey)
+		waitFor := idempotencyPending[cacheKey]
+		if !cached && waitFor == nil {
+			pending = &pendingRequest{request: request, done: make(chan struct{})}
+			idempotencyPending[cacheKey] = pending
+		}
+		idempotencyMutex.Unlock()
+
+		if cached {
+			if response.request != request {
+				writeErrorResponse(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if response.contentType != "" {
+				w.Header().Set("Content-Type", response.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(response.status)
+			w.Write(response.body)
+			return
+		}
+		if waitFor == nil {
+			break
+		}
+		if waitFor.request != request {
+			writeErrorResponse(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		<-waitFor.done
+	}
+
+	recorder := &recordingResponseWriter{ResponseWriter: w}
+	defer func() {
+		idempotencyMutex.Lock()
+		if recorder.status >= 200 && recorder.status < 300 {
+			cache.put(cacheKey, idempotentResponse{
+				status:      recorder.status,
+				contentType: w.Header().Get("Content-Type"),
+				body:        recorder.body.Bytes(),
+				request:     request,
+			})
+		}
+		delete(idempotencyPending, cacheKey)
+		idempotencyMutex.Unlock()
+		close(pending.done)
+	}()
+	handler(recorder)
+}
@@ -0,0 +1,102 @@
+package syzgydb
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of buckets of a latencyHistogram, enough for
+// durations of over an hour.
+const latencyBuckets = 128
+
+/*
+latencyHistogram counts durations in buckets that grow exponentially, with four
+buckets for each power of two microseconds, so percentiles are accurate to
+within about 25% however long the durations are. Recording a duration doesn't
+allocate or lock, so it can be updated by many requests at once.
+*/
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Uint64
+}
+
+// latencyBucket returns the bucket that counts a duration.
+func latencyBucket(d time.Duration) int {
+	us := uint64(max(d, 0) / time.Microsecond)
+	if us < 4 {
+		return int(us)
+	}
+	exp := bits.Len64(us) - 1
+	sub := int(us>>(exp-2)) & 3
+	return min(4*(exp-1)+sub, latencyBuckets-1)
+}
+
+// latencyBucketLimit returns the end of the range of durations counted by a
+// bucket.
+func latencyBucketLimit(bucket int) time.Duration {
+	if bucket < 4 {
+		return time.Duration(bucket+1) * time.Microsecond
+	}
+	exp := bucket/4 + 1
+	sub := bucket % 4
+	return time.Duration(uint64(5+sub)<<(exp-2)) * time.Microsecond
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.buckets[latencyBucket(d)].Add(1)
+}
+
+// count returns the number of durations recorded.
+func (h *latencyHistogram) count() uint64 {
+	var total uint64
+	for i := range h.buckets {
+		total += h.buckets[i].Load()
+	}
+	return total
+}
+
+// percentile returns the duration that the fraction p of the recorded
+// durations don't exceed, rounded up to the end of its bucket. It returns 0 if
+// nothing has been recorded.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(p*float64(total) + 0.5)
+	target = min(max(target, 1), total)
+	var seen uint64
+	for i, count := range counts {
+		seen += count
+		if seen >= target {
+			return latencyBucketLimit(i)
+		}
+	}
+	return latencyBucketLimit(latencyBuckets - 1)
+}
+
+// latencySummary is the JSON form of a latencyHistogram, in milliseconds.
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+func (h *latencyHistogram) summary() latencySummary {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return latencySummary{
+		Count: h.count(),
+		P50:   ms(h.percentile(0.5)),
+		P90:   ms(h.percentile(0.9)),
+		P99:   ms(h.percentile(0.99)),
+	}
+}
@@ -0,0 +1,61 @@
+package syzgydb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the least severe level of the messages that are logged.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota // details of each request and search
+	LogInfo                  // changes to collections and the server
+	LogWarn                  // problems that don't stop an operation
+	LogError                 // operations that failed
+)
+
+// logLevel holds the current LogLevel, so it can be read without a lock.
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LogInfo))
+}
+
+/*
+ParseLogLevel returns the LogLevel named by "debug", "info", "warn" or "error".
+An empty name means LogInfo.
+*/
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogDebug, nil
+	case "", "info":
+		return LogInfo, nil
+	case "warn", "warning":
+		return LogWarn, nil
+	case "error":
+		return LogError, nil
+	}
+	return LogInfo, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", name)
+}
+
+// SetLogLevel sets the least severe level of the messages that are logged. It
+// is also set from Config.LogLevel by Configure.
+func SetLogLevel(level LogLevel) {
+	logLevel.Store(int32(level))
+}
+
+// logf logs a message with log.Printf if its level is not below the current one.
+func logf(level LogLevel, format string, v ...interface{}) {
+	if level >= LogLevel(logLevel.Load()) {
+		log.Printf(format, v...)
+	}
+}
+
+func logDebugf(format string, v ...interface{}) { logf(LogDebug, format, v...) }
+func logInfof(format string, v ...interface{})  { logf(LogInfo, format, v...) }
+func logWarnf(format string, v ...interface{})  { logf(LogWarn, format, v...) }
+func logErrorf(format string, v ...interface{}) { logf(LogError, format, v...) }
@@ -2,8 +2,11 @@ package syzgydb
 
 import (
 	"container/heap"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"math"
+	"sort"
 	"sync"
 )
 
@@ -67,6 +70,12 @@ func distanceToHyperplane(method int, vector []float64, length float64, normal [
 		return
 	}
 
+	// A zero vector has no angle to the hyperplane; keep it on the left side
+	// rather than dividing by zero.
+	if length == 0 {
+		return 0, false
+	}
+
 	// angular distance of two already-normalized vectors
 	dist = math.Acos(dist/length) / math.Pi
 	if dist > 0.5 {
@@ -81,8 +90,8 @@ type lshTree struct {
 	threshold int
 	c         *Collection
 
-	// random source
-	rand *myRandomType
+	// random source of each tree, since the trees are updated in parallel
+	rands []*myRandomType
 }
 
 func newLSHTree(c *Collection, threshold int, numTrees int) *lshTree {
@@ -90,11 +99,55 @@ func newLSHTree(c *Collection, threshold int, numTrees int) *lshTree {
 	for i := 0; i < numTrees; i++ {
 		roots[i] = &lshNode{ids: []uint64{}}
 	}
+	source := myRandom
+	if c.LSHSeed != 0 {
+		source = newSeededRandom(c.LSHSeed)
+	}
+	rands := make([]*myRandomType, numTrees)
+	for i := range rands {
+		rands[i] = source.ThreadsafeNew()
+	}
 	return &lshTree{
 		roots:     roots,
 		threshold: threshold,
 		c:         c,
-		rand:      myRandom.ThreadsafeNew(),
+		rands:     rands,
+	}
+}
+
+// maxPresplitDepth limits the number of levels built by presplit.
+const maxPresplitDepth = 16
+
+/*
+presplit builds the upper levels of each empty tree in advance for the expected
+number of documents, so that they are not split one by one as documents are
+added. Splits of cosine trees use random hyperplanes through the origin, which
+don't depend on the documents, so only cosine trees are presplit; euclidean
+splits need the documents in the node and are left to grow as usual.
+*/
+func (tree *lshTree) presplit(expectedDocuments int) {
+	if tree.c.DistanceMethod != Cosine || tree.c.DimensionCount == 0 || tree.threshold <= 0 {
+		return
+	}
+	depth := 0
+	for leaves := expectedDocuments / tree.threshold; leaves > 1 && depth < maxPresplitDepth; leaves /= 2 {
+		depth++
+	}
+	for i, root := range tree.roots {
+		if root.isLeaf() && len(root.ids) == 0 {
+			tree.roots[i] = tree.presplitNode(tree.rands[i], depth)
+		}
+	}
+}
+
+func (tree *lshTree) presplitNode(rand *myRandomType, depth int) *lshNode {
+	if depth == 0 {
+		return &lshNode{ids: make([]uint64, 0, tree.threshold+1)}
+	}
+	return &lshNode{
+		normal: randomNormalizedVector(rand, tree.c.DimensionCount),
+		left:   tree.presplitNode(rand, depth-1),
+		right:  tree.presplitNode(rand, depth-1),
 	}
 }
 
@@ -105,7 +158,7 @@ func (tree *lshTree) addPoint(docid uint64, vector []float64) {
 
 	for i, root := range tree.roots {
 		go func(i int, root *lshNode) {
-			tree.roots[i] = tree.insert(root, docid, vector, length)
+			tree.roots[i] = tree.insert(tree.rands[i], root, docid, vector, length)
 			wg.Done()
 		}(i, root)
 	}
@@ -113,11 +166,11 @@ func (tree *lshTree) addPoint(docid uint64, vector []float64) {
 	wg.Wait()
 }
 
-func (tree *lshTree) insert(node *lshNode, docid uint64, vector []float64, length float64) *lshNode {
+func (tree *lshTree) insert(rand *myRandomType, node *lshNode, docid uint64, vector []float64, length float64) *lshNode {
 	if node.isLeaf() {
 		node.ids = append(node.ids, docid)
 		if len(node.ids) > tree.threshold {
-			node = tree.split(node)
+			node = tree.split(rand, node)
 		}
 		return node
 	}
@@ -125,9 +178,9 @@ func (tree *lshTree) insert(node *lshNode, docid uint64, vector []float64, lengt
 	distance, right := distanceToHyperplane(tree.c.DistanceMethod, vector, length, node.normal, node.b)
 	node.radius = math.Max(node.radius, distance)
 	if !right {
-		node.left = tree.insert(node.left, docid, vector, length)
+		node.left = tree.insert(rand, node.left, docid, vector, length)
 	} else {
-		node.right = tree.insert(node.right, docid, vector, length)
+		node.right = tree.insert(rand, node.right, docid, vector, length)
 	}
 
 	return node
@@ -169,11 +222,11 @@ func aboutEqual(vector1, vector2 []float64) bool {
 	return true
 }
 
-func (tree *lshTree) split(node *lshNode) *lshNode {
-	randomIndex1 := tree.rand.Intn(len(node.ids))
+func (tree *lshTree) split(rand *myRandomType, node *lshNode) *lshNode {
+	randomIndex1 := rand.Intn(len(node.ids))
 	var randomIndex2 int
 	for {
-		randomIndex2 = tree.rand.Intn(len(node.ids))
+		randomIndex2 = rand.Intn(len(node.ids))
 		if randomIndex2 != randomIndex1 {
 			break
 		}
@@ -203,11 +256,11 @@ func (tree *lshTree) split(node *lshNode) *lshNode {
 	var b float64
 
 	if tree.c.DistanceMethod == Euclidean {
-		normal = randomNormalizedVector(tree.rand, len(pointChosen))
+		normal = randomNormalizedVector(rand, len(pointChosen))
 		b = math.Sqrt(dotProduct(pointChosen, pointChosen))
 	} else {
 		//normal = normalizeVector(pointChosen)
-		normal = randomNormalizedVector(tree.rand, len(pointChosen))
+		normal = randomNormalizedVector(rand, len(pointChosen))
 	}
 
 	leftIDs := []uint64{}
@@ -247,10 +300,84 @@ func (tree *lshTree) split(node *lshNode) *lshNode {
 	}
 }
 
+// countIDs adds one to counts for each tree that has a document ID in its
+// leaves. A replaced document can be in a tree more than once, since the trees
+// keep its old position, but it is only counted once.
+func (tree *lshTree) countIDs(counts map[uint64]int) {
+	// seen holds the number of the last tree each ID was counted in
+	seen := make(map[uint64]int)
+	var walk func(tree int, node *lshNode)
+	walk = func(tree int, node *lshNode) {
+		if node.isLeaf() {
+			for _, id := range node.ids {
+				if seen[id] != tree {
+					seen[id] = tree
+					counts[id]++
+				}
+			}
+			return
+		}
+		walk(tree, node.left)
+		walk(tree, node.right)
+	}
+	for i, root := range tree.roots {
+		walk(i+1, root)
+	}
+}
+
+// stats walks the trees to describe their shape for IndexStats.
+func (tree *lshTree) stats() IndexStats {
+	stats := IndexStats{Trees: len(tree.roots), LeafSize: tree.threshold}
+	var sizes []int
+	totalDepth := 0
+	var walk func(node *lshNode, depth int)
+	walk = func(node *lshNode, depth int) {
+		if node.isLeaf() {
+			sizes = append(sizes, len(node.ids))
+			totalDepth += depth
+			stats.MaxDepth = max(stats.MaxDepth, depth)
+			if len(node.ids) == 0 {
+				stats.EmptyLeaves++
+			} else if len(node.ids) > tree.threshold {
+				stats.OversizedLeaves++
+			}
+			return
+		}
+		walk(node.left, depth+1)
+		walk(node.right, depth+1)
+	}
+	for _, root := range tree.roots {
+		walk(root, 0)
+	}
+
+	stats.Leaves = len(sizes)
+	if len(sizes) == 0 {
+		return stats
+	}
+	sort.Ints(sizes)
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	stats.AverageDepth = float64(totalDepth) / float64(len(sizes))
+	stats.AverageLeafDocuments = float64(total) / float64(len(sizes))
+	stats.MedianLeafDocuments = sizes[len(sizes)/2]
+	stats.P90LeafDocuments = sizes[len(sizes)*9/10]
+	stats.MaxLeafDocuments = sizes[len(sizes)-1]
+	if stats.AverageLeafDocuments > 0 {
+		stats.Skew = float64(stats.MaxLeafDocuments) / stats.AverageLeafDocuments
+	}
+	return stats
+}
+
 func (tree *lshTree) removePoint(docid uint64, vector []float64) {
 	length := vectorLength(vector)
 	for i, root := range tree.roots {
 		tree.roots[i] = tree.remove(root, docid, vector, length)
+		if tree.roots[i] == nil {
+			// The tree is empty
+			tree.roots[i] = &lshNode{ids: []uint64{}}
+		}
 	}
 }
 
@@ -277,23 +404,35 @@ func (tree *lshTree) remove(node *lshNode, docid uint64, vector []float64, lengt
 	} else {
 		node.right = tree.remove(node.right, docid, vector, length)
 	}
+
+	// If one side is now empty, the other side takes the place of this node
+	if node.left == nil {
+		return node.right
+	}
+	if node.right == nil {
+		return node.left
+	}
 	return node
 }
 
-func (tree *lshTree) search(vector []float64, radius float64, callback searchCallback) {
+func (tree *lshTree) search(vector []float64, radius float64, callback searchCallback, trace *SearchExplanation) {
 	length := vectorLength(vector)
 	visited := make(map[uint64]bool)
 	const search_k = 200 // how many points do we search beyond what is required in hopes of finding a better result.
 	k_counter := 0       // number of times we visited a point and it didn't yield any better results.
 	pointAccepted := false
 
+	if trace != nil {
+		defer func() { trace.FinalRadius = radius }()
+	}
+
 	// Initialize the priority queue
 	pq := &nodePriorityQueue{}
 	heap.Init(pq)
 
 	// Add all roots to the priority queue
-	for _, root := range tree.roots {
-		heap.Push(pq, &nodePriorityItem{node: root, priority: 0})
+	for i, root := range tree.roots {
+		heap.Push(pq, &nodePriorityItem{node: root, priority: 0, tree: i})
 	}
 
 	for pq.Len() > 0 {
@@ -305,11 +444,26 @@ func (tree *lshTree) search(vector []float64, radius float64, callback searchCal
 			// This is the "other" side of the hyperplane.
 			// We can stop searching because the distance to the hyperplane is greater than the radius
 			//log.Printf("Early stopping; %v > %v", -item.priority, radius)
+			if trace != nil {
+				trace.NodesPruned++
+			}
 			continue
 		}
 
 		if k_counter >= search_k {
-			break
+			if trace != nil {
+				trace.StopReason = "no better results found"
+			}
+			return
+		}
+
+		if trace != nil {
+			trace.Nodes = append(trace.Nodes, ExplainedNode{
+				Tree:     item.tree,
+				Depth:    item.depth,
+				Leaf:     node.isLeaf(),
+				Priority: item.priority,
+			})
 		}
 
 		if node.isLeaf() {
@@ -318,10 +472,17 @@ func (tree *lshTree) search(vector []float64, radius float64, callback searchCal
 					continue
 				}
 				visited[id] = true
+				if trace != nil {
+					trace.Nodes[len(trace.Nodes)-1].Candidates++
+					trace.Candidates++
+				}
 				var signal int
 				signal, radius = callback(id, radius)
 				switch signal {
 				case StopSearch:
+					if trace != nil {
+						trace.StopReason = "stopped by search"
+					}
 					return
 				case PointAccepted:
 					k_counter = 0
@@ -339,20 +500,28 @@ func (tree *lshTree) search(vector []float64, radius float64, callback searchCal
 			dist, right := distanceToHyperplane(tree.c.DistanceMethod, vector, length, node.normal, node.b)
 
 			// Add child nodes to the priority queue
+			depth := item.depth + 1
 			if right {
-				heap.Push(pq, &nodePriorityItem{node: node.right, priority: dist})
-				heap.Push(pq, &nodePriorityItem{node: node.left, priority: -dist})
+				heap.Push(pq, &nodePriorityItem{node: node.right, priority: dist, tree: item.tree, depth: depth})
+				heap.Push(pq, &nodePriorityItem{node: node.left, priority: -dist, tree: item.tree, depth: depth})
 			} else {
-				heap.Push(pq, &nodePriorityItem{node: node.left, priority: dist})
-				heap.Push(pq, &nodePriorityItem{node: node.right, priority: -dist})
+				heap.Push(pq, &nodePriorityItem{node: node.left, priority: dist, tree: item.tree, depth: depth})
+				heap.Push(pq, &nodePriorityItem{node: node.right, priority: -dist, tree: item.tree, depth: depth})
 			}
 		}
 	}
+
+	if trace != nil {
+		trace.StopReason = "all nodes visited"
+	}
 }
 
 type nodePriorityItem struct {
 	node     *lshNode
 	priority float64
+
+	// tree and depth locate the node, for search explanations
+	tree, depth int
 }
 
 type nodePriorityQueue []*nodePriorityItem
@@ -379,3 +548,129 @@ func (pq *nodePriorityQueue) Pop() interface{} {
 	*pq = old[0 : n-1]
 	return item
 }
+
+/*
+encode serializes the trees, so that they can be saved with the collection and
+loaded instead of being built again when it is opened. The documents are the
+number of documents in the trees, checked when they are loaded. Each node is
+written in preorder: a leaf as a zero byte followed by the count and IDs of its
+documents, and an inner node as a one byte followed by its hyperplane and
+radius, and then its children.
+*/
+func (tree *lshTree) encode(documents int) []byte {
+	buf := binary.AppendUvarint(nil, uint64(documents))
+	buf = binary.AppendUvarint(buf, uint64(tree.threshold))
+	buf = binary.AppendUvarint(buf, uint64(len(tree.roots)))
+	var encodeNode func(node *lshNode)
+	encodeNode = func(node *lshNode) {
+		if node.isLeaf() {
+			buf = append(buf, 0)
+			buf = binary.AppendUvarint(buf, uint64(len(node.ids)))
+			for _, id := range node.ids {
+				buf = binary.AppendUvarint(buf, id)
+			}
+			return
+		}
+		buf = append(buf, 1)
+		buf = binary.AppendUvarint(buf, uint64(len(node.normal)))
+		for _, v := range node.normal {
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		}
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(node.b))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(node.radius))
+		encodeNode(node.left)
+		encodeNode(node.right)
+	}
+	for _, root := range tree.roots {
+		encodeNode(root)
+	}
+	return buf
+}
+
+/*
+decodeLSHTree loads trees saved with encode for the collection. It returns an
+error if the data is damaged, or the trees were built with another leaf size or
+number of trees, or for another number of documents.
+*/
+func decodeLSHTree(c *Collection, threshold, numTrees, documents int, data []byte) (*lshTree, error) {
+	var err error
+	readUvarint := func() uint64 {
+		n, size := binary.Uvarint(data)
+		if size <= 0 {
+			err = fmt.Errorf("saved index is truncated")
+			return 0
+		}
+		data = data[size:]
+		return n
+	}
+	readFloat := func() float64 {
+		if len(data) < 8 {
+			err = fmt.Errorf("saved index is truncated")
+			return 0
+		}
+		v := math.Float64frombits(binary.BigEndian.Uint64(data))
+		data = data[8:]
+		return v
+	}
+
+	if saved := readUvarint(); err == nil && saved != uint64(documents) {
+		return nil, fmt.Errorf("saved index has %d documents, but the collection has %d", saved, documents)
+	}
+	if saved := readUvarint(); err == nil && saved != uint64(threshold) {
+		return nil, fmt.Errorf("saved index has a leaf size of %d, expected %d", saved, threshold)
+	}
+	if saved := readUvarint(); err == nil && saved != uint64(numTrees) {
+		return nil, fmt.Errorf("saved index has %d trees, expected %d", saved, numTrees)
+	}
+
+	var decodeNode func() *lshNode
+	decodeNode = func() *lshNode {
+		if err != nil {
+			return nil
+		}
+		if len(data) == 0 {
+			err = fmt.Errorf("saved index is truncated")
+			return nil
+		}
+		kind := data[0]
+		data = data[1:]
+		if kind == 0 {
+			count := readUvarint()
+			if count > uint64(len(data)) {
+				err = fmt.Errorf("saved index is truncated")
+				return nil
+			}
+			ids := make([]uint64, 0, count)
+			for i := uint64(0); i < count && err == nil; i++ {
+				ids = append(ids, readUvarint())
+			}
+			return &lshNode{ids: ids}
+		}
+		dimensions := readUvarint()
+		if dimensions > uint64(len(data)/8) {
+			err = fmt.Errorf("saved index is truncated")
+			return nil
+		}
+		node := &lshNode{normal: make([]float64, dimensions)}
+		for i := range node.normal {
+			node.normal[i] = readFloat()
+		}
+		node.b = readFloat()
+		node.radius = readFloat()
+		node.left = decodeNode()
+		node.right = decodeNode()
+		return node
+	}
+
+	tree := newLSHTree(c, threshold, numTrees)
+	for i := range tree.roots {
+		tree.roots[i] = decodeNode()
+	}
+	if err == nil && len(data) > 0 {
+		err = fmt.Errorf("saved index has %d extra bytes", len(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
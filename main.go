@@ -1,10 +1,13 @@
 package syzgydb
 
 import (
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func RunServer() {
@@ -12,32 +15,34 @@ func RunServer() {
 		collections: make(map[string]*Collection),
 	}
 
-	// Scan for existing .dat files and create collections
-	dataFolder := globalConfig.DataFolder
-	files, err := filepath.Glob(filepath.Join(dataFolder, "*.dat"))
-	if err != nil {
-		log.Fatalf("Failed to list .dat files: %v", err)
+	if err := server.loadCollections(); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	for _, file := range files {
-		collectionName := server.fileNameToCollectionName(file)
-		log.Printf("Loading collection from file: %s", file)
+	if globalConfig.WarmupOnStart {
+		go server.warmupCollections()
+	}
 
-		// Create a collection with empty CollectionOptions
-		opts := CollectionOptions{Name: file}
-		collection, err := NewCollection(opts)
-		if err != nil {
-			log.Fatalf("Failed to create collection %s: %v", collectionName, err)
-		}
-		server.collections[collectionName] = collection
-		log.Printf("Collection %s loaded successfully", collectionName)
+	if globalConfig.PurgeInterval > 0 {
+		go server.purgeExpiredLoop(globalConfig.PurgeInterval)
 	}
 
-	http.Handle("/api/v1/collections", gzipMiddleware(http.HandlerFunc(server.handleCollections)))
-	http.Handle("/api/v1/collections/", gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.URL.Path)
+	// The metrics are left out of the limit, so that the server can be
+	// monitored while it is busy
+	limit := limitConcurrency(globalConfig.MaxConcurrentRequests)
+	http.Handle("/api/v1/search", gzipMiddleware(limit(limitRequestBody(http.HandlerFunc(server.handleMultiSearch)))))
+	http.Handle("/api/v1/metrics", gzipMiddleware(http.HandlerFunc(server.handleMetrics)))
+	http.Handle("/api/v1/collections", gzipMiddleware(limit(limitRequestBody(http.HandlerFunc(server.handleCollections)))))
+	http.Handle("/api/v1/collections/", gzipMiddleware(limit(limitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logDebugf("%s %s", r.Method, r.URL.Path)
 		if strings.HasSuffix(r.URL.Path, "/records") && r.Method == http.MethodPost {
 			server.handleInsertRecord(w, r)
+		} else if strings.Contains(r.URL.Path, "/records/") && strings.Contains(r.URL.Path, "/streams/") && (r.Method == http.MethodGet || r.Method == http.MethodPut) {
+			server.handleRecordStream(w, r)
+		} else if strings.Contains(r.URL.Path, "/records/") && strings.Contains(r.URL.Path, "/metadata/") && r.Method == http.MethodPatch {
+			server.handleSetMetadataField(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/records/metadata") && r.Method == http.MethodPut {
+			server.handleUpdateMetadataBatch(w, r)
 		} else if strings.Contains(r.URL.Path, "/records/") && r.Method == http.MethodPut {
 			server.handleUpdateMetadata(w, r)
 		} else if strings.Contains(r.URL.Path, "/records/") && r.Method == http.MethodDelete {
@@ -47,7 +52,7 @@ func RunServer() {
 		} else {
 			server.handleCollection(w, r)
 		}
-	})))
+	})))))
 
 	// Serve static files if HTMLRoot is set
 	if globalConfig.HTMLRoot != "" {
@@ -56,9 +61,96 @@ func RunServer() {
 	}
 
 	host := globalConfig.SyzgyHost
-	log.Printf("Starting server on %s", host)
+	logInfof("Starting server on %s", host)
 	if globalConfig.HTMLRoot != "" {
-		log.Printf("Serving static files from %s", globalConfig.HTMLRoot)
+		logInfof("Serving static files from %s", globalConfig.HTMLRoot)
 	}
 	http.ListenAndServe(host, nil)
 }
+
+// loadCollections opens every collection file found in the data folder and its
+// subfolders.
+func (s *Server) loadCollections() error {
+	switch globalConfig.DataFolderLayout {
+	case "", DataFolderLayoutFlat, DataFolderLayoutHashed:
+	default:
+		return fmt.Errorf("unknown data folder layout %q", globalConfig.DataFolderLayout)
+	}
+
+	var files []string
+	err := filepath.WalkDir(globalConfig.DataFolder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".dat") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list .dat files: %v", err)
+	}
+
+	for _, file := range files {
+		collectionName, ok := s.fileNameToCollectionKey(file)
+		if !ok {
+			logWarnf("Warning -- skipping %s, which is not where the %s layout keeps collections", file, globalConfig.DataFolderLayout)
+			continue
+		}
+		logInfof("Loading collection from file: %s", file)
+
+		// Create a collection with empty CollectionOptions
+		opts := CollectionOptions{Name: file}
+		collection, err := NewCollection(opts)
+		if err != nil {
+			return fmt.Errorf("failed to create collection %s: %v", collectionName, err)
+		}
+		s.collections[collectionName] = collection
+		logInfof("Collection %s loaded successfully", collectionName)
+	}
+	return nil
+}
+
+// warmupCollections reads the files of every loaded collection into memory.
+func (s *Server) warmupCollections() {
+	s.mutex.Lock()
+	collections := make(map[string]*Collection, len(s.collections))
+	for name, collection := range s.collections {
+		collections[name] = collection
+	}
+	s.mutex.Unlock()
+
+	start := time.Now()
+	for name, collection := range collections {
+		if err := collection.Warmup(); err != nil {
+			logWarnf("Warning -- failed to warm up collection %s: %v", name, err)
+		}
+	}
+	logInfof("Warmed up %d collections in %v", len(collections), time.Since(start))
+}
+
+// purgeExpiredLoop periodically removes expired documents from every collection.
+func (s *Server) purgeExpiredLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.mutex.Lock()
+		collections := make(map[string]*Collection, len(s.collections))
+		for name, collection := range s.collections {
+			collections[name] = collection
+		}
+		s.mutex.Unlock()
+
+		for name, collection := range collections {
+			count, err := collection.PurgeExpired(now)
+			if err != nil {
+				logErrorf("Failed to purge expired documents from %s: %v", name, err)
+				continue
+			}
+			if count > 0 {
+				logInfof("Purged %d expired documents from %s", count, name)
+			}
+		}
+	}
+}
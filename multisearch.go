@@ -0,0 +1,197 @@
+package syzgydb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// handleMultiSearch runs the same search on several collections in parallel and
+// merges the results by distance, so that collections split by time or category
+// can be searched as one. The collections must have the same number of
+// dimensions and the same distance method, or the distances could not be
+// compared.
+func (s *Server) handleMultiSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Collections []string  `json:"collections"`
+		Vector      []float64 `json:"vector,omitempty"`
+		Text        string    `json:"text,omitempty"`
+		Radius      float64   `json:"radius,omitempty"`
+		K           int       `json:"k,omitempty"`
+		Limit       int       `json:"limit,omitempty"`
+		Precision   string    `json:"precision,omitempty"`
+		Filter      string    `json:"filter,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(request.Collections) == 0 {
+		http.Error(w, "At least one collection must be given", http.StatusBadRequest)
+		return
+	}
+	if request.Vector == nil && request.Text == "" {
+		http.Error(w, "Either vector or text must be provided", http.StatusBadRequest)
+		return
+	}
+	if request.K < 0 || request.K > maxSearchK() {
+		http.Error(w, fmt.Sprintf("Invalid k: must be at most %d", maxSearchK()), http.StatusBadRequest)
+		return
+	}
+	if request.Limit < 0 || request.Limit > maxSearchLimit() {
+		http.Error(w, fmt.Sprintf("Invalid limit: must be at most %d", maxSearchLimit()), http.StatusBadRequest)
+		return
+	}
+	if request.Radius < 0 {
+		http.Error(w, "Invalid radius: must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	// A search without k returns at most the largest limit in all, so that a
+	// radius search can't return every document of every collection
+	if request.Limit == 0 && request.K == 0 {
+		request.Limit = maxSearchLimit()
+	}
+	// Without k or a radius, the documents would be listed without their
+	// distances, which the results are merged by, so the nearest are found
+	if request.K == 0 && request.Radius == 0 {
+		request.K = min(request.Limit, maxSearchK())
+	}
+	timeout, err := searchTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, len(request.Collections))
+	for i, name := range request.Collections {
+		keys[i], err = collectionKey(r, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	collections := make([]*Collection, len(request.Collections))
+	s.mutex.Lock()
+	for i, key := range keys {
+		collections[i] = s.collections[key]
+	}
+	s.mutex.Unlock()
+	options := make([]CollectionOptions, len(collections))
+	for i, collection := range collections {
+		if collection == nil {
+			http.Error(w, fmt.Sprintf("Collection %s not found", request.Collections[i]), http.StatusNotFound)
+			return
+		}
+		options[i] = collection.GetOptions()
+		if options[i].DimensionCount != options[0].DimensionCount || options[i].DistanceMethod != options[0].DistanceMethod {
+			http.Error(w, fmt.Sprintf("Collection %s does not have the same dimensions and distance method as %s",
+				request.Collections[i], request.Collections[0]), http.StatusBadRequest)
+			return
+		}
+	}
+
+	searchArgs := SearchArgs{
+		Vector:    request.Vector,
+		Radius:    request.Radius,
+		K:         request.K,
+		Limit:     request.Limit,
+		Precision: request.Precision,
+	}
+	if request.Filter != "" {
+		if _, err := BuildParsedFilter(request.Filter); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid filter query: %v", err), http.StatusBadRequest)
+			return
+		}
+		searchArgs.FilterQuery = request.Filter
+	}
+
+	if request.Text != "" && request.Vector == nil {
+		vector, err := embedText([]string{request.Text}, true) // Use cache for searches
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to convert text to vector: %v", err), http.StatusInternalServerError)
+			return
+		}
+		searchArgs.Vector = vector[0]
+	}
+	if err := checkVectorDimensions(collections[0], searchArgs.Vector, request.Text != "" && request.Vector == nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateVector(searchArgs.Vector); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type multiSearchResult struct {
+		ID         uint64                 `json:"id"`
+		Collection string                 `json:"collection"`
+		Metadata   map[string]interface{} `json:"metadata"`
+		Distance   float64                `json:"distance"`
+	}
+
+	startSearch := time.Now()
+	if timeout > 0 {
+		searchArgs.Deadline = startSearch.Add(timeout)
+	}
+	resultsByCollection := make([]SearchResults, len(collections))
+	errs := make([]error, len(collections))
+	var wg sync.WaitGroup
+	for i, collection := range collections {
+		wg.Add(1)
+		go func(i int, collection *Collection) {
+			defer wg.Done()
+			resultsByCollection[i], errs[i] = s.searchCollection(keys[i], collection, searchArgs)
+		}(i, collection)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Search of %s failed: %v", request.Collections[i], err), searchErrorStatus(err))
+			return
+		}
+	}
+
+	merged := []multiSearchResult{}
+	timedOut := false
+	for i, results := range resultsByCollection {
+		timedOut = timedOut || results.TimedOut
+		for _, result := range results.Results {
+			metadata, err := resultMetadata(result)
+			if err != nil {
+				logWarnf("Error decoding metadata for ID %d: %v", result.ID, err)
+				continue
+			}
+			merged = append(merged, multiSearchResult{
+				ID:         result.ID,
+				Collection: request.Collections[i],
+				Metadata:   metadata,
+				Distance:   result.Distance,
+			})
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Distance < merged[j].Distance
+	})
+	if request.K > 0 && len(merged) > request.K {
+		merged = merged[:request.K]
+	}
+	if request.Limit > 0 && len(merged) > request.Limit {
+		merged = merged[:request.Limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results    []multiSearchResult `json:"results"`
+		SearchTime int64               `json:"search_time"`
+		TimedOut   bool                `json:"timed_out,omitempty"`
+	}{merged, time.Since(startSearch).Milliseconds(), timedOut})
+}
@@ -3,6 +3,12 @@ package syzgydb
 import "math"
 
 func quantize(value float64, bits int) uint64 {
+	return quantizeRange(value, bits, -1, 1)
+}
+
+// quantizeRange is like quantize, but maps values between min and max, instead
+// of between -1 and 1, to the available integers.
+func quantizeRange(value float64, bits int, min, max float64) uint64 {
 	switch bits {
 	case 32:
 		return uint64(math.Float32bits(float32(value)))
@@ -10,19 +16,24 @@ func quantize(value float64, bits int) uint64 {
 		return math.Float64bits(value)
 	}
 	// Ensure the value is within the expected range
-	if value < -1 {
-		value = -1
-	} else if value > 1 {
-		value = 1
+	if value < min {
+		value = min
+	} else if value > max {
+		value = max
 	}
 
-	// Map the float64 value from [-1, 1] to [0, maxInt]
+	// Map the float64 value from [min, max] to [0, maxInt]
 	maxInt := (1 << bits) - 1
-	quantizedValue := (value + 1) / 2 * float64(maxInt)
+	quantizedValue := (value - min) / (max - min) * float64(maxInt)
 	return uint64(math.Round(quantizedValue))
 }
 
 func dequantize(value uint64, bits int) float64 {
+	return dequantizeRange(value, bits, -1, 1)
+}
+
+// dequantizeRange reverses quantizeRange.
+func dequantizeRange(value uint64, bits int, min, max float64) float64 {
 	switch bits {
 	case 32:
 		return float64(math.Float32frombits(uint32(value)))
@@ -30,7 +41,7 @@ func dequantize(value uint64, bits int) float64 {
 		return math.Float64frombits(value)
 	}
 
-	// Map the integer value from [0, maxInt] back to [-1, 1]
+	// Map the integer value from [0, maxInt] back to [min, max]
 	maxInt := (1 << bits) - 1
-	return (float64(value) / float64(maxInt)) * 2 - 1
+	return min + (float64(value)/float64(maxInt))*(max-min)
 }
@@ -3,10 +3,10 @@ package query
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -45,7 +45,7 @@ func CompileExpression(node Node) CompiledExpression {
 		}
 	case *IdentifierNode:
 		return func(data interface{}) (interface{}, error) {
-			return getField(data, strings.Split(n.Name, "."))
+			return GetField(data, strings.Split(n.Name, "."))
 		}
 	case *ValueNode:
 		return func(data interface{}) (interface{}, error) {
@@ -150,6 +150,37 @@ func CompileExpression(node Node) CompiledExpression {
 			}
 			return true, nil
 		}
+	case *FilterNode:
+		arrayExpr := CompileExpression(n.Array)
+		condition := CompileExpression(n.Condition)
+		return func(data interface{}) (interface{}, error) {
+			arr, err := arrayExpr(data)
+			if err != nil {
+				return nil, err
+			}
+			matches := []interface{}{}
+			if arr == nil {
+				return matches, nil // A missing array has no matching elements
+			}
+			slice, ok := arr.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected array, got %T", arr)
+			}
+			for _, item := range slice {
+				match, err := condition(item)
+				if err != nil {
+					return nil, err
+				}
+				if m, ok := asCondition(match); ok && m {
+					matches = append(matches, item)
+				}
+			}
+			return matches, nil
+		}
+	case *CurrentElementNode:
+		return func(data interface{}) (interface{}, error) {
+			return data, nil
+		}
 	case *ArrayStarNode:
 		arrayExpr := CompileExpression(n.Array)
 		return func(data interface{}) (interface{}, error) {
@@ -178,27 +209,27 @@ func evaluateOperation(operator string, left, right interface{}) (interface{}, e
 	case ">", ">=", "<", "<=":
 		return compareValues(operator, left, right)
 	case "AND":
-		l, lok := left.(bool)
-		r, rok := right.(bool)
+		l, lok := asCondition(left)
+		r, rok := asCondition(right)
 		if !lok || !rok {
 			return nil, fmt.Errorf("AND operation requires boolean operands")
 		}
 		return l && r, nil
 	case "OR":
-		l, lok := left.(bool)
+		l, lok := asCondition(left)
 		if !lok {
 			return nil, fmt.Errorf("OR operation requires boolean operands, got %T for left operand", left)
 		}
 		if l {
 			return true, nil // Short-circuit if left operand is true
 		}
-		r, rok := right.(bool)
+		r, rok := asCondition(right)
 		if !rok {
 			return nil, fmt.Errorf("OR operation requires boolean operands, got %T for right operand", right)
 		}
 		return r, nil
 	case "NOT":
-		r, rok := right.(bool)
+		r, rok := asCondition(right)
 		if !rok {
 			return nil, fmt.Errorf("NOT operation requires a boolean operand")
 		}
@@ -265,62 +296,135 @@ func evaluateOperation(operator string, left, right interface{}) (interface{}, e
 	}
 }
 
+// asCondition returns the truth of a value used as a condition. Besides booleans,
+// arrays are accepted, and are true when they have elements, so that a filter
+// such as tags[?(. == 'urgent')] can be used as a condition.
+func asCondition(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case []interface{}:
+		return len(v) > 0, true
+	}
+	return false, false
+}
+
+// LenientComparisons controls whether the ordering operators (>, >=, <, <=)
+// convert a numeric string to a number when it is compared with a number, so
+// that "80" > 75 is true. Two strings are always compared as strings. When it
+// is false, comparing a string with a number is an error.
+var LenientComparisons = true
+
 func compareValues(operator string, left, right interface{}) (bool, error) {
+	if LenientComparisons {
+		left, right = coerceNumericString(left, right)
+	}
+
 	lv := reflect.ValueOf(left)
+	rv := reflect.ValueOf(right)
 
-	switch lv.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		l := lv.Int()
-		r, err := toInt64(right)
-		if err != nil {
-			return false, err
-		}
-		switch operator {
-		case ">":
-			return l > r, nil
-		case ">=":
-			return l >= r, nil
-		case "<":
-			return l < r, nil
-		case "<=":
-			return l <= r, nil
-		}
-	case reflect.Float32, reflect.Float64:
-		l := lv.Float()
+	switch {
+	case isIntKind(lv.Kind()) && isIntKind(rv.Kind()):
+		return applyComparison(operator, compareOrdered(lv.Int(), rv.Int()))
+	case isNumberKind(lv.Kind()):
+		l, _ := toFloat64(left)
 		r, err := toFloat64(right)
 		if err != nil {
 			return false, err
 		}
-		switch operator {
-		case ">":
-			return l > r, nil
-		case ">=":
-			return l >= r, nil
-		case "<":
-			return l < r, nil
-		case "<=":
-			return l <= r, nil
-		}
-	case reflect.String:
-		l := lv.String()
+		return applyComparison(operator, compareOrdered(l, r))
+	case lv.Kind() == reflect.String:
 		r, ok := right.(string)
 		if !ok {
 			return false, fmt.Errorf("cannot compare string with non-string")
 		}
-		switch operator {
-		case ">":
-			return l > r, nil
-		case ">=":
-			return l >= r, nil
-		case "<":
-			return l < r, nil
-		case "<=":
-			return l <= r, nil
-		}
+		return applyComparison(operator, compareOrdered(lv.String(), r))
 	}
 	return false, fmt.Errorf("unsupported comparison: %v %s %v", left, operator, right)
 }
 
+// coerceNumericString converts whichever operand is a numeric string to a
+// float64 when the other operand is a number. Other operands are returned
+// unchanged.
+func coerceNumericString(left, right interface{}) (interface{}, interface{}) {
+	if s, ok := left.(string); ok && isNumberKind(reflect.ValueOf(right).Kind()) {
+		if f, err := parseNumber(s); err == nil {
+			left = f
+		}
+	} else if s, ok := right.(string); ok && isNumberKind(reflect.ValueOf(left).Kind()) {
+		if f, err := parseNumber(s); err == nil {
+			right = f
+		}
+	}
+	return left, right
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return isIntKind(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func compareOrdered[T int64 | float64 | string](l, r T) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func applyComparison(operator string, cmp int) (bool, error) {
+	switch operator {
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported comparison operator: %s", operator)
+}
+
+// parseNumber parses a numeric string, ignoring surrounding whitespace.
+func parseNumber(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert %q to a number", s)
+	}
+	return f, nil
+}
+
+// evaluateToNumber converts a value to a float64. Numbers are converted
+// directly, numeric strings are parsed, booleans become 1 or 0, and null stays
+// null so that missing fields can still be tested. Anything else is an error.
+func evaluateToNumber(arg interface{}) (interface{}, error) {
+	switch v := arg.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return parseNumber(v)
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	}
+	if isNumberKind(reflect.ValueOf(arg).Kind()) {
+		return reflect.ValueOf(arg).Convert(reflect.TypeOf(float64(0))).Float(), nil
+	}
+	return nil, fmt.Errorf("TO_NUMBER function not supported for type %T", arg)
+}
+
 func evaluateFunction(name string, args []CompiledExpression, data interface{}) (interface{}, error) {
 	switch name {
 	case "LENGTH":
@@ -332,6 +436,15 @@ func evaluateFunction(name string, args []CompiledExpression, data interface{})
 			return nil, err
 		}
 		return evaluateLength(arg)
+	case "TO_NUMBER":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("TO_NUMBER function requires exactly one argument")
+		}
+		arg, err := args[0](data)
+		if err != nil {
+			return nil, err
+		}
+		return evaluateToNumber(arg)
 	case "EXISTS":
 		if len(args) != 1 {
 			return nil, fmt.Errorf("EXISTS function requires exactly one argument")
@@ -379,14 +492,11 @@ func evaluateIn(left, right interface{}) (bool, error) {
 	if !ok {
 		return false, fmt.Errorf("IN operator requires a list on the right side")
 	}
-	log.Printf("Evaluating IN: %v, %v", left, list)
 	for _, item := range list {
-		log.Printf("Comparing %v(type: %T) with %v(type: %T)", left, left, item, item)
 		if reflect.DeepEqual(left, item) {
 			return true, nil
 		}
 	}
-	log.Printf("IN evaluation result: %v", false)
 	return false, nil
 }
 
@@ -430,12 +540,15 @@ func evaluateMatches(left, right interface{}) (bool, error) {
 	return matched, nil
 }
 
-func getField(data interface{}, path []string) (interface{}, error) {
+// GetField returns the value at a path of field names in data decoded from JSON,
+// the same paths that queries use with dot notation. A missing field gives nil,
+// and a path through a value that is not an object gives an error.
+func GetField(data interface{}, path []string) (interface{}, error) {
 	current := data
 	for _, key := range path {
 		switch v := current.(type) {
 		case map[string]interface{}:
-			return v[key], nil
+			current = v[key]
 		case []interface{}:
 			if key == "*" {
 				return v, nil
@@ -448,6 +561,45 @@ func getField(data interface{}, path []string) (interface{}, error) {
 	return current, nil
 }
 
+// SetField sets the value at a path of field names in data decoded from JSON,
+// the same paths that queries use with dot notation, and returns the updated
+// data. Objects are created for missing fields along the path. A field name
+// that is a number indexes an array, and must be within its bounds.
+func SetField(data interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	key := path[0]
+	switch v := data.(type) {
+	case nil:
+		child, err := SetField(nil, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{key: child}, nil
+	case map[string]interface{}:
+		child, err := SetField(v[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		v[key] = child
+		return v, nil
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= len(v) {
+			return nil, fmt.Errorf("invalid index %s for array of length %d", key, len(v))
+		}
+		child, err := SetField(v[index], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		v[index] = child
+		return v, nil
+	default:
+		return nil, fmt.Errorf("cannot set field %s on %T", key, data)
+	}
+}
+
 func toInt64(v interface{}) (int64, error) {
 	switch i := v.(type) {
 	case int:
@@ -475,6 +627,7 @@ func toFloat64(v interface{}) (float64, error) {
 }
 
 func CreateFilterFunction(compiledExpr CompiledExpression) func([]byte) (bool, error) {
+	filter := CreateParsedFilterFunction(compiledExpr)
 	return func(record []byte) (bool, error) {
 		var data interface{}
 		err := json.Unmarshal(record, &data)
@@ -482,12 +635,20 @@ func CreateFilterFunction(compiledExpr CompiledExpression) func([]byte) (bool, e
 			return false, fmt.Errorf("failed to unmarshal JSON: %v", err)
 		}
 
+		return filter(data)
+	}
+}
+
+// CreateParsedFilterFunction returns a filter that evaluates the expression
+// against metadata that has already been unmarshalled.
+func CreateParsedFilterFunction(compiledExpr CompiledExpression) func(interface{}) (bool, error) {
+	return func(data interface{}) (bool, error) {
 		result, err := compiledExpr(data)
 		if err != nil {
 			return false, err
 		}
 
-		boolResult, ok := result.(bool)
+		boolResult, ok := asCondition(result)
 		if !ok {
 			return false, fmt.Errorf("query result is not a boolean: %v", result)
 		}
@@ -346,3 +346,140 @@ func TestCreateFilterFunction(t *testing.T) {
 		})
 	}
 }
+
+func TestArrayFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		data  string
+		want  bool
+	}{
+		{name: "matching string", query: "tags[?(. == 'urgent')]", data: `{"tags": ["low", "urgent"]}`, want: true},
+		{name: "no matching string", query: "tags[?(. == 'urgent')]", data: `{"tags": ["low", "later"]}`, want: false},
+		{name: "empty array", query: "tags[?(. == 'urgent')]", data: `{"tags": []}`, want: false},
+		{name: "missing array", query: "tags[?(. == 'urgent')]", data: `{}`, want: false},
+		{name: "combined with AND", query: "tags[?(. == 'urgent')] AND priority > 1", data: `{"tags": ["urgent"], "priority": 2}`, want: true},
+		{name: "negated", query: "NOT tags[?(. STARTS_WITH 'ur')]", data: `{"tags": ["low"]}`, want: true},
+		{name: "element fields", query: "items[?(.quantity > 100)].length == 2", data: `{"items": [{"quantity": 50}, {"quantity": 120}, {"quantity": 180}]}`, want: true},
+		{name: "compound condition", query: "items[?(.quantity > 100 AND .name == 'b')]", data: `{"items": [{"quantity": 120, "name": "a"}, {"quantity": 50, "name": "b"}]}`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filterFunc, err := FilterFunctionFromQuery(tt.query)
+			if err != nil {
+				t.Fatalf("Failed to parse query: %v", err)
+			}
+			got, err := filterFunc([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("Filter function failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Filter function returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Outside of a condition, the filter returns the matching elements
+	ast, err := NewParser(NewLexer("tags[?(. == 'urgent' OR . == 'high')]")).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	if ast.String() != "tags[?(OR(==(., 'urgent'), ==(., 'high')))]" {
+		t.Errorf("Unexpected AST %s", ast.String())
+	}
+	var data interface{}
+	json.Unmarshal([]byte(`{"tags": ["high", "low", "urgent"]}`), &data)
+	matches, err := CompileExpression(ast)(data)
+	if err != nil {
+		t.Fatalf("Failed to evaluate filter: %v", err)
+	}
+	if !reflect.DeepEqual(matches, []interface{}{"high", "urgent"}) {
+		t.Errorf("Expected the matching elements, got %v", matches)
+	}
+}
+
+func TestNumericCoercion(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		data    string
+		lenient bool
+		want    bool
+		wantErr bool
+	}{
+		// A numeric string compared with a number is converted to a number.
+		{name: "string field vs number", query: "score > 75", data: `{"score": "80"}`, lenient: true, want: true},
+		{name: "number field vs string", query: "score <= '80'", data: `{"score": 80}`, lenient: true, want: true},
+		{name: "decimal string with spaces", query: "price < 10", data: `{"price": " 9.5 "}`, lenient: true, want: true},
+		// Two strings are always compared as strings, so "9" sorts after "10".
+		{name: "two strings stay strings", query: "score > '10'", data: `{"score": "9"}`, lenient: true, want: true},
+		// A string that is not a number cannot be compared with a number.
+		{name: "non-numeric string", query: "score > 75", data: `{"score": "high"}`, lenient: true, wantErr: true},
+		// Without leniency, strings and numbers are never compared.
+		{name: "strict mode", query: "score > 75", data: `{"score": "80"}`, lenient: false, wantErr: true},
+		// TO_NUMBER converts explicitly, regardless of the lenient flag.
+		{name: "TO_NUMBER string", query: "TO_NUMBER(score) > 75", data: `{"score": "80"}`, lenient: false, want: true},
+		{name: "TO_NUMBER number", query: "TO_NUMBER(score) == 80", data: `{"score": 80}`, lenient: false, want: true},
+		{name: "TO_NUMBER boolean", query: "TO_NUMBER(flag) == 1", data: `{"flag": true}`, lenient: false, want: true},
+		{name: "TO_NUMBER missing field", query: "TO_NUMBER(score) == NULL", data: `{}`, lenient: false, want: true},
+		{name: "TO_NUMBER non-numeric", query: "TO_NUMBER(score) > 1", data: `{"score": "n/a"}`, lenient: false, wantErr: true},
+	}
+
+	defer func(saved bool) { LenientComparisons = saved }(LenientComparisons)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			LenientComparisons = tt.lenient
+			filterFunc, err := FilterFunctionFromQuery(tt.query)
+			if err != nil {
+				t.Fatalf("Failed to parse query: %v", err)
+			}
+
+			got, err := filterFunc([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Filter function failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Filter function returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareMixedNumberTypes(t *testing.T) {
+	// An integer is compared with a float threshold without truncating the threshold.
+	got, err := compareValues(">", 3, 2.5)
+	if err != nil || !got {
+		t.Errorf("Expected 3 > 2.5, got %v, %v", got, err)
+	}
+	got, err = compareValues("<", int64(2), 2.5)
+	if err != nil || !got {
+		t.Errorf("Expected 2 < 2.5, got %v, %v", got, err)
+	}
+	got, err = compareValues(">", 3, 2.9)
+	if err != nil || !got {
+		t.Errorf("Expected 3 > 2.9, got %v, %v", got, err)
+	}
+}
+
+func TestGetField(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`{"user": {"country": "CA"}, "tags": ["a"]}`), &data)
+
+	if got, err := GetField(data, []string{"user", "country"}); err != nil || got != "CA" {
+		t.Errorf("Expected the nested field, got %v, %v", got, err)
+	}
+	if got, err := GetField(data, []string{"user", "city"}); err != nil || got != nil {
+		t.Errorf("Expected nil for a missing field, got %v, %v", got, err)
+	}
+	if _, err := GetField(data, []string{"user", "country", "code"}); err == nil {
+		t.Errorf("Expected an error for a path through a string")
+	}
+}
@@ -40,6 +40,7 @@ const (
 	TokenColon        // ':'
 	TokenDot          // '.'
 	TokenArrayStar    // '[*]'
+	TokenFilterStart  // '[?('
 )
 
 type Token struct {
@@ -131,6 +132,10 @@ func (l *Lexer) NextToken() Token {
 			tok = Token{Type: TokenArrayStar, Literal: "[*]", Line: l.line, Column: l.column}
 			l.readChar() // consume '*'
 			l.readChar() // consume ']'
+		} else if l.peekChar() == '?' && l.peekNextChar() == '(' {
+			tok = Token{Type: TokenFilterStart, Literal: "[?(", Line: l.line, Column: l.column}
+			l.readChar() // consume '?'
+			l.readChar() // consume '('
 		} else {
 			tok = Token{Type: TokenLeftBracket, Literal: string(l.ch), Line: l.line, Column: l.column}
 		}
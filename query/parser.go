@@ -103,6 +103,26 @@ func (n *ArrayStarNode) String() string {
 	return fmt.Sprintf("%s[*]", n.Array.String())
 }
 
+// FilterNode selects the elements of an array that meet a condition, written
+// array[?(condition)]. Within the condition, CurrentElementNode stands for the
+// element being tested.
+type FilterNode struct {
+	Array     Node
+	Condition Node
+}
+
+func (n *FilterNode) String() string {
+	return fmt.Sprintf("%s[?(%s)]", n.Array.String(), n.Condition.String())
+}
+
+// CurrentElementNode is the element being tested by the condition of a filter,
+// written as a single dot.
+type CurrentElementNode struct{}
+
+func (n *CurrentElementNode) String() string {
+	return "."
+}
+
 type Parser struct {
 	lexer        *Lexer
 	currentToken Token
@@ -184,7 +204,7 @@ func (p *Parser) parseNot() (Node, error) {
 // PrimaryExpression := Identifier | Value | Parameter | GroupedExpression | ArrayLiteral
 func (p *Parser) parsePrimary() (Node, error) {
 	switch p.currentToken.Type {
-	case TokenIdentifier:
+	case TokenIdentifier, TokenDot:
 		return p.parseIdentifierOrFunction()
 	case TokenNumber:
 		return p.parseNumber()
@@ -326,13 +346,34 @@ func (p *Parser) parseArrayExpression() (Node, error) {
 }*/
 
 func (p *Parser) parseArrayAccessOrIdentifier() (Node, error) {
-	expr, err := p.parseIdentifier()
-	if err != nil {
-		return nil, err
+	var expr Node
+	if p.currentToken.Type == TokenDot {
+		expr = p.parseCurrentElement()
+	} else {
+		var err error
+		expr, err = p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	for p.currentToken.Type == TokenLeftBracket || p.currentToken.Type == TokenDot {
-		if p.currentToken.Type == TokenLeftBracket {
+	for p.currentToken.Type == TokenLeftBracket || p.currentToken.Type == TokenDot || p.currentToken.Type == TokenFilterStart {
+		if p.currentToken.Type == TokenFilterStart {
+			p.nextToken() // consume '[?('
+			condition, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if p.currentToken.Type != TokenRightParen {
+				return nil, fmt.Errorf("expected ')' after filter condition, got %s", p.currentToken.Literal)
+			}
+			p.nextToken() // consume ')'
+			if p.currentToken.Type != TokenRightBracket {
+				return nil, fmt.Errorf("expected ']' after filter, got %s", p.currentToken.Literal)
+			}
+			p.nextToken() // consume ']'
+			expr = &FilterNode{Array: expr, Condition: condition}
+		} else if p.currentToken.Type == TokenLeftBracket {
 			p.nextToken() // consume '['
 			index, err := p.parseExpression()
 			if err != nil {
@@ -357,6 +398,17 @@ func (p *Parser) parseArrayAccessOrIdentifier() (Node, error) {
 	return expr, nil
 }
 
+// CurrentElement := DOT Identifier?
+func (p *Parser) parseCurrentElement() Node {
+	p.nextToken() // consume '.'
+	var expr Node = &CurrentElementNode{}
+	if p.currentToken.Type == TokenIdentifier {
+		expr = &ExpressionNode{Left: expr, Operator: ".", Right: &IdentifierNode{Name: p.currentToken.Literal}}
+		p.nextToken()
+	}
+	return expr
+}
+
 func (p *Parser) parseIdentifier() (Node, error) {
 	if p.currentToken.Type != TokenIdentifier {
 		return nil, fmt.Errorf("expected identifier, got %s", p.currentToken.Literal)
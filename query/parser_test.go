@@ -2,6 +2,7 @@ package query
 
 import (
 	"log"
+	"reflect"
 	"testing"
 )
 
@@ -68,3 +69,29 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func TestEqualityConditions(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected map[string]interface{}
+	}{
+		{"status == 'active'", map[string]interface{}{"status": "active"}},
+		{"'active' == status AND age >= 18", map[string]interface{}{"status": "active"}},
+		{"(kind == 'a' AND n == 3) AND ok == true", map[string]interface{}{"kind": "a", "n": 3.0, "ok": true}},
+		{"status == 'active' OR role == 'admin'", map[string]interface{}{}},
+		{"NOT (status == 'active')", map[string]interface{}{}},
+		{"user.name == 'bob' AND deleted == null", map[string]interface{}{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			conditions, err := EqualityConditions(tc.input)
+			if err != nil {
+				t.Fatalf("Parser error: %v", err)
+			}
+			if !reflect.DeepEqual(conditions, tc.expected) {
+				t.Errorf("Expected conditions %v, got %v", tc.expected, conditions)
+			}
+		})
+	}
+}
@@ -1,7 +1,13 @@
 package query
 
+import "strings"
+
 type FilterFunction func(metadata []byte) (bool, error)
 
+// ParsedFilterFunction is like FilterFunction, but receives metadata that has
+// already been decoded from JSON, so the caller can reuse the decoded value.
+type ParsedFilterFunction func(data interface{}) (bool, error)
+
 // FilterFunctionFromQuery takes a query string and returns a FilterFunction.
 // This function performs the following steps:
 // 1. Lexical analysis
@@ -30,3 +36,57 @@ func FilterFunctionFromQuery(query string) (FilterFunction, error) {
 	// Return the filter function and any error that occurred during the process
 	return filterFunc, err
 }
+
+// ParsedFilterFunctionFromQuery compiles a query string into a ParsedFilterFunction.
+func ParsedFilterFunctionFromQuery(query string) (ParsedFilterFunction, error) {
+	parser := NewParser(NewLexer(query))
+	ast, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return CreateParsedFilterFunction(CompileExpression(ast)), nil
+}
+
+// EqualityConditions returns the conditions of the form `field == value` that a
+// document must meet to match the query, keyed by field name. Only conditions
+// joined to the rest of the query by AND are returned, and only those that
+// compare a top-level field with a string, number or boolean. The query may
+// contain other conditions, which are not returned, so a document that meets
+// every returned condition may still not match.
+func EqualityConditions(query string) (map[string]interface{}, error) {
+	ast, err := NewParser(NewLexer(query)).Parse()
+	if err != nil {
+		return nil, err
+	}
+	conditions := make(map[string]interface{})
+	collectEqualityConditions(ast, conditions)
+	return conditions, nil
+}
+
+func collectEqualityConditions(node Node, conditions map[string]interface{}) {
+	n, ok := node.(*ExpressionNode)
+	if !ok {
+		return
+	}
+	switch n.Operator {
+	case "AND":
+		collectEqualityConditions(n.Left, conditions)
+		collectEqualityConditions(n.Right, conditions)
+	case "==":
+		ident, ok := n.Left.(*IdentifierNode)
+		value, vok := n.Right.(*ValueNode)
+		if !ok || !vok {
+			ident, ok = n.Right.(*IdentifierNode)
+			value, vok = n.Left.(*ValueNode)
+		}
+		if !ok || !vok || strings.ContainsAny(ident.Name, ".[") {
+			return
+		}
+		switch value.Value.(type) {
+		case string, float64, bool:
+			if _, exists := conditions[ident.Name]; !exists {
+				conditions[ident.Name] = value.Value
+			}
+		}
+	}
+}
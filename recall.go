@@ -0,0 +1,41 @@
+package syzgydb
+
+/*
+EvaluateRecall measures how many of the true nearest neighbours a search finds,
+which is useful when choosing the Precision and search index parameters. Each
+query is searched for its k nearest documents at the given precision, and
+groundTruth holds the IDs of the true nearest documents of the query with the
+same index, nearest first, such as those found with the "exact" precision. The
+result is the fraction of the first k IDs of each ground truth that the search
+returned, averaged over the queries. Queries without ground truth are skipped.
+*/
+func EvaluateRecall(c *Collection, queries [][]float64, groundTruth [][]uint64, k int, precision string) float64 {
+	total := 0.0
+	count := 0
+	for i, query := range queries {
+		if i >= len(groundTruth) || len(groundTruth[i]) == 0 {
+			continue
+		}
+		truth := groundTruth[i]
+		if len(truth) > k {
+			truth = truth[:k]
+		}
+
+		found := make(map[uint64]bool, k)
+		for _, result := range c.Search(SearchArgs{Vector: query, K: k, Precision: precision}).Results {
+			found[result.ID] = true
+		}
+		matched := 0
+		for _, id := range truth {
+			if found[id] {
+				matched++
+			}
+		}
+		total += float64(matched) / float64(len(truth))
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
@@ -1,9 +1,13 @@
 package syzgydb
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -12,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -20,10 +25,44 @@ import (
 type Server struct {
 	collections map[string]*Collection
 	mutex       sync.Mutex
+
+	// compactions holds the background compactions started through the
+	// API, by job ID. Jobs are forgotten compactionJobRetention after they
+	// finish.
+	compactions map[string]serverCompaction
+	nextJobID   int
+
+	// creating holds the keys of collections that are being created, so that
+	// the mutex need not be held while their files are set up.
+	creating map[string]bool
+
+	// moving holds the keys of collections whose files are being swapped by
+	// SwapCollection, renamed by RenameCollection or deleted, and the new
+	// names they are renamed to. They can't be renamed, deleted or compacted
+	// until it is done.
+	moving map[string]bool
+
+	// searchLatency counts how long the searches of the search API took.
+	searchLatency latencyHistogram
 }
 
+type serverCompaction struct {
+	collection string
+	job        *CompactionJob
+}
+
+// compactionJobRetention is how long the status of a finished compaction can
+// still be asked for.
+const compactionJobRetention = time.Hour
+
+// gzipMiddleware compresses responses of the usual text content types when the
+// client accepts gzip, unless they are smaller than Config.GzipMinSize.
 func gzipMiddleware(wrappedHandler http.Handler) http.Handler {
-	handler, err := gziphandler.GzipHandlerWithOpts(gziphandler.ContentTypes([]string{
+	minSize := globalConfig.GzipMinSize
+	if minSize <= 0 {
+		minSize = DefaultGzipMinSize
+	}
+	handler, err := gziphandler.GzipHandlerWithOpts(gziphandler.MinSize(minSize), gziphandler.ContentTypes([]string{
 		"application/json",
 		"text",
 		"text/html",
@@ -34,7 +73,89 @@ func gzipMiddleware(wrappedHandler http.Handler) http.Handler {
 	if err != nil {
 		panic(err)
 	}
-	return handler(wrappedHandler)
+	return handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrappedHandler.ServeHTTP(&defaultContentTypeWriter{ResponseWriter: w}, r)
+	}))
+}
+
+// limitRequestBody makes reading the body of a request fail once it is larger
+// than Config.MaxRequestBytes. Handlers report the failure with writeBodyError.
+func limitRequestBody(wrappedHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes())
+		wrappedHandler.ServeHTTP(w, r)
+	})
+}
+
+// limitConcurrency returns a middleware that lets at most max requests run at
+// once through all of the handlers it wraps, and turns away the rest with 503
+// Service Unavailable. Zero or less means no limit.
+func limitConcurrency(max int) func(http.Handler) http.Handler {
+	if max <= 0 {
+		return func(wrappedHandler http.Handler) http.Handler { return wrappedHandler }
+	}
+	slots := make(chan struct{}, max)
+	return func(wrappedHandler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				wrappedHandler.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeErrorResponse(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// writeBodyError responds to a request whose body could not be read or
+// decoded. A body larger than Config.MaxRequestBytes gets 413 Request Entity
+// Too Large, and others 400 Bad Request.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if !writeBodyTooLarge(w, err) {
+		writeErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+	}
+}
+
+// writeBodyTooLarge writes a 413 Request Entity Too Large response and returns
+// true if err comes from reading a body larger than Config.MaxRequestBytes.
+func writeBodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeErrorResponse(w, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// defaultContentTypeWriter sets the Content-Type to application/json if the
+// handler did not set one before writing the response. A Content-Type set by the
+// handler is left alone.
+type defaultContentTypeWriter struct {
+	http.ResponseWriter
+}
+
+func (w *defaultContentTypeWriter) setDefaultContentType() {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+}
+
+func (w *defaultContentTypeWriter) WriteHeader(statusCode int) {
+	w.setDefaultContentType()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *defaultContentTypeWriter) Write(b []byte) (int, error) {
+	w.setDefaultContentType()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *defaultContentTypeWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 type gzipResponseWriter struct {
@@ -54,8 +175,15 @@ func (w gzipResponseWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// collectionNameToFileName returns the file of a collection, given its key, in
+// the configured layout of the data folder.
 func (s *Server) collectionNameToFileName(name string) string {
-	return filepath.Join(globalConfig.DataFolder, name+".dat")
+	tenant, base := tenantOfKey(name), name[strings.LastIndexByte(name, '/')+1:]
+	dir := filepath.Join(globalConfig.DataFolder, tenant)
+	if globalConfig.DataFolderLayout == DataFolderLayoutHashed {
+		dir = filepath.Join(dir, filepath.FromSlash(hashedFolder(base)))
+	}
+	return filepath.Join(dir, base+".dat")
 }
 
 func (s *Server) fileNameToCollectionName(fileName string) string {
@@ -64,29 +192,101 @@ func (s *Server) fileNameToCollectionName(fileName string) string {
 	// Remove the .dat extension
 	return strings.TrimSuffix(baseName, ".dat")
 }
+
+// fileNameToCollectionKey returns the collection key of a .dat file found in the
+// data folder, which is laid out as collectionNameToFileName describes. It
+// returns false if the file is not where a collection would be kept.
+func (s *Server) fileNameToCollectionKey(fileName string) (string, bool) {
+	rel, err := filepath.Rel(globalConfig.DataFolder, fileName)
+	if err != nil {
+		return "", false
+	}
+	dirs := strings.Split(filepath.ToSlash(filepath.Dir(rel)), "/")
+	if dirs[0] == "." {
+		dirs = nil
+	}
+	name := s.fileNameToCollectionName(fileName)
+	if globalConfig.DataFolderLayout == DataFolderLayoutHashed {
+		if len(dirs) < 2 || strings.Join(dirs[len(dirs)-2:], "/") != hashedFolder(name) {
+			return "", false
+		}
+		dirs = dirs[:len(dirs)-2]
+	}
+	switch len(dirs) {
+	case 0:
+		return name, true
+	case 1:
+		return dirs[0] + "/" + name, true
+	}
+	return "", false
+}
+
+// hashedFolder returns the two levels of folders, such as "ab/cd", that hold the
+// file of the named collection in the hashed layout of the data folder.
+func hashedFolder(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	hash := fmt.Sprintf("%08x", h.Sum32())
+	return hash[0:2] + "/" + hash[2:4]
+}
+
 func (s *Server) handleCollections(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received %s request for %s", r.Method, r.URL.Path)
+	logDebugf("Received %s request for %s", r.Method, r.URL.Path)
 
 	switch r.Method {
 	case http.MethodPost:
 		var temp struct {
-			Name           string `json:"name"`
-			DistanceMethod string `json:"distance_function"`
-			DimensionCount int    `json:"vector_size"`
-			Quantization   int    `json:"quantization"`
+			Name           string  `json:"name"`
+			DistanceMethod string  `json:"distance_function"`
+			DimensionCount int     `json:"vector_size"`
+			Quantization   int     `json:"quantization"`
+			QuantMin       float64 `json:"quant_min"`
+			QuantMax       float64 `json:"quant_max"`
+			FitQuantRange  bool    `json:"fit_quant_range"`
+			Sparse         bool    `json:"sparse"`
+
+			SeparateVectors bool `json:"separate_vectors"`
+			UseWAL          bool `json:"use_wal"`
+			SkipChecksums   bool `json:"skip_checksums"`
+			WriteBufferSize int  `json:"write_buffer_size"`
+
+			NormalizeOnInsert bool     `json:"normalize_on_insert"`
+			WithNorms         bool     `json:"with_norms"`
+			Dedup             bool     `json:"dedup"`
+			DimensionPolicy   string   `json:"dimension_policy"`
+			IndexedFields     []string `json:"indexed_fields"`
+			LSHSeed           int64    `json:"lsh_seed"`
+			IndexType         string   `json:"index_type"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&temp); err != nil {
-			writeErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			writeBodyError(w, err)
 			return
 		}
 
-		log.Printf("Creating collection with options: %+v", temp)
+		logInfof("Creating collection with options: %+v", temp)
 
 		opts := CollectionOptions{
 			Name:           temp.Name,
 			DimensionCount: temp.DimensionCount,
 			Quantization:   temp.Quantization,
+			QuantMin:       temp.QuantMin,
+			QuantMax:       temp.QuantMax,
+			FitQuantRange:  temp.FitQuantRange,
+			Sparse:         temp.Sparse,
+
+			SeparateVectors: temp.SeparateVectors,
+			UseWAL:          temp.UseWAL,
+			SkipChecksums:   temp.SkipChecksums,
+			WriteBufferSize: temp.WriteBufferSize,
+
+			NormalizeOnInsert: temp.NormalizeOnInsert,
+			WithNorms:         temp.WithNorms,
+			Dedup:             temp.Dedup,
+			DimensionPolicy:   temp.DimensionPolicy,
+			IndexedFields:     temp.IndexedFields,
+			LSHSeed:           temp.LSHSeed,
+			IndexType:         temp.IndexType,
 		}
 
 		switch temp.DistanceMethod {
@@ -100,39 +300,53 @@ func (s *Server) handleCollections(w http.ResponseWriter, r *http.Request) {
 		}
 
 		name := opts.Name
-		opts.Name = s.collectionNameToFileName(name)
-
-		s.mutex.Lock()
-		if _, exists := s.collections[name]; exists {
-			s.mutex.Unlock()
-			writeErrorResponse(w, "Collection already exists", http.StatusBadRequest)
+		key, err := collectionKey(r, name)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		collection, err := NewCollection(opts)
-		if err != nil {
-			s.mutex.Unlock()
+		if !checkCollectionOwner(w, key) {
+			return
+		}
+		if _, err := s.CreateCollection(key, opts); errors.Is(err, ErrCollectionExists) {
+			writeErrorResponse(w, "Collection already exists", http.StatusBadRequest)
+			return
+		} else if err != nil {
 			writeErrorResponse(w, fmt.Sprintf("Failed to create collection: %v", err), http.StatusInternalServerError)
 			return
 		}
-		s.collections[name] = collection
-		s.mutex.Unlock()
 
-		log.Printf("Collection %s created successfully", name)
+		logInfof("Collection %s created successfully", name)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Collection created successfully.", "collection_name": name})
 
 	case http.MethodGet:
 		collectionsInfo := []collectionStatsWithName{}
 
+		tenant, err := requestTenant(r)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		s.mutex.Lock()
 		collections := make([]*Collection, 0, len(s.collections))
-		for _, collection := range s.collections {
-			collections = append(collections, collection)
+		for key, collection := range s.collections {
+			if tenantOfKey(key) == tenant {
+				collections = append(collections, collection)
+			}
 		}
 		s.mutex.Unlock()
 
+		// Sampling the average distance reads documents, so it is only done
+		// when asked for
+		averageDistance := r.URL.Query().Get("average_distance") == "true"
 		for _, collection := range collections {
-			collectionsInfo = append(collectionsInfo, s.getCollectionStats(collection))
+			if averageDistance {
+				collectionsInfo = append(collectionsInfo, s.getCollectionStats(collection))
+			} else {
+				collectionsInfo = append(collectionsInfo, s.getCollectionStatsLite(collection))
+			}
 		}
 
 		sort.Slice(collectionsInfo, func(i, j int) bool {
@@ -157,7 +371,11 @@ func (s *Server) handleGetCollectionIDs(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-	collectionName := parts[4]
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	s.mutex.Lock()
 	collection, exists := s.collections[collectionName]
@@ -174,14 +392,24 @@ func (s *Server) handleGetCollectionIDs(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *Server) handleCollection(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received %s request for %s", r.Method, r.URL.Path)
+	logDebugf("Received %s request for %s", r.Method, r.URL.Path)
 
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 5 {
 		writeErrorResponse(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-	collectionName := parts[4]
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPatch || r.Method == http.MethodDelete || r.Method == http.MethodPost {
+		if !checkCollectionOwner(w, collectionName) {
+			return
+		}
+	}
 
 	s.mutex.Lock()
 	collection, exists := s.collections[collectionName]
@@ -203,181 +431,1141 @@ func (s *Server) handleCollection(w http.ResponseWriter, r *http.Request) {
 			s.handleGetCollectionIDs(w, r)
 			return
 		}
-		log.Printf("Fetching info for collection %s", collectionName)
-		json.NewEncoder(w).Encode(s.getCollectionStats(collection))
+		if len(parts) == 7 && parts[5] == "compact" {
+			s.handleCompactionStatus(w, collectionName, parts[6])
+			return
+		}
+		if len(parts) == 6 && parts[5] == "options" {
+			s.handleGetCollectionOptions(w, collection)
+			return
+		}
+		if len(parts) == 6 && parts[5] == "index-stats" {
+			json.NewEncoder(w).Encode(collection.IndexStats())
+			return
+		}
+		logDebugf("Fetching info for collection %s", collectionName)
+		json.NewEncoder(w).Encode(struct {
+			collectionStatsWithName
+			Storage StorageBreakdown `json:"storage"`
+		}{s.getCollectionStats(collection), collection.StorageBreakdown()})
+
+	case http.MethodPatch:
+		s.handleUpdateCollection(w, r, collection)
+
+	case http.MethodPost:
+		if len(parts) == 6 && parts[5] == "rename" {
+			s.handleRenameCollection(w, r, collectionName)
+			return
+		}
+		if len(parts) == 6 && parts[5] == "swap" {
+			s.handleSwapCollection(w, r, collectionName)
+			return
+		}
+		if len(parts) == 6 && parts[5] == "compact" {
+			s.handleCompactCollection(w, collectionName, collection)
+			return
+		}
+		if len(parts) == 6 && parts[5] == "reembed" {
+			s.handleReembedCollection(w, collectionName)
+			return
+		}
+		writeErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
 
 	case http.MethodDelete:
-		log.Printf("Deleting collection %s", collectionName)
+		logInfof("Deleting collection %s", collectionName)
+		s.mutex.Lock()
+		if s.moving[collectionName] {
+			s.mutex.Unlock()
+			writeErrorResponse(w, ErrCollectionBusy.Error(), http.StatusConflict)
+			return
+		}
+		if s.moving == nil {
+			s.moving = make(map[string]bool)
+		}
+		s.moving[collectionName] = true
+		s.mutex.Unlock()
+
+		// The collection is closed before it is forgotten, so that it is
+		// kept if a long search holds it open past its LockTimeout
+		err := collection.Close()
 		s.mutex.Lock()
-		delete(s.collections, collectionName)
+		delete(s.moving, collectionName)
+		if err == nil {
+			delete(s.collections, collectionName)
+		}
 		s.mutex.Unlock()
-		collection.Close()
-		os.Remove(s.collectionNameToFileName(collectionName))
+		if errors.Is(err, ErrLockTimeout) {
+			writeErrorResponse(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			writeErrorResponse(w, fmt.Sprintf("Failed to close collection: %v", err), http.StatusInternalServerError)
+			return
+		}
+		removeCollectionFiles(s.collectionNameToFileName(collectionName))
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Collection deleted successfully."})
 	}
 }
 
-func (s *Server) handleInsertRecord(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 5 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
-	}
-	collectionName := parts[4]
-
+/*
+CreateCollection creates a collection with the given key and options, storing its
+file where the key says, whatever options.Name is. It returns ErrCollectionExists
+if there is already a collection with the key, or one is being created. Several
+collections can be created at once.
+*/
+func (s *Server) CreateCollection(key string, options CollectionOptions) (*Collection, error) {
 	s.mutex.Lock()
-	collection, exists := s.collections[collectionName]
-	s.mutex.Unlock()
-
-	if !exists {
-		http.Error(w, "Collection not found", http.StatusNotFound)
-		return
+	if _, exists := s.collections[key]; exists || s.creating[key] || s.moving[key] {
+		s.mutex.Unlock()
+		return nil, ErrCollectionExists
 	}
-
-	var records []struct {
-		ID       uint64            `json:"id"`
-		Vector   []float64         `json:"vector,omitempty"`
-		Text     string            `json:"text,omitempty"`
-		Metadata map[string]string `json:"metadata"`
+	if s.creating == nil {
+		s.creating = make(map[string]bool)
 	}
+	s.creating[key] = true
+	s.mutex.Unlock()
 
-	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	collection, err := s.createCollectionFile(key, options)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.creating, key)
+	if err != nil {
+		return nil, err
 	}
+	s.collections[key] = collection
+	return collection, nil
+}
 
-	// Collect all texts that need to be embedded
-	var textsToEmbed []string
-	textIndices := make(map[int]int) // Map from text index to record index
-	for i, record := range records {
-		if record.Text != "" && record.Vector == nil {
-			textIndices[len(textsToEmbed)] = i
-			textsToEmbed = append(textsToEmbed, record.Text)
-		}
+func (s *Server) createCollectionFile(key string, options CollectionOptions) (*Collection, error) {
+	options.Name = s.collectionNameToFileName(key)
+	if err := os.MkdirAll(filepath.Dir(options.Name), 0755); err != nil {
+		return nil, err
 	}
+	return NewCollection(options)
+}
 
-	// Call embedText once for all texts
-	if len(textsToEmbed) > 0 {
-		vectors, err := embedText(textsToEmbed, false) // Don't cache for inserts
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to convert text to vector: %v", err), http.StatusInternalServerError)
-			return
-		}
+// Errors returned by CreateCollection, RenameCollection and SwapCollection.
+var (
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrCollectionExists   = errors.New("collection already exists")
+	ErrCollectionBusy     = errors.New("collection is being swapped or renamed")
+)
 
-		// Assign the resulting vectors back to the corresponding records
-		for textIndex, recordIndex := range textIndices {
-			records[recordIndex].Vector = vectors[textIndex]
-		}
+/*
+RenameCollection renames a collection, given the keys of its old and new names,
+and moves its files to match. It returns ErrCollectionNotFound if there is no
+collection with the old name, ErrCollectionExists if there is already one with
+the new name, and ErrCollectionBusy if the collection is being swapped or
+renamed.
+*/
+func (s *Server) RenameCollection(oldName, newName string) error {
+	s.mutex.Lock()
+	collection, exists := s.collections[oldName]
+	newFile := s.collectionNameToFileName(newName)
+	var err error
+	switch {
+	case !exists:
+		err = ErrCollectionNotFound
+	case s.moving[oldName]:
+		err = ErrCollectionBusy
+	case s.collections[newName] != nil || s.creating[newName] || s.moving[newName]:
+		err = ErrCollectionExists
 	}
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	if s.moving == nil {
+		s.moving = make(map[string]bool)
+	}
+	s.moving[oldName] = true
+	s.moving[newName] = true
+	s.mutex.Unlock()
 
-	for _, record := range records {
-		// Ensure a vector is present
-		if record.Vector == nil {
-			http.Error(w, "Either vector or text must be provided", http.StatusBadRequest)
-			return
-		}
-
-		metadataBytes, err := json.Marshal(record.Metadata)
-		if err != nil {
-			http.Error(w, "Failed to encode metadata", http.StatusInternalServerError)
-			return
-		}
+	// The rename waits for the searches of the collection, so the mutex isn't
+	// held for it
+	err = renameCollectionFile(collection, newFile, newName)
 
-		collection.AddDocument(record.ID, record.Vector, metadataBytes)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.moving, oldName)
+	delete(s.moving, newName)
+	if err != nil {
+		return err
 	}
+	delete(s.collections, oldName)
+	s.collections[newName] = collection
+	return nil
+}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Records inserted successfully."})
+// renameCollectionFile moves the files of a collection to newFile, which must
+// not exist yet.
+func renameCollectionFile(collection *Collection, newFile, newName string) error {
+	if _, err := os.Stat(newFile); err == nil {
+		return ErrCollectionExists
+	}
+	if err := os.MkdirAll(filepath.Dir(newFile), 0755); err != nil {
+		return fmt.Errorf("failed to create folder for %s: %v", newName, err)
+	}
+	return collection.rename(newFile)
 }
 
-func (s *Server) handleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 6 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+// handleRenameCollection renames a collection to the new_name given in the
+// request body.
+func (s *Server) handleRenameCollection(w http.ResponseWriter, r *http.Request, collectionName string) {
+	var request struct {
+		NewName string `json:"new_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
 		return
 	}
-	collectionName := parts[4]
-	id, err := strconv.ParseUint(parts[len(parts)-2], 10, 64)
+	if request.NewName == "" {
+		writeErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	newName, err := collectionKey(r, request.NewName)
 	if err != nil {
-		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, newName) {
 		return
 	}
 
-	s.mutex.Lock()
-	collection, exists := s.collections[collectionName]
-	s.mutex.Unlock()
-
-	if !exists {
-		http.Error(w, "Collection not found", http.StatusNotFound)
+	logInfof("Renaming collection %s to %s", collectionName, newName)
+	err = s.RenameCollection(collectionName, newName)
+	switch {
+	case errors.Is(err, ErrCollectionExists):
+		writeErrorResponse(w, "Collection already exists", http.StatusConflict)
+		return
+	case errors.Is(err, ErrCollectionBusy):
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrCollectionNotFound):
+		writeErrorResponse(w, "Collection not found", http.StatusNotFound)
+		return
+	case err != nil:
+		writeErrorResponse(w, fmt.Sprintf("Failed to rename collection: %v", err), http.StatusInternalServerError)
 		return
 	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Collection renamed successfully.", "collection_name": request.NewName})
+}
 
-	var metadata struct {
-		Metadata map[string]string `json:"metadata"`
+/*
+SwapCollection replaces the contents of a collection with those of a staging
+collection, given their keys, so that a new version of a collection can be built
+in full before it is searched. The staging collection takes the name and files of
+the live one, whose old files are removed, and searches of the live name find the
+new documents as soon as it returns. Searches already running on the old
+contents are finished before its files are closed, and writes waiting for them
+are made to the new contents instead. It returns
+ErrCollectionNotFound if either collection doesn't exist, ErrCollectionBusy if
+either is already being swapped, and ErrCompactionRunning if either is being
+compacted.
+*/
+func (s *Server) SwapCollection(name, stagingName string) error {
+	s.mutex.Lock()
+	live, exists := s.collections[name]
+	staging, stagingExists := s.collections[stagingName]
+	var err error
+	switch {
+	case !exists || !stagingExists:
+		err = ErrCollectionNotFound
+	case live == staging:
+		err = fmt.Errorf("cannot swap collection %s with itself", name)
+	case s.moving[name] || s.moving[stagingName]:
+		err = ErrCollectionBusy
+	case live.compacting.Load() || staging.compacting.Load():
+		err = ErrCompactionRunning
 	}
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	if s.moving == nil {
+		s.moving = make(map[string]bool)
+	}
+	s.moving[name] = true
+	s.moving[stagingName] = true
+	s.mutex.Unlock()
 
-	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	// The renames wait for the searches of each collection, so the mutex
+	// isn't held for them. The old files are moved aside first, so that they
+	// can be put back if the staging collection can't take their place. The
+	// live collection stays locked until it is closed, so that no write is
+	// made to the old files once they are moved, and writes waiting for it
+	// go to the staging collection instead.
+	liveFile := s.collectionNameToFileName(name)
+	oldFile := liveFile + ".swap"
+	err = live.lock()
+	if err == nil {
+		if err = live.renameUnlocked(oldFile); err == nil {
+			if err = staging.rename(liveFile); err != nil {
+				live.renameUnlocked(liveFile)
+			}
+		}
+		if err != nil {
+			live.mutex.Unlock()
+		}
 	}
 
-	// Encode new metadata to JSON
-	metadataBytes, err := json.Marshal(metadata.Metadata)
+	s.mutex.Lock()
+	delete(s.moving, name)
+	delete(s.moving, stagingName)
+	if err == nil {
+		delete(s.collections, stagingName)
+		s.collections[name] = staging
+	}
+	s.mutex.Unlock()
 	if err != nil {
-		http.Error(w, "Failed to encode metadata", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	if err := collection.UpdateDocument(id, metadataBytes); err != nil {
-		http.Error(w, "Record not found", http.StatusNotFound)
-		return
+	err = live.close()
+	live.mutex.Unlock()
+	if err != nil {
+		logWarnf("Warning -- failed to close the old contents of %s: %v", name, err)
 	}
+	removeCollectionFiles(oldFile)
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Metadata updated successfully.", "id": id})
+// removeCollectionFiles removes the files of a closed collection.
+func removeCollectionFiles(fileName string) {
+	os.Remove(fileName)
+	os.Remove(vectorFileName(fileName))
+	os.Remove(walFileName(fileName))
+	os.Remove(walFileName(vectorFileName(fileName)))
 }
 
-func (s *Server) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 7 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+// handleSwapCollection replaces the contents of a collection with those of the
+// staging collection named in the request body.
+func (s *Server) handleSwapCollection(w http.ResponseWriter, r *http.Request, collectionName string) {
+	var request struct {
+		StagingName string `json:"staging_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
 		return
 	}
-	collectionName := parts[4]
-	id, err := strconv.ParseUint(parts[6], 10, 64)
+	if request.StagingName == "" {
+		writeErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	stagingName, err := collectionKey(r, request.StagingName)
 	if err != nil {
-		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	s.mutex.Lock()
-	collection, exists := s.collections[collectionName]
-	s.mutex.Unlock()
-
-	if !exists {
-		http.Error(w, "Collection not found", http.StatusNotFound)
+	if !checkCollectionOwner(w, stagingName) {
 		return
 	}
-
-	if err := collection.removeDocument(id); err != nil {
-		http.Error(w, "Record not found", http.StatusNotFound)
+	if stagingName == collectionName {
+		writeErrorResponse(w, "Cannot swap a collection with itself", http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Record deleted successfully.", "id": id})
-}
-func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 5 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	logInfof("Swapping collection %s with %s", collectionName, stagingName)
+	err = s.SwapCollection(collectionName, stagingName)
+	switch {
+	case errors.Is(err, ErrCollectionNotFound):
+		writeErrorResponse(w, "Collection not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrCollectionBusy), errors.Is(err, ErrCompactionRunning):
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		writeErrorResponse(w, fmt.Sprintf("Failed to swap collection: %v", err), http.StatusInternalServerError)
 		return
 	}
-	collectionName := parts[4]
+	json.NewEncoder(w).Encode(map[string]string{"message": "Collection swapped successfully."})
+}
 
+// handleCompactCollection starts compacting a collection in the background and
+// returns the ID of the job, which handleCompactionStatus reports on.
+func (s *Server) handleCompactCollection(w http.ResponseWriter, collectionName string, collection *Collection) {
+	// The compaction is started with the mutex held, so that SwapCollection
+	// sees it
 	s.mutex.Lock()
-	collection, exists := s.collections[collectionName]
+	if s.moving[collectionName] {
+		s.mutex.Unlock()
+		writeErrorResponse(w, ErrCollectionBusy.Error(), http.StatusConflict)
+		return
+	}
+	job, err := collection.CompactAsync()
+	s.mutex.Unlock()
+	if errors.Is(err, ErrCompactionRunning) {
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		writeErrorResponse(w, fmt.Sprintf("Failed to start compaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	if s.compactions == nil {
+		s.compactions = make(map[string]serverCompaction)
+	}
+	expired := time.Now().Add(-compactionJobRetention)
+	for jobID, compaction := range s.compactions {
+		if compaction.job.finishedBefore(expired) {
+			delete(s.compactions, jobID)
+		}
+	}
+	s.nextJobID++
+	jobID := strconv.Itoa(s.nextJobID)
+	s.compactions[jobID] = serverCompaction{collection: collectionName, job: job}
+	s.mutex.Unlock()
+
+	logInfof("Started compaction %s of collection %s", jobID, collectionName)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Compaction started.", "job_id": jobID})
+}
+
+// handleCompactionStatus reports the progress of a compaction started by
+// handleCompactCollection.
+func (s *Server) handleCompactionStatus(w http.ResponseWriter, collectionName, jobID string) {
+	s.mutex.Lock()
+	compaction, exists := s.compactions[jobID]
+	s.mutex.Unlock()
+	if !exists || compaction.collection != collectionName {
+		writeErrorResponse(w, "Compaction job not found", http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		JobID    string  `json:"job_id"`
+		Status   string  `json:"status"`
+		Progress float64 `json:"progress"`
+		Error    string  `json:"error,omitempty"`
+	}{JobID: jobID, Status: "running", Progress: compaction.job.Progress()}
+	finished, err := compaction.job.Result()
+	switch {
+	case !finished:
+	case errors.Is(err, ErrCompactionCancelled):
+		response.Status = "cancelled"
+	case err != nil:
+		response.Status = "failed"
+		response.Error = err.Error()
+	default:
+		response.Status = "done"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// reembedBatchSize is the number of texts ReembedCollection embeds at once.
+const reembedBatchSize = 100
+
+// ReembedResult counts the documents of a collection that ReembedCollection
+// embedded again, and those it skipped because they have no stored text.
+type ReembedResult struct {
+	Reembedded int `json:"reembedded"`
+	Skipped    int `json:"skipped"`
+}
+
+/*
+ReembedCollection computes the vectors of a collection's documents again from
+the text kept in their metadata by store_text, for example after changing the
+text model. The texts are passed to embed in batches. Documents without a stored
+text are skipped. It returns ErrCollectionNotFound if there is no collection
+with the name. If it fails part way, the documents counted in the result have
+their new vectors.
+*/
+func (s *Server) ReembedCollection(name string, embed func(texts []string) ([][]float64, error)) (ReembedResult, error) {
+	var result ReembedResult
+	s.mutex.Lock()
+	collection, exists := s.collections[name]
+	s.mutex.Unlock()
+	if !exists {
+		return result, ErrCollectionNotFound
+	}
+
+	var ids []uint64
+	var texts []string
+	err := collection.IterateBySequence(func(doc *Document) bool {
+		var metadata map[string]interface{}
+		json.Unmarshal(doc.Metadata, &metadata)
+		if text, ok := metadata[storedTextField].(string); ok && text != "" {
+			ids = append(ids, doc.ID)
+			texts = append(texts, text)
+		} else {
+			result.Skipped++
+		}
+		return true
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for start := 0; start < len(texts); start += reembedBatchSize {
+		end := min(start+reembedBatchSize, len(texts))
+		vectors, err := embed(texts[start:end])
+		if err != nil {
+			return result, fmt.Errorf("failed to embed texts: %v", err)
+		}
+		if len(vectors) != end-start {
+			return result, fmt.Errorf("failed to embed texts: got %d vectors for %d texts", len(vectors), end-start)
+		}
+		for i, vector := range vectors {
+			err := collection.UpdateDocumentVector(ids[start+i], vector)
+			if errors.Is(err, ErrRecordNotFound) {
+				// The document was removed since it was read
+				result.Skipped++
+				continue
+			} else if err != nil {
+				return result, fmt.Errorf("document %d: %w", ids[start+i], err)
+			}
+			result.Reembedded++
+		}
+	}
+	return result, nil
+}
+
+// handleReembedCollection embeds the stored texts of a collection's documents
+// again with the text model.
+func (s *Server) handleReembedCollection(w http.ResponseWriter, collectionName string) {
+	logInfof("Re-embedding collection %s", collectionName)
+	result, err := s.ReembedCollection(collectionName, func(texts []string) ([][]float64, error) {
+		return embedText(texts, false)
+	})
+	if errors.Is(err, ErrCollectionNotFound) {
+		writeErrorResponse(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeErrorResponse(w, fmt.Sprintf("Failed to re-embed collection after %d documents: %v", result.Reembedded, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+		ReembedResult
+	}{"Collection re-embedded successfully.", result})
+}
+
+// handleGetCollectionOptions returns the options of a collection, with the
+// collection's name in place of the path of its file.
+func (s *Server) handleGetCollectionOptions(w http.ResponseWriter, collection *Collection) {
+	options := collection.GetOptions()
+	options.Name = s.fileNameToCollectionName(options.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// handleUpdateCollection changes the options of an existing collection. Options
+// that would require rewriting the stored vectors are rejected with 409 Conflict.
+func (s *Server) handleUpdateCollection(w http.ResponseWriter, r *http.Request, collection *Collection) {
+	var temp struct {
+		DistanceMethod *string `json:"distance_function"`
+		DimensionCount *int    `json:"vector_size"`
+		Quantization   *int    `json:"quantization"`
+		LSHTrees       *int    `json:"lsh_trees"`
+		LSHLeafSize    *int    `json:"lsh_leaf_size"`
+
+		AutoCompactThreshold *float64  `json:"auto_compact_threshold"`
+		IndexedFields        *[]string `json:"indexed_fields"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&temp); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	opts := collection.GetOptions()
+	if temp.DistanceMethod != nil {
+		switch *temp.DistanceMethod {
+		case "euclidean":
+			opts.DistanceMethod = Euclidean
+		case "cosine":
+			opts.DistanceMethod = Cosine
+		default:
+			writeErrorResponse(w, "Invalid distance method", http.StatusBadRequest)
+			return
+		}
+	}
+	if temp.DimensionCount != nil {
+		opts.DimensionCount = *temp.DimensionCount
+	}
+	if temp.Quantization != nil {
+		opts.Quantization = *temp.Quantization
+	}
+	if temp.LSHTrees != nil {
+		opts.LSHTrees = *temp.LSHTrees
+	}
+	if temp.LSHLeafSize != nil {
+		opts.LSHLeafSize = *temp.LSHLeafSize
+	}
+	if temp.AutoCompactThreshold != nil {
+		opts.AutoCompactThreshold = *temp.AutoCompactThreshold
+	}
+	if temp.IndexedFields != nil {
+		opts.IndexedFields = *temp.IndexedFields
+	}
+
+	if err := collection.UpdateOptions(opts); err != nil {
+		if errors.Is(err, ErrImmutableOption) {
+			writeErrorResponse(w, err.Error(), http.StatusConflict)
+		} else {
+			writeErrorResponse(w, fmt.Sprintf("Failed to update collection: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(s.getCollectionStats(collection))
+}
+
+func (s *Server) handleInsertRecord(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, collectionName) {
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	withIdempotencyKey(w, r, collectionName, func(w http.ResponseWriter) {
+		s.insertRecords(w, r, collectionName, collection)
+	})
+}
+
+// storedTextField is the metadata field that holds the text of a record
+// inserted with store_text.
+const storedTextField = "text"
+
+// insertRecords adds or replaces the records in the body of the request.
+func (s *Server) insertRecords(w http.ResponseWriter, r *http.Request, collectionName string, collection *Collection) {
+	var records []struct {
+		ID       uint64            `json:"id"`
+		Vector   []float64         `json:"vector,omitempty"`
+		Text     string            `json:"text,omitempty"`
+		Metadata map[string]string `json:"metadata"`
+
+		// StoreText keeps Text in the metadata, so that it can be shown
+		// or embedded again with another model.
+		StoreText bool `json:"store_text,omitempty"`
+
+		// OnDuplicate decides what happens when a record with the ID
+		// already exists. See AddDocumentWithPolicy.
+		OnDuplicate string `json:"on_duplicate,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// Collect all texts that need to be embedded
+	var textsToEmbed []string
+	textIndices := make(map[int]int) // Map from text index to record index
+	for i, record := range records {
+		if record.Text != "" && record.Vector == nil {
+			textIndices[len(textsToEmbed)] = i
+			textsToEmbed = append(textsToEmbed, record.Text)
+		}
+	}
+
+	// Call embedText once for all texts
+	if len(textsToEmbed) > 0 {
+		vectors, err := embedText(textsToEmbed, false) // Don't cache for inserts
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to convert text to vector: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Assign the resulting vectors back to the corresponding records
+		for textIndex, recordIndex := range textIndices {
+			records[recordIndex].Vector = vectors[textIndex]
+		}
+	}
+
+	policy := collection.GetOptions().DimensionPolicy
+	for i, record := range records {
+		// Ensure a vector is present
+		if record.Vector == nil {
+			http.Error(w, "Either vector or text must be provided", http.StatusBadRequest)
+			return
+		}
+		record.Vector = applyDimensionPolicy(policy, record.Vector, collection.DimensionCount)
+		records[i].Vector = record.Vector
+		if err := checkVectorDimensions(collection, record.Vector, record.Text != ""); err != nil {
+			http.Error(w, fmt.Sprintf("Record %d: %v", record.ID, err), http.StatusBadRequest)
+			return
+		}
+		if err := validateVector(record.Vector); err != nil {
+			http.Error(w, fmt.Sprintf("Record %d: %v", record.ID, err), http.StatusBadRequest)
+			return
+		}
+		if err := checkDuplicatePolicy(record.OnDuplicate); err != nil {
+			http.Error(w, fmt.Sprintf("Record %d: %v", record.ID, err), http.StatusBadRequest)
+			return
+		}
+		if record.StoreText && record.Text != "" {
+			if _, exists := record.Metadata[storedTextField]; exists {
+				http.Error(w, fmt.Sprintf("Record %d: metadata already has a %q field to store the text in", record.ID, storedTextField), http.StatusBadRequest)
+				return
+			}
+			if record.Metadata == nil {
+				records[i].Metadata = make(map[string]string)
+			}
+			records[i].Metadata[storedTextField] = record.Text
+		}
+	}
+
+	// Fit the quantization range to the first vectors added, when asked to
+	if collection.FitQuantRange {
+		vectors := make([][]float64, len(records))
+		for i, record := range records {
+			vectors[i] = record.Vector
+		}
+		if err := collection.FitQuantizationRange(vectors); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fit quantization range: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	docs := make([]Document, len(records))
+	policies := make([]string, len(records))
+	for i, record := range records {
+		metadataBytes, err := json.Marshal(record.Metadata)
+		if err != nil {
+			http.Error(w, "Failed to encode metadata", http.StatusInternalServerError)
+			return
+		}
+		docs[i] = Document{ID: record.ID, Vector: record.Vector, Metadata: metadataBytes}
+		policies[i] = record.OnDuplicate
+	}
+
+	// No record is written if one of them conflicts. If the collection is
+	// swapped, the records are added to the collection that replaced it.
+	var added []bool
+	err := s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		var err error
+		added, err = collection.AddDocumentsWithPolicy(docs, policies)
+		return err
+	})
+	switch {
+	case errors.Is(err, ErrCollectionClosed):
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrDuplicateID):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	skipped := []uint64{}
+	for i, record := range records {
+		if !added[i] {
+			skipped = append(skipped, record.ID)
+		}
+	}
+
+	response := map[string]interface{}{"message": "Records inserted successfully."}
+	if len(skipped) > 0 {
+		response["skipped"] = skipped
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 6 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, collectionName) {
+		return
+	}
+	id, err := strconv.ParseUint(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	var metadata struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// Encode new metadata to JSON
+	metadataBytes, err := json.Marshal(metadata.Metadata)
+	if err != nil {
+		http.Error(w, "Failed to encode metadata", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		return collection.UpdateDocument(id, metadataBytes)
+	})
+	if errors.Is(err, ErrCollectionClosed) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Metadata updated successfully.", "id": id})
+}
+
+// handleUpdateMetadataBatch replaces the metadata of several records, given as
+// an array of {id, metadata} objects.
+func (s *Server) handleUpdateMetadataBatch(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 7 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, collectionName) {
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	var records []struct {
+		ID       uint64            `json:"id"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	ids := make([]uint64, len(records))
+	metadata := make([][]byte, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+		metadata[i], err = json.Marshal(record.Metadata)
+		if err != nil {
+			http.Error(w, "Failed to encode metadata", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		return collection.UpdateDocuments(ids, metadata)
+	})
+	if errors.Is(err, ErrCollectionClosed) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		// The other records were still updated, so say which ones failed
+		failed := failedDocuments(err)
+		if len(failed) == 0 {
+			writeErrorResponse(w, fmt.Sprintf("Failed to update records: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		logInfof("Error: some records were not updated: %v, Status Code: %d", err, status)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": fmt.Sprintf("Some records were not updated: %v", err),
+			"count":   len(records) - len(failed),
+			"failed":  failed,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Metadata updated successfully.", "count": len(records)})
+}
+
+// handleSetMetadataField sets one field of a record's metadata, named by a
+// dotted path at the end of the URL, to the value in the request body.
+func (s *Server) handleSetMetadataField(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 9 || parts[5] != "records" || parts[7] != "metadata" || parts[8] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, collectionName) {
+		return
+	}
+	id, err := strconv.ParseUint(parts[6], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	err = s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		return collection.SetMetadataField(id, parts[8], request.Value)
+	})
+	if err != nil {
+		if errors.Is(err, ErrCollectionClosed) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		} else if errors.Is(err, ErrRecordNotFound) {
+			http.Error(w, "Record not found", http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to set metadata field: %v", err), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Metadata updated successfully.", "id": id})
+}
+
+// handleRecordStream reads (GET) or replaces (PUT) a data stream of a record,
+// named by its ID at the end of the URL. The stream is sent as raw bytes.
+func (s *Server) handleRecordStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 9 || parts[5] != "records" || parts[7] != "streams" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPut && !checkCollectionOwner(w, collectionName) {
+		return
+	}
+	id, err := strconv.ParseUint(parts[6], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return
+	}
+	streamID, err := strconv.ParseUint(parts[8], 10, 8)
+	if err != nil {
+		http.Error(w, "Invalid stream ID", http.StatusBadRequest)
+		return
+	}
+	if err := checkCustomStreamID(uint8(streamID)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var data []byte
+		var contentType string
+		err := s.retryClosed(collectionName, collection, func(collection *Collection) error {
+			var err error
+			data, contentType, err = collection.GetStreamWithType(id, uint8(streamID))
+			return err
+		})
+		if errors.Is(err, ErrCollectionClosed) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrRecordNotFound) {
+			http.Error(w, "Record not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrStreamNotFound) {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read stream: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+		return
+	}
+
+	// The stream takes the type of the request body, except for the form
+	// encoding that curl sends by default with --data-binary
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "application/x-www-form-urlencoded" {
+		contentType = ""
+	}
+	if err := checkContentType(contentType); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	err = s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		return collection.SetStreamWithType(id, uint8(streamID), data, contentType)
+	})
+	if errors.Is(err, ErrCollectionClosed) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrRecordNotFound) {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write stream: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Stream updated successfully.", "id": id, "stream_id": streamID})
+}
+
+func (s *Server) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 7 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionOwner(w, collectionName) {
+		return
+	}
+	id, err := strconv.ParseUint(parts[6], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
+	s.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	err = s.retryClosed(collectionName, collection, func(collection *Collection) error {
+		return collection.removeDocument(id)
+	})
+	if errors.Is(err, ErrCollectionClosed) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Record deleted successfully.", "id": id})
+}
+
+// resultMetadata returns the metadata of a search result as a map, reusing the
+// copy decoded by the filter when there is one.
+func resultMetadata(result SearchResult) (map[string]interface{}, error) {
+	if parsed, ok := result.ParsedMetadata.(map[string]interface{}); ok {
+		return parsed, nil
+	}
+	var metadata map[string]interface{}
+	err := json.Unmarshal(result.Metadata, &metadata)
+	return metadata, err
+}
+
+// dropInvalidMetadata removes the results whose metadata isn't valid JSON, as
+// the JSON responses do unless keep_invalid_metadata is set.
+func dropInvalidMetadata(results []SearchResult) []SearchResult {
+	valid := results[:0]
+	for _, result := range results {
+		if _, err := resultMetadata(result); err != nil {
+			logWarnf("Error decoding metadata for ID %d: %v", result.ID, err)
+			continue
+		}
+		valid = append(valid, result)
+	}
+	return valid
+}
+
+func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	collectionName, err := collectionKey(r, parts[4])
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	collection, exists := s.collections[collectionName]
 	s.mutex.Unlock()
 
 	if !exists {
@@ -396,9 +1584,21 @@ func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
 		K         int       `json:"k,omitempty"`
 		Precision string    `json:"precision,omitempty"`
 		Filter    string    `json:"filter,omitempty"`
+		ScoreType string    `json:"score_type,omitempty"`
+		Sort      string    `json:"sort,omitempty"`
+		Stream    bool      `json:"stream,omitempty"`
+
+		KeepInvalidMetadata bool     `json:"keep_invalid_metadata,omitempty"`
+		ExcludeIDs          []uint64 `json:"exclude_ids,omitempty"`
+		Facets              []string `json:"facets,omitempty"`
+		Farthest            bool     `json:"farthest,omitempty"`
+
+		// Vectors are averaged into the query vector
+		Vectors [][]float64 `json:"vectors,omitempty"`
 	}
 
-	if r.Method == http.MethodGet {
+	binaryRequest := r.Method == http.MethodPost && isBinaryContentType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodGet || binaryRequest {
 		query := r.URL.Query()
 		searchArgs.Offset, _ = strconv.Atoi(query.Get("offset"))
 		searchArgs.Limit, _ = strconv.Atoi(query.Get("limit"))
@@ -407,9 +1607,25 @@ func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
 		searchRequest.Text = query.Get("text")
 		searchArgs.Precision = query.Get("precision")
 		searchRequest.Filter = query.Get("filter")
+		searchArgs.ScoreType = query.Get("score_type")
+		searchArgs.SortBy = query.Get("sort")
+		searchRequest.Stream, _ = strconv.ParseBool(query.Get("stream"))
+		searchRequest.KeepInvalidMetadata, _ = strconv.ParseBool(query.Get("keep_invalid_metadata"))
+		searchArgs.Farthest, _ = strconv.ParseBool(query.Get("farthest"))
+		if facets := query.Get("facets"); facets != "" {
+			searchArgs.Facets = strings.Split(facets, ",")
+		}
+		if binaryRequest {
+			if err := readBinarySearchRequest(r.Body, &searchArgs); err != nil {
+				if !writeBodyTooLarge(w, err) {
+					http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+				}
+				return
+			}
+		}
 	} else if r.Method == http.MethodPost {
 		if err := json.NewDecoder(r.Body).Decode(&searchRequest); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			writeBodyError(w, err)
 			return
 		}
 
@@ -420,19 +1636,61 @@ func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
 			Radius:    searchRequest.Radius,
 			K:         searchRequest.K,
 			Precision: searchRequest.Precision,
+			ScoreType: searchRequest.ScoreType,
+			SortBy:    searchRequest.Sort,
+
+			ExcludeIDs: searchRequest.ExcludeIDs,
+			Facets:     searchRequest.Facets,
+			Farthest:   searchRequest.Farthest,
+		}
+
+		if len(searchRequest.Vectors) > 0 {
+			if searchRequest.Vector != nil || searchRequest.Text != "" {
+				http.Error(w, "Invalid request: give only one of vector, vectors and text", http.StatusBadRequest)
+				return
+			}
+			for _, vector := range searchRequest.Vectors {
+				if err := checkVectorDimensions(collection, vector, false); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			searchArgs.Vector, err = Centroid(searchRequest.Vectors)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 	} else {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if searchArgs.K > maxSearchK() {
+		http.Error(w, fmt.Sprintf("Invalid k: must be at most %d", maxSearchK()), http.StatusBadRequest)
+		return
+	}
+	if searchArgs.Limit > maxSearchLimit() {
+		http.Error(w, fmt.Sprintf("Invalid limit: must be at most %d", maxSearchLimit()), http.StatusBadRequest)
+		return
+	}
+
 	if searchRequest.Filter != "" {
-		filterFn, err := BuildFilter(searchRequest.Filter)
-		if err != nil {
+		if _, err := BuildParsedFilter(searchRequest.Filter); err != nil {
 			http.Error(w, fmt.Sprintf("Invalid filter query: %v", err), http.StatusBadRequest)
 			return
 		}
-		searchArgs.Filter = filterFn
+		searchArgs.FilterQuery = searchRequest.Filter
+	}
+
+	if _, err := collection.scoreFunction(searchArgs.ScoreType); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid score type: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := resultOrder(searchArgs.SortBy); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sort: %v", err), http.StatusBadRequest)
+		return
 	}
 
 	var embeddingTime time.Duration
@@ -447,45 +1705,303 @@ func (s *Server) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
 		embeddingTime = time.Since(startEmbed)
 	}
 
-	startSearch := time.Now()
-	results := collection.Search(searchArgs)
-	searchTime := time.Since(startSearch)
+	if searchArgs.Vector != nil {
+		if err := checkVectorDimensions(collection, searchArgs.Vector, searchRequest.Text != ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateVector(searchArgs.Vector); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout, err := searchTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeout > 0 {
+		searchArgs.Deadline = time.Now().Add(timeout)
+	}
+
 	type jsonSearchResult struct {
 		ID       uint64                 `json:"id"`
 		Metadata map[string]interface{} `json:"metadata"`
 		Distance float64                `json:"distance"`
+		Score    *float64               `json:"score,omitempty"`
+
+		// Set instead of Metadata when the metadata isn't valid JSON and
+		// keep_invalid_metadata was requested. RawMetadata is base64 encoded.
+		MetadataError string `json:"metadata_error,omitempty"`
+		RawMetadata   []byte `json:"raw_metadata,omitempty"`
+	}
+
+	toJSON := func(result SearchResult) (jsonSearchResult, bool) {
+		jsonResult := jsonSearchResult{
+			ID:       result.ID,
+			Distance: result.Distance,
+		}
+		metadata, err := resultMetadata(result)
+		if err != nil {
+			logWarnf("Error decoding metadata for ID %d: %v", result.ID, err)
+			if !searchRequest.KeepInvalidMetadata {
+				return jsonSearchResult{}, false
+			}
+			jsonResult.MetadataError = err.Error()
+			jsonResult.RawMetadata = result.Metadata
+		}
+		jsonResult.Metadata = metadata
+		if searchArgs.ScoreType != "" && searchArgs.ScoreType != "distance" {
+			score := result.Score
+			jsonResult.Score = &score
+		}
+		return jsonResult, true
+	}
+
+	if isBinaryContentType(r.Header.Get("Accept")) {
+		results, err := s.searchCollection(collectionName, collection, searchArgs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Search failed: %v", err), searchErrorStatus(err))
+			return
+		}
+		if !searchRequest.KeepInvalidMetadata {
+			results.Results = dropInvalidMetadata(results.Results)
+		}
+		writeBinarySearchResults(w, results)
+		return
+	}
+
+	if searchRequest.Stream {
+		// Write each result on its own line as soon as it is found. The
+		// search runs in its own goroutine and queues copies of the results,
+		// so that a slow client doesn't keep the collection locked. Stop
+		// searching if the client goes away.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		queue := newResultQueue()
+		var stopped atomic.Bool
+		searched := make(chan error, 1)
+		go func() {
+			searched <- s.retryClosed(collectionName, collection, func(collection *Collection) error {
+				_, err := collection.searchStream(searchArgs, func(result SearchResult) bool {
+					if stopped.Load() {
+						return false
+					}
+					result.Metadata = bytes.Clone(result.Metadata)
+					queue.push(result)
+					return true
+				})
+				return err
+			})
+			queue.close()
+		}()
+
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+	write:
+		for {
+			results, more := queue.next()
+			if !more {
+				break
+			}
+			for _, result := range results {
+				jsonResult, ok := toJSON(result)
+				if !ok {
+					continue
+				}
+				if err := encoder.Encode(jsonResult); err != nil {
+					stopped.Store(true)
+					break write
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err := <-searched; err != nil {
+			logWarnf("Warning -- search failed: %v", err)
+		}
+		return
+	}
+
+	startSearch := time.Now()
+	results, err := s.searchCollection(collectionName, collection, searchArgs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Search failed: %v", err), searchErrorStatus(err))
+		return
 	}
+	searchTime := time.Since(startSearch)
+	s.searchLatency.record(searchTime)
 
 	jsonResults := make([]jsonSearchResult, 0, len(results.Results))
 	for _, result := range results.Results {
-		var metadata map[string]interface{}
-		if err := json.Unmarshal(result.Metadata, &metadata); err != nil {
-			log.Printf("Error decoding metadata for ID %d: %v", result.ID, err)
-			continue
+		if jsonResult, ok := toJSON(result); ok {
+			jsonResults = append(jsonResults, jsonResult)
 		}
-		jsonResults = append(jsonResults, jsonSearchResult{
-			ID:       result.ID,
-			Metadata: metadata,
-			Distance: result.Distance,
-		})
 	}
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(struct {
+	err = json.NewEncoder(w).Encode(struct {
 		Results         []jsonSearchResult `json:"results"`
 		PercentSearched float64            `json:"percent_searched"`
 		SearchTime      int64              `json:"search_time"`
 		EmbeddingTime   int64              `json:"embedding_time"`
+		TimedOut        bool               `json:"timed_out,omitempty"`
+
+		Facets map[string]map[string]int `json:"facets,omitempty"`
 	}{
 		Results:         jsonResults,
 		PercentSearched: results.PercentSearched,
 		SearchTime:      searchTime.Milliseconds(),
 		EmbeddingTime:   embeddingTime.Milliseconds(),
+		TimedOut:        results.TimedOut,
+
+		Facets: results.Facets,
 	})
 	if err != nil {
 		log.Panicf("Failed to encode search results: %v", err)
 	}
 }
 
+// resultQueue passes the results of a streaming search to the goroutine that
+// writes them, without making the search wait for it.
+type resultQueue struct {
+	mutex   sync.Mutex
+	results []SearchResult
+	closed  bool
+	ready   chan struct{}
+}
+
+func newResultQueue() *resultQueue {
+	return &resultQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *resultQueue) push(result SearchResult) {
+	q.mutex.Lock()
+	q.results = append(q.results, result)
+	q.mutex.Unlock()
+	q.signal()
+}
+
+// close marks the end of the results.
+func (q *resultQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.signal()
+}
+
+func (q *resultQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for results and returns those queued since it was last called. It
+// returns false once the queue is closed and every result has been returned.
+func (q *resultQueue) next() ([]SearchResult, bool) {
+	for {
+		q.mutex.Lock()
+		results, closed := q.results, q.closed
+		q.results = nil
+		q.mutex.Unlock()
+		if len(results) > 0 {
+			return results, true
+		}
+		if closed {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+/*
+retryClosed runs fn with a collection, given its key. If the collection is found
+to be closed because SwapCollection replaced it while the request was waiting,
+fn is run again with the collection that took its place. It returns
+ErrCollectionClosed if the collection was deleted instead.
+*/
+func (s *Server) retryClosed(name string, collection *Collection, fn func(*Collection) error) error {
+	for {
+		err := fn(collection)
+		if !errors.Is(err, ErrCollectionClosed) {
+			return err
+		}
+		s.mutex.Lock()
+		next, exists := s.collections[name]
+		s.mutex.Unlock()
+		if !exists || next == collection {
+			return err
+		}
+		collection = next
+	}
+}
+
+// searchCollection runs SearchE on a collection, given its key, as retryClosed
+// describes.
+func (s *Server) searchCollection(name string, collection *Collection, args SearchArgs) (SearchResults, error) {
+	var results SearchResults
+	err := s.retryClosed(name, collection, func(collection *Collection) error {
+		var err error
+		results, err = collection.SearchE(args)
+		return err
+	})
+	return results, err
+}
+
+// searchTimeout returns how long a search request may take: the time in its
+// X-Search-Timeout-Ms header, if any, but no more than Config.SearchTimeout.
+// Zero means no limit.
+func searchTimeout(r *http.Request) (time.Duration, error) {
+	timeout := globalConfig.SearchTimeout
+	if header := r.Header.Get("X-Search-Timeout-Ms"); header != "" {
+		ms, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || ms <= 0 {
+			return 0, fmt.Errorf("invalid X-Search-Timeout-Ms: must be a positive number of milliseconds")
+		}
+		if requested := time.Duration(ms) * time.Millisecond; timeout == 0 || requested < timeout {
+			timeout = requested
+		}
+	}
+	return timeout, nil
+}
+
+// handleMetrics reports the server's metrics, currently the percentiles of the
+// time taken by searches.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		SearchLatency latencySummary `json:"search_latency"`
+	}{s.searchLatency.summary()})
+}
+
+// searchErrorStatus returns the HTTP status for an error returned by SearchE.
+func searchErrorStatus(err error) int {
+	if errors.Is(err, ErrDimensionMismatch) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// checkVectorDimensions returns an error if the vector does not have the number of
+// dimensions that the collection expects. fromText indicates that the vector was
+// produced by the text model, which is the usual cause of a mismatch.
+func checkVectorDimensions(collection *Collection, vector []float64, fromText bool) error {
+	dimensions := collection.GetOptions().DimensionCount
+	if len(vector) == dimensions {
+		return nil
+	}
+	if fromText {
+		return fmt.Errorf("text model %s produced %d dimensions but the collection expects %d; check the TEXT_MODEL setting",
+			globalConfig.TextModel, len(vector), dimensions)
+	}
+	return fmt.Errorf("vector has %d dimensions but the collection expects %d", len(vector), dimensions)
+}
+
 type collectionStatsWithName struct {
 	CollectionStats
 	Name string `json:"name"`
@@ -499,7 +2015,15 @@ func (s *Server) getCollectionStats(collection *Collection) collectionStatsWithN
 	}
 }
 
+// getCollectionStatsLite is getCollectionStats without the average distance.
+func (s *Server) getCollectionStatsLite(collection *Collection) collectionStatsWithName {
+	return collectionStatsWithName{
+		CollectionStats: collection.ComputeStatsLite(),
+		Name:            s.fileNameToCollectionName(collection.Name),
+	}
+}
+
 func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	http.Error(w, message, statusCode)
-	log.Printf("Error: %s, Status Code: %d", message, statusCode)
+	logInfof("Error: %s, Status Code: %d", message, statusCode)
 }
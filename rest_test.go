@@ -2,13 +2,23 @@ package syzgydb
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -171,18 +181,34 @@ func TestDeleteCollection(t *testing.T) {
 		DistanceMethod: Cosine,
 		DimensionCount: 128,
 		Quantization:   64,
+		LockTimeout:    20 * time.Millisecond,
 	})
 	if err != nil {
 		t.Fatalf("Failed to create test collection: %v", err)
 	}
 	server.collections[collectionName] = collection
 
-	req, err := http.NewRequest(http.MethodDelete, "/api/v1/collections/test_collection", nil)
-	if err != nil {
-		t.Fatal(err)
+	// A collection held open by a search is kept
+	collection.mutex.RLock()
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/collections/test_collection", nil)
+	rr := httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	collection.mutex.RUnlock()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v while the collection is in use, got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+	if server.collections[collectionName] != collection {
+		t.Errorf("Expected the collection to be kept")
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("Expected the collection's file to be kept: %v", err)
+	}
+	if _, err := collection.GetDocument(1); errors.Is(err, ErrCollectionClosed) {
+		t.Errorf("Expected the collection to stay open")
 	}
 
-	rr := httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/collections/test_collection", nil)
+	rr = httptest.NewRecorder()
 	handler := http.HandlerFunc(server.handleCollection)
 	handler.ServeHTTP(rr, req)
 
@@ -195,6 +221,12 @@ func TestDeleteCollection(t *testing.T) {
 	if actual != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", actual, expected)
 	}
+	if _, exists := server.collections[collectionName]; exists {
+		t.Errorf("Expected the collection to be removed")
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("Expected the collection's file to be removed, got %v", err)
+	}
 }
 
 func TestSearchRecords(t *testing.T) {
@@ -247,6 +279,36 @@ func TestSearchRecords(t *testing.T) {
 	}
 }
 
+func TestSearchRecordsScoreType(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_score_type.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	server.collections["test_score_type"] = collection
+	collection.AddDocument(1, []float64{0.1, 0.2}, []byte(`{}`))
+
+	reqBody := `{"vector": [0.1, 0.2], "k": 1, "score_type": "similarity"}`
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/collections/test_score_type/search", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleSearchRecords).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
 func TestCreateCollection(t *testing.T) {
 	ensureTestFolder(t)
 	server := setupTestServer()
@@ -326,6 +388,81 @@ func TestGetCollectionInfo(t *testing.T) {
 	if response["name"] != "test_collection" {
 		t.Errorf("handler returned unexpected name: got %v want %v", response["name"], "test_collection")
 	}
+	if storage, ok := response["storage"].(map[string]interface{}); !ok || storage["total_bytes"] == nil {
+		t.Errorf("handler returned no storage breakdown: got %v", response["storage"])
+	}
+}
+
+func TestGetCollectionOptions(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 96,
+		Quantization:   8,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_collection/options", nil)
+	rr := httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var options CollectionOptions
+	if err := json.NewDecoder(rr.Body).Decode(&options); err != nil {
+		t.Fatal(err)
+	}
+	if options.DimensionCount != 96 || options.Quantization != 8 || options.DistanceMethod != Cosine {
+		t.Errorf("handler returned unexpected options: %+v", options)
+	}
+	if options.Name != "test_collection" {
+		t.Errorf("Expected the collection name instead of its file, got %q", options.Name)
+	}
+}
+
+func TestGetIndexStats(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_index_stats.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		LSHTrees:       3,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_index_stats"] = collection
+	for i := 0; i < 10; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 1}, nil)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_index_stats/index-stats", nil)
+	rr := httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var stats IndexStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Trees != 3 || stats.Leaves != 3 || stats.MaxLeafDocuments != 10 || stats.Skew != 1 {
+		t.Errorf("handler returned unexpected stats: %+v", stats)
+	}
 }
 
 func mockEmbedText(texts []string, useCache bool) ([][]float64, error) {
@@ -400,6 +537,435 @@ func TestInsertRecords(t *testing.T) {
 	}
 }
 
+func TestEmbeddingDimensionMismatch(t *testing.T) {
+	saved := embedText
+	defer func() { embedText = saved }()
+	embedText = func(texts []string, useCache bool) ([][]float64, error) {
+		vectors := make([][]float64, len(texts))
+		for i := range texts {
+			vectors[i] = []float64{0.1, 0.2, 0.3}
+		}
+		return vectors, nil
+	}
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_embedding_mismatch.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 5,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	server.collections["test_collection"] = collection
+
+	reqBody := `[{"id": 1, "text": "example text", "metadata": {"key": "value"}}]`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/records", strings.NewReader(reqBody))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleInsertRecord).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("insert returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), "3 dimensions") {
+		t.Errorf("expected the error to mention the dimension count, got %q", rr.Body.String())
+	}
+	if count := collection.GetDocumentCount(); count != 0 {
+		t.Errorf("expected no documents to be inserted, got %d", count)
+	}
+
+	reqBody = `{"text": "example text", "k": 1}`
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/search", strings.NewReader(reqBody))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.handleSearchRecords).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("search returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestInsertStoreText(t *testing.T) {
+	saved := embedText
+	defer func() { embedText = saved }()
+	embedText = mockEmbedText
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_store_text.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 5,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_store_text"] = collection
+
+	insert := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_store_text/records", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.handleInsertRecord(rr, req)
+		return rr
+	}
+
+	rr := insert(`[{"id": 1, "text": "a red apple", "store_text": true, "metadata": {"kind": "fruit"}},
+		{"id": 2, "text": "a green pear", "store_text": true},
+		{"id": 3, "text": "a yellow banana"}]`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for id, want := range map[uint64]map[string]string{
+		1: {"kind": "fruit", "text": "a red apple"},
+		2: {"text": "a green pear"},
+		3: {},
+	} {
+		doc, err := collection.GetDocument(id)
+		if err != nil {
+			t.Fatalf("Failed to get document %d: %v", id, err)
+		}
+		var metadata map[string]string
+		if err := json.Unmarshal(doc.Metadata, &metadata); err != nil {
+			t.Fatalf("Failed to decode metadata of document %d: %v", id, err)
+		}
+		if len(metadata) != len(want) {
+			t.Errorf("Document %d: got metadata %v want %v", id, metadata, want)
+		}
+		for key, value := range want {
+			if metadata[key] != value {
+				t.Errorf("Document %d: got metadata %v want %v", id, metadata, want)
+			}
+		}
+	}
+
+	rr = insert(`[{"id": 4, "text": "a plum", "store_text": true, "metadata": {"text": "taken"}}]`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a conflicting text field to be rejected, got status %d", rr.Code)
+	}
+	if _, err := collection.GetDocument(4); err == nil {
+		t.Errorf("Expected the rejected record not to be inserted")
+	}
+}
+
+func TestInsertOnDuplicate(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_on_duplicate.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_on_duplicate"] = collection
+	collection.AddDocument(1, []float64{1, 1}, []byte(`{"version":"1"}`))
+
+	insert := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_on_duplicate/records", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.handleInsertRecord(rr, req)
+		return rr
+	}
+	version := func(id uint64) string {
+		doc, err := collection.GetDocument(id)
+		if err != nil {
+			return ""
+		}
+		var metadata map[string]string
+		json.Unmarshal(doc.Metadata, &metadata)
+		return metadata["version"]
+	}
+
+	rr := insert(`[{"id": 1, "vector": [2, 2], "metadata": {"version": "2"}, "on_duplicate": "skip"},
+		{"id": 2, "vector": [2, 2], "metadata": {"version": "1"}, "on_duplicate": "skip"}]`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Skipped []uint64 `json:"skipped"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !equalUint64Slices(response.Skipped, []uint64{1}) {
+		t.Errorf("Expected record 1 to be skipped, got %v", response.Skipped)
+	}
+	if version(1) != "1" || version(2) != "1" {
+		t.Errorf("Expected the existing record to be kept and the new one added, got versions %q and %q", version(1), version(2))
+	}
+
+	rr = insert(`[{"id": 3, "vector": [3, 3], "metadata": {"version": "1"}, "on_duplicate": "error"},
+		{"id": 1, "vector": [2, 2], "metadata": {"version": "2"}, "on_duplicate": "error"}]`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status Conflict, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if version(1) != "1" || version(3) != "" {
+		t.Errorf("Expected no record of the batch to be written, got versions %q and %q", version(1), version(3))
+	}
+
+	rr = insert(`[{"id": 1, "vector": [2, 2], "metadata": {"version": "2"}}]`)
+	if rr.Code != http.StatusCreated || version(1) != "2" {
+		t.Errorf("Expected the record to be overwritten by default, got status %d and version %q", rr.Code, version(1))
+	}
+
+	rr = insert(`[{"id": 4, "vector": [2, 2], "on_duplicate": "replace"}]`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown policy to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestReembedCollection(t *testing.T) {
+	saved := embedText
+	defer func() { embedText = saved }()
+	// The first model puts north on the y axis and the second on the x axis
+	model := func(north []float64) EmbedTextFunc {
+		return func(texts []string, useCache bool) ([][]float64, error) {
+			vectors := make([][]float64, len(texts))
+			for i, text := range texts {
+				vectors[i] = []float64{north[1], north[0]}
+				if text == "north" {
+					vectors[i] = north
+				}
+			}
+			return vectors, nil
+		}
+	}
+	embedText = model([]float64{0, 1})
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_reembed.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_reembed"] = collection
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_reembed/records", strings.NewReader(`[
+		{"id": 1, "text": "north", "store_text": true},
+		{"id": 2, "text": "east", "store_text": true},
+		{"id": 3, "vector": [5, 5]}]`))
+	rr := httptest.NewRecorder()
+	server.handleInsertRecord(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	nearest := func(vector []float64) uint64 {
+		results := collection.Search(SearchArgs{Vector: vector, K: 1, Precision: "exact"})
+		if len(results.Results) != 1 {
+			t.Fatalf("Expected one result, got %v", results.Results)
+		}
+		return results.Results[0].ID
+	}
+	if id := nearest([]float64{0, 1}); id != 1 {
+		t.Errorf("Expected north to be on the y axis, got document %d", id)
+	}
+
+	embedText = model([]float64{1, 0})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_reembed/reembed", nil)
+	rr = httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result ReembedResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Reembedded != 2 || result.Skipped != 1 {
+		t.Errorf("Expected 2 documents re-embedded and 1 skipped, got %+v", result)
+	}
+	if id := nearest([]float64{1, 0}); id != 1 {
+		t.Errorf("Expected north to be on the x axis after re-embedding, got document %d", id)
+	}
+	if id := nearest([]float64{0, 1}); id != 2 {
+		t.Errorf("Expected east to be on the y axis after re-embedding, got document %d", id)
+	}
+	if doc, _ := collection.GetDocument(3); !aboutEqual(doc.Vector, []float64{5, 5}) {
+		t.Errorf("Expected the document without text to keep its vector, got %v", doc.Vector)
+	}
+
+	if _, err := server.ReembedCollection("missing", nil); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected ErrCollectionNotFound, got %v", err)
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	handler := limitConcurrency(2)(blocking)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/collections", nil))
+			codes[i] = rr.Code
+		}(i)
+	}
+	<-started
+	<-started
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/collections", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 when the limit is reached, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected request %d to succeed, got status %d", i, code)
+		}
+	}
+
+	// The slots are given back when the requests finish
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/collections", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected a request after the others finished to succeed, got status %d", rr.Code)
+	}
+
+	// Without a limit, the handler is not wrapped
+	rr = httptest.NewRecorder()
+	limitConcurrency(0)(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected the handler to run without a limit, got status %d", rr.Code)
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	globalConfig.MaxRequestBytes = 200
+	defer func() { globalConfig.MaxRequestBytes = 0 }()
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_max_request_bytes.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_max_request_bytes"] = collection
+
+	post := func(handler http.HandlerFunc, path, contentType, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		limitRequestBody(handler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	insertPath := "/api/v1/collections/test_max_request_bytes/records"
+	if code := post(server.handleInsertRecord, insertPath, "application/json", `[{"id": 1, "vector": [1, 2]}]`); code != http.StatusCreated {
+		t.Errorf("Expected a small insert to succeed, got status %d", code)
+	}
+	large := `[{"id": 2, "vector": [1, 2], "metadata": {"note": "` + strings.Repeat("x", 300) + `"}}]`
+	if code := post(server.handleInsertRecord, insertPath, "application/json", large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized insert to be rejected with 413, got status %d", code)
+	}
+	if _, err := collection.GetDocument(2); err == nil {
+		t.Errorf("Expected the oversized insert not to add a document")
+	}
+
+	searchPath := "/api/v1/collections/test_max_request_bytes/search"
+	large = `{"vector": [1, 2], "k": 1, "filter": "` + strings.Repeat("x", 300) + `"}`
+	if code := post(server.handleSearchRecords, searchPath, "application/json", large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized search to be rejected with 413, got status %d", code)
+	}
+	packed := make([]byte, 16+300*4)
+	binary.BigEndian.PutUint32(packed, 300) // dimensions
+	if code := post(server.handleSearchRecords, searchPath, "application/octet-stream", string(packed)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized binary search to be rejected with 413, got status %d", code)
+	}
+	if code := post(server.handleSearchRecords, searchPath, "application/json", `{"vector": [1, 2], "k": 1}`); code != http.StatusOK {
+		t.Errorf("Expected a small search to succeed, got status %d", code)
+	}
+}
+
+func TestUpdateCollectionOptions(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	fileName := testFilePath("test_update_options.dat")
+	collection, err := NewCollection(CollectionOptions{
+		Name:           fileName,
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	server.collections["test_collection"] = collection
+	for i := 0; i < 100; i++ {
+		collection.AddDocument(uint64(i), []float64{myRandom.Float64(), myRandom.Float64()}, []byte(`{}`))
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/collections/test_collection", strings.NewReader(`{"lsh_trees": 3, "lsh_leaf_size": 10}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleCollection).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+	if len(collection.lshTree.roots) != 3 {
+		t.Errorf("Expected the index to be rebuilt with 3 trees, got %d", len(collection.lshTree.roots))
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/v1/collections/test_collection", strings.NewReader(`{"quantization": 8}`))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.handleCollection).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	// The new options survive reopening the collection.
+	collection.Close()
+	collection, err = NewCollection(CollectionOptions{Name: fileName, FileMode: ReadWrite})
+	if err != nil {
+		t.Fatalf("Failed to reopen collection: %v", err)
+	}
+	defer collection.Close()
+	options := collection.GetOptions()
+	if options.LSHTrees != 3 || options.LSHLeafSize != 10 || options.Quantization != 64 {
+		t.Errorf("Options were not persisted: %+v", options)
+	}
+	if len(collection.lshTree.roots) != 3 {
+		t.Errorf("Expected 3 trees after reopening, got %d", len(collection.lshTree.roots))
+	}
+	results := collection.Search(SearchArgs{Vector: []float64{0.5, 0.5}, K: 5})
+	if len(results.Results) != 5 {
+		t.Errorf("Expected 5 results after reopening, got %d", len(results.Results))
+	}
+}
+
 func TestUpdateRecordMetadata(t *testing.T) {
 	ensureTestFolder(t)
 	server := setupTestServer()
@@ -627,3 +1193,1825 @@ func TestGetAllCollections(t *testing.T) {
 		}
 	}
 }
+
+func TestGzipMiddlewareContentType(t *testing.T) {
+	body := strings.Repeat("a,b,c\n", 1000)
+
+	tests := []struct {
+		name        string
+		contentType string
+		expected    string
+	}{
+		{"handler sets content type", "text/csv", "text/csv"},
+		{"handler streams NDJSON", "application/x-ndjson", "application/x-ndjson"},
+		{"handler sets no content type", "", "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Write([]byte(body))
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if ct := rr.Header().Get("Content-Type"); ct != tt.expected {
+				t.Errorf("unexpected Content-Type: got %q want %q", ct, tt.expected)
+			}
+			if ce := rr.Header().Get("Content-Encoding"); tt.expected == "application/json" && ce != "gzip" {
+				t.Errorf("expected gzip encoding, got %q", ce)
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareMinSize(t *testing.T) {
+	savedConfig := globalConfig
+	defer func() { globalConfig = savedConfig }()
+
+	tests := []struct {
+		name       string
+		minSize    int
+		body       string
+		compressed bool
+	}{
+		{"small response", 0, `{"message": "ok"}`, false},
+		{"large response", 0, strings.Repeat(`{"message": "ok"}`, 200), true},
+		{"configured threshold", 10, `{"message": "ok"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			globalConfig.GzipMinSize = tt.minSize
+			handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			compressed := rr.Header().Get("Content-Encoding") == "gzip"
+			if compressed != tt.compressed {
+				t.Errorf("compressed = %v, want %v", compressed, tt.compressed)
+			}
+			if !compressed && rr.Body.String() != tt.body {
+				t.Errorf("unexpected body: %q", rr.Body.String())
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("unexpected Content-Type: %q", ct)
+			}
+		})
+	}
+}
+
+func TestSearchRecordsStream(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_stream_rest.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	server.collections["test_search_stream_rest"] = collection
+	for i := 0; i < 5; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(`{"n": 1}`))
+	}
+
+	reqBody := `{"vector": [0, 0], "radius": 2.5, "precision": "exact", "stream": true}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_stream_rest/search", strings.NewReader(reqBody))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleSearchRecords).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected Content-Type: %q", ct)
+	}
+
+	var ids []uint64
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		var result struct {
+			ID       uint64                 `json:"id"`
+			Metadata map[string]interface{} `json:"metadata"`
+		}
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("Failed to decode line %q: %v", line, err)
+		}
+		ids = append(ids, result.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if !equalUint64Slices(ids, []uint64{0, 1, 2}) {
+		t.Errorf("Unexpected streamed IDs: %v", ids)
+	}
+
+	// A client that stops reading doesn't keep the collection locked
+	writer := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), unblock: make(chan struct{})}
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_stream_rest/search", strings.NewReader(reqBody))
+	streamed := make(chan struct{})
+	go func() {
+		http.HandlerFunc(server.handleSearchRecords).ServeHTTP(writer, req)
+		close(streamed)
+	}()
+	<-writer.writing
+	if err := collection.AddDocument(10, []float64{10, 0}, []byte(`{"n": 1}`)); err != nil {
+		t.Errorf("Failed to add a document while a client is stalled: %v", err)
+	}
+	close(writer.unblock)
+	<-streamed
+}
+
+// blockingResponseWriter blocks the first write to it until unblock is closed,
+// like a client that stops reading.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingResponseWriter) Write(data []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.unblock
+	})
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestTenantCollections(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	for _, tenant := range []string{"alpha", "beta"} {
+		os.Remove(testFilePath(tenant + "/shared.dat"))
+	}
+
+	request := func(method, path, tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set(tenantHeader, tenant)
+		}
+		rr := httptest.NewRecorder()
+		if path == "/api/v1/collections" {
+			server.handleCollections(rr, req)
+		} else if strings.HasSuffix(path, "/records") {
+			server.handleInsertRecord(rr, req)
+		} else {
+			server.handleCollection(rr, req)
+		}
+		return rr
+	}
+
+	// Create a collection with the same name for two tenants
+	for i, tenant := range []string{"alpha", "beta"} {
+		rr := request(http.MethodPost, "/api/v1/collections", tenant,
+			`{"name":"shared","vector_size":2,"quantization":64,"distance_function":"euclidean"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to create collection for %s: %d %s", tenant, rr.Code, rr.Body.String())
+		}
+		defer server.collections[tenant+"/shared"].Close()
+		for id := 0; id <= i; id++ {
+			rr = request(http.MethodPost, "/api/v1/collections/shared/records", tenant,
+				fmt.Sprintf(`[{"id":%d,"vector":[1,2],"metadata":{}}]`, id))
+			if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+				t.Fatalf("Failed to insert record for %s: %d %s", tenant, rr.Code, rr.Body.String())
+			}
+		}
+		if _, err := os.Stat(testFilePath(tenant + "/shared.dat")); err != nil {
+			t.Errorf("Expected the collection of %s in its own folder: %v", tenant, err)
+		}
+	}
+
+	// Each tenant sees only its own collection
+	for i, tenant := range []string{"alpha", "beta"} {
+		var list []collectionStatsWithName
+		rr := request(http.MethodGet, "/api/v1/collections", tenant, "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed to decode list: %v", err)
+		}
+		if len(list) != 1 || list[0].Name != "shared" || list[0].DocumentCount != i+1 {
+			t.Errorf("Unexpected collections for %s: %+v", tenant, list)
+		}
+	}
+
+	var list []collectionStatsWithName
+	rr := request(http.MethodGet, "/api/v1/collections", "", "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Errorf("Expected no collections without a tenant, got %+v", list)
+	}
+	if rr := request(http.MethodGet, "/api/v1/collections/shared", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a tenant, got %d", rr.Code)
+	}
+
+	if rr := request(http.MethodGet, "/api/v1/collections", "../etc", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tenant, got %d", rr.Code)
+	}
+}
+
+func TestSearchKeepInvalidMetadata(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_invalid_metadata.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_invalid_metadata"] = collection
+	collection.AddDocument(1, []float64{0, 0}, []byte(`{"valid": true}`))
+	collection.AddDocument(2, []float64{1, 0}, []byte(`not json`))
+
+	search := func(reqBody string) []map[string]interface{} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_invalid_metadata/search", strings.NewReader(reqBody))
+		rr := httptest.NewRecorder()
+		server.handleSearchRecords(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var response struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response.Results
+	}
+
+	if results := search(`{"vector": [0, 0], "k": 2, "precision": "exact"}`); len(results) != 1 {
+		t.Errorf("Expected the invalid record to be left out, got %v", results)
+	}
+
+	results := search(`{"vector": [0, 0], "k": 2, "precision": "exact", "keep_invalid_metadata": true}`)
+	if len(results) != 2 {
+		t.Fatalf("Expected both records, got %v", results)
+	}
+	invalid := results[1]
+	if invalid["id"] != float64(2) || invalid["metadata"] != nil || invalid["metadata_error"] == nil {
+		t.Errorf("Unexpected result for invalid metadata: %v", invalid)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(fmt.Sprint(invalid["raw_metadata"]))
+	if string(raw) != "not json" {
+		t.Errorf("Expected the raw metadata, got %q", raw)
+	}
+	if _, ok := results[0]["metadata_error"]; ok {
+		t.Errorf("Unexpected metadata_error for valid metadata: %v", results[0])
+	}
+
+	// Binary responses leave out the same results
+	for _, keep := range []bool{false, true} {
+		reqBody := fmt.Sprintf(`{"vector": [0, 0], "k": 2, "precision": "exact", "keep_invalid_metadata": %v}`, keep)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_invalid_metadata/search", strings.NewReader(reqBody))
+		req.Header.Set("Accept", "application/octet-stream")
+		rr := httptest.NewRecorder()
+		server.handleSearchRecords(rr, req)
+		expected := 1
+		if keep {
+			expected = 2
+		}
+		if count := binary.BigEndian.Uint32(rr.Body.Bytes()); count != uint32(expected) {
+			t.Errorf("Expected %d binary results with keep_invalid_metadata=%v, got %d", expected, keep, count)
+		}
+	}
+}
+
+func TestSearchMaxK(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_max_k.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_search_max_k"] = collection
+	collection.AddDocument(1, []float64{0, 0}, []byte(`{}`))
+
+	tests := []struct {
+		body    string
+		status  int
+		message string
+	}{
+		{`{"vector": [0, 0], "k": 10000}`, http.StatusOK, ""},
+		{`{"vector": [0, 0], "k": 100000000}`, http.StatusBadRequest, "Invalid k: must be at most 10000"},
+		{`{"limit": 10001}`, http.StatusBadRequest, "Invalid limit: must be at most 10000"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_max_k/search", strings.NewReader(test.body))
+		rr := httptest.NewRecorder()
+		server.handleSearchRecords(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s: got status %d want %d", test.body, rr.Code, test.status)
+		}
+		if !strings.Contains(rr.Body.String(), test.message) {
+			t.Errorf("%s: expected message %q, got %q", test.body, test.message, rr.Body.String())
+		}
+	}
+
+	globalConfig.MaxSearchK = 5
+	defer func() { globalConfig.MaxSearchK = 0 }()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_search_max_k/search?k=6", nil)
+	rr := httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected the configured limit to apply, got status %d", rr.Code)
+	}
+}
+
+func TestBinarySearch(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_binary_search.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 3,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_binary_search"] = collection
+	for i := 0; i < 20; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), float64(i % 3), 1}, []byte(fmt.Sprintf(`{"even":%v}`, i%2 == 0)))
+	}
+
+	// The query uses values that are exact as float32, so both requests
+	// search for the same vector.
+	query := []float32{4.5, 0.25, 1}
+	jsonBody := `{"vector": [4.5, 0.25, 1], "k": 5, "precision": "exact", "filter": "even == true"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_binary_search/search", strings.NewReader(jsonBody))
+	rr := httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	var jsonResponse struct {
+		Results []struct {
+			ID       uint64  `json:"id"`
+			Distance float64 `json:"distance"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &jsonResponse); err != nil {
+		t.Fatalf("Failed to decode JSON response: %v", err)
+	}
+	if len(jsonResponse.Results) != 5 {
+		t.Fatalf("Expected 5 JSON results, got %d", len(jsonResponse.Results))
+	}
+
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, uint32(len(query)))
+	body = binary.BigEndian.AppendUint32(body, 5)
+	body = binary.BigEndian.AppendUint64(body, math.Float64bits(0))
+	for _, v := range query {
+		body = binary.BigEndian.AppendUint32(body, math.Float32bits(v))
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_binary_search/search?precision=exact&filter=even+%3D%3D+true", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Binary search failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Unexpected Content-Type: %q", ct)
+	}
+
+	data := rr.Body.Bytes()
+	count := binary.BigEndian.Uint32(data[0:4])
+	if int(count) != len(jsonResponse.Results) || len(data) != 4+int(count)*16 {
+		t.Fatalf("Expected %d binary results in %d bytes, got %d in %d bytes", len(jsonResponse.Results), 4+len(jsonResponse.Results)*16, count, len(data))
+	}
+	for i, expected := range jsonResponse.Results {
+		result := data[4+i*16:]
+		id := binary.BigEndian.Uint64(result[0:8])
+		distance := math.Float64frombits(binary.BigEndian.Uint64(result[8:16]))
+		if id != expected.ID || distance != expected.Distance {
+			t.Errorf("Result %d: got (%d, %v), want (%d, %v)", i, id, distance, expected.ID, expected.Distance)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_binary_search/search", bytes.NewReader(body[:10]))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a truncated request, got %d", rr.Code)
+	}
+}
+
+func TestSearchTimeout(t *testing.T) {
+	defer func() { globalConfig.SearchTimeout = 0 }()
+	tests := []struct {
+		config  time.Duration
+		header  string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{0, "", 0, false},
+		{0, "250", 250 * time.Millisecond, false},
+		{time.Second, "", time.Second, false},
+		{time.Second, "250", 250 * time.Millisecond, false},
+		{time.Second, "5000", time.Second, false},
+		{0, "soon", 0, true},
+		{0, "-5", 0, true},
+	}
+	for _, test := range tests {
+		globalConfig.SearchTimeout = test.config
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test/search", nil)
+		if test.header != "" {
+			req.Header.Set("X-Search-Timeout-Ms", test.header)
+		}
+		timeout, err := searchTimeout(req)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v, %q: unexpected error %v", test.config, test.header, err)
+		}
+		if timeout != test.timeout {
+			t.Errorf("%v, %q: got timeout %v want %v", test.config, test.header, timeout, test.timeout)
+		}
+	}
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_timeout.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_search_timeout"] = collection
+	collection.AddDocument(1, []float64{0, 0}, []byte(`{}`))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_timeout/search", strings.NewReader(`{"vector": [0, 0], "k": 1}`))
+	req.Header.Set("X-Search-Timeout-Ms", "soon")
+	rr := httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid timeout to be rejected, got status %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_timeout/search", strings.NewReader(`{"vector": [0, 0], "k": 1}`))
+	req.Header.Set("X-Search-Timeout-Ms", "60000")
+	rr = httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	var response map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response["timed_out"]; ok || len(response["results"].([]interface{})) != 1 {
+		t.Errorf("Expected a search within its timeout to finish, got %v", response)
+	}
+}
+
+func TestSearchLatencyMetrics(t *testing.T) {
+	var histogram latencyHistogram
+	if histogram.percentile(0.5) != 0 {
+		t.Errorf("Expected an empty histogram to report 0")
+	}
+	// 90 searches of 1ms and 10 of 100ms
+	for i := 0; i < 100; i++ {
+		d := time.Millisecond
+		if i >= 90 {
+			d = 100 * time.Millisecond
+		}
+		histogram.record(d)
+	}
+	for _, test := range []struct {
+		p    float64
+		want time.Duration
+	}{{0.5, time.Millisecond}, {0.9, time.Millisecond}, {0.99, 100 * time.Millisecond}} {
+		got := histogram.percentile(test.p)
+		if got < test.want || got > test.want*5/4 {
+			t.Errorf("p%v: got %v want about %v", test.p*100, got, test.want)
+		}
+	}
+
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_metrics.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 8,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_search_metrics"] = collection
+	for i := 0; i < 2000; i++ {
+		vector := make([]float64, 8)
+		for j := range vector {
+			vector[j] = myRandom.Float64()
+		}
+		collection.AddDocument(uint64(i), vector, []byte(`{}`))
+	}
+
+	start := time.Now()
+	searches := 0
+	for _, k := range []int{1, 10, 100, 1000} {
+		for _, precision := range []string{"", "exact"} {
+			body := fmt.Sprintf(`{"vector": [0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5], "k": %d, "precision": %q}`, k, precision)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_metrics/search", strings.NewReader(body))
+			rr := httptest.NewRecorder()
+			server.handleSearchRecords(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Search failed with status %d: %s", rr.Code, rr.Body.String())
+			}
+			searches++
+		}
+	}
+	elapsed := time.Since(start)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", rr.Code)
+	}
+	var metrics struct {
+		SearchLatency latencySummary `json:"search_latency"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	latency := metrics.SearchLatency
+	if latency.Count != uint64(searches) {
+		t.Errorf("Expected %d searches, got %d", searches, latency.Count)
+	}
+	if latency.P50 <= 0 || latency.P50 > latency.P90 || latency.P90 > latency.P99 {
+		t.Errorf("Expected ordered percentiles, got %+v", latency)
+	}
+	// No search can take longer than all of them did together
+	if maxMs := float64(elapsed) / float64(time.Millisecond) * 5 / 4; latency.P99 > maxMs {
+		t.Errorf("p99 of %vms is longer than all the searches took (%vms)", latency.P99, maxMs)
+	}
+}
+
+func TestSearchFacetsREST(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_facets_rest.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_search_facets_rest"] = collection
+	for i := 0; i < 10; i++ {
+		category := "even"
+		if i%2 == 1 {
+			category = "odd"
+		}
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"category":%q}`, category)))
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_facets_rest/search",
+			strings.NewReader(`{"vector": [0, 0], "k": 5, "facets": ["category"]}`)),
+		httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_search_facets_rest/search?k=5&facets=category", nil),
+	} {
+		rr := httptest.NewRecorder()
+		server.handleSearchRecords(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var response struct {
+			Results []struct {
+				ID uint64 `json:"id"`
+			} `json:"results"`
+			Facets map[string]map[string]int `json:"facets"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]int{}
+		for _, result := range response.Results {
+			if result.ID%2 == 0 {
+				expected["even"]++
+			} else {
+				expected["odd"]++
+			}
+		}
+		if len(response.Results) != 5 || !reflect.DeepEqual(response.Facets["category"], expected) {
+			t.Errorf("%s: expected category counts %v for %d results, got %v", req.Method, expected, len(response.Results), response.Facets)
+		}
+	}
+}
+
+func TestSearchMetadataOnlyREST(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_search_metadata_only.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_search_metadata_only"] = collection
+	for i := 0; i < 10; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_search_metadata_only/search",
+		strings.NewReader(`{"filter": "n >= 3 AND n < 8", "k": 3}`))
+	rr := httptest.NewRecorder()
+	server.handleSearchRecords(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Results []struct {
+			ID       uint64  `json:"id"`
+			Distance float64 `json:"distance"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, result := range response.Results {
+		ids = append(ids, result.ID)
+		if result.Distance != 0 {
+			t.Errorf("Expected no distance for record %d, got %v", result.ID, result.Distance)
+		}
+	}
+	if !equalUint64Slices(ids, []uint64{3, 4, 5}) {
+		t.Errorf("Expected the first 3 matching records, got %v", ids)
+	}
+}
+
+func TestCentroidSearch(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_centroid_search.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_centroid_search"] = collection
+	for i := 0; i < 10; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(`{}`))
+	}
+
+	search := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_centroid_search/search", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.handleSearchRecords(rr, req)
+		return rr
+	}
+
+	// The centroid of the three vectors is (4, 0)
+	rr := search(`{"vectors": [[1, 0], [4, 1], [7, -1]], "k": 1, "precision": "exact"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Results []struct {
+			ID       uint64  `json:"id"`
+			Distance float64 `json:"distance"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 1 || response.Results[0].ID != 4 || response.Results[0].Distance > 1e-6 {
+		t.Errorf("Expected document 4 at the centroid, got %+v", response.Results)
+	}
+
+	if rr := search(`{"vectors": [[1, 0], [4, 1, 2]], "k": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected vectors of the wrong size to be rejected, got status %d", rr.Code)
+	}
+	if rr := search(`{"vector": [1, 0], "vectors": [[1, 0]], "k": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected both vector and vectors to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestMultiSearch(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	for i, name := range []string{"test_multi_a", "test_multi_b", "test_multi_other"} {
+		dimensions := 2
+		if i == 2 {
+			dimensions = 3
+		}
+		collection, err := NewCollection(CollectionOptions{
+			Name:           testFilePath(name + ".dat"),
+			DistanceMethod: Euclidean,
+			DimensionCount: dimensions,
+			FileMode:       CreateAndOverwrite,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create test collection: %v", err)
+		}
+		defer collection.Close()
+		server.collections[name] = collection
+	}
+	// Collection a has the points at even distances and b those at odd ones
+	for i := 0; i < 10; i++ {
+		name := "test_multi_a"
+		if i%2 == 1 {
+			name = "test_multi_b"
+		}
+		server.collections[name].AddDocument(uint64(i), []float64{float64(i), 0}, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	search := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/search", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.handleMultiSearch(rr, req)
+		return rr
+	}
+
+	rr := search(`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0.1, 0], "k": 5, "precision": "exact"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Multi search failed: %d %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Results []struct {
+			ID         uint64  `json:"id"`
+			Collection string  `json:"collection"`
+			Distance   float64 `json:"distance"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Results) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(response.Results))
+	}
+	for i, result := range response.Results {
+		expectedCollection := []string{"test_multi_a", "test_multi_b"}[i%2]
+		if result.ID != uint64(i) || result.Collection != expectedCollection {
+			t.Errorf("Result %d: got ID %d from %s, want ID %d from %s", i, result.ID, result.Collection, i, expectedCollection)
+		}
+		if i > 0 && result.Distance < response.Results[i-1].Distance {
+			t.Errorf("Results are not ordered by distance: %v", response.Results)
+		}
+	}
+
+	// Without k or a radius, the nearest documents are found
+	rr = search(`{"collections": ["test_multi_a", "test_multi_b"], "vector": [9, 0], "limit": 2}`)
+	response.Results = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || len(response.Results) != 2 ||
+		response.Results[0].ID != 9 || response.Results[1].ID != 8 || response.Results[1].Distance != 1 {
+		t.Errorf("Expected documents 9 and 8 by distance without k, got %s", rr.Body.String())
+	}
+
+	if rr := search(`{"collections": ["test_multi_a", "test_multi_other"], "vector": [0, 0], "k": 5}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for collections with different dimensions, got %d", rr.Code)
+	}
+	if rr := search(`{"collections": ["test_multi_a", "missing"], "vector": [0, 0], "k": 5}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing collection, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/search", strings.NewReader(`{"collections": ["test_multi_a"], "vector": [0, 0], "k": 5}`))
+	req.Header.Set("X-Search-Timeout-Ms", "soon")
+	rr = httptest.NewRecorder()
+	server.handleMultiSearch(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid timeout, got %d", rr.Code)
+	}
+
+	// The same limits apply as to the search of one collection
+	globalConfig.MaxSearchLimit = 3
+	defer func() { globalConfig.MaxSearchLimit = 0 }()
+	for _, body := range []string{
+		`{"collections": ["test_multi_a"], "vector": [0, 0], "limit": 4}`,
+		`{"collections": ["test_multi_a"], "vector": [0, 0], "k": -1}`,
+		`{"collections": ["test_multi_a"], "vector": [0, 0], "radius": -1}`,
+		`{"collections": ["test_multi_a", "../test_multi_b"], "vector": [0, 0], "k": 5}`,
+	} {
+		if rr := search(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	for body, want := range map[string]int{
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0]}`:                3,
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0], "radius": 100}`: 3,
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0], "radius": 2.5}`: 3,
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0], "limit": 2}`:    2,
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0], "k": 2}`:        2,
+		`{"collections": ["test_multi_a", "test_multi_b"], "vector": [0, 0], "radius": 1.5}`: 2,
+	} {
+		rr := search(body)
+		var response struct {
+			Results []struct{} `json:"results"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || len(response.Results) != want {
+			t.Errorf("%s: expected %d results, got %d %s", body, want, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestHashedDataFolderLayout(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	dataFolder := testFilePath("hashed_layout")
+	os.RemoveAll(dataFolder)
+	globalConfig.DataFolder = dataFolder
+	globalConfig.DataFolderLayout = DataFolderLayoutHashed
+	defer func() {
+		globalConfig.DataFolder = "./testdata"
+		globalConfig.DataFolderLayout = ""
+	}()
+
+	for _, tenant := range []string{"", "alpha"} {
+		for _, name := range []string{"first", "second"} {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/collections", strings.NewReader(
+				fmt.Sprintf(`{"name":%q,"vector_size":2,"quantization":64,"distance_function":"euclidean"}`, name)))
+			if tenant != "" {
+				req.Header.Set(tenantHeader, tenant)
+			}
+			rr := httptest.NewRecorder()
+			server.handleCollections(rr, req)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("Failed to create collection %s: %d %s", name, rr.Code, rr.Body.String())
+			}
+
+			fileName := filepath.Join(dataFolder, tenant, filepath.FromSlash(hashedFolder(name)), name+".dat")
+			if _, err := os.Stat(fileName); err != nil {
+				t.Errorf("Expected collection file at %s: %v", fileName, err)
+			}
+		}
+	}
+	server.collections["first"].AddDocument(1, []float64{1, 2}, []byte("{}"))
+	for _, collection := range server.collections {
+		collection.Close()
+	}
+
+	reloaded := &Server{collections: make(map[string]*Collection)}
+	if err := reloaded.loadCollections(); err != nil {
+		t.Fatalf("Failed to load collections: %v", err)
+	}
+	defer func() {
+		for _, collection := range reloaded.collections {
+			collection.Close()
+		}
+	}()
+	var keys []string
+	for key := range reloaded.collections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "alpha/first,alpha/second,first,second" {
+		t.Errorf("Unexpected collections after reloading: %v", keys)
+	}
+	if count := reloaded.collections["first"].GetDocumentCount(); count != 1 {
+		t.Errorf("Expected 1 document in the reloaded collection, got %d", count)
+	}
+}
+
+func TestRenameCollection(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	for _, name := range []string{"rename_old", "rename_new", "rename_other", "rename_third"} {
+		os.Remove(testFilePath(name + ".dat"))
+		os.Remove(testFilePath(name + ".dat.vectors"))
+	}
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		if path == "/api/v1/collections" {
+			server.handleCollections(rr, req)
+		} else if strings.HasSuffix(path, "/records") {
+			server.handleInsertRecord(rr, req)
+		} else {
+			server.handleCollection(rr, req)
+		}
+		return rr
+	}
+
+	for _, name := range []string{"rename_old", "rename_other"} {
+		rr := request(http.MethodPost, "/api/v1/collections",
+			`{"name":"`+name+`","vector_size":2,"quantization":64,"distance_function":"euclidean","separate_vectors":true}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to create collection: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	defer func() {
+		for _, collection := range server.collections {
+			collection.Close()
+		}
+	}()
+	rr := request(http.MethodPost, "/api/v1/collections/rename_old/records",
+		`[{"id":1,"vector":[1,2],"metadata":{"a":"1"}},{"id":2,"vector":[3,4],"metadata":{"a":"2"}}]`)
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("Failed to insert records: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A collection can't take the name of another
+	rr = request(http.MethodPost, "/api/v1/collections/rename_old/rename", `{"new_name":"rename_other"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 renaming to an existing collection, got %d", rr.Code)
+	}
+
+	rr = request(http.MethodPost, "/api/v1/collections/rename_old/rename", `{"new_name":"rename_new"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to rename collection: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The records are under the new name, and the old name is gone
+	rr = request(http.MethodGet, "/api/v1/collections/rename_new/ids", "")
+	var ids []uint64
+	if err := json.Unmarshal(rr.Body.Bytes(), &ids); err != nil || !equalUint64Slices(ids, []uint64{1, 2}) {
+		t.Errorf("Expected IDs [1 2] under the new name, got %s", rr.Body.String())
+	}
+	if rr = request(http.MethodGet, "/api/v1/collections/rename_old", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the old name, got %d", rr.Code)
+	}
+	for _, file := range []string{"rename_old.dat", "rename_old.dat.vectors"} {
+		if _, err := os.Stat(testFilePath(file)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be gone", file)
+		}
+	}
+	var stats collectionStatsWithName
+	rr = request(http.MethodGet, "/api/v1/collections/rename_new", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil || stats.Name != "rename_new" || stats.DocumentCount != 2 {
+		t.Errorf("Unexpected info for renamed collection: %s", rr.Body.String())
+	}
+
+	// While a rename waits for a running search, other requests go on, and
+	// neither name can be taken
+	other := server.collections["rename_other"]
+	other.mutex.RLock()
+	renamed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		renamed <- request(http.MethodPost, "/api/v1/collections/rename_other/rename", `{"new_name":"rename_third"}`)
+	}()
+	for {
+		server.mutex.Lock()
+		moving := server.moving["rename_third"]
+		server.mutex.Unlock()
+		if moving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rr = request(http.MethodGet, "/api/v1/collections/rename_new", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for another collection during the rename, got %d", rr.Code)
+	}
+	rr = request(http.MethodPost, "/api/v1/collections",
+		`{"name":"rename_third","vector_size":2,"quantization":64,"distance_function":"euclidean"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 creating a collection with the new name during the rename, got %d", rr.Code)
+	}
+	if rr = request(http.MethodPost, "/api/v1/collections/rename_other/rename", `{"new_name":"rename_fourth"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 renaming a collection during its rename, got %d", rr.Code)
+	}
+	other.mutex.RUnlock()
+	if rr = <-renamed; rr.Code != http.StatusOK {
+		t.Fatalf("Failed to rename collection: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, exists := server.collections["rename_third"]; !exists {
+		t.Errorf("Expected the collection under its new name")
+	}
+
+	// The renamed collection can still be written and reopened
+	rr = request(http.MethodPost, "/api/v1/collections/rename_new/records", `[{"id":3,"vector":[5,6],"metadata":{}}]`)
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("Failed to insert record after renaming: %d %s", rr.Code, rr.Body.String())
+	}
+	server.collections["rename_new"].Close()
+	collection, err := NewCollection(CollectionOptions{Name: testFilePath("rename_new.dat")})
+	if err != nil {
+		t.Fatalf("Failed to reopen renamed collection: %v", err)
+	}
+	defer collection.Close()
+	if collection.Name != testFilePath("rename_new.dat") {
+		t.Errorf("Expected the reopened collection to have its new name, got %s", collection.Name)
+	}
+	if doc, err := collection.GetDocument(1); err != nil || !aboutEqual(doc.Vector, []float64{1, 2}) {
+		t.Errorf("Expected document 1 after reopening, got %v (%v)", doc, err)
+	}
+	if count := collection.GetDocumentCount(); count != 3 {
+		t.Errorf("Expected 3 documents after reopening, got %d", count)
+	}
+}
+
+func TestInsertFitQuantRange(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	records := make([]string, minQuantRangeSample)
+	for i := range records {
+		records[i] = fmt.Sprintf(`{"id":%d,"vector":[%d,-3],"metadata":{}}`, i, i%5)
+	}
+	body := "[" + strings.Join(records, ",") + "]"
+
+	for _, fit := range []bool{false, true} {
+		name := fmt.Sprintf("fit_quant_range_%v", fit)
+		os.Remove(testFilePath(name + ".dat"))
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections", strings.NewReader(
+			fmt.Sprintf(`{"name":"%s","vector_size":2,"quantization":8,"distance_function":"euclidean","fit_quant_range":%v}`, name, fit)))
+		rr := httptest.NewRecorder()
+		server.handleCollections(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to create collection: %d %s", rr.Code, rr.Body.String())
+		}
+		req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/"+name+"/records", strings.NewReader(body))
+		rr = httptest.NewRecorder()
+		server.handleInsertRecord(rr, req)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to insert records: %d %s", rr.Code, rr.Body.String())
+		}
+
+		// Only a collection created with fit_quant_range gets a range
+		collection := server.collections[name]
+		fitted := collection.QuantMin != 0 || collection.QuantMax != 0
+		if fitted != fit || fit && (collection.QuantMin > -3 || collection.QuantMax < 4) {
+			t.Errorf("fit_quant_range=%v: unexpected range %v to %v", fit, collection.QuantMin, collection.QuantMax)
+		}
+		collection.Close()
+	}
+}
+
+func TestSwapCollection(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	for _, name := range []string{"swap_live", "swap_staging"} {
+		os.Remove(testFilePath(name + ".dat"))
+		os.Remove(testFilePath(name + ".dat.vectors"))
+	}
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		if path == "/api/v1/collections" {
+			server.handleCollections(rr, req)
+		} else if strings.HasSuffix(path, "/records") {
+			server.handleInsertRecord(rr, req)
+		} else if strings.HasSuffix(path, "/search") {
+			server.handleSearchRecords(rr, req)
+		} else {
+			server.handleCollection(rr, req)
+		}
+		return rr
+	}
+	search := func() ([]uint64, int) {
+		rr := request(http.MethodPost, "/api/v1/collections/swap_live/search", `{"vector":[0,0],"k":10,"precision":"exact"}`)
+		var response struct {
+			Results []SearchResult `json:"results"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		ids := resultIDs(response.Results)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids, rr.Code
+	}
+
+	for name, records := range map[string]string{
+		"swap_live":    `[{"id":1,"vector":[1,2],"metadata":{}},{"id":2,"vector":[3,4],"metadata":{}}]`,
+		"swap_staging": `[{"id":3,"vector":[5,6],"metadata":{}},{"id":4,"vector":[7,8],"metadata":{}},{"id":5,"vector":[9,10],"metadata":{}}]`,
+	} {
+		rr := request(http.MethodPost, "/api/v1/collections",
+			`{"name":"`+name+`","vector_size":2,"quantization":64,"distance_function":"euclidean","separate_vectors":true}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to create collection: %d %s", rr.Code, rr.Body.String())
+		}
+		rr = request(http.MethodPost, "/api/v1/collections/"+name+"/records", records)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to insert records: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	defer func() {
+		for _, collection := range server.collections {
+			collection.Close()
+		}
+	}()
+
+	if rr := request(http.MethodPost, "/api/v1/collections/swap_live/swap", `{"staging_name":"swap_missing"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 swapping in a missing collection, got %d", rr.Code)
+	}
+
+	// A collection being compacted can't be swapped
+	server.collections["swap_staging"].compacting.Store(true)
+	if rr := request(http.MethodPost, "/api/v1/collections/swap_live/swap", `{"staging_name":"swap_staging"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 swapping in a collection being compacted, got %d", rr.Code)
+	}
+	server.collections["swap_staging"].compacting.Store(false)
+
+	// Searches during the swap find either the old or the new documents
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ids, code := search()
+				if code != http.StatusOK || !equalUint64Slices(ids, []uint64{1, 2}) && !equalUint64Slices(ids, []uint64{3, 4, 5}) {
+					t.Errorf("Unexpected search during swap: %d %v", code, ids)
+					return
+				}
+			}
+		}()
+	}
+
+	// While the swap waits for a running search, other requests go on, and
+	// the collections can't be changed
+	live := server.collections["swap_live"]
+	live.mutex.RLock()
+	swapped := make(chan *httptest.ResponseRecorder)
+	go func() {
+		swapped <- request(http.MethodPost, "/api/v1/collections/swap_live/swap", `{"staging_name":"swap_staging"}`)
+	}()
+	for {
+		server.mutex.Lock()
+		swapping := server.moving["swap_live"]
+		server.mutex.Unlock()
+		if swapping {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, path := range []string{"/api/v1/collections/swap_live/compact", "/api/v1/collections/swap_staging/rename"} {
+		if rr := request(http.MethodPost, path, `{"new_name":"swap_other"}`); rr.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409 during the swap, got %d", path, rr.Code)
+		}
+	}
+	if rr := request(http.MethodDelete, "/api/v1/collections/swap_staging", ""); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 deleting a collection during the swap, got %d", rr.Code)
+	}
+	live.mutex.RUnlock()
+	rr := <-swapped
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to swap collection: %d %s", rr.Code, rr.Body.String())
+	}
+	if ids, _ := search(); !equalUint64Slices(ids, []uint64{3, 4, 5}) {
+		t.Errorf("Expected the new documents right after the swap, got %v", ids)
+	}
+	close(stop)
+	wg.Wait()
+
+	if rr = request(http.MethodGet, "/api/v1/collections/swap_staging", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the staging name, got %d", rr.Code)
+	}
+	for _, file := range []string{"swap_staging.dat", "swap_staging.dat.vectors", "swap_live.dat.swap", "swap_live.dat.swap.vectors"} {
+		if _, err := os.Stat(testFilePath(file)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be gone", file)
+		}
+	}
+
+	// The new contents are kept in the live collection's files
+	server.collections["swap_live"].Close()
+	collection, err := NewCollection(CollectionOptions{Name: testFilePath("swap_live.dat")})
+	if err != nil {
+		t.Fatalf("Failed to reopen swapped collection: %v", err)
+	}
+	defer collection.Close()
+	if count := collection.GetDocumentCount(); count != 3 {
+		t.Errorf("Expected 3 documents after reopening, got %d", count)
+	}
+}
+
+func TestInsertDuringSwap(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	for _, name := range []string{"swap_insert_live", "swap_insert_staging"} {
+		os.Remove(testFilePath(name + ".dat"))
+	}
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		if path == "/api/v1/collections" {
+			server.handleCollections(rr, req)
+		} else if strings.HasSuffix(path, "/records") {
+			server.handleInsertRecord(rr, req)
+		} else {
+			server.handleCollection(rr, req)
+		}
+		return rr
+	}
+	insert := func(id int) *httptest.ResponseRecorder {
+		return request(http.MethodPost, "/api/v1/collections/swap_insert_live/records",
+			fmt.Sprintf(`[{"id":%d,"vector":[%d,0],"metadata":{}}]`, id, id))
+	}
+	for _, name := range []string{"swap_insert_live", "swap_insert_staging"} {
+		rr := request(http.MethodPost, "/api/v1/collections",
+			`{"name":"`+name+`","vector_size":2,"quantization":64,"distance_function":"euclidean"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to create collection: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	defer func() {
+		for _, collection := range server.collections {
+			collection.Close()
+		}
+	}()
+
+	// Inserts running during the swap all succeed. They are paused while
+	// the swap starts, so that it is the only write waiting for the lock.
+	var wg sync.WaitGroup
+	var paused sync.RWMutex
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for id := 1000 * (i + 1); ; id++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				paused.RLock()
+				rr := insert(id)
+				paused.RUnlock()
+				if rr.Code != http.StatusCreated {
+					t.Errorf("Insert during swap failed: %d %s", rr.Code, rr.Body.String())
+					return
+				}
+			}
+		}(i)
+	}
+
+	// An insert that waits for the swap goes to the collection that takes
+	// the place of the old one
+	paused.Lock()
+	live := server.collections["swap_insert_live"]
+	live.mutex.RLock()
+	swapped := make(chan *httptest.ResponseRecorder)
+	go func() {
+		swapped <- request(http.MethodPost, "/api/v1/collections/swap_insert_live/swap", `{"staging_name":"swap_insert_staging"}`)
+	}()
+	for live.mutex.TryRLock() {
+		// The swap isn't waiting for the lock yet
+		live.mutex.RUnlock()
+		time.Sleep(time.Millisecond)
+	}
+	inserted := make(chan *httptest.ResponseRecorder)
+	go func() {
+		inserted <- insert(1)
+	}()
+	paused.Unlock()
+	live.mutex.RUnlock()
+	if rr := <-swapped; rr.Code != http.StatusOK {
+		t.Fatalf("Failed to swap collection: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := <-inserted; rr.Code != http.StatusCreated {
+		t.Fatalf("Insert waiting for the swap failed: %d %s", rr.Code, rr.Body.String())
+	}
+	close(stop)
+	wg.Wait()
+
+	if _, err := server.collections["swap_insert_live"].GetDocument(1); err != nil {
+		t.Errorf("Expected the insert that waited for the swap in the new collection: %v", err)
+	}
+	if _, err := live.GetDocument(1); !errors.Is(err, ErrCollectionClosed) {
+		t.Errorf("Expected ErrCollectionClosed from the old collection, got %v", err)
+	}
+}
+
+func TestGetAllCollectionsAverageDistance(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("collection_stats.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 8,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["collection_stats"] = collection
+	for i := 0; i < 1000; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 1, 2, 3, 4, 5, 6, float64(i % 7)}, nil)
+	}
+
+	var sampled atomic.Int32
+	averageDistanceSampled = func() { sampled.Add(1) }
+	defer func() { averageDistanceSampled = func() {} }()
+
+	// Lite stats don't read documents, so they are fast and repeatable
+	lite := collection.ComputeStatsLite()
+	if sampled.Load() != 0 {
+		t.Errorf("Expected lite stats not to sample the documents")
+	}
+	if lite.AverageDistance != nil || lite.DocumentCount != 1000 {
+		t.Errorf("Expected 1000 documents and no average distance, got %+v", lite)
+	}
+	if again := collection.ComputeStatsLite(); again != lite {
+		t.Errorf("Expected the same stats, got %+v and %+v", lite, again)
+	}
+	if full := collection.ComputeStats(); full.AverageDistance == nil || *full.AverageDistance <= 0 {
+		t.Errorf("Expected an average distance, got %v", full.AverageDistance)
+	}
+
+	list := func(url string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rr := httptest.NewRecorder()
+		server.handleCollections(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var response []map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 1 {
+			t.Fatalf("expected 1 collection, got %v", len(response))
+		}
+		return response[0]
+	}
+
+	sampled.Store(0)
+	if info := list("/api/v1/collections"); info["average_distance"] != nil || sampled.Load() != 0 {
+		t.Errorf("Expected no average distance by default, got %v", info["average_distance"])
+	}
+	if info := list("/api/v1/collections?average_distance=true"); info["average_distance"] == nil || sampled.Load() != 1 {
+		t.Errorf("Expected an average distance when requested, got %v", info)
+	}
+}
+
+func TestRecordStreamEndpoint(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+	collection.AddDocument(1, []float64{1, 2}, []byte(`{"key1":"value1"}`))
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/collections/test_collection/records/"+path, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.handleRecordStream(rr, req)
+		return rr
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0, 0, 13)
+	if rr := request(http.MethodPut, "1/streams/8", png); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr := request(http.MethodGet, "1/streams/8", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), png) {
+		t.Errorf("Expected the stored bytes back, got %q", rr.Body.Bytes())
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("Expected Content-Type image/png, got %q", contentType)
+	}
+
+	for path, want := range map[string]int{
+		"1/streams/9":   http.StatusNotFound,
+		"2/streams/8":   http.StatusNotFound,
+		"1/streams/1":   http.StatusBadRequest,
+		"1/streams/256": http.StatusBadRequest,
+		"x/streams/8":   http.StatusBadRequest,
+	} {
+		if rr := request(http.MethodGet, path, nil); rr.Code != want {
+			t.Errorf("GET %s: expected status %d, got %d", path, want, rr.Code)
+		}
+	}
+	if rr := request(http.MethodPut, "2/streams/8", []byte("x")); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 writing a stream of a missing record, got %d", rr.Code)
+	}
+	if rr := request(http.MethodPut, "1/streams/0", []byte("{}")); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 writing the metadata stream, got %d", rr.Code)
+	}
+
+	// A stream is served with the type it was stored with, and an untyped
+	// stream whose contents aren't recognized as binary data
+	typed := func(path, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/collections/test_collection/records/"+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		server.handleRecordStream(rr, req)
+		return rr
+	}
+	if rr := typed("1/streams/10", "image/png", png[:8]); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := typed("1/streams/11", "application/x-www-form-urlencoded", []byte{0, 1, 2}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := typed("1/streams/12", "text/plain; charset=utf-8", []byte("\x89PNG\r\n\x1a\n")); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for path, want := range map[string]string{
+		"1/streams/10": "image/png",
+		"1/streams/11": "application/octet-stream",
+		"1/streams/12": "text/plain; charset=utf-8",
+	} {
+		if contentType := request(http.MethodGet, path, nil).Header().Get("Content-Type"); contentType != want {
+			t.Errorf("GET %s: expected Content-Type %s, got %q", path, want, contentType)
+		}
+	}
+	if rr := typed("1/streams/10", "image/", png); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid content type, got %d", rr.Code)
+	}
+}
+
+func TestUpdateMetadataBatchEndpoint(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+	collection.AddDocument(1, []float64{1, 0}, []byte(`{"key":"old"}`))
+	collection.AddDocument(3, []float64{3, 0}, []byte(`{"key":"old"}`))
+
+	body := `[{"id": 1, "metadata": {"key": "new"}}, {"id": 2, "metadata": {"key": "new"}}, {"id": 3, "metadata": {"key": "new"}}]`
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/collections/test_collection/records/metadata", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	server.handleUpdateMetadataBatch(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// The response says which records were updated despite the error
+	var response struct {
+		Count  int      `json:"count"`
+		Failed []uint64 `json:"failed"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Count != 2 || len(response.Failed) != 1 || response.Failed[0] != 2 {
+		t.Errorf("Expected 2 records updated and record 2 failed, got %+v", response)
+	}
+	for _, id := range []uint64{1, 3} {
+		doc, err := collection.GetDocument(id)
+		if err != nil || string(doc.Metadata) != `{"key":"new"}` {
+			t.Errorf("Expected record %d to be updated, got %v, %v", id, doc, err)
+		}
+	}
+}
+
+func TestSetMetadataFieldEndpoint(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Cosine,
+		DimensionCount: 5,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+	collection.AddDocument(1, []float64{0.1, 0.2, 0.3, 0.4, 0.5}, []byte(`{"key1":"value1"}`))
+
+	patch := func(path, body string) int {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/collections/test_collection/records/"+path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		server.handleSetMetadataField(rr, req)
+		return rr.Code
+	}
+
+	if code := patch("1/metadata/user.profile.active", `{"value": true}`); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	doc, err := collection.GetDocument(1)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if expected := `{"key1":"value1","user":{"profile":{"active":true}}}`; string(doc.Metadata) != expected {
+		t.Errorf("Expected metadata %s, got %s", expected, doc.Metadata)
+	}
+
+	if code := patch("2/metadata/key1", `{"value": 1}`); code != http.StatusNotFound {
+		t.Errorf("Expected %v for a missing record, got %v", http.StatusNotFound, code)
+	}
+	if code := patch("1/metadata/key1.nested", `{"value": 1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected %v for a path through a string, got %v", http.StatusBadRequest, code)
+	}
+}
+
+func TestCompactCollectionEndpoint(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+	for i := 0; i < 100; i++ {
+		collection.AddDocument(uint64(i), []float64{float64(i), 0}, []byte(`{}`))
+	}
+	for i := 0; i < 100; i += 2 {
+		collection.removeDocument(uint64(i))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/compact", nil)
+	rr := httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var started struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&started); err != nil || started.JobID == "" {
+		t.Fatalf("Expected a job ID, got %v", err)
+	}
+
+	var status struct {
+		Status   string  `json:"status"`
+		Progress float64 `json:"progress"`
+		Error    string  `json:"error"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for status.Status != "done" && time.Now().Before(deadline) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_collection/compact/"+started.JobID, nil)
+		rr := httptest.NewRecorder()
+		server.handleCollection(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != "running" && status.Status != "done" {
+			t.Fatalf("Expected the compaction to run, got %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status.Status != "done" || status.Progress != 1 {
+		t.Errorf("Expected the compaction to finish, got %+v", status)
+	}
+	if count := collection.Metrics().Compactions; count != 1 {
+		t.Errorf("Expected 1 compaction, got %d", count)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_collection/compact/999", nil)
+	rr = httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected %v for an unknown job, got %v", http.StatusNotFound, rr.Code)
+	}
+
+	// Jobs that finished long ago are forgotten when the next one starts
+	job := server.compactions[started.JobID].job
+	job.mutex.Lock()
+	job.finishedAt = time.Now().Add(-compactionJobRetention - time.Minute)
+	job.mutex.Unlock()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/compact", nil)
+	rr = httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&started); err != nil {
+		t.Fatal(err)
+	}
+	<-server.compactions[started.JobID].job.Done()
+	if len(server.compactions) != 1 {
+		t.Errorf("Expected only the new job to be kept, got %d jobs", len(server.compactions))
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/collections/test_collection/compact/1", nil)
+	rr = httptest.NewRecorder()
+	server.handleCollection(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected %v for a forgotten job, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestInsertIdempotencyKey(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	collection, err := NewCollection(CollectionOptions{
+		Name:           testFilePath("test_collection.dat"),
+		DistanceMethod: Euclidean,
+		DimensionCount: 2,
+		Quantization:   64,
+		FileMode:       CreateAndOverwrite,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test collection: %v", err)
+	}
+	defer collection.Close()
+	server.collections["test_collection"] = collection
+	idempotencyCache = nil
+
+	insert := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/records", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		server.handleInsertRecord(rr, req)
+		return rr
+	}
+
+	body := `[{"id": 1, "vector": [0.1, 0.2], "metadata": {"a": "1"}}]`
+	first := insert("key-1", body)
+	second := insert("key-1", body)
+	if first.Code != http.StatusCreated || second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("Expected the same response twice, got %v %q and %v %q", first.Code, first.Body, second.Code, second.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the second response to be marked as replayed")
+	}
+	if ids := collection.GetAllIDs(); len(ids) != 1 {
+		t.Errorf("Expected 1 document, got %v", ids)
+	}
+	if writes := collection.Metrics().Writes; writes != 1 {
+		t.Errorf("Expected the document to be written once, got %d writes", writes)
+	}
+
+	// A key can't be reused for another request
+	if rr := insert("key-1", `[{"id": 5, "vector": [0.5, 0.5]}]`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %v reusing a key with another body, got %v", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	// Other keys, and requests without a key, insert again
+	insert("key-2", body)
+	insert("", body)
+	if writes := collection.Metrics().Writes; writes != 3 {
+		t.Errorf("Expected 3 writes, got %d", writes)
+	}
+
+	// Failed inserts are not remembered
+	if rr := insert("key-3", `[{"id": 2, "vector": [0.1]}]`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v for a bad vector, got %v", http.StatusBadRequest, rr.Code)
+	}
+	if rr := insert("key-3", `[{"id": 2, "vector": [0.1, 0.3]}]`); rr.Code != http.StatusCreated {
+		t.Errorf("Expected the retry to succeed, got %v", rr.Code)
+	}
+	if ids := collection.GetAllIDs(); len(ids) != 2 {
+		t.Errorf("Expected 2 documents, got %v", ids)
+	}
+}
+
+func TestIdempotencyKeyConcurrent(t *testing.T) {
+	idempotencyCache = nil
+
+	// Retries that arrive while the first request is handled wait for its
+	// response instead of running the handler again
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter) {
+		calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/c/records", strings.NewReader("body"))
+		req.Header.Set("Idempotency-Key", "key")
+		rr := httptest.NewRecorder()
+		withIdempotencyKey(rr, req, "c", handler)
+		return rr
+	}
+
+	const retries = 5
+	responses := make(chan *httptest.ResponseRecorder, retries)
+	for i := 0; i < retries; i++ {
+		go func() { responses <- request() }()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < retries; i++ {
+		if rr := <-responses; rr.Code != http.StatusCreated || rr.Body.String() != "done" {
+			t.Errorf("Expected every retry to get the first response, got %v %q", rr.Code, rr.Body)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", n)
+	}
+}
+
+func TestConcurrentCreateCollection(t *testing.T) {
+	ensureTestFolder(t)
+	server := setupTestServer()
+	os.Remove(testFilePath("concurrent_collection.dat"))
+
+	const attempts = 20
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reqBody := `{"name": "concurrent_collection", "vector_size": 4, "quantization": 64, "distance_function": "cosine"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/collections", bytes.NewBufferString(reqBody))
+			rr := httptest.NewRecorder()
+			server.handleCollections(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("Unexpected status code %v", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected exactly one create to succeed, got %d", created)
+	}
+	if len(server.collections) != 1 || server.collections["concurrent_collection"] == nil {
+		t.Errorf("Expected one collection, got %v", server.collections)
+	}
+	server.collections["concurrent_collection"].Close()
+
+	// Collections with different names can be created at the same time
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			collection, err := server.CreateCollection(fmt.Sprintf("concurrent_%d", i), CollectionOptions{
+				DistanceMethod: Euclidean,
+				DimensionCount: 4,
+				FileMode:       CreateAndOverwrite,
+			})
+			if err == nil {
+				collection.Close()
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Failed to create collection: %v", err)
+		}
+	}
+	if len(server.collections) != attempts+1 {
+		t.Errorf("Expected %d collections, got %d", attempts+1, len(server.collections))
+	}
+}
@@ -1,6 +1,11 @@
 package syzgydb
 
-import "math/rand"
+import (
+	"math/rand"
+	"time"
+
+	"github.com/NYTimes/gziphandler"
+)
 
 // Config holds the configuration settings for the service.
 type Config struct {
@@ -11,12 +16,134 @@ type Config struct {
 	SyzgyHost    string `mapstructure:"syzgy_host"`
 	HTMLRoot     string `mapstructure:"html_root"`
 
+	// If non-zero, embeddings returned by the text model must have exactly this many dimensions.
+	EmbeddingDimensions int `mapstructure:"embedding_dimensions"`
+
+	// How many times a failed embedding request is retried, and the delay before
+	// the first retry. The delay doubles after each attempt.
+	EmbeddingRetries    int           `mapstructure:"embedding_retries"`
+	EmbeddingRetryDelay time.Duration `mapstructure:"embedding_retry_delay"`
+
+	// How many search texts have their embeddings cached, and for how long.
+	// A size of zero uses the default; a TTL of zero never expires entries.
+	EmbeddingCacheSize int           `mapstructure:"embedding_cache_size"`
+	EmbeddingCacheTTL  time.Duration `mapstructure:"embedding_cache_ttl"`
+
+	// How many idempotency keys of record inserts are remembered, and for how
+	// long. Zero uses the defaults.
+	IdempotencyCacheSize int           `mapstructure:"idempotency_cache_size"`
+	IdempotencyTTL       time.Duration `mapstructure:"idempotency_ttl"`
+
+	// How often the server removes documents whose "expires_at" time has passed.
+	// Zero disables the background purge.
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+
+	// If set, the server reads every collection's files into memory in the
+	// background after loading them, so that the first searches are fast.
+	WarmupOnStart bool `mapstructure:"warmup_on_start"`
+
+	// When ShardNodes is set, each collection is owned by one of the listed nodes,
+	// chosen with ShardFor, and this node rejects writes to collections owned by
+	// another node. NodeID identifies this node in the list.
+	NodeID     uint64   `mapstructure:"node_id"`
+	ShardNodes []uint64 `mapstructure:"shard_nodes"`
+
+	// How collection files are arranged in the data folder: "flat" (the
+	// default) or "hashed". See DataFolderLayoutHashed.
+	DataFolderLayout string `mapstructure:"data_folder_layout"`
+
+	// The largest DimensionCount a collection may have. Zero means DefaultMaxDimensions.
+	MaxDimensions int `mapstructure:"max_dimensions"`
+
+	// Responses smaller than this many bytes are sent without gzip compression.
+	// Zero means DefaultGzipMinSize.
+	GzipMinSize int `mapstructure:"gzip_min_size"`
+
+	// The largest k and limit accepted by the search API. Zero means
+	// DefaultMaxSearchK and DefaultMaxSearchLimit.
+	MaxSearchK     int `mapstructure:"max_search_k"`
+	MaxSearchLimit int `mapstructure:"max_search_limit"`
+
+	// The longest a search API request may search for before returning the
+	// results found so far. Requests can ask for less time with the
+	// X-Search-Timeout-Ms header. Zero means no limit.
+	SearchTimeout time.Duration `mapstructure:"search_timeout"`
+
+	// The largest request body accepted, in bytes. Zero means
+	// DefaultMaxRequestBytes.
+	MaxRequestBytes int64 `mapstructure:"max_request_bytes"`
+
+	// The most API requests handled at once. Requests beyond that are turned
+	// away with 503 Service Unavailable. Zero means no limit.
+	MaxConcurrentRequests int `mapstructure:"max_concurrent_requests"`
+
+	// The least severe messages that are logged: "debug", "info", "warn" or
+	// "error". Empty means "info".
+	LogLevel string `mapstructure:"log_level"`
+
 	// If non-zero, we will use psuedorandom numbers so everything is predictable for testing.
 	RandomSeed int64
 }
 
 var globalConfig Config
 
+// Layouts of the data folder. With the flat layout every collection file is
+// directly in the data folder, or its tenant's folder. With the hashed layout
+// each file is two levels deeper, in folders named after a hash of the
+// collection name, such as "ab/cd/name.dat", so that no folder holds too many
+// files when there are thousands of collections.
+const (
+	DataFolderLayoutFlat   = "flat"
+	DataFolderLayoutHashed = "hashed"
+)
+
+// DefaultMaxDimensions is the largest DimensionCount allowed when Config.MaxDimensions is not set.
+const DefaultMaxDimensions = 65536
+
+// DefaultGzipMinSize is the smallest response compressed when Config.GzipMinSize is not set.
+const DefaultGzipMinSize = gziphandler.DefaultMinSize
+
+// DefaultMaxSearchK is the largest k accepted by the search API when Config.MaxSearchK is not set.
+const DefaultMaxSearchK = 10000
+
+// DefaultMaxSearchLimit is the largest limit accepted by the search API when Config.MaxSearchLimit is not set.
+const DefaultMaxSearchLimit = 10000
+
+// DefaultMaxRequestBytes is the largest request body accepted when Config.MaxRequestBytes is not set.
+const DefaultMaxRequestBytes = 32 << 20
+
+// maxDimensions returns the configured limit on the number of dimensions in a collection.
+func maxDimensions() int {
+	if globalConfig.MaxDimensions > 0 {
+		return globalConfig.MaxDimensions
+	}
+	return DefaultMaxDimensions
+}
+
+// maxSearchK returns the configured limit on k in the search API.
+func maxSearchK() int {
+	if globalConfig.MaxSearchK > 0 {
+		return globalConfig.MaxSearchK
+	}
+	return DefaultMaxSearchK
+}
+
+// maxSearchLimit returns the configured limit on limit in the search API.
+func maxSearchLimit() int {
+	if globalConfig.MaxSearchLimit > 0 {
+		return globalConfig.MaxSearchLimit
+	}
+	return DefaultMaxSearchLimit
+}
+
+// maxRequestBytes returns the configured limit on the size of request bodies.
+func maxRequestBytes() int64 {
+	if globalConfig.MaxRequestBytes > 0 {
+		return globalConfig.MaxRequestBytes
+	}
+	return DefaultMaxRequestBytes
+}
+
 func init() {
 	globalConfig = Config{
 		OllamaServer: "default_ollama_server",
@@ -32,6 +159,11 @@ func init() {
 
 func Configure(cfg Config) {
 	globalConfig = cfg
+	level, err := ParseLogLevel(cfg.LogLevel)
+	SetLogLevel(level)
+	if err != nil {
+		logWarnf("Warning -- %v; using info", err)
+	}
 	if cfg.RandomSeed != 0 {
 		myRandom.Seed(cfg.RandomSeed)
 	} else {
@@ -68,6 +200,12 @@ func (r *myRandomType) Seed(n int64) {
 	r.rand = rand.New(rand.NewSource(n))
 }
 
+// newSeededRandom returns a random source that always gives the same numbers
+// for the same seed.
+func newSeededRandom(seed int64) *myRandomType {
+	return &myRandomType{rand.New(rand.NewSource(seed))}
+}
+
 func (r *myRandomType) ThreadsafeNew() *myRandomType {
 	if r.rand == nil {
 		return r
@@ -0,0 +1,55 @@
+package syzgydb
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+)
+
+/*
+ShardFor returns the node that owns the given key, such as a collection name,
+chosen from nodeIDs by rendezvous hashing. Every node that knows the same list of
+nodes reaches the same answer, and when a node is added or removed only the keys
+owned by that node move. It returns 0 if nodeIDs is empty.
+*/
+func ShardFor(key string, nodeIDs []uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	keyHash := h.Sum64()
+
+	var owner, best uint64
+	for i, nodeID := range nodeIDs {
+		score := mix64(keyHash ^ mix64(nodeID))
+		if i == 0 || score > best || (score == best && nodeID < owner) {
+			owner, best = nodeID, score
+		}
+	}
+	return owner
+}
+
+// mix64 scrambles the bits of x so that similar inputs give unrelated outputs.
+// It is the finalizer of the splitmix64 generator.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// checkCollectionOwner writes a 421 Misdirected Request response and returns
+// false if sharding is configured and another node owns the collection. The
+// X-Syzgy-Owner header names the node that owns it.
+func checkCollectionOwner(w http.ResponseWriter, collectionName string) bool {
+	if len(globalConfig.ShardNodes) == 0 {
+		return true
+	}
+	owner := ShardFor(collectionName, globalConfig.ShardNodes)
+	if owner == globalConfig.NodeID {
+		return true
+	}
+	w.Header().Set("X-Syzgy-Owner", strconv.FormatUint(owner, 10))
+	writeErrorResponse(w, "Collection "+collectionName+" is owned by node "+strconv.FormatUint(owner, 10), http.StatusMisdirectedRequest)
+	return false
+}
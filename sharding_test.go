@@ -0,0 +1,85 @@
+package syzgydb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShardForDistribution(t *testing.T) {
+	nodes := []uint64{11, 22, 33, 44, 55}
+	const numKeys = 10000
+	counts := make(map[uint64]int)
+	for i := 0; i < numKeys; i++ {
+		counts[ShardFor(fmt.Sprintf("collection%d", i), nodes)]++
+	}
+
+	expected := numKeys / len(nodes)
+	for _, node := range nodes {
+		if counts[node] < expected*8/10 || counts[node] > expected*12/10 {
+			t.Errorf("Node %d owns %d keys, expected about %d", node, counts[node], expected)
+		}
+	}
+
+	if owner := ShardFor("anything", nil); owner != 0 {
+		t.Errorf("Expected 0 with no nodes, got %d", owner)
+	}
+}
+
+func TestShardForStability(t *testing.T) {
+	nodes := []uint64{1, 2, 3, 4}
+	grown := []uint64{1, 2, 3, 4, 5}
+	shrunk := []uint64{1, 2, 4}
+	reordered := []uint64{4, 3, 2, 1}
+
+	moved := 0
+	const numKeys = 5000
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ShardFor(key, nodes)
+
+		if ShardFor(key, reordered) != owner {
+			t.Fatalf("Owner of %s depends on the order of the nodes", key)
+		}
+
+		// Adding a node only moves keys to the new node
+		if newOwner := ShardFor(key, grown); newOwner != owner {
+			if newOwner != 5 {
+				t.Fatalf("Key %s moved from %d to %d when node 5 was added", key, owner, newOwner)
+			}
+			moved++
+		}
+
+		// Removing a node only moves the keys it owned
+		if newOwner := ShardFor(key, shrunk); newOwner != owner && owner != 3 {
+			t.Fatalf("Key %s moved from %d to %d when node 3 was removed", key, owner, newOwner)
+		}
+	}
+
+	// About a fifth of the keys should move to the new node
+	if moved < numKeys/5*8/10 || moved > numKeys/5*12/10 {
+		t.Errorf("Expected about %d keys to move to the new node, got %d", numKeys/5, moved)
+	}
+}
+
+func TestInsertRejectedByNonOwner(t *testing.T) {
+	saved := globalConfig
+	defer func() { globalConfig = saved }()
+	globalConfig.ShardNodes = []uint64{1, 2}
+	owner := ShardFor("test_collection", globalConfig.ShardNodes)
+	globalConfig.NodeID = 3 - owner
+
+	server := setupTestServer()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/collections/test_collection/records", strings.NewReader(`[]`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.handleInsertRecord).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMisdirectedRequest)
+	}
+	if got := rr.Header().Get("X-Syzgy-Owner"); got != fmt.Sprint(owner) {
+		t.Errorf("Expected owner header %d, got %q", owner, got)
+	}
+}
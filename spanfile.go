@@ -24,13 +24,17 @@ and there is not enough space to fit in at leeast an empty span.
 package syzgydb
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"log"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/edsrzf/mmap-go"
 )
@@ -42,10 +46,14 @@ type SpanReader struct {
 }
 
 func (db *SpanFile) getSpanReader(recordID string) (*SpanReader, error) {
+	if data, ok := db.pending[recordID]; ok {
+		return &SpanReader{data: data}, nil
+	}
+
 	// Find the offset of the record
 	offset, exists := db.index[recordID]
 	if !exists {
-		return nil, fmt.Errorf("record not found")
+		return nil, ErrRecordNotFound
 	}
 
 	// Create a SpanReader for the data at the offset
@@ -62,26 +70,64 @@ const (
 
 const minSpanLength = 15
 
+// headerRecordID is the ID of the record that holds the file's header, such as
+// the collection options. It is skipped when iterating over records.
+const headerRecordID = ""
+
 type DataStream struct {
 	StreamID uint8
 	Data     []byte
 }
 
 func (sr *SpanReader) getStream(id uint8) ([]byte, error) {
+	var found []byte
+	err := sr.walkStreams(func(streamID uint8, data []byte) bool {
+		if streamID == id {
+			found = data
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("stream ID %d not found", id)
+	}
+	return found, nil
+}
+
+// getAllStreams returns every data stream of the span by stream ID, reading the
+// span only once. The streams refer to the span's data and are not copied.
+func (sr *SpanReader) getAllStreams() (map[uint8][]byte, error) {
+	streams := make(map[uint8][]byte)
+	err := sr.walkStreams(func(streamID uint8, data []byte) bool {
+		streams[streamID] = data
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// walkStreams calls fn with each data stream of the span, in order, until fn
+// returns false.
+func (sr *SpanReader) walkStreams(fn func(streamID uint8, data []byte) bool) error {
 	at := 8 // Skip MagicNumber and length
 	var err error
 
 	// Skip SequenceNumber
 	_, at, err = read7Code(sr.data, at)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Skip RecordID
 	var idLength uint64
 	idLength, at, err = read7Code(sr.data, at)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	at += int(idLength)
 
@@ -91,7 +137,7 @@ func (sr *SpanReader) getStream(id uint8) ([]byte, error) {
 
 	for i := 0; i < numStreams; i++ {
 		if at >= len(sr.data) {
-			return nil, fmt.Errorf("data too short to contain all streams")
+			return fmt.Errorf("data too short to contain all streams")
 		}
 		streamID := sr.data[at]
 		at++
@@ -99,27 +145,46 @@ func (sr *SpanReader) getStream(id uint8) ([]byte, error) {
 		var streamLen uint64
 		streamLen, at, err = read7Code(sr.data, at)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if at+int(streamLen) > len(sr.data) {
-			return nil, fmt.Errorf("data too short for stream data")
+			return fmt.Errorf("data too short for stream data")
 		}
 
-		if streamID == id {
-			return sr.data[at : at+int(streamLen)], nil
+		if !fn(streamID, sr.data[at:at+int(streamLen)]) {
+			return nil
 		}
 
 		at += int(streamLen)
 	}
 
-	return nil, fmt.Errorf("stream ID %d not found", id)
+	return nil
 }
 
 func (db *SpanFile) Close() error {
 	db.fileMutex.Lock()
 	defer db.fileMutex.Unlock()
 
+	if db.mmapData != nil {
+		if err := db.flush(); err != nil {
+			return err
+		}
+	}
+
+	if db.wal != nil && db.mmapData != nil {
+		if err := db.checkpoint(); err != nil {
+			return err
+		}
+	}
+	if db.wal != nil {
+		err := db.wal.Close()
+		if err != nil {
+			return err
+		}
+		db.wal = nil
+		os.Remove(walFileName(db.fileName))
+	}
 	if db.mmapData != nil {
 		err := msync(db.mmapData)
 		if err != nil {
@@ -150,6 +215,16 @@ type Span struct {
 	Checksum       uint32
 }
 
+// getStream returns the data of the stream with the given ID.
+func (span *Span) getStream(id uint8) ([]byte, error) {
+	for _, stream := range span.DataStreams {
+		if stream.StreamID == id {
+			return stream.Data, nil
+		}
+	}
+	return nil, fmt.Errorf("stream ID %d not found", id)
+}
+
 type IndexEntry struct {
 	Offset         uint64
 	Span           *Span
@@ -165,6 +240,27 @@ type SpanFile struct {
 	freeMap        freeMap // Change from freeList to freeMap
 	sequenceNumber uint32
 	fileMutex      sync.Mutex
+	readOnly       bool
+
+	// wal is the write-ahead log, if EnableWAL was called, and walSize is the
+	// number of bytes written to it since it was last emptied.
+	wal     *os.File
+	walSize int
+
+	// skipChecksums is set when ReadRecord should trust the file's contents.
+	skipChecksums bool
+
+	// repair is set when the file was opened in Repair mode.
+	repair bool
+
+	// When writes are buffered, pending holds the records written since the
+	// last flush, already serialized, and pendingOrder the order they were
+	// written in. pendingSize is their total size, and bufferSize is the size
+	// at which they are flushed.
+	pending      map[string][]byte
+	pendingOrder []string
+	pendingSize  int
+	bufferSize   int
 }
 
 type FreeSpan struct {
@@ -176,18 +272,27 @@ type FileMode int
 
 const (
 	CreateIfNotExists  FileMode = 0 // Create the file only if it doesn't exist
-	ReadWrite          FileMode = 1 // Open the file for read/write access
-	ReadOnly           FileMode = 2 // Open the file for read-only access
+	ReadWrite          FileMode = 1 // Open an existing file for read/write access
+	ReadOnly           FileMode = 2 // Open an existing file for read-only access
 	CreateAndOverwrite FileMode = 3 // Always create and overwrite the file if it exists
+	Repair             FileMode = 4 // Open an existing file for read/write access, skipping corrupt spans
 )
 
+// ErrFileNotFound is returned when opening a file that does not exist in the
+// ReadWrite, ReadOnly or Repair modes, which never create files.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrRecordNotFound is returned when reading or removing a record that is not
+// in the file.
+var ErrRecordNotFound = errors.New("record not found")
+
 func OpenFile(filename string, mode FileMode) (*SpanFile, error) {
 	flags := os.O_RDWR
 	mmapFlag := mmap.RDWR
 	switch mode {
 	case CreateIfNotExists:
 		flags |= os.O_CREATE
-	case ReadWrite:
+	case ReadWrite, Repair:
 		// No additional flags needed
 	case ReadOnly:
 		flags = os.O_RDONLY
@@ -200,10 +305,28 @@ func OpenFile(filename string, mode FileMode) (*SpanFile, error) {
 
 	file, err := os.OpenFile(filename, flags, 0666)
 	if err != nil {
-		log.Printf("Error opening file: %v", err)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+		}
+		logErrorf("Error opening file: %v", err)
 		return nil, err
 	}
 
+	// Complete any writes that were logged but interrupted by a crash
+	switch mode {
+	case CreateAndOverwrite:
+		os.Remove(walFileName(filename))
+	case ReadOnly:
+		if _, err := os.Stat(walFileName(filename)); err == nil {
+			logWarnf("Warning -- %s has a write-ahead log that cannot be replayed in read-only mode", filename)
+		}
+	default:
+		if err := replayWAL(file, walFileName(filename)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
 	// Check the file size
 	fileInfo, err := file.Stat()
 	if err != nil {
@@ -237,8 +360,9 @@ func OpenFile(filename string, mode FileMode) (*SpanFile, error) {
 		}
 	}
 
-	// Check the magic number if the file is not empty
-	if fileInfo.Size() > 0 {
+	// Check the magic number if the file is not empty. In repair mode a bad
+	// first span is skipped like any other.
+	if fileInfo.Size() > 0 && mode != Repair {
 		// Read the first 4 bytes to check the magic number
 		magicNumber := make([]byte, 4)
 		_, err := file.ReadAt(magicNumber, 0)
@@ -256,7 +380,7 @@ func OpenFile(filename string, mode FileMode) (*SpanFile, error) {
 	}
 	mmapData, err := mmap.MapRegion(file, -1, mmapFlag, 0, 0)
 	if err != nil {
-		log.Printf("Error mapping file: %v", err)
+		logErrorf("Error mapping file: %v", err)
 		file.Close()
 		return nil, err
 	}
@@ -268,6 +392,8 @@ func OpenFile(filename string, mode FileMode) (*SpanFile, error) {
 		freeMap:        freeMap{freeSpaces: []space{}}, // Initialize freeMap
 		sequenceNumber: 0,
 		fileName:       filename,
+		readOnly:       mode == ReadOnly,
+		repair:         mode == Repair,
 	}
 
 	err = db.scanFile()
@@ -284,6 +410,7 @@ func (db *SpanFile) scanFile() error {
 	fileSize := len(db.mmapData)
 	highestSeqNum := uint32(0)
 	sequences := make(map[string]uint32)
+	prev := -1 // offset of the last span read, for skipCorruptSpan
 	for offset < fileSize {
 		// Ensure there is enough data to read the magic number and length
 		if offset+minSpanLength > fileSize {
@@ -293,7 +420,21 @@ func (db *SpanFile) scanFile() error {
 		magicNumber := binary.BigEndian.Uint32(db.mmapData[offset : offset+4])
 
 		// if the magic number of 0 then assume we are at the end of the file
-		// and mark the rest as free.
+		// and mark the rest as free. In repair mode, make sure that no spans
+		// follow it first.
+		if magicNumber == 0 && db.repair {
+			if next := db.findNextSpan(offset); next < fileSize {
+				start := offset
+				var err error
+				if offset, err = db.skipCorruptSpan(prev, offset, next); err != nil {
+					return err
+				}
+				if offset-start >= 8 {
+					prev = start
+				}
+				continue
+			}
+		}
 		if magicNumber == 0 {
 			SpanLog("Marking rest of file as free space: span%v:%v/%v", offset, fileSize-offset, fileSize)
 			db.addFreeSpan(uint64(offset), uint64(fileSize-offset))
@@ -303,6 +444,21 @@ func (db *SpanFile) scanFile() error {
 		length, err := readUint32(db.mmapData, int(offset+4))
 		//log.Printf("Scanning span at offset %d...%d\n", offset, length)
 
+		// In repair mode, skip over any span that can't be read
+		if db.repair && (err != nil || length < minSpanLength || offset+int(length) > fileSize ||
+			(magicNumber != activeMagic && magicNumber != freeMagic) ||
+			(magicNumber == activeMagic && !verifyChecksum(db.mmapData[offset:offset+int(length)]))) {
+			start := offset
+			offset, err = db.skipCorruptSpan(prev, offset, db.findNextSpan(offset))
+			if err != nil {
+				return err
+			}
+			if offset-start >= 8 {
+				prev = start
+			}
+			continue
+		}
+
 		// Ensure there is enough data for the entire span
 		if err != nil || offset+int(length) > fileSize {
 			break // Not enough data for the complete span
@@ -313,7 +469,7 @@ func (db *SpanFile) scanFile() error {
 		if magicNumber == activeMagic {
 			spanData := db.mmapData[offset : offset+int(length)]
 			if !verifyChecksum(spanData) {
-				log.Printf("Checksum failed for span at offset %d\n", offset)
+				logWarnf("Checksum failed for span at offset %d\n", offset)
 				offset += int(length)
 				if length == 0 {
 					return fmt.Errorf("length is 0; can't continue")
@@ -323,7 +479,7 @@ func (db *SpanFile) scanFile() error {
 
 			span, err := parseSpan(spanData)
 			if err != nil {
-				log.Printf("Error parsing span: %v", err)
+				logWarnf("Error parsing span: %v", err)
 				offset += int(length)
 				continue
 			}
@@ -344,6 +500,7 @@ func (db *SpanFile) scanFile() error {
 			db.addFreeSpan(uint64(offset), uint64(length))
 		}
 
+		prev = offset
 		offset += int(length)
 		if length == 0 {
 			return fmt.Errorf("length is 0; can't continue")
@@ -356,6 +513,75 @@ func (db *SpanFile) scanFile() error {
 	return nil
 }
 
+// findNextSpan returns the offset of the first span after offset that has a
+// valid checksum, or the end of the file if there is none.
+func (db *SpanFile) findNextSpan(offset int) int {
+	fileSize := len(db.mmapData)
+	for next := offset + 1; next+minSpanLength <= fileSize; next++ {
+		if binary.BigEndian.Uint32(db.mmapData[next:next+4]) != activeMagic {
+			continue
+		}
+		length := int(binary.BigEndian.Uint32(db.mmapData[next+4 : next+8]))
+		if length >= minSpanLength && next+length <= fileSize && verifyChecksum(db.mmapData[next:next+length]) {
+			return next
+		}
+	}
+	return fileSize
+}
+
+/*
+skipCorruptSpan is used in repair mode when the span at offset can't be read. It
+marks the bytes up to next, the offset of the next readable span, as a free span
+so that later opens will skip them too, and returns the offset to continue
+scanning from. A gap too small to hold a span header is added to the span before
+it, prev, or if there is none, to the span at next, which is moved back to
+offset.
+*/
+func (db *SpanFile) skipCorruptSpan(prev, offset, next int) (int, error) {
+	logWarnf("Warning -- corrupt span at offset %d in %s; skipping %d bytes", offset, db.fileName, next-offset)
+	if next-offset >= 8 {
+		freeSpan := make([]byte, 8)
+		binary.BigEndian.PutUint32(freeSpan[0:4], freeMagic)
+		binary.BigEndian.PutUint32(freeSpan[4:8], uint32(next-offset))
+		if err := db.writeAt(freeSpan, uint64(offset)); err != nil {
+			return 0, err
+		}
+		db.addFreeSpan(uint64(offset), uint64(next-offset))
+		return next, nil
+	}
+
+	if prev >= 0 {
+		if err := db.resizeSpan(prev, prev, next); err != nil {
+			return 0, err
+		}
+		if binary.BigEndian.Uint32(db.mmapData[prev:prev+4]) == freeMagic {
+			db.addFreeSpan(uint64(offset), uint64(next-offset))
+		}
+		return next, nil
+	}
+
+	// Scan the moved span again from its new offset
+	length := int(binary.BigEndian.Uint32(db.mmapData[next+4 : next+8]))
+	if err := db.resizeSpan(next, offset, next+length); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// resizeSpan rewrites the span at offset so that it covers start to end,
+// padding an active span before its checksum to fill the extra space.
+func (db *SpanFile) resizeSpan(offset, start, end int) error {
+	length := int(binary.BigEndian.Uint32(db.mmapData[offset+4 : offset+8]))
+	if binary.BigEndian.Uint32(db.mmapData[offset:offset+4]) == freeMagic {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], freeMagic)
+		binary.BigEndian.PutUint32(header[4:8], uint32(end-start))
+		return db.writeAt(header, uint64(start))
+	}
+	spanBytes := append([]byte(nil), db.mmapData[offset:offset+length-4]...)
+	return db.writeAt(sealSpan(spanBytes, end-start-length), uint64(start))
+}
+
 // TODO: use freemap instead
 func (db *SpanFile) addFreeSpan(offset, length uint64) {
 	db.freeMap.markFree(int(offset), int(length)) // Use markFree from freeMap
@@ -365,10 +591,20 @@ func (db *SpanFile) RemoveRecord(recordID string) error {
 	db.fileMutex.Lock()
 	defer db.fileMutex.Unlock()
 
+	// A record that has not been flushed only needs to be forgotten
+	_, buffered := db.pending[recordID]
+	if buffered {
+		db.pendingSize -= len(db.pending[recordID])
+		delete(db.pending, recordID)
+	}
+
 	// Find the offset of the record
 	offset, exists := db.index[recordID]
 	if !exists {
-		return fmt.Errorf("record not found")
+		if buffered {
+			return nil
+		}
+		return ErrRecordNotFound
 	}
 
 	// Get the length of the span
@@ -381,7 +617,7 @@ func (db *SpanFile) RemoveRecord(recordID string) error {
 	SpanLog(" -->Mark span:%d-%d/%d as freed", offset, offset+length, length)
 
 	// Mark the span as free
-	err = db.markSpanAsFreed(offset)
+	err = db.applyWrites([]walEntry{freeMagicEntry(offset)})
 	if err != nil {
 		return err
 	}
@@ -399,7 +635,12 @@ func (db *SpanFile) WriteRecord(recordID string, dataStreams []DataStream) error
 	//TODO: Remove locks; we are protected at a higher level.
 	db.fileMutex.Lock()
 	defer db.fileMutex.Unlock()
+	return db.writeRecord(recordID, dataStreams)
+}
 
+// writeRecord writes a record as WriteRecord does. The caller must hold
+// fileMutex.
+func (db *SpanFile) writeRecord(recordID string, dataStreams []DataStream) error {
 	sequenceNumber := db.sequenceNumber
 	db.sequenceNumber++
 
@@ -415,26 +656,23 @@ func (db *SpanFile) WriteRecord(recordID string, dataStreams []DataStream) error
 		return err
 	}
 
+	if db.bufferSize > 0 {
+		return db.bufferSpan(recordID, sealSpan(spanBytes, 0))
+	}
+
 	offset, remaining, err := db.allocateSpan(len(spanBytes) + 4) //+4 for checksum
 	if err != nil {
 		return err
 	}
 
 	// If remaining is > 0 and < minSpanLength then we need to add padding
-	// before the checksum, and add the length of this padding to the uint32
-	// stored at offset 4 of the spanBytes.
+	// before the checksum.
+	padding := 0
 	if remaining > 0 && remaining < minSpanLength {
 		db.freeMap.markUsed(int(offset)+len(spanBytes)+4, int(remaining))
-		padding := make([]byte, remaining)
-		spanBytes = append(spanBytes, padding...)
-
-		// Update the length in the spanBytes
-		length := uint32(len(spanBytes) + 4) // +4 for the checksum
-		binary.BigEndian.PutUint32(spanBytes[4:8], length)
+		padding = int(remaining)
 	}
-
-	checksum := calculateChecksum(spanBytes)
-	spanBytes = append(spanBytes, byte(checksum>>24), byte(checksum>>16), byte(checksum>>8), byte(checksum))
+	spanBytes = sealSpan(spanBytes, padding)
 
 	SpanLog("Write %s to span:%v-%v/%v", recordID, offset, offset+uint64(len(spanBytes)), len(spanBytes))
 	if remaining > 0 && remaining < minSpanLength {
@@ -451,26 +689,286 @@ func (db *SpanFile) WriteRecord(recordID string, dataStreams []DataStream) error
 		spanBytes = append(spanBytes, freeSpan...)
 	}
 
-	err = db.writeAt(spanBytes, offset)
+	// Write the new span, and mark the version it replaces as free
+	writes := []walEntry{{offset: offset, data: spanBytes}}
+	oldOffset, replacing := db.index[recordID]
+	var oldLength uint64
+	if replacing {
+		oldLength, err = db.getSpanLength(int(oldOffset))
+		if err != nil {
+			return err
+		}
+		SpanLog(" -->Replaced record %s at span:%v-%v/%v)", recordID, oldOffset, oldOffset+oldLength, oldLength)
+		writes = append(writes, freeMagicEntry(oldOffset))
+	}
+
+	err = db.applyWrites(writes)
 	if err != nil {
 		return err
 	}
 
-	if oldOffset, exists := db.index[recordID]; exists {
-		oldLength, err := db.getSpanLength(int(oldOffset))
-		if err != nil {
+	if replacing {
+		db.addFreeSpan(oldOffset, oldLength)
+	}
+
+	db.index[recordID] = offset
+
+	return nil
+}
+
+/*
+AppendStream adds a data stream to an existing record. When the record's span
+has enough padding, or is followed by enough free space, the stream is written
+in place and only the changed parts of the span are written. Otherwise the
+record is rewritten with the new stream, as WriteRecord would. The record gets a
+new sequence number either way. It returns an error if the record already has a
+stream with the same ID.
+*/
+func (db *SpanFile) AppendStream(recordID string, stream DataStream) error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	span, err := db.readRecord(recordID)
+	if err != nil {
+		return err
+	}
+	for _, s := range span.DataStreams {
+		if s.StreamID == stream.StreamID {
+			return fmt.Errorf("record %s already has stream ID %d", recordID, stream.StreamID)
+		}
+	}
+	if len(span.DataStreams) >= 255 {
+		return fmt.Errorf("record %s has too many streams", recordID)
+	}
+
+	// Buffered records are rewritten in memory
+	if _, buffered := db.pending[recordID]; !buffered {
+		appended, err := db.appendInPlace(db.index[recordID], span, stream)
+		if appended || err != nil {
 			return err
 		}
-		SpanLog(" -->Replaced record %s at span:%v-%v/%v)", recordID, oldOffset, oldOffset+oldLength, oldLength)
-		err = db.markSpanAsFreed(oldOffset)
+	}
+
+	// The streams may refer to the mapped file, which writing can remap, so
+	// they are copied first.
+	streams := make([]DataStream, 0, len(span.DataStreams)+1)
+	for _, s := range span.DataStreams {
+		streams = append(streams, DataStream{StreamID: s.StreamID, Data: append([]byte(nil), s.Data...)})
+	}
+	return db.writeRecord(recordID, append(streams, stream))
+}
+
+/*
+appendInPlace adds a stream to the end of the span at offset, using its padding
+and, if that is not enough, the free space after it. It writes only the span's
+header, with the new length, sequence number and stream count, and the new
+stream, padding and checksum. It returns false if the stream doesn't fit, or if
+the new sequence number would change the size of the header. The caller must
+hold fileMutex.
+*/
+func (db *SpanFile) appendInPlace(offset uint64, span *Span, stream DataStream) (bool, error) {
+	sequenceLength := int(lengthOf7Code(uint64(span.SequenceNumber)))
+	if int(lengthOf7Code(uint64(db.sequenceNumber))) != sequenceLength {
+		return false, nil
+	}
+
+	// The streams end where the padding begins
+	headerLength := 8 + sequenceLength + int(lengthOf7Code(uint64(len(span.RecordID)))) + len(span.RecordID) + 1
+	end := headerLength
+	for _, s := range span.DataStreams {
+		end += 1 + int(lengthOf7Code(uint64(len(s.Data)))) + len(s.Data)
+	}
+	streamBytes := write7Code([]byte{stream.StreamID}, uint64(len(stream.Data)))
+	streamBytes = append(streamBytes, stream.Data...)
+
+	// Grow the span into the free space after it if the padding is too small.
+	// Free space too small to hold a span of its own becomes padding.
+	length := int(span.Length)
+	newLength := length
+	remaining := 0
+	if extra := end + len(streamBytes) + 4 - length; extra > 0 {
+		available := db.freeMap.freeLengthAt(int(offset) + length)
+		if available < extra {
+			return false, nil
+		}
+		newLength += extra
+		remaining = available - extra
+		if remaining < minSpanLength {
+			newLength += remaining
+			remaining = 0
+		}
+	}
+
+	data := db.mmapData[offset : offset+uint64(length)]
+	header := writeUint32(nil, activeMagic)
+	header = writeUint32(header, uint32(newLength))
+	header = write7Code(header, uint64(db.sequenceNumber))
+	header = append(header, data[8+sequenceLength:headerLength]...)
+	header[len(header)-1]++ // DataStreamCount
+
+	tail := make([]byte, newLength-end)
+	copy(tail, streamBytes)
+	checksum := crc32.ChecksumIEEE(header)
+	checksum = crc32.Update(checksum, crc32.IEEETable, data[headerLength:end])
+	checksum = crc32.Update(checksum, crc32.IEEETable, tail[:len(tail)-4])
+	binary.BigEndian.PutUint32(tail[len(tail)-4:], checksum)
+
+	SpanLog("Append stream %d to %s at span:%v-%v/%v", stream.StreamID, span.RecordID, offset, offset+uint64(newLength), newLength)
+	writes := []walEntry{
+		{offset: offset, data: header},
+		{offset: offset + uint64(end), data: tail},
+	}
+	if remaining > 0 {
+		freeSpan := make([]byte, 8)
+		binary.BigEndian.PutUint32(freeSpan[0:4], freeMagic)
+		binary.BigEndian.PutUint32(freeSpan[4:8], uint32(remaining))
+		writes = append(writes, walEntry{offset: offset + uint64(newLength), data: freeSpan})
+	}
+	if err := db.applyWrites(writes); err != nil {
+		return false, err
+	}
+
+	db.freeMap.markUsed(int(offset)+length, newLength-length)
+	db.sequenceNumber++
+	return true, nil
+}
+
+// sealSpan adds padding and the checksum to a serialized span, including the
+// padding in the span's length.
+func sealSpan(spanBytes []byte, padding int) []byte {
+	if padding > 0 {
+		spanBytes = append(spanBytes, make([]byte, padding)...)
+
+		// Update the length in the spanBytes
+		length := uint32(len(spanBytes) + 4) // +4 for the checksum
+		binary.BigEndian.PutUint32(spanBytes[4:8], length)
+	}
+
+	checksum := calculateChecksum(spanBytes)
+	return append(spanBytes, byte(checksum>>24), byte(checksum>>16), byte(checksum>>8), byte(checksum))
+}
+
+/*
+SetWriteBuffer makes WriteRecord hold up to size bytes of records in memory
+instead of writing each one to the file right away. When the buffer fills, or
+Flush is called, the buffered records are written together into one range of
+the file, which saves extending and syncing the file for each record. Records
+in the buffer can be read and iterated like the others, but are lost if the
+program ends before they are flushed. A size of 0 flushes the buffer and turns
+buffering off.
+*/
+func (db *SpanFile) SetWriteBuffer(size int) error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	if db.readOnly {
+		return fmt.Errorf("cannot buffer writes to a read-only file")
+	}
+	db.bufferSize = size
+	if db.pendingSize >= size {
+		return db.flush()
+	}
+	return nil
+}
+
+// bufferSpan adds a sealed span to the write buffer, flushing the buffer if it
+// is full.
+func (db *SpanFile) bufferSpan(recordID string, spanBytes []byte) error {
+	if db.pending == nil {
+		db.pending = make(map[string][]byte)
+	}
+	if old, ok := db.pending[recordID]; ok {
+		db.pendingSize -= len(old)
+	}
+	db.pending[recordID] = spanBytes
+	db.pendingOrder = append(db.pendingOrder, recordID)
+	db.pendingSize += len(spanBytes)
+	if db.pendingSize >= db.bufferSize {
+		return db.flush()
+	}
+	return nil
+}
+
+// Flush writes the records held in the write buffer to the file.
+func (db *SpanFile) Flush() error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+	return db.flush()
+}
+
+// flush writes the buffered records one after another into a single range of
+// the file. The caller must hold fileMutex.
+func (db *SpanFile) flush() error {
+	if len(db.pending) == 0 {
+		db.pendingOrder = db.pendingOrder[:0]
+		return nil
+	}
+
+	// Lay out the records in the order they were first written. A record
+	// written more than once is only written in its last version.
+	recordIDs := make([]string, 0, len(db.pending))
+	seen := make(map[string]bool, len(db.pending))
+	for _, recordID := range db.pendingOrder {
+		if _, ok := db.pending[recordID]; ok && !seen[recordID] {
+			seen[recordID] = true
+			recordIDs = append(recordIDs, recordID)
+		}
+	}
+
+	start, remaining, err := db.allocateSpan(db.pendingSize)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 0, db.pendingSize+8)
+	offsets := make([]uint64, len(recordIDs))
+	for i, recordID := range recordIDs {
+		spanBytes := db.pending[recordID]
+		if i == len(recordIDs)-1 && remaining > 0 && remaining < minSpanLength {
+			// Pad the last span, as WriteRecord does
+			db.freeMap.markUsed(int(start)+db.pendingSize, int(remaining))
+			spanBytes = sealSpan(append([]byte(nil), spanBytes[:len(spanBytes)-4]...), int(remaining))
+		}
+		offsets[i] = start + uint64(len(data))
+		data = append(data, spanBytes...)
+	}
+	if remaining >= minSpanLength {
+		freeSpan := make([]byte, 8)
+		binary.BigEndian.PutUint32(freeSpan[0:4], freeMagic)
+		binary.BigEndian.PutUint32(freeSpan[4:8], uint32(remaining))
+		data = append(data, freeSpan...)
+	}
+	SpanLog("Flush %d records to span:%v-%v/%v", len(recordIDs), start, start+uint64(len(data)), len(data))
+
+	// Write the new spans, and mark the versions they replace as free
+	writes := []walEntry{{offset: start, data: data}}
+	var replaced []FreeSpan
+	for _, recordID := range recordIDs {
+		oldOffset, replacing := db.index[recordID]
+		if !replacing {
+			continue
+		}
+		oldLength, err := db.getSpanLength(int(oldOffset))
 		if err != nil {
 			return err
 		}
-		db.addFreeSpan(oldOffset, oldLength)
+		writes = append(writes, freeMagicEntry(oldOffset))
+		replaced = append(replaced, FreeSpan{Offset: oldOffset, Length: oldLength})
 	}
 
-	db.index[recordID] = offset
+	if err := db.applyWrites(writes); err != nil {
+		return err
+	}
 
+	for _, s := range replaced {
+		db.addFreeSpan(s.Offset, s.Length)
+	}
+	for i, recordID := range recordIDs {
+		db.index[recordID] = offsets[i]
+	}
+	db.pending = nil
+	db.pendingOrder = nil
+	db.pendingSize = 0
 	return nil
 }
 
@@ -505,17 +1003,84 @@ func (db *SpanFile) writeAt(data []byte, offset uint64) error {
 	return msync(db.mmapData[offset : offset+uint64(len(data))])
 }
 
-func (db *SpanFile) markSpanAsFreed(offset uint64) error {
-	binary.BigEndian.PutUint32(db.mmapData[offset:offset+4], freeMagic)
-	return msync(db.mmapData[offset : offset+4])
+// freeMagicEntry returns the change that marks the span at offset as free.
+func freeMagicEntry(offset uint64) walEntry {
+	return walEntry{offset: offset, data: binary.BigEndian.AppendUint32(nil, freeMagic)}
 }
 
+/*
+ReadRecord returns the record with the given ID. The data streams are copied, so
+they stay valid after the record is replaced or the file is compacted.
+*/
 func (db *SpanFile) ReadRecord(recordID string) (*Span, error) {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	span, err := db.readRecord(recordID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range span.DataStreams {
+		span.DataStreams[i].Data = bytes.Clone(span.DataStreams[i].Data)
+	}
+	return span, nil
+}
+
+// readRecord is ReadRecord without the copying. The streams refer to the mapped
+// file, so the caller must make sure nothing writes to or compacts the file
+// while they are used.
+func (db *SpanFile) readRecord(recordID string) (*Span, error) {
+	if data, ok := db.pending[recordID]; ok {
+		return parseSpanAtOffset(data, 0, false)
+	}
 	offset, exists := db.index[recordID]
 	if !exists {
-		return nil, fmt.Errorf("record not found")
+		return nil, ErrRecordNotFound
+	}
+	return parseSpanAtOffset(db.mmapData, offset, !db.skipChecksums)
+}
+
+/*
+ReadRecordAtSequence returns the version of a record that was written with the
+given sequence number. Unlike ReadRecord, it also finds versions that have since
+been replaced or removed, as long as their space has not been reused or
+compacted away. The returned span has a MagicNumber of 'FREE' if it is no longer
+the current version. This scans the whole file, so it is meant for auditing and
+debugging rather than normal reads.
+*/
+func (db *SpanFile) ReadRecordAtSequence(recordID string, seq uint32) (*Span, error) {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	fileSize := len(db.mmapData)
+	offset := 0
+	for offset+minSpanLength <= fileSize {
+		magic := binary.BigEndian.Uint32(db.mmapData[offset : offset+4])
+		if magic != activeMagic && magic != freeMagic {
+			break
+		}
+		length, err := readUint32(db.mmapData, offset+4)
+		if err != nil || length == 0 || offset+int(length) > fileSize {
+			break
+		}
+
+		spanData := db.mmapData[offset : offset+int(length)]
+		if magic == freeMagic {
+			// A replaced or removed span keeps its contents until the space is
+			// reused. Its checksum was computed with the active magic number.
+			spanData = append([]byte(nil), spanData...)
+			binary.BigEndian.PutUint32(spanData[0:4], activeMagic)
+		}
+		span, err := parseSpan(spanData)
+		if err == nil && span.RecordID == recordID && span.SequenceNumber == seq {
+			span.MagicNumber = magic
+			return span, nil
+		}
+
+		offset += int(length)
 	}
-	return parseSpanAtOffset(db.mmapData, offset)
+
+	return nil, fmt.Errorf("record %s with sequence number %d not found", recordID, seq)
 }
 
 func (db *SpanFile) IterateRecords(callback func(recordID string, sr *SpanReader) error) error {
@@ -523,7 +1088,7 @@ func (db *SpanFile) IterateRecords(callback func(recordID string, sr *SpanReader
 		return db.IterateSortedRecords(callback)
 	}
 	for recordID, offset := range db.index {
-		if recordID == "" {
+		if _, buffered := db.pending[recordID]; recordID == headerRecordID || buffered {
 			continue
 		}
 		spanData := db.mmapData[offset:]
@@ -534,24 +1099,38 @@ func (db *SpanFile) IterateRecords(callback func(recordID string, sr *SpanReader
 			return err
 		}
 	}
+	for recordID, data := range db.pending {
+		if recordID == headerRecordID {
+			continue
+		}
+		if err := callback(recordID, &SpanReader{data: data}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (db *SpanFile) IterateSortedRecords(callback func(recordID string, sr *SpanReader) error) error {
-	recordIDs := make([]string, 0, len(db.index))
+	recordIDs := make([]string, 0, len(db.index)+len(db.pending))
 	for recordID := range db.index {
-		if recordID != "" {
+		if _, buffered := db.pending[recordID]; recordID != headerRecordID && !buffered {
+			recordIDs = append(recordIDs, recordID)
+		}
+	}
+	for recordID := range db.pending {
+		if recordID != headerRecordID {
 			recordIDs = append(recordIDs, recordID)
 		}
 	}
 	sort.Strings(recordIDs)
 
 	for _, recordID := range recordIDs {
-		offset := db.index[recordID]
-		spanData := db.mmapData[offset:]
-		sr := &SpanReader{data: spanData}
+		sr, err := db.getSpanReader(recordID)
+		if err != nil {
+			return err
+		}
 
-		err := callback(recordID, sr)
+		err = callback(recordID, sr)
 		if err != nil {
 			return err
 		}
@@ -559,9 +1138,488 @@ func (db *SpanFile) IterateSortedRecords(callback func(recordID string, sr *Span
 	return nil
 }
 
+/*
+IterateRecordsBySequence calls callback for the current version of each record,
+in the order they were written, according to their sequence numbers. A record
+that was replaced comes where its latest version was written.
+*/
+func (db *SpanFile) IterateRecordsBySequence(callback func(recordID string, sr *SpanReader) error) error {
+	type sequencedRecord struct {
+		recordID string
+		sequence uint64
+		sr       *SpanReader
+	}
+	records := make([]sequencedRecord, 0, len(db.index)+len(db.pending))
+	add := func(recordID string) error {
+		sr, err := db.getSpanReader(recordID)
+		if err != nil {
+			return err
+		}
+		sequence, _, err := read7Code(sr.data, 8)
+		if err != nil {
+			return fmt.Errorf("failed to read sequence number of %s: %v", recordID, err)
+		}
+		records = append(records, sequencedRecord{recordID, sequence, sr})
+		return nil
+	}
+	for recordID := range db.index {
+		if _, buffered := db.pending[recordID]; recordID != headerRecordID && !buffered {
+			if err := add(recordID); err != nil {
+				return err
+			}
+		}
+	}
+	for recordID := range db.pending {
+		if recordID != headerRecordID {
+			if err := add(recordID); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].sequence < records[j].sequence })
+
+	for _, record := range records {
+		if err := callback(record.recordID, record.sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreeSpace returns the number of bytes in the file that are not used by the
+// current version of any record, such as deleted and replaced records. Unused
+// space at the end of the file, which is reserved for growth, is not counted.
+func (db *SpanFile) FreeSpace() uint64 {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	var free uint64
+	for _, s := range db.freeMap.freeSpaces {
+		if s.start+s.length < len(db.mmapData) {
+			free += uint64(s.length)
+		}
+	}
+	return free
+}
+
+/*
+FreeSpaceStats describes how the free space of a file is divided, to help decide
+when to compact it. Like FreeSpace, it leaves out the unused space at the end of
+the file.
+*/
+type FreeSpaceStats struct {
+	// Total bytes of free space
+	FreeBytes uint64 `json:"free_bytes"`
+
+	// Number of separate free spans
+	FreeSpans int `json:"free_spans"`
+
+	// Bytes in the largest free span
+	LargestFreeSpan uint64 `json:"largest_free_span"`
+
+	// FreeBytes divided by LargestFreeSpan. It is 1 when the free space is in
+	// one piece, and grows as it is split into smaller pieces. It is 0 when
+	// there is no free space.
+	FragmentationRatio float64 `json:"fragmentation_ratio"`
+}
+
+// FreeSpaceStats returns the amount of free space in the file and how many
+// pieces it is in.
+func (db *SpanFile) FreeSpaceStats() FreeSpaceStats {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	var stats FreeSpaceStats
+	for _, s := range db.freeMap.freeSpaces {
+		if s.start+s.length >= len(db.mmapData) {
+			continue
+		}
+		stats.FreeBytes += uint64(s.length)
+		stats.FreeSpans++
+		if uint64(s.length) > stats.LargestFreeSpan {
+			stats.LargestFreeSpan = uint64(s.length)
+		}
+	}
+	stats.updateRatio()
+	return stats
+}
+
+func (stats *FreeSpaceStats) updateRatio() {
+	stats.FragmentationRatio = 0
+	if stats.LargestFreeSpan > 0 {
+		stats.FragmentationRatio = float64(stats.FreeBytes) / float64(stats.LargestFreeSpan)
+	}
+}
+
+/*
+Compact rewrites the file so that it contains only the current version of each
+record, releasing the space used by deleted and replaced records. The records are
+copied to a temporary file, which then replaces the original, so the original is
+left intact if compaction fails part way. Slices previously returned from the
+file must not be used after compaction.
+*/
+func (db *SpanFile) Compact() error {
+	cp, err := db.startCompaction()
+	if err != nil || cp == nil {
+		return err
+	}
+	for {
+		done, err := cp.step(compactionStepSpans)
+		if err != nil {
+			cp.abort()
+			return err
+		}
+		if done {
+			return cp.finish()
+		}
+	}
+}
+
+// compactionStepSpans is the number of spans copied in each step of a compaction.
+const compactionStepSpans = 1000
+
+/*
+compaction copies the current records of a file to a temporary file in steps.
+Each step holds the file's mutex, but records can be read, written and removed
+between steps. Records written or removed after they were copied are fixed up in
+the last step, which replaces the file, so the caller must make sure nothing is
+reading the file then.
+*/
+type compaction struct {
+	db       *SpanFile
+	temp     *os.File
+	tempName string
+	w        *bufio.Writer
+	written  uint64
+
+	// offsets holds the offsets of the spans that are still to be copied, in
+	// the order they appear in the file, and total is how many there were.
+	offsets []uint64
+	total   int
+
+	// copied holds where each copied record was found, and where it was
+	// written in the temporary file.
+	copied map[string]copiedSpan
+}
+
+type copiedSpan struct {
+	sequence uint32
+	offset   uint64 // offset in the original file
+	copiedTo uint64 // offset in the temporary file
+}
+
+// startCompaction begins compacting the file. It returns nil if there is
+// nothing to compact.
+func (db *SpanFile) startCompaction() (*compaction, error) {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	if db.readOnly {
+		return nil, fmt.Errorf("cannot compact a read-only file")
+	}
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	if len(db.index) == 0 {
+		return nil, nil
+	}
+
+	// Copy the live spans in the order they appear in the file
+	offsets := make([]uint64, 0, len(db.index))
+	for _, offset := range db.index {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	tempName := db.fileName + ".compact"
+	temp, err := os.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compacted file: %v", err)
+	}
+	return &compaction{
+		db:       db,
+		temp:     temp,
+		tempName: tempName,
+		w:        bufio.NewWriter(temp),
+		offsets:  offsets,
+		total:    len(offsets),
+		copied:   make(map[string]copiedSpan, len(offsets)),
+	}, nil
+}
+
+// progress returns the fraction of the spans that have been copied.
+func (cp *compaction) progress() float64 {
+	return float64(cp.total-len(cp.offsets)) / float64(cp.total)
+}
+
+// step copies up to n more spans, and returns true when all of them have been
+// copied. Spans that no longer hold the current version of their record are
+// skipped.
+func (cp *compaction) step(n int) (bool, error) {
+	db := cp.db
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	for ; n > 0 && len(cp.offsets) > 0; n-- {
+		offset := cp.offsets[0]
+		cp.offsets = cp.offsets[1:]
+
+		span, err := parseSpanAtOffset(db.mmapData, offset, false)
+		if err != nil {
+			continue
+		}
+		if current, ok := db.index[span.RecordID]; !ok || current != offset {
+			continue
+		}
+		copiedTo, err := cp.copySpan(offset)
+		if err != nil {
+			return false, err
+		}
+		cp.copied[span.RecordID] = copiedSpan{sequence: span.SequenceNumber, offset: offset, copiedTo: copiedTo}
+	}
+	return len(cp.offsets) == 0, nil
+}
+
+// copySpan appends the span at offset in the original file to the temporary
+// file, and returns its offset there. The caller must hold fileMutex.
+func (cp *compaction) copySpan(offset uint64) (uint64, error) {
+	length, err := cp.db.getSpanLength(int(offset))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := cp.w.Write(cp.db.mmapData[offset : offset+length]); err != nil {
+		return 0, fmt.Errorf("failed to write compacted file: %v", err)
+	}
+	copiedTo := cp.written
+	cp.written += length
+	return copiedTo, nil
+}
+
+/*
+finish copies the records that were written since they were copied, or that
+were not copied at all, marks the copies of records that were replaced or removed
+as free, and replaces the file with the temporary file. Nothing may read the file
+while it runs.
+*/
+func (cp *compaction) finish() error {
+	db := cp.db
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	err := db.flush()
+	for recordID, offset := range db.index {
+		if err != nil {
+			break
+		}
+		// The copy is current if the span it was copied from still holds
+		// the record. The sequence number tells whether the record was
+		// written to the same place again.
+		if copied, ok := cp.copied[recordID]; ok && copied.offset == offset {
+			var sequence uint64
+			sequence, _, err = read7Code(db.mmapData, int(offset)+8)
+			if err == nil && uint32(sequence) == copied.sequence {
+				delete(cp.copied, recordID)
+				continue
+			}
+		}
+		_, err = cp.copySpan(offset)
+	}
+	if err == nil {
+		err = cp.w.Flush()
+	}
+
+	// Whatever is left in copied was replaced or removed after it was copied
+	freeMarker := make([]byte, 4)
+	binary.BigEndian.PutUint32(freeMarker, freeMagic)
+	for _, copied := range cp.copied {
+		if err != nil {
+			break
+		}
+		_, err = cp.temp.WriteAt(freeMarker, int64(copied.copiedTo))
+	}
+	if err == nil {
+		err = cp.temp.Sync()
+	}
+	if err != nil {
+		cp.abort()
+		return fmt.Errorf("failed to write compacted file: %v", err)
+	}
+
+	// The log refers to offsets in the current file, so empty it before the
+	// file is replaced.
+	if err := db.checkpoint(); err != nil {
+		cp.abort()
+		return err
+	}
+
+	// Replace the original file with the compacted one. The original stays
+	// mapped until the rename has succeeded.
+	if err := os.Rename(cp.tempName, db.fileName); err != nil {
+		cp.abort()
+		return fmt.Errorf("failed to replace file with compacted file: %v", err)
+	}
+	db.mmapData.Unmap()
+	db.file.Close()
+	db.file = cp.temp
+	db.mmapData, err = mmap.Map(db.file, mmap.RDWR, 0)
+	if err != nil {
+		return err
+	}
+	db.index = make(map[string]uint64)
+	db.freeMap = freeMap{freeSpaces: []space{}}
+	return db.scanFile()
+}
+
+// abort removes the temporary file of a compaction that will not be finished.
+func (cp *compaction) abort() {
+	cp.temp.Close()
+	os.Remove(cp.tempName)
+}
+
+// storageBreakdown walks the file, classifying each span. Current versions of
+// document records are live, except for their framing, which is overhead along
+// with reserved records such as the header. Freed spans that still hold a
+// record are deleted, and the rest of the file is free.
+func (db *SpanFile) storageBreakdown() StorageBreakdown {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	var b StorageBreakdown
+	fileSize := len(db.mmapData)
+	b.TotalBytes = uint64(fileSize)
+	offset := 0
+	for offset+minSpanLength <= fileSize {
+		magic := binary.BigEndian.Uint32(db.mmapData[offset : offset+4])
+		if magic != activeMagic && magic != freeMagic {
+			break
+		}
+		length, err := readUint32(db.mmapData, offset+4)
+		if err != nil || length == 0 || offset+int(length) > fileSize {
+			break
+		}
+
+		spanData := db.mmapData[offset : offset+int(length)]
+		if magic == freeMagic {
+			// A freed span that still parses is a deleted or replaced record;
+			// otherwise it only marks unused space.
+			spanData = append([]byte(nil), spanData...)
+			binary.BigEndian.PutUint32(spanData[0:4], activeMagic)
+			if _, err := parseSpan(spanData); err == nil {
+				b.DeletedBytes += uint64(length)
+			} else {
+				b.FreeBytes += uint64(length)
+			}
+		} else {
+			span, err := parseSpan(spanData)
+			current := false
+			if err == nil {
+				indexed, ok := db.index[span.RecordID]
+				current = ok && indexed == uint64(offset)
+			}
+			if !current {
+				b.DeletedBytes += uint64(length)
+			} else if _, ok := parseDocumentID(span.RecordID); !ok {
+				b.OverheadBytes += uint64(length)
+			} else {
+				var data uint64
+				for _, stream := range span.DataStreams {
+					data += uint64(len(stream.Data))
+				}
+				b.LiveBytes += data
+				b.OverheadBytes += uint64(length) - data
+			}
+		}
+
+		offset += int(length)
+	}
+	b.FreeBytes += uint64(fileSize - offset)
+	return b
+}
+
+// rename moves the file, and its write-ahead log, to newName while it is open.
+func (db *SpanFile) rename(newName string) error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	if err := os.Rename(db.fileName, newName); err != nil {
+		return err
+	}
+	if db.wal != nil {
+		if err := os.Rename(walFileName(db.fileName), walFileName(newName)); err != nil {
+			os.Rename(newName, db.fileName)
+			return err
+		}
+	}
+	db.fileName = newName
+	return nil
+}
+
+/*
+SetVerifyChecksums controls whether ReadRecord checks the checksum of each record
+it reads. Checksums are verified by default. Turning verification off makes reads
+faster, but a record damaged on disk, for example by a crash part way through a
+write or by a failing drive, is then returned as if it were intact instead of
+causing an error. Checksums are still written, and still checked when the file is
+opened.
+*/
+func (db *SpanFile) SetVerifyChecksums(verify bool) {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+	db.skipChecksums = !verify
+}
+
+// warmupSink receives the bytes read by Warmup, so that the reads can't be
+// optimized away.
+var warmupSink atomic.Uint32
+
+// warmupChunkSize is how much of the file Warmup reads each time it takes the
+// file's mutex.
+const warmupChunkSize = 64 << 20
+
+/*
+Warmup reads one byte from every page of the memory mapped file, so that the
+operating system loads the whole file from disk now instead of during the
+first reads of its records. The file is read in chunks of warmupChunkSize, and
+can be used in between them.
+*/
+func (db *SpanFile) Warmup() {
+	pageSize := os.Getpagesize()
+	for start := 0; ; start += warmupChunkSize {
+		db.fileMutex.Lock()
+		if start >= len(db.mmapData) {
+			db.fileMutex.Unlock()
+			return
+		}
+		var sum byte
+		end := min(start+warmupChunkSize, len(db.mmapData))
+		for offset := start; offset < end; offset += pageSize {
+			sum += db.mmapData[offset]
+		}
+		db.fileMutex.Unlock()
+		warmupSink.Add(uint32(sum))
+	}
+}
+
+// lastSequenceNumber returns the sequence number of the last record written.
+func (db *SpanFile) lastSequenceNumber() uint32 {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+	return db.sequenceNumber - 1
+}
+
 func (db *SpanFile) GetStats() (size uint64, numRecords int) {
 	size = uint64(len(db.mmapData))
-	numRecords = len(db.index) - 1 // Subtract 1 for the empty record
+	numRecords = len(db.index)
+	for recordID := range db.pending {
+		if _, ok := db.index[recordID]; !ok {
+			numRecords++
+		}
+	}
+	if _, ok := db.index[headerRecordID]; ok {
+		numRecords--
+	} else if _, ok := db.pending[headerRecordID]; ok {
+		numRecords--
+	}
 	return
 }
 
@@ -728,6 +1786,11 @@ func serializeSpan(span *Span) ([]byte, error) {
 }
 
 func parseSpan(data []byte) (*Span, error) {
+	return parseSpanChecked(data, true)
+}
+
+// parseSpanChecked parses a span, verifying its checksum only if verify is true.
+func parseSpanChecked(data []byte, verify bool) (*Span, error) {
 	if len(data) < minSpanLength {
 		return nil, fmt.Errorf("data too short to be a valid span")
 	}
@@ -754,7 +1817,7 @@ func parseSpan(data []byte) (*Span, error) {
 		return nil, fmt.Errorf("data too short for span length, data=%v lengthRead=%v", len(data), span.Length)
 	}
 
-	if !verifyChecksum(data[:span.Length]) {
+	if verify && !verifyChecksum(data[:span.Length]) {
 		return nil, fmt.Errorf("checksum failed")
 	}
 
@@ -817,11 +1880,11 @@ func parseSpan(data []byte) (*Span, error) {
 	return span, nil
 }
 
-func parseSpanAtOffset(data []byte, offset uint64) (*Span, error) {
+func parseSpanAtOffset(data []byte, offset uint64, verify bool) (*Span, error) {
 	if offset >= uint64(len(data)) {
 		return nil, fmt.Errorf("offset out of bounds")
 	}
-	return parseSpan(data[offset:])
+	return parseSpanChecked(data[offset:], verify)
 }
 
 func (db *SpanFile) getSpanLength(offset int) (uint64, error) {
@@ -1,7 +1,9 @@
 package syzgydb
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -39,6 +41,37 @@ func TestOpenFileWithInvalidMagicNumber(t *testing.T) {
 	}
 }
 
+func TestOpenMissingFile(t *testing.T) {
+	ensureTestFolder(t)
+	fileName := testFilePath("missing_file_test.dat")
+
+	for _, mode := range []FileMode{ReadWrite, ReadOnly} {
+		os.Remove(fileName)
+		_, err := OpenFile(fileName, mode)
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("mode %d: expected ErrFileNotFound, got %v", mode, err)
+		}
+		if _, statErr := os.Stat(fileName); !os.IsNotExist(statErr) {
+			t.Errorf("mode %d: file should not have been created", mode)
+		}
+
+		_, err = NewCollection(CollectionOptions{Name: fileName, DimensionCount: 2, FileMode: mode})
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("mode %d: expected NewCollection to return ErrFileNotFound, got %v", mode, err)
+		}
+	}
+
+	for _, mode := range []FileMode{CreateIfNotExists, CreateAndOverwrite} {
+		os.Remove(fileName)
+		db, err := OpenFile(fileName, mode)
+		if err != nil {
+			t.Fatalf("mode %d: expected file to be created, got %v", mode, err)
+		}
+		db.Close()
+	}
+	os.Remove(fileName)
+}
+
 func TestGetSpanReader(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -63,6 +96,43 @@ func TestGetSpanReader(t *testing.T) {
 	}
 }
 
+func TestGetAllStreams(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	dataStreams := []DataStream{
+		{StreamID: 0, Data: []byte("metadata")},
+		{StreamID: 1, Data: []byte("vector")},
+		{StreamID: 2, Data: []byte{}},
+		{StreamID: 7, Data: []byte("extra stream")},
+	}
+	db.WriteRecord("record1", dataStreams)
+
+	spanReader, err := db.getSpanReader("record1")
+	if err != nil {
+		t.Fatalf("Failed to get SpanReader: %v", err)
+	}
+	streams, err := spanReader.getAllStreams()
+	if err != nil {
+		t.Fatalf("Failed to get streams: %v", err)
+	}
+	if len(streams) != len(dataStreams) {
+		t.Errorf("Expected %d streams, got %d", len(dataStreams), len(streams))
+	}
+	for _, ds := range dataStreams {
+		single, err := spanReader.getStream(ds.StreamID)
+		if err != nil {
+			t.Fatalf("Failed to get stream %d: %v", ds.StreamID, err)
+		}
+		if !bytes.Equal(streams[ds.StreamID], ds.Data) || !bytes.Equal(single, ds.Data) {
+			t.Errorf("Stream %d: expected %q, got %q and %q", ds.StreamID, ds.Data, streams[ds.StreamID], single)
+		}
+	}
+	if _, err := spanReader.getStream(3); err == nil {
+		t.Error("Expected an error for a missing stream")
+	}
+}
+
 func TestChecksumVerification(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -96,6 +166,34 @@ func TestChecksumVerification(t *testing.T) {
 	}
 }
 
+func TestSkipChecksumVerification(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	db.WriteRecord("record1", []DataStream{{StreamID: 1, Data: []byte("Hello")}})
+
+	// Corrupt the data without touching the span's structure
+	offset := db.index["record1"]
+	pos := bytes.Index(db.mmapData[offset:], []byte("Hello"))
+	if pos < 0 {
+		t.Fatal("Could not find record data")
+	}
+	db.mmapData[offset+uint64(pos)] = 'J'
+
+	if _, err := db.ReadRecord("record1"); err == nil {
+		t.Fatal("Expected checksum verification to fail")
+	}
+
+	db.SetVerifyChecksums(false)
+	span, err := db.ReadRecord("record1")
+	if err != nil {
+		t.Fatalf("Expected read without verification to succeed, got: %v", err)
+	}
+	if string(span.DataStreams[0].Data) != "Jello" {
+		t.Fatalf("Expected corrupted data to be returned, got %q", span.DataStreams[0].Data)
+	}
+}
+
 func TestInvalidSpanHandling(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -427,3 +525,531 @@ func TestBatchOperations(t *testing.T) {
 		}
 	}
 }
+
+func TestCompact(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		recordID := fmt.Sprintf("record%d", i)
+		data := bytes.Repeat([]byte{byte('A' + i%26)}, 200)
+		if err := db.WriteRecord(recordID, []DataStream{{StreamID: 1, Data: data}}); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+		expected[recordID] = data
+	}
+
+	// Delete most records and replace some of the rest
+	for i := 0; i < 500; i++ {
+		recordID := fmt.Sprintf("record%d", i)
+		if i%5 != 0 {
+			if err := db.RemoveRecord(recordID); err != nil {
+				t.Fatalf("Failed to remove record: %v", err)
+			}
+			delete(expected, recordID)
+		} else if i%10 == 0 {
+			data := []byte(fmt.Sprintf("updated %d", i))
+			if err := db.WriteRecord(recordID, []DataStream{{StreamID: 1, Data: data}}); err != nil {
+				t.Fatalf("Failed to update record: %v", err)
+			}
+			expected[recordID] = data
+		}
+	}
+
+	sizeBefore, _ := db.GetStats()
+	if db.FreeSpace() == 0 {
+		t.Errorf("Expected free space before compaction")
+	}
+
+	// Records read before the compaction stay readable after it
+	before, err := db.ReadRecord("record5")
+	if err != nil {
+		t.Fatalf("Failed to read record: %v", err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if !bytes.Equal(before.DataStreams[0].Data, expected["record5"]) {
+		t.Errorf("Record read before compaction changed")
+	}
+
+	sizeAfter, numRecords := db.GetStats()
+	if sizeAfter >= sizeBefore/2 {
+		t.Errorf("Expected the file to shrink, went from %d to %d bytes", sizeBefore, sizeAfter)
+	}
+	if free := db.FreeSpace(); free != 0 {
+		t.Errorf("Expected no free space after compaction, got %d", free)
+	}
+	if numRecords != len(expected) {
+		t.Errorf("Expected %d records, got %d", len(expected), numRecords)
+	}
+
+	check := func(db *SpanFile) {
+		for recordID, data := range expected {
+			span, err := db.ReadRecord(recordID)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", recordID, err)
+			}
+			if !bytes.Equal(span.DataStreams[0].Data, data) {
+				t.Errorf("Record %s has the wrong data after compaction", recordID)
+			}
+		}
+	}
+	check(db)
+
+	// The compacted file is still writable and can be reopened
+	if err := db.WriteRecord("new", []DataStream{{StreamID: 1, Data: []byte("new")}}); err != nil {
+		t.Fatalf("Failed to write after compaction: %v", err)
+	}
+	expected["new"] = []byte("new")
+	db.Close()
+
+	db, err = OpenFile(db.fileName, ReadWrite)
+	if err != nil {
+		t.Fatalf("Failed to reopen compacted file: %v", err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestFreeSpaceStats(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if stats := db.FreeSpaceStats(); stats.FreeBytes != 0 || stats.FragmentationRatio != 0 {
+		t.Errorf("Expected no free space in a new file, got %+v", stats)
+	}
+
+	// Removing every other record leaves free spans between the live ones
+	for i := 0; i < 100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100)
+		if err := db.WriteRecord(fmt.Sprintf("record%d", i), []DataStream{{StreamID: 1, Data: data}}); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := db.RemoveRecord(fmt.Sprintf("record%d", i)); err != nil {
+			t.Fatalf("Failed to remove record: %v", err)
+		}
+	}
+
+	stats := db.FreeSpaceStats()
+	if stats.FreeBytes != db.FreeSpace() {
+		t.Errorf("Expected %d free bytes, got %d", db.FreeSpace(), stats.FreeBytes)
+	}
+	if stats.FreeSpans < 2 {
+		t.Errorf("Expected several free spans, got %d", stats.FreeSpans)
+	}
+	if stats.LargestFreeSpan == 0 || stats.LargestFreeSpan >= stats.FreeBytes {
+		t.Errorf("Expected the largest free span to be smaller than the total, got %d of %d", stats.LargestFreeSpan, stats.FreeBytes)
+	}
+	if stats.FragmentationRatio <= 1 {
+		t.Errorf("Expected a fragmentation ratio above 1, got %v", stats.FragmentationRatio)
+	}
+}
+
+func TestReadRecordAtSequence(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Each version is larger than the last so that it can't reuse the space of
+	// an earlier one.
+	versions := [][]byte{
+		[]byte("version one"),
+		[]byte("version two, longer"),
+		[]byte("version three, longer still"),
+	}
+	var sequences []uint32
+	for _, data := range versions {
+		if err := db.WriteRecord("record1", []DataStream{{StreamID: 1, Data: data}}); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+		span, err := db.ReadRecord("record1")
+		if err != nil {
+			t.Fatalf("Failed to read record: %v", err)
+		}
+		sequences = append(sequences, span.SequenceNumber)
+	}
+
+	for i, seq := range sequences {
+		span, err := db.ReadRecordAtSequence("record1", seq)
+		if err != nil {
+			t.Fatalf("Failed to read sequence %d: %v", seq, err)
+		}
+		if !bytes.Equal(span.DataStreams[0].Data, versions[i]) {
+			t.Errorf("Sequence %d: expected %q, got %q", seq, versions[i], span.DataStreams[0].Data)
+		}
+		current := i == len(versions)-1
+		if (span.MagicNumber == activeMagic) != current {
+			t.Errorf("Sequence %d: unexpected magic number %x", seq, span.MagicNumber)
+		}
+	}
+
+	if _, err := db.ReadRecordAtSequence("record2", sequences[0]); err == nil {
+		t.Errorf("Expected an error for a record that was never written")
+	}
+
+	// Compaction discards the old versions
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if _, err := db.ReadRecordAtSequence("record1", sequences[0]); err == nil {
+		t.Errorf("Expected an error for a compacted version")
+	}
+	if _, err := db.ReadRecordAtSequence("record1", sequences[2]); err != nil {
+		t.Errorf("Failed to read the current version after compaction: %v", err)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	ensureTestFolder(t)
+	fileName := testFilePath("test_wal.dat")
+	db, err := OpenFile(fileName, CreateAndOverwrite)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if err := db.EnableWAL(); err != nil {
+		t.Fatalf("Failed to enable WAL: %v", err)
+	}
+	if err := db.WriteRecord("a", []DataStream{{StreamID: 1, Data: []byte("first a")}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	if err := db.checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	// Write two records, then undo the changes to the file itself, as if the
+	// process had crashed after appending to the log but before writing the file.
+	before := append([]byte(nil), db.mmapData...)
+	if err := db.WriteRecord("a", []DataStream{{StreamID: 1, Data: []byte("second a")}}); err != nil {
+		t.Fatalf("Failed to replace record: %v", err)
+	}
+	if err := db.WriteRecord("b", []DataStream{{StreamID: 1, Data: []byte("only b")}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	copy(db.mmapData, before)
+	for i := len(before); i < len(db.mmapData); i++ {
+		db.mmapData[i] = 0
+	}
+	db.mmapData.Flush()
+	db.mmapData.Unmap()
+	db.file.Close()
+	db.wal.Close()
+
+	// Add a torn entry, as if the crash happened part way through appending.
+	wal, err := os.OpenFile(walFileName(fileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Expected a write-ahead log: %v", err)
+	}
+	wal.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	wal.Close()
+
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if bytes.Contains(raw, []byte("only b")) || bytes.Contains(raw, []byte("second a")) {
+		t.Fatalf("Expected the file to be missing the crashed writes")
+	}
+
+	db, err = OpenFile(fileName, CreateIfNotExists)
+	if err != nil {
+		t.Fatalf("Failed to reopen file: %v", err)
+	}
+	defer db.Close()
+
+	for recordID, expected := range map[string]string{"a": "second a", "b": "only b"} {
+		span, err := db.ReadRecord(recordID)
+		if err != nil {
+			t.Fatalf("Failed to read record %s after recovery: %v", recordID, err)
+		}
+		if string(span.DataStreams[0].Data) != expected {
+			t.Errorf("Record %s: expected %q, got %q", recordID, expected, span.DataStreams[0].Data)
+		}
+	}
+	if _, err := os.Stat(walFileName(fileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the write-ahead log to be removed after replay")
+	}
+}
+
+func TestWALDamagedLength(t *testing.T) {
+	ensureTestFolder(t)
+	fileName := testFilePath("test_wal_length.dat")
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	// An entry whose length is far past the end of the log is ignored,
+	// instead of being allocated
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[8:], 0xffffffff)
+	if err := os.WriteFile(walFileName(fileName), append(header, "short"...), 0666); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	if err := replayWAL(file, walFileName(fileName)); err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 0 {
+		t.Errorf("Expected nothing to be replayed, got %v, %v", info, err)
+	}
+	if _, err := os.Stat(walFileName(fileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the write-ahead log to be removed after replay")
+	}
+}
+
+func TestRepairOpen(t *testing.T) {
+	ensureTestFolder(t)
+	fileName := testFilePath("test_repair.dat")
+	db, err := OpenFile(fileName, CreateAndOverwrite)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	for _, id := range []string{"before", "middle", "after"} {
+		if err := db.WriteRecord(id, []DataStream{{StreamID: 1, Data: []byte("data for " + id)}}); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	// Set the length of the middle span to zero
+	binary.BigEndian.PutUint32(db.mmapData[db.index["middle"]+4:], 0)
+	db.Close()
+
+	if _, err := OpenFile(fileName, ReadWrite); err == nil {
+		t.Fatal("Expected opening a corrupt file to fail")
+	}
+
+	db, err = OpenFile(fileName, Repair)
+	if err != nil {
+		t.Fatalf("Failed to open file in repair mode: %v", err)
+	}
+	for _, id := range []string{"before", "after"} {
+		span, err := db.ReadRecord(id)
+		if err != nil {
+			t.Fatalf("Failed to read record %s: %v", id, err)
+		}
+		if string(span.DataStreams[0].Data) != "data for "+id {
+			t.Errorf("Data mismatch for record %s: got %s", id, span.DataStreams[0].Data)
+		}
+	}
+	if _, err := db.ReadRecord("middle"); err == nil {
+		t.Error("Expected the corrupt record to be skipped")
+	}
+	db.Close()
+
+	// The corrupt span is now marked as free, so the file opens normally
+	db, err = OpenFile(fileName, ReadWrite)
+	if err != nil {
+		t.Fatalf("Failed to reopen repaired file: %v", err)
+	}
+	defer db.Close()
+	if len(db.index) != 3 {
+		t.Errorf("Expected the header and two records after repair, got %d", len(db.index))
+	}
+}
+
+func TestRepairSmallGap(t *testing.T) {
+	ensureTestFolder(t)
+	fileName := testFilePath("test_repair_gap.dat")
+	for gap := 1; gap < 8; gap++ {
+		// Odd gaps follow a removed record, even ones a live record
+		removeBefore := gap%2 == 1
+		db, err := OpenFile(fileName, CreateAndOverwrite)
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		for _, id := range []string{"before", "middle", "after"} {
+			if err := db.WriteRecord(id, []DataStream{{StreamID: 1, Data: []byte("data for " + id)}}); err != nil {
+				t.Fatalf("Failed to write record: %v", err)
+			}
+		}
+		if removeBefore {
+			if err := db.RemoveRecord("before"); err != nil {
+				t.Fatalf("Failed to remove record: %v", err)
+			}
+		}
+		middle := int(db.index["middle"])
+		db.Close()
+
+		// Insert a few stray bytes in front of the middle span
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		corrupt := append(append(append([]byte(nil), data[:middle]...), bytes.Repeat([]byte{0xab}, gap)...), data[middle:]...)
+		if err := os.WriteFile(fileName, corrupt, 0666); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		db, err = OpenFile(fileName, Repair)
+		if err != nil {
+			t.Fatalf("Failed to open file in repair mode with a %d byte gap: %v", gap, err)
+		}
+		db.Close()
+
+		// The gap has been absorbed, so the file opens normally
+		db, err = OpenFile(fileName, ReadWrite)
+		if err != nil {
+			t.Fatalf("Failed to reopen file repaired with a %d byte gap: %v", gap, err)
+		}
+		for _, id := range []string{"before", "middle", "after"} {
+			span, err := db.ReadRecord(id)
+			if id == "before" && removeBefore {
+				if err == nil {
+					t.Errorf("Expected removed record to stay removed with a %d byte gap", gap)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Failed to read record %s with a %d byte gap: %v", id, gap, err)
+			}
+			if string(span.DataStreams[0].Data) != "data for "+id {
+				t.Errorf("Data mismatch for record %s: got %s", id, span.DataStreams[0].Data)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	db.WriteRecord("old", []DataStream{{StreamID: 1, Data: []byte("flushed")}})
+	db.WriteRecord("gone", []DataStream{{StreamID: 1, Data: []byte("flushed")}})
+	if err := db.SetWriteBuffer(1 << 20); err != nil {
+		t.Fatalf("Failed to enable write buffer: %v", err)
+	}
+	size, _ := db.GetStats()
+
+	for i := 0; i < 50; i++ {
+		db.WriteRecord(fmt.Sprintf("rec%d", i), []DataStream{{StreamID: 1, Data: []byte(fmt.Sprintf("data%d", i))}})
+	}
+	db.WriteRecord("old", []DataStream{{StreamID: 1, Data: []byte("replaced")}})
+	db.WriteRecord("rec7", []DataStream{{StreamID: 1, Data: []byte("again")}})
+	db.WriteRecord("rec9", []DataStream{{StreamID: 1, Data: []byte("data9")}})
+	db.RemoveRecord("rec9")
+	db.RemoveRecord("gone")
+
+	// Buffered records are visible but not yet in the file
+	if newSize, numRecords := db.GetStats(); newSize != size || numRecords != 50 {
+		t.Errorf("Expected %d bytes and 50 records before flushing, got %d and %d", size, newSize, numRecords)
+	}
+	span, err := db.ReadRecord("rec7")
+	if err != nil || string(span.DataStreams[0].Data) != "again" {
+		t.Fatalf("Expected to read buffered record, got %v", err)
+	}
+	if _, err := db.ReadRecord("rec9"); err == nil {
+		t.Error("Expected removed buffered record to be gone")
+	}
+	count := 0
+	db.IterateSortedRecords(func(recordID string, sr *SpanReader) error {
+		count++
+		return nil
+	})
+	if count != 50 {
+		t.Errorf("Expected to iterate over 50 records, got %d", count)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// Reopen the file to check that the flushed records are intact
+	reopened, err := OpenFile(db.fileName, ReadOnly)
+	if err != nil {
+		t.Fatalf("Failed to reopen file: %v", err)
+	}
+	defer reopened.Close()
+	if _, numRecords := reopened.GetStats(); numRecords != 50 {
+		t.Errorf("Expected 50 records after flushing, got %d", numRecords)
+	}
+	for recordID, expected := range map[string]string{"rec0": "data0", "rec7": "again", "rec49": "data49", "old": "replaced"} {
+		span, err := reopened.ReadRecord(recordID)
+		if err != nil || string(span.DataStreams[0].Data) != expected {
+			t.Errorf("Expected %s to be %q, got %v", recordID, expected, err)
+		}
+	}
+}
+
+func TestAppendStream(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	vector := bytes.Repeat([]byte{7}, 1000)
+	if err := db.WriteRecord("events", []DataStream{{StreamID: 1, Data: vector}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	offset := db.index["events"]
+
+	// The record is followed by free space, so the streams are added in place
+	sequence := uint32(0)
+	for i := 2; i <= 10; i++ {
+		if err := db.AppendStream("events", DataStream{StreamID: uint8(i), Data: []byte(fmt.Sprintf("event%d", i))}); err != nil {
+			t.Fatalf("Failed to append stream %d: %v", i, err)
+		}
+		span, err := db.ReadRecord("events")
+		if err != nil {
+			t.Fatalf("Failed to read record after appending stream %d: %v", i, err)
+		}
+		if span.SequenceNumber <= sequence {
+			t.Errorf("Expected a new sequence number after appending stream %d", i)
+		}
+		sequence = span.SequenceNumber
+	}
+	if db.index["events"] != offset {
+		t.Errorf("Expected the streams to be appended in place")
+	}
+
+	// Another record takes the space after it, so the next one is rewritten
+	if err := db.WriteRecord("next", []DataStream{{StreamID: 1, Data: []byte("next")}}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	if err := db.AppendStream("events", DataStream{StreamID: 11, Data: bytes.Repeat([]byte("x"), 100)}); err != nil {
+		t.Fatalf("Failed to append stream: %v", err)
+	}
+	if db.index["events"] == offset {
+		t.Errorf("Expected the record to be rewritten when the stream doesn't fit")
+	}
+
+	if err := db.AppendStream("events", DataStream{StreamID: 3, Data: []byte("again")}); err == nil {
+		t.Errorf("Expected an error appending an existing stream ID")
+	}
+	if err := db.AppendStream("missing", DataStream{StreamID: 1}); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+
+	// Check every stream, also after reopening the file
+	check := func(db *SpanFile) {
+		span, err := db.ReadRecord("events")
+		if err != nil {
+			t.Fatalf("Failed to read record: %v", err)
+		}
+		if len(span.DataStreams) != 11 || !bytes.Equal(span.DataStreams[0].Data, vector) {
+			t.Fatalf("Expected the vector and 10 appended streams, got %d streams", len(span.DataStreams))
+		}
+		for i := 2; i <= 10; i++ {
+			data, err := span.getStream(uint8(i))
+			if err != nil || string(data) != fmt.Sprintf("event%d", i) {
+				t.Errorf("Stream %d: got %q, %v", i, data, err)
+			}
+		}
+		if data, _ := span.getStream(11); len(data) != 100 {
+			t.Errorf("Expected stream 11 to have 100 bytes, got %d", len(data))
+		}
+	}
+	check(db)
+	db.Close()
+	reopened, err := OpenFile(db.fileName, ReadOnly)
+	if err != nil {
+		t.Fatalf("Failed to reopen file: %v", err)
+	}
+	defer reopened.Close()
+	check(reopened)
+	if _, numRecords := reopened.GetStats(); numRecords != 2 {
+		t.Errorf("Expected 2 records after reopening, got %d", numRecords)
+	}
+}
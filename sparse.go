@@ -0,0 +1,161 @@
+package syzgydb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/*
+Sparse collections store only the nonzero components of each vector, which
+saves space when vectors have many dimensions but few nonzero components, such
+as TF-IDF vectors. A stored sparse vector is the number of nonzero components,
+as a 7code, followed by each component in increasing order of index: the
+difference from the previous index as a 7code, and the quantized value. Values
+take a whole number of bytes, so 4-bit quantization uses one byte per value.
+*/
+
+// sparseVector holds the nonzero components of a vector and their indices.
+type sparseVector struct {
+	indices []int
+	values  []float64
+}
+
+// sparseValueSize returns the number of bytes used to store each value.
+func sparseValueSize(quantization int) int {
+	return (quantization + 7) / 8
+}
+
+func encodeSparseVector(vector []float64, quantization int, min, max float64) []byte {
+	count := 0
+	for _, v := range vector {
+		if v != 0 {
+			count++
+		}
+	}
+
+	valueSize := sparseValueSize(quantization)
+	data := write7Code(make([]byte, 0, 3+count*(3+valueSize)), uint64(count))
+	last := 0
+	for i, v := range vector {
+		if v == 0 {
+			continue
+		}
+		data = write7Code(data, uint64(i-last))
+		last = i
+
+		quantizedValue := quantizeRange(v, quantization, min, max)
+		switch valueSize {
+		case 1:
+			data = append(data, byte(quantizedValue))
+		case 2:
+			data = binary.BigEndian.AppendUint16(data, uint16(quantizedValue))
+		case 4:
+			data = binary.BigEndian.AppendUint32(data, uint32(quantizedValue))
+		case 8:
+			data = binary.BigEndian.AppendUint64(data, quantizedValue)
+		}
+	}
+	return data
+}
+
+// decodeSparseVectorInto decodes a stored sparse vector into sv, reusing its
+// slices. Values were quantized with the range min to max.
+func decodeSparseVectorInto(sv *sparseVector, data []byte, dimensions, quantization int, min, max float64) error {
+	count, offset, err := read7Code(data, 0)
+	if err != nil {
+		return err
+	}
+	valueSize := sparseValueSize(quantization)
+	if count > uint64(dimensions) || uint64(len(data)-offset) < count*uint64(1+valueSize) {
+		return fmt.Errorf("invalid sparse vector: %d components", count)
+	}
+
+	sv.indices = sv.indices[:0]
+	sv.values = sv.values[:0]
+	index := 0
+	for i := uint64(0); i < count; i++ {
+		var delta uint64
+		delta, offset, err = read7Code(data, offset)
+		if err != nil {
+			return err
+		}
+		index += int(delta)
+		if index >= dimensions || offset+valueSize > len(data) {
+			return fmt.Errorf("invalid sparse vector: component %d out of range", index)
+		}
+
+		var quantizedValue uint64
+		switch valueSize {
+		case 1:
+			quantizedValue = uint64(data[offset])
+		case 2:
+			quantizedValue = uint64(binary.BigEndian.Uint16(data[offset:]))
+		case 4:
+			quantizedValue = uint64(binary.BigEndian.Uint32(data[offset:]))
+		case 8:
+			quantizedValue = binary.BigEndian.Uint64(data[offset:])
+		}
+		offset += valueSize
+
+		sv.indices = append(sv.indices, index)
+		sv.values = append(sv.values, dequantizeRange(quantizedValue, quantization, min, max))
+	}
+	return nil
+}
+
+// denseInto writes the vector into dst, which must be long enough to hold
+// every dimension.
+func (sv *sparseVector) denseInto(dst []float64) {
+	clear(dst)
+	for i, index := range sv.indices {
+		dst[index] = sv.values[i]
+	}
+}
+
+// sparseDotProduct returns the dot product of a dense and a sparse vector.
+func sparseDotProduct(dense []float64, sv *sparseVector) float64 {
+	sum := 0.0
+	for i, index := range sv.indices {
+		sum += dense[index] * sv.values[i]
+	}
+	return sum
+}
+
+// sparseEuclideanDistance returns the euclidean distance between a dense and a
+// sparse vector, given the squared magnitude of the dense vector. Only the
+// nonzero components of the sparse vector are visited.
+func sparseEuclideanDistance(dense []float64, denseSquared float64, sv *sparseVector) float64 {
+	sum, overlap := 0.0, 0.0
+	for i, index := range sv.indices {
+		diff := dense[index] - sv.values[i]
+		sum += diff * diff
+		overlap += dense[index] * dense[index]
+	}
+
+	// The rest of the dense vector is compared with zeros. When it is all
+	// zeros, rounding errors must not make the distance of identical vectors
+	// greater than zero.
+	rest := denseSquared - overlap
+	if rest < denseSquared*1e-12 {
+		rest = 0
+	}
+	return math.Sqrt(sum + rest)
+}
+
+// sparseAngularDistance is angularDistance for a dense and a sparse vector,
+// given the squared magnitude of the dense vector.
+func sparseAngularDistance(dense []float64, denseSquared float64, sv *sparseVector) float64 {
+	magnitude := 0.0
+	for _, v := range sv.values {
+		magnitude += v * v
+	}
+	if denseSquared == 0 && magnitude == 0 {
+		return 0.0 // Two zero vectors are identical
+	}
+	if denseSquared == 0 || magnitude == 0 {
+		return 1.0 // Return max distance if one vector is zero
+	}
+	cosine := sparseDotProduct(dense, sv) / (math.Sqrt(denseSquared) * math.Sqrt(magnitude))
+	return math.Acos(math.Max(-1, math.Min(1, cosine))) / math.Pi
+}
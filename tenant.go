@@ -0,0 +1,56 @@
+package syzgydb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+Tenants keep the collections of different users of a server apart. A request
+names its tenant in the X-Syzgy-Tenant header. The collections of a tenant are
+stored in a subdirectory of the data folder with the tenant's name, and are
+known to the server by the key "tenant/name", so that two tenants may each have
+a collection with the same name. Requests without the header use the collections
+stored directly in the data folder.
+*/
+
+// tenantHeader is the request header that names the tenant.
+const tenantHeader = "X-Syzgy-Tenant"
+
+// requestTenant returns the tenant named by the request, or "" if there is none.
+// Tenant names are used as directory names, so only letters, digits, '-' and '_'
+// are allowed.
+func requestTenant(r *http.Request) (string, error) {
+	tenant := r.Header.Get(tenantHeader)
+	for _, c := range tenant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("invalid tenant %q", tenant)
+		}
+	}
+	return tenant, nil
+}
+
+// collectionKey returns the key in Server.collections of the named collection
+// of the request's tenant.
+func collectionKey(r *http.Request, name string) (string, error) {
+	if strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid collection name %q", name)
+	}
+	tenant, err := requestTenant(r)
+	if err != nil {
+		return "", err
+	}
+	if tenant == "" {
+		return name, nil
+	}
+	return tenant + "/" + name, nil
+}
+
+// tenantOfKey returns the tenant part of a collection key.
+func tenantOfKey(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
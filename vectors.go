@@ -0,0 +1,44 @@
+package syzgydb
+
+import "fmt"
+
+// AddVectors returns the sum of two vectors. It returns ErrDimensionMismatch if
+// they don't have the same length.
+func AddVectors(a, b []float64) ([]float64, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("%w: vectors have lengths %d and %d", ErrDimensionMismatch, len(a), len(b))
+	}
+	sum := make([]float64, len(a))
+	for i := range a {
+		sum[i] = a[i] + b[i]
+	}
+	return sum, nil
+}
+
+// ScaleVector returns the vector multiplied by factor.
+func ScaleVector(vector []float64, factor float64) []float64 {
+	scaled := make([]float64, len(vector))
+	for i, v := range vector {
+		scaled[i] = v * factor
+	}
+	return scaled
+}
+
+/*
+Centroid returns the average of vectors of the same length, which can be used to
+search for the documents near all of them. It returns nil if there are no
+vectors, and ErrDimensionMismatch if their lengths differ.
+*/
+func Centroid(vectors [][]float64) ([]float64, error) {
+	if len(vectors) == 0 {
+		return nil, nil
+	}
+	sum := make([]float64, len(vectors[0]))
+	for _, vector := range vectors {
+		var err error
+		if sum, err = AddVectors(sum, vector); err != nil {
+			return nil, err
+		}
+	}
+	return ScaleVector(sum, 1/float64(len(vectors))), nil
+}
@@ -0,0 +1,178 @@
+package syzgydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+Write-Ahead Log Format:
+
+WAL ::= Entry*
+Entry ::= Offset (8)
+          Length (4)
+          Data (...bytes)
+          Checksum (4 bytes CRC of Offset, Length and Data)
+
+Each entry is a range of bytes to be written to the span file at the given
+offset. Before a span file with a log changes its contents, it appends the
+changes to the log and syncs it to disk. When the file is opened, the entries
+are written again, so that a change interrupted by a crash is completed.
+Writing the same bytes twice is harmless, so the log only needs to be emptied
+once the span file itself has been flushed to disk.
+*/
+
+// walCheckpointSize is the size the log may grow to before the span file is
+// flushed to disk and the log emptied.
+const walCheckpointSize = 4 * 1024 * 1024
+
+// walEntry is a single change to the span file.
+type walEntry struct {
+	offset uint64
+	data   []byte
+}
+
+// walFileName returns the name of the log kept beside a span file.
+func walFileName(filename string) string {
+	return filename + ".wal"
+}
+
+/*
+EnableWAL makes the file record every change in a write-ahead log before making
+it, so that a write interrupted by a crash is completed the next time the file
+is opened. Writes become slower, because the log is synced to disk each time.
+*/
+func (db *SpanFile) EnableWAL() error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+
+	if db.readOnly {
+		return fmt.Errorf("cannot log writes to a read-only file")
+	}
+	if db.wal != nil {
+		return nil
+	}
+	wal, err := os.OpenFile(walFileName(db.fileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	db.wal = wal
+	return nil
+}
+
+// applyWrites logs the changes, if there is a log, and then makes them.
+func (db *SpanFile) applyWrites(writes []walEntry) error {
+	if db.wal != nil {
+		if err := db.appendWAL(writes); err != nil {
+			return err
+		}
+	}
+	for _, w := range writes {
+		if err := db.writeAt(w.data, w.offset); err != nil {
+			return err
+		}
+	}
+	if db.walSize > walCheckpointSize {
+		return db.checkpoint()
+	}
+	return nil
+}
+
+// appendWAL adds the changes to the log and syncs it to disk.
+func (db *SpanFile) appendWAL(writes []walEntry) error {
+	var buf []byte
+	for _, w := range writes {
+		start := len(buf)
+		buf = binary.BigEndian.AppendUint64(buf, w.offset)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(w.data)))
+		buf = append(buf, w.data...)
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+	}
+	if _, err := db.wal.Write(buf); err != nil {
+		return fmt.Errorf("failed to write to write-ahead log: %v", err)
+	}
+	if err := db.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %v", err)
+	}
+	db.walSize += len(buf)
+	return nil
+}
+
+// checkpoint flushes the span file to disk and empties the log, whose changes
+// are now all durable.
+func (db *SpanFile) checkpoint() error {
+	if db.wal == nil {
+		return nil
+	}
+	if err := db.mmapData.Flush(); err != nil {
+		return fmt.Errorf("failed to flush file: %v", err)
+	}
+	if err := db.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %v", err)
+	}
+	db.walSize = 0
+	return db.wal.Sync()
+}
+
+// replayWAL writes the complete entries of the log at walName to file, syncs
+// the file and removes the log. An entry that was cut short by a crash, and
+// everything after it, is ignored. It does nothing if there is no log.
+func replayWAL(file *os.File, walName string) error {
+	wal, err := os.Open(walName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	defer wal.Close()
+	info, err := wal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+
+	r := bufio.NewReader(wal)
+	header := make([]byte, 12)
+	remaining := info.Size()
+	replayed := 0
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		remaining -= int64(len(header))
+		offset := binary.BigEndian.Uint64(header[0:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+
+		// A damaged length is treated like an entry cut short, rather than
+		// allocating more than is left in the log
+		if int64(length)+4 > remaining {
+			break
+		}
+		rest := make([]byte, int(length)+4)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			break
+		}
+		remaining -= int64(len(rest))
+		data := rest[:length]
+		checksum := binary.BigEndian.Uint32(rest[length:])
+		if crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, data) != checksum {
+			break
+		}
+		if _, err := file.WriteAt(data, int64(offset)); err != nil {
+			return fmt.Errorf("failed to replay write-ahead log: %v", err)
+		}
+		replayed++
+	}
+
+	if replayed > 0 {
+		logInfof("Replayed %d changes from %s", replayed, walName)
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	wal.Close()
+	return os.Remove(walName)
+}